@@ -12,7 +12,28 @@ GREEDY_SCRAPING_FREQUENCY=10
 DATABASE=/tmp/home-service.db
 UPLOAD_TARGET=/Users/rlommers/projects/home/upload-target
 X_HOME_API_KEY=supersecretkey
+X_HOME_SCOPED_API_KEYS=greedy:feedreaderkey,events:sensorkey
 USERNAME=
 PASSWORD=
 FILE_CLEANUP_DAYS=1
+MQTT_BROKER=
+MQTT_USERNAME=
+MQTT_PASSWORD=
+MQTT_CLIENT_ID=home-service
+MQTT_TOPICS=zigbee2mqtt/+=sensor,home/alarm/#=alarm
+EVENTS_ARCHIVE_DIR=/tmp/home-service-archive
+EVENTS_UNKNOWN_SOURCE_POLICY=accept
+SHARE_SECRET=
+PUBLIC_URL=http://localhost:3000
+STORAGE_QUOTA_MB=10240
+STORAGE_MAX_UPLOAD_MB=2048
+STORAGE_MIN_FREE_MB=512
+STORAGE_ENCRYPTION_KEY=
+STORAGE_ENCRYPTION_OLD_KEY=
+STORAGE_ALLOWED_TYPES=
+STORAGE_DENIED_TYPES=application/vnd.microsoft.portable-executable,application/x-elf
+QUICKNOTE_ALLOWED_TYPES=image/*,application/pdf,text/*
+QUICKNOTE_DENIED_TYPES=
+CLAMAV_SOCKET=
+MAIL_ATTACHMENT_LIMIT_MB=20
 DEV=true
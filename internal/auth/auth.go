@@ -0,0 +1,256 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rogierlommers/home/internal/config"
+	"github.com/rogierlommers/home/internal/sqlitedb"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// SessionCookie is set after logging in on the login page, it holds a signed
+	// session, see NewSession
+	SessionCookie = "auth"
+
+	// APIKeyHeader carries an api key, the key may also be sent as bearer token
+	APIKeyHeader = "X-HOME-API-KEY"
+
+	// SourceTokenHeader carries the token of a registered event source
+	SourceTokenHeader = "X-HOME-SOURCE-TOKEN"
+
+	// LoginPage is where pages redirect to without a session
+	LoginPage = "/"
+
+	identityKey = "auth.identity"
+)
+
+// Scope limits what an api key may be used for
+type Scope string
+
+const (
+	ScopeAll        Scope = "*"
+	ScopeBookmarks  Scope = "bookmarks"
+	ScopeEvents     Scope = "events"
+	ScopeFiles      Scope = "files"
+	ScopeGreedy     Scope = "greedy"
+	ScopeHeartbeats Scope = "heartbeats"
+	ScopeNotes      Scope = "notes"
+	ScopeStats      Scope = "stats"
+)
+
+// Method is how a request was authenticated
+type Method string
+
+const (
+	MethodNone        Method = ""
+	MethodSession     Method = "session"
+	MethodAPIKey      Method = "api-key"
+	MethodSourceToken Method = "source-token"
+	MethodBasicAuth   Method = "basic-auth"
+)
+
+// BasicAuthRealm is announced to clients that may log in with basic auth
+const BasicAuthRealm = `Basic realm="home", charset="UTF-8"`
+
+// Identity describes who made a request
+type Identity struct {
+	Method Method
+	Scopes []Scope
+	Source *sqlitedb.EventSource // the registered source for MethodSourceToken
+}
+
+// HasScope reports if an api key may be used for the scope
+func (i Identity) HasScope(scope Scope) bool {
+	for _, s := range i.Scopes {
+		if s == ScopeAll || s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// Authenticator identifies requests and enforces policies. The X_HOME_API_KEY has
+// all scopes, keys in X_HOME_SCOPED_API_KEYS only have the scopes listed with them.
+type Authenticator struct {
+	db         *sqlitedb.DB
+	keys       map[string][]Scope
+	username   string
+	password   string
+	sessionKey []byte // signs sessions, derived from the credentials
+}
+
+func New(cfg config.AppConfig, db *sqlitedb.DB) *Authenticator {
+	a := &Authenticator{db: db, keys: map[string][]Scope{}, username: cfg.Username, password: cfg.Password}
+
+	// changing the credentials ends all sessions
+	sessionKey := sha256.Sum256([]byte("session:" + cfg.Username + ":" + cfg.Password))
+	a.sessionKey = sessionKey[:]
+
+	if cfg.XHomeAPIKey != "" {
+		a.keys[cfg.XHomeAPIKey] = []Scope{ScopeAll}
+	}
+
+	// "scope:key,scope:key", a key with several scopes is listed once per scope
+	for _, entry := range strings.Split(cfg.ScopedAPIKeys, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		scope, key, found := strings.Cut(entry, ":")
+		if !found || scope == "" || key == "" {
+			logrus.Errorf("invalid scoped api key %q, expected scope:key", entry)
+			continue
+		}
+		a.keys[key] = append(a.keys[key], Scope(scope))
+	}
+
+	return a
+}
+
+// Middleware enforces the policy, the identity of the request is available to
+// handlers through FromContext
+func (a *Authenticator) Middleware(p Policy) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		identity, ok := a.identify(c, p)
+		c.Set(identityKey, identity)
+
+		switch {
+		case p.allows(identity):
+			c.Next()
+		case p.page:
+			c.Redirect(302, LoginPage)
+			c.Abort()
+		case ok && identity.Method == MethodAPIKey:
+			c.String(403, "Forbidden")
+			c.Abort()
+		default:
+			if p.basicAuth {
+				c.Header("WWW-Authenticate", BasicAuthRealm)
+			}
+			c.String(401, "Unauthorized")
+			c.Abort()
+		}
+	}
+}
+
+// identify determines who made the request. It returns false when the request
+// carried credentials that are not valid.
+func (a *Authenticator) identify(c *gin.Context, p Policy) (Identity, bool) {
+	if a.hasSession(c) {
+		return Identity{Method: MethodSession}, true
+	}
+
+	if token := c.GetHeader(SourceTokenHeader); token != "" && p.sourceToken {
+		source, err := a.db.GetEventSourceByToken(token)
+		if err != nil {
+			logrus.Errorf("failed to look up event source: %v", err)
+		}
+		if source == nil {
+			return Identity{}, false
+		}
+		return Identity{Method: MethodSourceToken, Source: source}, true
+	}
+
+	if username, password, found := c.Request.BasicAuth(); found && p.basicAuth {
+		return a.basicAuth(username, password)
+	}
+
+	key := apiKey(c, p.queryKey)
+	if key == "" {
+		return Identity{}, true
+	}
+
+	scopes, found := a.keys[key]
+	if !found {
+		return Identity{}, false
+	}
+	return Identity{Method: MethodAPIKey, Scopes: scopes}, true
+}
+
+// basicAuth identifies clients that can only send a username and password, such as
+// network drives. They log in like on the login page, or with an api key as password.
+func (a *Authenticator) basicAuth(username, password string) (Identity, bool) {
+	if a.password != "" && equal(username, a.username) && equal(password, a.password) {
+		return Identity{Method: MethodBasicAuth}, true
+	}
+
+	if scopes, found := a.keys[password]; found {
+		return Identity{Method: MethodAPIKey, Scopes: scopes}, true
+	}
+	return Identity{}, false
+}
+
+func equal(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// FromContext returns the identity the middleware determined for the request
+func FromContext(c *gin.Context) Identity {
+	if identity, ok := c.Get(identityKey); ok {
+		return identity.(Identity)
+	}
+	return Identity{}
+}
+
+// NewSession returns the value of the session cookie for a browser that logged in, a
+// random id with its signature
+func (a *Authenticator) NewSession() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+
+	encoded := base64.RawURLEncoding.EncodeToString(id)
+	return encoded + "." + base64.RawURLEncoding.EncodeToString(a.sessionSignature(encoded)), nil
+}
+
+// hasSession reports if the request comes from a browser that logged in, the cookie
+// has to carry a session signed by NewSession
+func (a *Authenticator) hasSession(c *gin.Context) bool {
+	cookie, err := c.Cookie(SessionCookie)
+	if err != nil {
+		return false
+	}
+
+	id, signature, found := strings.Cut(cookie, ".")
+	if !found {
+		return false
+	}
+
+	decoded, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil {
+		return false
+	}
+	return hmac.Equal(decoded, a.sessionSignature(id))
+}
+
+func (a *Authenticator) sessionSignature(id string) []byte {
+	mac := hmac.New(sha256.New, a.sessionKey)
+	mac.Write([]byte("session:" + id))
+	return mac.Sum(nil)
+}
+
+// apiKey returns the api key of the request. Tools like Alertmanager can only set an
+// Authorization header, and feed readers can only use the query string.
+func apiKey(c *gin.Context, allowQuery bool) string {
+	if key := c.GetHeader(APIKeyHeader); key != "" {
+		return key
+	}
+
+	if token, found := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer "); found {
+		return token
+	}
+
+	if allowQuery {
+		return c.Query("key")
+	}
+	return ""
+}
@@ -0,0 +1,201 @@
+package auth
+
+import (
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rogierlommers/home/internal/config"
+	"github.com/rogierlommers/home/internal/sqlitedb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestRouter(t *testing.T) (*Router, *sqlitedb.DB) {
+	gin.SetMode(gin.TestMode)
+
+	cfg := config.AppConfig{
+		Database:      filepath.Join(t.TempDir(), "test.db"),
+		XHomeAPIKey:   "supersecretkey",
+		Username:      "rogier",
+		Password:      "hunter2",
+		ScopedAPIKeys: "greedy:feedkey, events:sensorkey,stats:sensorkey,invalid",
+	}
+	db := sqlitedb.InitDatabase(cfg)
+	t.Cleanup(db.Close)
+
+	router := NewRouter(gin.New(), New(cfg, db))
+	ok := func(c *gin.Context) { c.String(200, string(FromContext(c).Method)) }
+
+	router.Group("/", Public()).GET("/", ok)
+	router.Group("/", Page()).GET("/events", ok)
+	router.Group("/api", Session()).GET("/categories", ok)
+	router.Group("/api", SessionOrAPIKey(ScopeStats)).GET("/stats", ok)
+	router.Group("/api/events", APIKey(ScopeEvents).OrSourceToken()).POST("", ok)
+	router.Group("/api/greedy", SessionOrAPIKey(ScopeGreedy).WithQueryKey()).GET("/rss", ok)
+	router.Group("/dav", APIKey(ScopeFiles).WithBasicAuth()).Handle("PROPFIND", "/*path", ok)
+
+	return router, db
+}
+
+func request(router *Router, method, url string, headers map[string]string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(method, url, nil)
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+	router.Engine().ServeHTTP(w, req)
+	return w
+}
+
+func TestPolicies(t *testing.T) {
+	router, _ := newTestRouter(t)
+
+	value, err := router.Authenticator().NewSession()
+	require.NoError(t, err)
+
+	session := map[string]string{"Cookie": SessionCookie + "=" + value}
+	forged := map[string]string{"Cookie": SessionCookie + "=true"}
+	master := map[string]string{APIKeyHeader: "supersecretkey"}
+	sensor := map[string]string{"Authorization": "Bearer sensorkey"}
+	wrong := map[string]string{APIKeyHeader: "wrong"}
+
+	tests := []struct {
+		name     string
+		method   string
+		url      string
+		headers  map[string]string
+		expected int
+	}{
+		{"public without credentials", "GET", "/", nil, 200},
+		{"page redirects to login", "GET", "/events", nil, 302},
+		{"page with session", "GET", "/events", session, 200},
+		{"page ignores api key", "GET", "/events", master, 302},
+		{"session only rejects api key", "GET", "/api/categories", master, 403},
+		{"session only with session", "GET", "/api/categories", session, 200},
+		{"forged session", "GET", "/api/categories", forged, 401},
+		{"forged session on page", "GET", "/events", forged, 302},
+		{"missing credentials", "GET", "/api/stats", nil, 401},
+		{"unknown api key", "GET", "/api/stats", wrong, 401},
+		{"master key has all scopes", "GET", "/api/stats", master, 200},
+		{"scoped key with scope", "GET", "/api/stats", sensor, 200},
+		{"scoped key without scope", "GET", "/api/greedy/rss", sensor, 403},
+		{"query key where allowed", "GET", "/api/greedy/rss?key=feedkey", nil, 200},
+		{"query key where not allowed", "GET", "/api/stats?key=supersecretkey", nil, 401},
+		{"api key route rejects session", "POST", "/api/events", session, 401},
+		{"unknown source token", "POST", "/api/events", map[string]string{SourceTokenHeader: "wrong"}, 401},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := request(router, tt.method, tt.url, tt.headers)
+			assert.Equal(t, tt.expected, w.Code)
+		})
+	}
+}
+
+func TestSession(t *testing.T) {
+	router, db := newTestRouter(t)
+
+	value, err := router.Authenticator().NewSession()
+	require.NoError(t, err)
+
+	other, err := router.Authenticator().NewSession()
+	require.NoError(t, err)
+	assert.NotEqual(t, value, other)
+
+	id, _, _ := strings.Cut(value, ".")
+	tampered := id + "." + strings.Repeat("A", 43)
+
+	for _, cookie := range []string{"true", tampered, id, value + "x"} {
+		w := request(router, "GET", "/api/stats", map[string]string{"Cookie": SessionCookie + "=" + cookie})
+		assert.Equal(t, 401, w.Code, cookie)
+	}
+
+	// sessions end when the credentials change
+	changed := NewRouter(gin.New(), New(config.AppConfig{Username: "rogier", Password: "changed"}, db))
+	changed.Group("/api", SessionOrAPIKey(ScopeStats)).GET("/stats", func(c *gin.Context) {})
+	w := request(changed, "GET", "/api/stats", map[string]string{"Cookie": SessionCookie + "=" + value})
+	assert.Equal(t, 401, w.Code)
+}
+
+func TestSourceToken(t *testing.T) {
+	router, db := newTestRouter(t)
+
+	_, token, err := db.AddEventSource(sqlitedb.EventSource{Name: "doorbell"})
+	require.NoError(t, err)
+
+	w := request(router, "POST", "/api/events", map[string]string{SourceTokenHeader: token})
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, string(MethodSourceToken), w.Body.String())
+
+	// source tokens are only accepted where the policy allows them
+	w = request(router, "GET", "/api/stats", map[string]string{SourceTokenHeader: token})
+	assert.Equal(t, 401, w.Code)
+}
+
+func TestBasicAuth(t *testing.T) {
+	router, _ := newTestRouter(t)
+
+	basic := func(username, password string) map[string]string {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.SetBasicAuth(username, password)
+		return map[string]string{"Authorization": req.Header.Get("Authorization")}
+	}
+
+	tests := []struct {
+		name     string
+		url      string
+		headers  map[string]string
+		expected int
+		identity Method
+	}{
+		{"login credentials", "/dav/", basic("rogier", "hunter2"), 200, MethodBasicAuth},
+		{"api key as password", "/dav/", basic("anyone", "supersecretkey"), 200, MethodAPIKey},
+		{"api key header", "/dav/", map[string]string{APIKeyHeader: "supersecretkey"}, 200, MethodAPIKey},
+		{"wrong password", "/dav/", basic("rogier", "wrong"), 401, MethodNone},
+		{"scoped key without scope", "/dav/", basic("rogier", "sensorkey"), 403, MethodNone},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := request(router, "PROPFIND", tt.url, tt.headers)
+			assert.Equal(t, tt.expected, w.Code)
+			if tt.expected == 200 {
+				assert.Equal(t, string(tt.identity), w.Body.String())
+			}
+		})
+	}
+
+	// basic auth is only accepted where the policy allows it, and only there clients
+	// are asked for credentials
+	w := request(router, "GET", "/api/stats", basic("rogier", "hunter2"))
+	assert.Equal(t, 401, w.Code)
+	assert.Empty(t, w.Header().Get("WWW-Authenticate"))
+
+	w = request(router, "PROPFIND", "/dav/", nil)
+	assert.Equal(t, 401, w.Code)
+	assert.Equal(t, BasicAuthRealm, w.Header().Get("WWW-Authenticate"))
+}
+
+func TestUnprotected(t *testing.T) {
+	router, _ := newTestRouter(t)
+	assert.Empty(t, router.Unprotected())
+
+	router.Engine().GET("/api/open", func(c *gin.Context) {})
+	assert.Equal(t, []string{"GET /api/open"}, router.Unprotected())
+
+	policy, found := router.Policy("GET", "/api/greedy/rss")
+	assert.True(t, found)
+	assert.Equal(t, "session or api key (greedy)", policy.String())
+	assert.Equal(t, "api key (files) or basic auth", APIKey(ScopeFiles).WithBasicAuth().String())
+}
+
+func TestJoinPaths(t *testing.T) {
+	assert.Equal(t, "/api", joinPaths("/api", ""))
+	assert.Equal(t, "/api/stats", joinPaths("/api", "/stats"))
+	assert.Equal(t, "/s/:token", joinPaths("/", "/s/:token"))
+	assert.Equal(t, "/api/files/", joinPaths("/api", "files/"))
+}
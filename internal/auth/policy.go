@@ -0,0 +1,94 @@
+package auth
+
+import "fmt"
+
+// Policy declares who may use a route
+type Policy struct {
+	session     bool
+	page        bool // redirect to the login page instead of a 401
+	apiKey      bool
+	scope       Scope
+	sourceToken bool
+	queryKey    bool
+	basicAuth   bool
+	public      bool
+}
+
+// Public routes are open to anyone, such as the login page and share links
+func Public() Policy {
+	return Policy{public: true}
+}
+
+// Page is a html page for logged in users, others are redirected to the login page
+func Page() Policy {
+	return Policy{session: true, page: true}
+}
+
+// Session routes can only be used by logged in users
+func Session() Policy {
+	return Policy{session: true}
+}
+
+// APIKey routes require an api key with the scope
+func APIKey(scope Scope) Policy {
+	return Policy{apiKey: true, scope: scope}
+}
+
+// SessionOrAPIKey routes can be used by logged in users and with an api key with the scope
+func SessionOrAPIKey(scope Scope) Policy {
+	return Policy{session: true, apiKey: true, scope: scope}
+}
+
+// OrSourceToken also allows registered event sources, with their own token
+func (p Policy) OrSourceToken() Policy {
+	p.sourceToken = true
+	return p
+}
+
+// WithQueryKey also accepts the api key as "key" query parameter, for clients
+// that cannot set headers such as feed readers
+func (p Policy) WithQueryKey() Policy {
+	p.queryKey = true
+	return p
+}
+
+// WithBasicAuth also accepts basic auth, with the login credentials or an api key as
+// password, for clients such as network drives
+func (p Policy) WithBasicAuth() Policy {
+	p.basicAuth = true
+	return p
+}
+
+func (p Policy) allows(identity Identity) bool {
+	switch identity.Method {
+	case MethodSession:
+		return p.public || p.session
+	case MethodAPIKey:
+		return p.public || (p.apiKey && identity.HasScope(p.scope))
+	case MethodSourceToken:
+		return p.public || p.sourceToken
+	case MethodBasicAuth:
+		return p.public || p.basicAuth
+	default:
+		return p.public
+	}
+}
+
+func (p Policy) String() string {
+	switch {
+	case p.public:
+		return "public"
+	case p.page:
+		return "page"
+	case p.apiKey && p.basicAuth:
+		return fmt.Sprintf("api key (%s) or basic auth", p.scope)
+	case p.session && p.apiKey:
+		return fmt.Sprintf("session or api key (%s)", p.scope)
+	case p.apiKey && p.sourceToken:
+		return fmt.Sprintf("api key (%s) or source token", p.scope)
+	case p.apiKey:
+		return fmt.Sprintf("api key (%s)", p.scope)
+	default:
+		return "session"
+	}
+}
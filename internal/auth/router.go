@@ -0,0 +1,113 @@
+package auth
+
+import (
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Router registers routes in gin route groups with a policy, and remembers the
+// policy of every route so routes without one can be found
+type Router struct {
+	engine   *gin.Engine
+	auth     *Authenticator
+	policies map[string]Policy
+}
+
+// NewRouter wraps the engine, routes are authenticated by auth
+func NewRouter(engine *gin.Engine, auth *Authenticator) *Router {
+	return &Router{engine: engine, auth: auth, policies: map[string]Policy{}}
+}
+
+// Authenticator returns the authenticator of the routes
+func (r *Router) Authenticator() *Authenticator {
+	return r.auth
+}
+
+// Engine returns the gin engine to serve
+func (r *Router) Engine() *gin.Engine {
+	return r.engine
+}
+
+// Group returns a group of routes under the prefix, all protected by the policy
+func (r *Router) Group(prefix string, policy Policy) *Group {
+	return &Group{
+		router: r,
+		group:  r.engine.Group(prefix, r.auth.Middleware(policy)),
+		policy: policy,
+	}
+}
+
+// Policy returns the policy of a registered route
+func (r *Router) Policy(method, path string) (Policy, bool) {
+	policy, found := r.policies[method+" "+path]
+	return policy, found
+}
+
+// Unprotected returns the routes of the engine that were not registered with a policy
+func (r *Router) Unprotected() []string {
+	var routes []string
+	for _, route := range r.engine.Routes() {
+		if _, found := r.Policy(route.Method, route.Path); !found {
+			routes = append(routes, route.Method+" "+route.Path)
+		}
+	}
+
+	sort.Strings(routes)
+	return routes
+}
+
+// Group is a gin route group with a policy
+type Group struct {
+	router *Router
+	group  *gin.RouterGroup
+	policy Policy
+}
+
+func (g *Group) Handle(method, relativePath string, handlers ...gin.HandlerFunc) {
+	g.group.Handle(method, relativePath, handlers...)
+	g.router.policies[method+" "+joinPaths(g.group.BasePath(), relativePath)] = g.policy
+}
+
+func (g *Group) GET(relativePath string, handlers ...gin.HandlerFunc) {
+	g.Handle("GET", relativePath, handlers...)
+}
+
+func (g *Group) POST(relativePath string, handlers ...gin.HandlerFunc) {
+	g.Handle("POST", relativePath, handlers...)
+}
+
+func (g *Group) PUT(relativePath string, handlers ...gin.HandlerFunc) {
+	g.Handle("PUT", relativePath, handlers...)
+}
+
+func (g *Group) PATCH(relativePath string, handlers ...gin.HandlerFunc) {
+	g.Handle("PATCH", relativePath, handlers...)
+}
+
+func (g *Group) DELETE(relativePath string, handlers ...gin.HandlerFunc) {
+	g.Handle("DELETE", relativePath, handlers...)
+}
+
+func (g *Group) HEAD(relativePath string, handlers ...gin.HandlerFunc) {
+	g.Handle("HEAD", relativePath, handlers...)
+}
+
+func (g *Group) OPTIONS(relativePath string, handlers ...gin.HandlerFunc) {
+	g.Handle("OPTIONS", relativePath, handlers...)
+}
+
+// joinPaths joins paths the way gin does for route groups
+func joinPaths(absolutePath, relativePath string) string {
+	if relativePath == "" {
+		return absolutePath
+	}
+
+	finalPath := path.Join(absolutePath, relativePath)
+	if strings.HasSuffix(relativePath, "/") && !strings.HasSuffix(finalPath, "/") {
+		return finalPath + "/"
+	}
+	return finalPath
+}
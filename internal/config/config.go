@@ -8,6 +8,13 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
+// policies for events of sources that are not registered
+const (
+	SourcePolicyAccept     = "accept"
+	SourcePolicyQuarantine = "quarantine"
+	SourcePolicyReject     = "reject"
+)
+
 type AppConfig struct {
 	HostPort                string
 	GreedyFile              string
@@ -18,7 +25,28 @@ type AppConfig struct {
 	Username                string
 	Password                string
 	XHomeAPIKey             string
+	ScopedAPIKeys           string
 	FileCleanUpInDys        int
+	MQTTBroker              string
+	MQTTUsername            string
+	MQTTPassword            string
+	MQTTClientID            string
+	MQTTTopics              string
+	EventsArchiveDir        string
+	UnknownSourcePolicy     string
+	ShareSecret             string
+	PublicURL               string
+	StorageQuotaMB          int
+	StorageMaxUploadMB      int
+	StorageMinFreeMB        int
+	StorageEncryptionKey    string
+	StorageEncryptionOldKey string
+	StorageAllowedTypes     string
+	StorageDeniedTypes      string
+	QuicknoteAllowedTypes   string
+	QuicknoteDeniedTypes    string
+	ClamAVSocket            string
+	MailAttachmentLimitMB   int
 }
 
 func ReadConfig() AppConfig {
@@ -32,6 +60,52 @@ func ReadConfig() AppConfig {
 		Username:                os.Getenv("USERNAME"),
 		Password:                os.Getenv("PASSWORD"),
 		XHomeAPIKey:             os.Getenv("X_HOME_API_KEY"),
+		ScopedAPIKeys:           os.Getenv("X_HOME_SCOPED_API_KEYS"),
+		MQTTBroker:              os.Getenv("MQTT_BROKER"),
+		MQTTUsername:            os.Getenv("MQTT_USERNAME"),
+		MQTTPassword:            os.Getenv("MQTT_PASSWORD"),
+		MQTTClientID:            os.Getenv("MQTT_CLIENT_ID"),
+		MQTTTopics:              os.Getenv("MQTT_TOPICS"),
+		EventsArchiveDir:        os.Getenv("EVENTS_ARCHIVE_DIR"),
+		UnknownSourcePolicy:     strings.ToLower(os.Getenv("EVENTS_UNKNOWN_SOURCE_POLICY")),
+		ShareSecret:             os.Getenv("SHARE_SECRET"),
+		PublicURL:               strings.TrimSuffix(os.Getenv("PUBLIC_URL"), "/"),
+		StorageQuotaMB:          optionalInt("STORAGE_QUOTA_MB", 0),      // default unlimited
+		StorageMaxUploadMB:      optionalInt("STORAGE_MAX_UPLOAD_MB", 0), // default unlimited
+		StorageMinFreeMB:        optionalInt("STORAGE_MIN_FREE_MB", 512), // keep room for the database
+		StorageEncryptionKey:    os.Getenv("STORAGE_ENCRYPTION_KEY"),     // files are not encrypted when empty
+		StorageEncryptionOldKey: os.Getenv("STORAGE_ENCRYPTION_OLD_KEY"), // only read, until the keys are rotated
+		StorageAllowedTypes:     os.Getenv("STORAGE_ALLOWED_TYPES"),      // comma separated, such as "image/*,application/pdf"
+		StorageDeniedTypes:      os.Getenv("STORAGE_DENIED_TYPES"),
+		QuicknoteAllowedTypes:   os.Getenv("QUICKNOTE_ALLOWED_TYPES"),
+		QuicknoteDeniedTypes:    os.Getenv("QUICKNOTE_DENIED_TYPES"),
+		ClamAVSocket:            os.Getenv("CLAMAV_SOCKET"),                  // uploads are not scanned when empty
+		MailAttachmentLimitMB:   optionalInt("MAIL_ATTACHMENT_LIMIT_MB", 20), // larger uploads are mailed as links
+	}
+
+	// links in mails and of shares point to the public url, such as https://home.lommers.org
+	if c.PublicURL == "" {
+		logrus.Info("PUBLIC_URL is not configured, share links are relative and large uploads are mailed as attachments")
+	}
+
+	// share links are signed with the api key, unless a separate secret is configured
+	if c.ShareSecret == "" {
+		c.ShareSecret = c.XHomeAPIKey
+	}
+
+	// mqtt client id
+	if c.MQTTClientID == "" {
+		c.MQTTClientID = "home-service"
+	}
+
+	// events without a registered source are accepted, unless configured otherwise
+	switch c.UnknownSourcePolicy {
+	case SourcePolicyAccept, SourcePolicyQuarantine, SourcePolicyReject:
+	case "":
+		c.UnknownSourcePolicy = SourcePolicyAccept
+	default:
+		logrus.Errorf("invalid EVENTS_UNKNOWN_SOURCE_POLICY value %q, defaulting to %s", c.UnknownSourcePolicy, SourcePolicyAccept)
+		c.UnknownSourcePolicy = SourcePolicyAccept
 	}
 
 	// host and port
@@ -61,6 +135,14 @@ func ReadConfig() AppConfig {
 	return c
 }
 
+// optionalInt reads an integer from the environment, unset variables use the default
+func optionalInt(key string, defaultValue int) int {
+	if os.Getenv(key) == "" {
+		return defaultValue
+	}
+	return convertToInt(os.Getenv(key), defaultValue)
+}
+
 func convertToInt(i string, defaultValue int) int {
 
 	var value int
@@ -11,6 +11,7 @@ import (
 	"github.com/gin-gonic/gin"
 	"github.com/gocolly/colly"
 	"github.com/gorilla/feeds"
+	"github.com/rogierlommers/home/internal/auth"
 	"github.com/rogierlommers/home/internal/config"
 	"github.com/rogierlommers/home/internal/sqlitedb"
 	"github.com/sirupsen/logrus"
@@ -35,7 +36,7 @@ type Greedy struct {
 	cfg config.AppConfig
 }
 
-func NewGreedy(router *gin.Engine, cfg config.AppConfig, db *sqlitedb.DB) (Greedy, error) {
+func NewGreedy(router *auth.Router, cfg config.AppConfig, db *sqlitedb.DB) (Greedy, error) {
 
 	// create instance
 	g := Greedy{
@@ -43,11 +44,14 @@ func NewGreedy(router *gin.Engine, cfg config.AppConfig, db *sqlitedb.DB) (Greed
 		cfg: cfg,
 	}
 
-	// add routes
-	router.GET("/api/greedy/add", g.addURL)
-	router.GET("/api/greedy/rss", g.displayRSS)
-	router.GET("/api/greedy/accepted", g.AcceptedResponse)
-	router.GET("/api/greedy/trigger-scraping", g.triggerScraping)
+	// add routes, feed readers and bookmarklets can only pass the api key in the url
+	api := router.Group("/api/greedy", auth.SessionOrAPIKey(auth.ScopeGreedy).WithQueryKey())
+	api.GET("/add", g.addURL)
+	api.GET("/rss", g.displayRSS)
+	api.GET("/trigger-scraping", g.triggerScraping)
+
+	// the page shown after adding an url
+	router.Group("/api/greedy", auth.Public()).GET("/accepted", g.AcceptedResponse)
 
 	// if not exist, create table
 	if err := g.createTable(); err != nil {
@@ -2,12 +2,13 @@ package homepage
 
 import (
 	"github.com/gin-gonic/gin"
+	"github.com/rogierlommers/home/internal/auth"
 	"github.com/rogierlommers/home/internal/config"
 	"github.com/sirupsen/logrus"
 )
 
 func displayLoginPage(c *gin.Context) {
-	if isAuthenticated(c) {
+	if auth.FromContext(c).Method == auth.MethodSession {
 		c.Redirect(302, "/bookmarks")
 		return
 	}
@@ -23,12 +24,7 @@ func displayLoginPage(c *gin.Context) {
 	c.String(200, string(htmlBytes))
 }
 
-func isAuthenticated(c *gin.Context) bool {
-	auth, err := c.Cookie("auth")
-	return err == nil && auth == "true"
-}
-
-func login(cfg config.AppConfig) gin.HandlerFunc {
+func login(cfg config.AppConfig, authenticator *auth.Authenticator) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		var credentials struct {
 			Username string `json:"username"`
@@ -42,8 +38,15 @@ func login(cfg config.AppConfig) gin.HandlerFunc {
 		}
 
 		if credentials.Username == cfg.Username && credentials.Password == cfg.Password {
+			session, err := authenticator.NewSession()
+			if err != nil {
+				logrus.Errorf("Failed to create session: %v", err)
+				c.String(500, "Failed to log in")
+				return
+			}
+
 			// valid for 6 months
-			c.SetCookie("auth", "true", 15552000, "/", "", false, true)
+			c.SetCookie(auth.SessionCookie, session, 15552000, "/", "", false, true)
 			c.String(200, "Login successful")
 			return
 		} else {
@@ -57,7 +60,7 @@ func login(cfg config.AppConfig) gin.HandlerFunc {
 func logout() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		// Clear the authentication cookie by setting its MaxAge to -1
-		c.SetCookie("auth", "", -1, "/", "", false, true)
+		c.SetCookie(auth.SessionCookie, "", -1, "/", "", false, true)
 		c.Redirect(302, "/")
 	}
 }
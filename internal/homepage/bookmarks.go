@@ -11,11 +11,6 @@ import (
 )
 
 func displayBookmarks(c *gin.Context) {
-	if !isAuthenticated(c) {
-		c.Redirect(302, "/login")
-		return
-	}
-
 	htmlBytes, err := staticFS.ReadFile("static_html/bookmarks.html")
 	if err != nil {
 		logrus.Errorf("Error reading static html: %v", err)
@@ -27,14 +22,8 @@ func displayBookmarks(c *gin.Context) {
 	c.String(200, string(htmlBytes))
 }
 
-func getBookmarks(db *sqlitedb.DB, XAPIkey string) gin.HandlerFunc {
+func getBookmarks(db *sqlitedb.DB) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		apiKey := c.GetHeader("X-HOME-API-KEY")
-		if !isAuthenticated(c) && apiKey != XAPIkey {
-			c.String(401, "Unauthorized")
-			return
-		}
-
 		bookmarks, err := db.GetBookmarks()
 		if err != nil {
 			logrus.Errorf("Failed to get bookmarks: %v", err)
@@ -46,15 +35,8 @@ func getBookmarks(db *sqlitedb.DB, XAPIkey string) gin.HandlerFunc {
 	}
 }
 
-func createImportScript(db *sqlitedb.DB, XAPIkey string) gin.HandlerFunc {
+func createImportScript(db *sqlitedb.DB) gin.HandlerFunc {
 	return func(c *gin.Context) {
-
-		apiKey := c.GetHeader("X-HOME-API-KEY")
-		if !isAuthenticated(c) && apiKey != XAPIkey {
-			c.String(401, "Unauthorized")
-			return
-		}
-
 		script, err := db.GenerateImportScript()
 		if err != nil {
 			logrus.Errorf("Failed to generate import script: %v", err)
@@ -69,11 +51,6 @@ func createImportScript(db *sqlitedb.DB, XAPIkey string) gin.HandlerFunc {
 
 func displayCategories(db *sqlitedb.DB) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		if !isAuthenticated(c) {
-			c.String(401, "Unauthorized")
-			return
-		}
-
 		excludeHiddenStr := c.Query("exclude_hidden")
 		excludeHidden, _ := strconv.ParseBool(excludeHiddenStr)
 
@@ -88,14 +65,8 @@ func displayCategories(db *sqlitedb.DB) gin.HandlerFunc {
 	}
 }
 
-func addBookmark(db *sqlitedb.DB, XAPIkey string) gin.HandlerFunc {
+func addBookmark(db *sqlitedb.DB) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		apiKey := c.GetHeader("X-HOME-API-KEY")
-		if !isAuthenticated(c) && apiKey != XAPIkey {
-			c.String(401, "Unauthorized")
-			return
-		}
-
 		var i sqlitedb.Item
 		if err := c.BindJSON(&i); err != nil {
 			logrus.Errorf("Failed to bind JSON: %v", err)
@@ -116,11 +87,6 @@ func addBookmark(db *sqlitedb.DB, XAPIkey string) gin.HandlerFunc {
 }
 
 func displayEditBookmarks(c *gin.Context) {
-	if !isAuthenticated(c) {
-		c.Redirect(302, "/login")
-		return
-	}
-
 	htmlBytes, err := staticFS.ReadFile("static_html/bookmarks_edit.html")
 	if err != nil {
 		logrus.Errorf("Error reading static html: %v", err)
@@ -134,14 +100,8 @@ func displayEditBookmarks(c *gin.Context) {
 
 func deleteBookmark(db *sqlitedb.DB) gin.HandlerFunc {
 	return func(c *gin.Context) {
-
 		id := convertToInt(c.Param("id"))
 
-		if !isAuthenticated(c) {
-			c.String(401, "Unauthorized")
-			return
-		}
-
 		if err := db.DeleteBookmark(id); err != nil {
 			logrus.Errorf("Failed to delete bookmark: %v", err)
 			c.String(500, "Failed to delete bookmark")
@@ -155,17 +115,11 @@ func deleteBookmark(db *sqlitedb.DB) gin.HandlerFunc {
 
 func editBookmark(db *sqlitedb.DB) gin.HandlerFunc {
 	return func(c *gin.Context) {
-
 		// display incoming body
 		logrus.Debugf("Edit bookmark url: %s, payload: %s", c.Request.RequestURI, c.Request.Body)
 
 		id := convertToInt(c.Param("id"))
 
-		if !isAuthenticated(c) {
-			c.String(401, "Unauthorized")
-			return
-		}
-
 		var i sqlitedb.Item
 		if err := c.BindJSON(&i); err != nil {
 			logrus.Errorf("Failed to bind JSON: %v", err)
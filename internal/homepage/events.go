@@ -2,30 +2,76 @@ package homepage
 
 import (
 	"bytes"
+	"database/sql"
+	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
+	"regexp"
+	"strconv"
 	"text/template"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/rogierlommers/home/internal/auth"
+	"github.com/rogierlommers/home/internal/config"
 	"github.com/rogierlommers/home/internal/mailer"
 	"github.com/rogierlommers/home/internal/sqlitedb"
 
 	"github.com/sirupsen/logrus"
 )
 
-const eventsToRetrieve = 1000
+const (
+	eventsToRetrieve = 1000
+
+	// events with the same dedup key within this window are stored once
+	dedupWindow = 10 * time.Minute
+
+	eventStatusCreated   = "created"
+	eventStatusDuplicate = "duplicate"
+	eventStatusCollapsed = "collapsed"
+)
+
+// attributeName restricts which attribute names can be aggregated
+var attributeName = regexp.MustCompile(`^[A-Za-z0-9_\-]+$`)
+
+// aggregateDefaults holds the default period to aggregate for each interval
+var aggregateDefaults = map[string]time.Duration{
+	"minute": 2 * time.Hour,
+	"hour":   48 * time.Hour,
+	"day":    30 * 24 * time.Hour,
+}
 
 // curl -X POST "https://home.lommers.org/api/events" -H "Content-Type: application/json" -d '{"source":"home-assistant","message": "hihi", "category": "sensor"}'
-// curl -X POST "http://localhost:3000/api/events" -H "Content-Type: application/json" -d '{"source":"home-assistant","message": "hihi", "category": "sensor"}'
+// curl -X POST "http://localhost:3000/api/events" -H "Content-Type: application/json" -d '{"source":"home-assistant","message": "hihi", "category": "sensor", "attributes": {"temperature": 21.5}}'
+// curl -X POST "http://localhost:3000/api/events" -H "Content-Type: application/json" -H "Idempotency-Key: 4f1c2a" -d '{"source":"home-assistant","message": "door open", "category": "alarm", "collapse": true}'
 
 type Message struct {
-	ID       int       `json:"id,omitempty"`
-	Source   string    `json:"source"`
-	Message  string    `json:"message"`
-	Category string    `json:"category"`
-	Added    time.Time `json:"added"`
+	ID          int            `json:"id,omitempty"`
+	Source      string         `json:"source"`
+	Message     string         `json:"message"`
+	Category    string         `json:"category"`
+	Severity    string         `json:"severity,omitempty"`
+	Added       time.Time      `json:"added"`
+	Attributes  map[string]any `json:"attributes,omitempty"`
+	DedupKey    string         `json:"dedup_key,omitempty"`
+	Collapse    bool           `json:"collapse,omitempty"`
+	RepeatCount int            `json:"repeat_count,omitempty"`
+	LastSeen    *time.Time     `json:"last_seen,omitempty"`
+
+	AcknowledgedAt *time.Time `json:"acknowledged_at,omitempty"`
+	AcknowledgedBy string     `json:"acknowledged_by,omitempty"`
+
+	// events of unknown sources are kept apart until released
+	Quarantined bool `json:"quarantined,omitempty"`
+}
+
+// eventFilter narrows down the events returned by getEvents
+type eventFilter struct {
+	Category    string
+	Source      string
+	Unread      bool
+	Quarantined bool // only quarantined events instead of only regular events
 }
 
 // dumpRequestBody reads and logs the request body, then restores it for further processing
@@ -46,14 +92,10 @@ func dumpRequestBody(c *gin.Context) error {
 }
 
 // documentation here: https://www.home-assistant.io/integrations/rest_command
-func eventsIncomingMessage(m *mailer.Mailer, db *sqlitedb.DB, XAPIkey string) gin.HandlerFunc {
+func eventsIncomingMessage(m *mailer.Mailer, db *sqlitedb.DB, cfg config.AppConfig) gin.HandlerFunc {
 	return func(c *gin.Context) {
-
-		apiKey := c.GetHeader("X-HOME-API-KEY")
-		if apiKey != XAPIkey {
-			c.String(401, "Unauthorized")
-			return
-		}
+		// requests with a source token carry the registered source, api key requests have none
+		source := auth.FromContext(c).Source
 
 		// first dump body
 		if err := dumpRequestBody(c); err != nil {
@@ -70,25 +112,33 @@ func eventsIncomingMessage(m *mailer.Mailer, db *sqlitedb.DB, XAPIkey string) gi
 			return
 		}
 
+		// the source is derived from the token, not from the body
+		if err := applySourcePolicy(db, &msg, source, cfg.UnknownSourcePolicy); err != nil {
+			logrus.Errorf("rejected event of source %q: %v", msg.Source, err)
+			c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+			return
+		}
+
+		// the header takes precedence, so retries of the same request are recognised
+		if key := c.GetHeader("Idempotency-Key"); key != "" {
+			msg.DedupKey = key
+		}
+
 		// add to database
-		if err := addEvent(db, msg); err != nil {
+		id, status, err := storeEvent(db.Conn, msg)
+		if err != nil {
 			logrus.Errorf("failed to add event to database: %v", err)
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store event"})
 			return
 		}
 
 		// respond okay
-		c.JSON(http.StatusOK, gin.H{"msg": "ok"})
+		c.JSON(http.StatusOK, gin.H{"msg": "ok", "id": id, "status": status})
 	}
 }
 
 func serveEventsHTML() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		if !isAuthenticated(c) {
-			c.Redirect(302, "/login")
-			return
-		}
-
 		// Read the template file from the embedded FS
 		htmlBytes, err := staticFS.ReadFile("static_html/events.html")
 		if err != nil {
@@ -117,24 +167,197 @@ func serveEventsHTML() gin.HandlerFunc {
 	}
 }
 
-func addEvent(db *sqlitedb.DB, msg Message) error {
-	_, err := db.Conn.Exec(`
-		INSERT INTO events (source, message, category)
-		VALUES (?, ?, ?)
-	`, msg.Source, msg.Message, msg.Category)
+// querier is implemented by both *sql.DB and *sql.Tx, so events can be
+// stored on their own or as part of a transaction
+type querier interface {
+	Exec(query string, args ...any) (sql.Result, error)
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+// AddEvent stores an event, it is the entry point for other packages that ingest events
+func AddEvent(db *sqlitedb.DB, msg Message) error {
+	_, _, err := storeEvent(db.Conn, msg)
+	return err
+}
+
+// storeEvent stores a single event unless it is a duplicate of an earlier event with
+// the same dedup key, or can be collapsed into the last identical event of its source.
+// It returns the id of the stored (or existing) event and what happened to it.
+func storeEvent(q querier, msg Message) (int64, string, error) {
+	attributes, err := encodeAttributes(msg.Attributes)
+	if err != nil {
+		return 0, "", err
+	}
+
+	var added sql.NullString
+	if !msg.Added.IsZero() {
+		added = sql.NullString{String: msg.Added.UTC().Format(sqlitedb.TimestampLayout), Valid: true}
+	}
+
+	// every event, even a duplicate, is a sign of life of its source
+	if !msg.Quarantined {
+		if _, err := q.Exec(`UPDATE heartbeat_monitors SET last_seen = CURRENT_TIMESTAMP WHERE name = ?`, msg.Source); err != nil {
+			return 0, "", fmt.Errorf("failed to update heartbeat: %v", err)
+		}
+
+		if _, err := q.Exec(`UPDATE event_sources SET last_seen = CURRENT_TIMESTAMP WHERE name = ?`, msg.Source); err != nil {
+			return 0, "", fmt.Errorf("failed to update event source: %v", err)
+		}
+	}
+
+	if msg.DedupKey != "" {
+		id, found, err := findDuplicate(q, msg.DedupKey)
+		if err != nil || found {
+			return id, eventStatusDuplicate, err
+		}
+	}
+
+	if msg.Collapse {
+		var (
+			id                      int64
+			message, category, attr string
+		)
+
+		err := q.QueryRow(`
+			SELECT id, message, COALESCE(category, ''), COALESCE(attributes, '')
+			FROM events WHERE source = ? AND quarantined = ? ORDER BY id DESC LIMIT 1
+		`, msg.Source, msg.Quarantined).Scan(&id, &message, &category, &attr)
+		if err != nil && err != sql.ErrNoRows {
+			return 0, "", fmt.Errorf("failed to look up last event: %v", err)
+		}
+
+		// a repeated event moves back into the inbox
+		if err == nil && message == msg.Message && category == msg.Category && attr == attributes.String {
+			_, err := q.Exec(`
+				UPDATE events SET repeat_count = repeat_count + 1, last_seen = COALESCE(?, CURRENT_TIMESTAMP),
+				                  acknowledged_at = NULL, acknowledged_by = NULL
+				WHERE id = ?
+			`, added, id)
+			if err != nil {
+				return 0, "", fmt.Errorf("failed to collapse event: %v", err)
+			}
+			return id, eventStatusCollapsed, autoAcknowledge(q, id, msg)
+		}
+	}
+
+	var dedupKey sql.NullString
+	if msg.DedupKey != "" {
+		dedupKey = sql.NullString{String: msg.DedupKey, Valid: true}
+	}
+
+	// the dedup key is checked again in the insert itself, so concurrent retries cannot
+	// both be stored
+	result, err := q.Exec(`
+		INSERT INTO events (source, message, category, severity, attributes, added, received, dedup_key, quarantined)
+		SELECT ?, ?, ?, NULLIF(?, ''), ?, COALESCE(?, CURRENT_TIMESTAMP), CURRENT_TIMESTAMP, ?, ?
+		WHERE ? IS NULL OR NOT EXISTS (
+			SELECT 1 FROM events WHERE dedup_key = ? AND COALESCE(received, added) >= ?
+		)
+	`, msg.Source, msg.Message, msg.Category, msg.Severity, attributes, added, dedupKey, msg.Quarantined,
+		dedupKey, dedupKey, dedupWindowStart())
+	if err != nil {
+		return 0, "", fmt.Errorf("failed to insert event: %v", err)
+	}
+
+	if inserted, err := result.RowsAffected(); err != nil || inserted == 0 {
+		if err != nil {
+			return 0, "", err
+		}
+		id, _, err := findDuplicate(q, msg.DedupKey)
+		return id, eventStatusDuplicate, err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, "", err
+	}
+
+	if err := autoAcknowledge(q, id, msg); err != nil {
+		return 0, "", err
+	}
+
+	// quarantined events are not trusted enough to be sent elsewhere
+	if msg.Quarantined {
+		return id, eventStatusCreated, nil
+	}
+
+	return id, eventStatusCreated, enqueueWebhooks(q, id, msg)
+}
+
+// findDuplicate returns the event that was received with the dedup key within the
+// dedup window. Events are matched on when they were received, not on when they
+// happened, so a retried backfill is a duplicate as well.
+func findDuplicate(q querier, key string) (int64, bool, error) {
+	var id int64
+	err := q.QueryRow(`
+		SELECT id FROM events WHERE dedup_key = ? AND COALESCE(received, added) >= ?
+		ORDER BY id DESC LIMIT 1
+	`, key, dedupWindowStart()).Scan(&id)
+
+	switch {
+	case err == sql.ErrNoRows:
+		return 0, false, nil
+	case err != nil:
+		return 0, false, fmt.Errorf("failed to look up dedup key: %v", err)
+	}
+
+	logrus.Debugf("event with dedup key %q already stored as %d", key, id)
+	return id, true, nil
+}
+
+func dedupWindowStart() string {
+	return time.Now().Add(-dedupWindow).UTC().Format(sqlitedb.TimestampLayout)
+}
+
+// autoAcknowledge acknowledges the event when it matches one of the auto-ack rules
+func autoAcknowledge(q querier, id int64, msg Message) error {
+	_, err := q.Exec(`
+		UPDATE events SET acknowledged_at = CURRENT_TIMESTAMP, acknowledged_by = ?
+		WHERE id = ? AND EXISTS (
+			SELECT 1 FROM event_autoack_rules
+			WHERE (category = '' OR category = ?) AND (source = '' OR source = ?)
+		)
+	`, sqlitedb.AutoAckBy, id, msg.Category, msg.Source)
 	if err != nil {
-		return fmt.Errorf("failed to insert event: %v", err)
+		return fmt.Errorf("failed to apply auto-ack rules: %v", err)
 	}
 	return nil
 }
 
-func getEvents(db *sqlitedb.DB, number int, categoryFilter string) []Message {
-	query := `SELECT id, message, category, added, source FROM events WHERE 1=1`
-	args := []any{}
+// encodeAttributes converts attributes into JSON, events without attributes are stored as NULL
+func encodeAttributes(attributes map[string]any) (sql.NullString, error) {
+	if len(attributes) == 0 {
+		return sql.NullString{}, nil
+	}
+
+	b, err := json.Marshal(attributes)
+	if err != nil {
+		return sql.NullString{}, fmt.Errorf("failed to encode attributes: %v", err)
+	}
+
+	return sql.NullString{String: string(b), Valid: true}, nil
+}
 
-	if categoryFilter != "" {
+// eventColumns are the columns scanned by scanEvent
+const eventColumns = `id, message, COALESCE(category, ''), COALESCE(severity, ''), added, COALESCE(source, ''), attributes,
+	repeat_count, last_seen, acknowledged_at, COALESCE(acknowledged_by, ''), quarantined`
+
+func getEvents(db *sqlitedb.DB, number int, filter eventFilter) []Message {
+	query := `SELECT ` + eventColumns + ` FROM events WHERE quarantined = ?`
+	args := []any{filter.Quarantined}
+
+	if filter.Category != "" {
 		query += ` AND category = ?`
-		args = append(args, categoryFilter)
+		args = append(args, filter.Category)
+	}
+
+	if filter.Source != "" {
+		query += ` AND source = ?`
+		args = append(args, filter.Source)
+	}
+
+	if filter.Unread {
+		query += ` AND acknowledged_at IS NULL`
 	}
 
 	query += ` ORDER BY id DESC LIMIT ?`
@@ -149,8 +372,8 @@ func getEvents(db *sqlitedb.DB, number int, categoryFilter string) []Message {
 
 	var events []Message
 	for rows.Next() {
-		var msg Message
-		if err := rows.Scan(&msg.ID, &msg.Message, &msg.Category, &msg.Added, &msg.Source); err != nil {
+		msg, err := scanEvent(rows)
+		if err != nil {
 			logrus.Errorf("failed to scan event row: %v", err)
 			continue
 		}
@@ -162,13 +385,39 @@ func getEvents(db *sqlitedb.DB, number int, categoryFilter string) []Message {
 	return events
 }
 
-func displayEventsCategories(db *sqlitedb.DB) gin.HandlerFunc {
-	return func(c *gin.Context) {
-		if !isAuthenticated(c) {
-			c.String(401, "Unauthorized")
-			return
+// scanEvent scans a row selected with eventColumns
+func scanEvent(rows *sql.Rows) (Message, error) {
+	var (
+		msg        Message
+		attributes sql.NullString
+		lastSeen   sql.NullTime
+		ackedAt    sql.NullTime
+	)
+
+	if err := rows.Scan(&msg.ID, &msg.Message, &msg.Category, &msg.Severity, &msg.Added, &msg.Source, &attributes,
+		&msg.RepeatCount, &lastSeen, &ackedAt, &msg.AcknowledgedBy, &msg.Quarantined); err != nil {
+		return msg, err
+	}
+
+	if lastSeen.Valid {
+		msg.LastSeen = &lastSeen.Time
+	}
+
+	if ackedAt.Valid {
+		msg.AcknowledgedAt = &ackedAt.Time
+	}
+
+	if attributes.Valid {
+		if err := json.Unmarshal([]byte(attributes.String), &msg.Attributes); err != nil {
+			logrus.Errorf("failed to decode attributes of event %d: %v", msg.ID, err)
 		}
+	}
 
+	return msg, nil
+}
+
+func displayEventsCategories(db *sqlitedb.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
 		categories, err := db.GetEventsCategories()
 		if err != nil {
 			logrus.Errorf("Failed to get categories: %v", err)
@@ -182,16 +431,59 @@ func displayEventsCategories(db *sqlitedb.DB) gin.HandlerFunc {
 
 func displayEvents(db *sqlitedb.DB) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		if !isAuthenticated(c) {
-			c.String(401, "Unauthorized")
+		// get potential filter
+		unread, _ := strconv.ParseBool(c.Query("unread"))
+		quarantined, _ := strconv.ParseBool(c.Query("quarantined"))
+		filter := eventFilter{
+			Category:    c.Query("category"),
+			Source:      c.Query("source"),
+			Unread:      unread,
+			Quarantined: quarantined,
+		}
+		logrus.Debugf("event filter: %+v", filter)
+
+		events := getEvents(db, eventsToRetrieve, filter)
+		c.IndentedJSON(200, events)
+	}
+}
+
+// curl "http://localhost:3000/api/events/aggregate?interval=hour&attribute=temperature&category=sensor"
+func aggregateEvents(db *sqlitedb.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		opts := sqlitedb.AggregateOptions{
+			Interval:  c.DefaultQuery("interval", "hour"),
+			Attribute: c.Query("attribute"),
+			Category:  c.Query("category"),
+			Source:    c.Query("source"),
+		}
+
+		period, ok := aggregateDefaults[opts.Interval]
+		if !ok {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "interval must be one of minute, hour or day"})
 			return
 		}
 
-		// get potential filter
-		categoryFilter := c.Query("category")
-		logrus.Debugf("category filter: %s", categoryFilter)
+		if since := c.Query("since"); since != "" {
+			var err error
+			if period, err = time.ParseDuration(since); err != nil || period <= 0 {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "since must be a positive duration, e.g. 24h"})
+				return
+			}
+		}
+		opts.Since = time.Now().Add(-period)
 
-		events := getEvents(db, eventsToRetrieve, categoryFilter)
-		c.IndentedJSON(200, events)
+		if opts.Attribute != "" && !attributeName.MatchString(opts.Attribute) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid attribute name"})
+			return
+		}
+
+		aggregates, err := db.AggregateEvents(opts)
+		if err != nil {
+			logrus.Errorf("failed to aggregate events: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to aggregate events"})
+			return
+		}
+
+		c.IndentedJSON(200, aggregates)
 	}
 }
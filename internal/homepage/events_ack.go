@@ -0,0 +1,150 @@
+package homepage
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rogierlommers/home/internal/auth"
+	"github.com/rogierlommers/home/internal/config"
+	"github.com/rogierlommers/home/internal/sqlitedb"
+	"github.com/sirupsen/logrus"
+)
+
+// curl -X POST "http://localhost:3000/api/events/42/ack" -H "X-HOME-API-KEY: supersecretkey"
+// curl -X POST "http://localhost:3000/api/events/ack" -H "X-HOME-API-KEY: supersecretkey" -d '{"category": "sensor"}'
+// curl -X POST "http://localhost:3000/api/events/ack" -H "X-HOME-API-KEY: supersecretkey" -d '{"all": true}'
+// curl "http://localhost:3000/api/events/unread" -H "X-HOME-API-KEY: supersecretkey"
+
+// acknowledger determines who acknowledges, based on how the request was authenticated
+func acknowledger(c *gin.Context, cfg config.AppConfig) string {
+	if auth.FromContext(c).Method != auth.MethodSession {
+		return "api"
+	}
+
+	if cfg.Username != "" {
+		return cfg.Username
+	}
+
+	return "session"
+}
+
+func acknowledgeEvent(db *sqlitedb.DB, cfg config.AppConfig) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid event id"})
+			return
+		}
+
+		acknowledged, err := db.AcknowledgeEvent(id, acknowledger(c, cfg))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to acknowledge event"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"id": id, "acknowledged": acknowledged})
+	}
+}
+
+func unacknowledgeEvent(db *sqlitedb.DB, cfg config.AppConfig) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid event id"})
+			return
+		}
+
+		if err := db.UnacknowledgeEvent(id); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to unacknowledge event"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"id": id, "acknowledged": false})
+	}
+}
+
+func acknowledgeEvents(db *sqlitedb.DB, cfg config.AppConfig) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var filter sqlitedb.AckFilter
+		if err := c.ShouldBindJSON(&filter); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+			return
+		}
+
+		// a request without filter is a mistake more often than not, everything
+		// is only acknowledged when asked for explicitly
+		if filter.Empty() {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Set ids, category, source or before_id, or all to acknowledge every event"})
+			return
+		}
+
+		count, err := db.AcknowledgeEvents(filter, acknowledger(c, cfg))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to acknowledge events"})
+			return
+		}
+
+		logrus.Debugf("acknowledged %d events with filter %+v", count, filter)
+		c.JSON(http.StatusOK, gin.H{"acknowledged": count})
+	}
+}
+
+func unreadEvents(db *sqlitedb.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		count, err := db.CountUnreadEvents()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to count unread events"})
+			return
+		}
+
+		c.JSON(http.StatusOK, count)
+	}
+}
+
+func displayAutoAckRules(db *sqlitedb.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		rules, err := db.GetAutoAckRules()
+		if err != nil {
+			logrus.Errorf("Failed to get auto-ack rules: %v", err)
+			c.String(500, "Failed to retrieve auto-ack rules")
+			return
+		}
+
+		c.IndentedJSON(200, rules)
+	}
+}
+
+func addAutoAckRule(db *sqlitedb.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var rule sqlitedb.AutoAckRule
+		if err := c.BindJSON(&rule); err != nil {
+			logrus.Errorf("Failed to bind JSON: %v", err)
+			c.String(400, "Invalid request payload")
+			return
+		}
+
+		id, err := db.AddAutoAckRule(rule)
+		if err != nil {
+			logrus.Errorf("Failed to add auto-ack rule: %v", err)
+			c.String(400, "Failed to add auto-ack rule: %v", err)
+			return
+		}
+
+		rule.ID = id
+		c.IndentedJSON(201, rule)
+	}
+}
+
+func deleteAutoAckRule(db *sqlitedb.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := convertToInt(c.Param("id"))
+		if err := db.DeleteAutoAckRule(id); err != nil {
+			logrus.Errorf("Failed to delete auto-ack rule: %v", err)
+			c.String(500, "Failed to delete auto-ack rule")
+			return
+		}
+
+		c.JSON(200, gin.H{"status": "ok", "deletedID": id})
+	}
+}
@@ -0,0 +1,336 @@
+package homepage
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rogierlommers/home/internal/auth"
+	"github.com/rogierlommers/home/internal/config"
+	"github.com/rogierlommers/home/internal/sqlitedb"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	severityCritical = "critical"
+	severityWarning  = "warning"
+	severityInfo     = "info"
+)
+
+// Alertmanager configuration:
+//
+//	receivers:
+//	  - name: home
+//	    webhook_configs:
+//	      - url: https://home.lommers.org/api/events/alertmanager
+//	        http_config:
+//	          authorization:
+//	            credentials: supersecretkey
+//
+// Registered sources send their token instead, in the X-HOME-SOURCE-TOKEN header.
+
+// alertmanagerPayload is the webhook payload of Prometheus Alertmanager, Grafana
+// unified alerting sends the same payload with a few additional fields
+type alertmanagerPayload struct {
+	Status string  `json:"status"`
+	Alerts []alert `json:"alerts"`
+
+	// Grafana legacy alerting
+	Title       string            `json:"title"`
+	RuleName    string            `json:"ruleName"`
+	RuleURL     string            `json:"ruleUrl"`
+	State       string            `json:"state"`
+	Message     string            `json:"message"`
+	Tags        map[string]string `json:"tags"`
+	EvalMatches []map[string]any  `json:"evalMatches"`
+}
+
+type alert struct {
+	Status       string            `json:"status"`
+	Labels       map[string]string `json:"labels"`
+	Annotations  map[string]string `json:"annotations"`
+	StartsAt     time.Time         `json:"startsAt"`
+	EndsAt       time.Time         `json:"endsAt"`
+	GeneratorURL string            `json:"generatorURL"`
+	Fingerprint  string            `json:"fingerprint"`
+
+	// Grafana unified alerting
+	ValueString  string `json:"valueString"`
+	DashboardURL string `json:"dashboardURL"`
+	PanelURL     string `json:"panelURL"`
+}
+
+// homeAssistantPayload covers both the RESTful notify integration (message, title
+// and data) and automations posting a state change of an entity
+type homeAssistantPayload struct {
+	Message  string         `json:"message"`
+	Title    string         `json:"title"`
+	Data     map[string]any `json:"data"`
+	Category string         `json:"category"`
+	Severity string         `json:"severity"`
+
+	EntityID     string         `json:"entity_id"`
+	FriendlyName string         `json:"friendly_name"`
+	State        string         `json:"state"`
+	OldState     string         `json:"old_state"`
+	Attributes   map[string]any `json:"attributes"`
+}
+
+func alertmanagerIncoming(db *sqlitedb.DB, cfg config.AppConfig) gin.HandlerFunc {
+	return adapterHandler(db, cfg, func(c *gin.Context) ([]Message, error) {
+		var payload alertmanagerPayload
+		if err := c.ShouldBindJSON(&payload); err != nil {
+			return nil, err
+		}
+		return alertsToMessages("alertmanager", payload.Alerts), nil
+	})
+}
+
+func grafanaIncoming(db *sqlitedb.DB, cfg config.AppConfig) gin.HandlerFunc {
+	return adapterHandler(db, cfg, func(c *gin.Context) ([]Message, error) {
+		var payload alertmanagerPayload
+		if err := c.ShouldBindJSON(&payload); err != nil {
+			return nil, err
+		}
+
+		if len(payload.Alerts) > 0 {
+			return alertsToMessages("grafana", payload.Alerts), nil
+		}
+		return []Message{legacyGrafanaToMessage(payload)}, nil
+	})
+}
+
+func homeAssistantIncoming(db *sqlitedb.DB, cfg config.AppConfig) gin.HandlerFunc {
+	return adapterHandler(db, cfg, func(c *gin.Context) ([]Message, error) {
+		var payload homeAssistantPayload
+		if err := c.ShouldBindJSON(&payload); err != nil {
+			return nil, err
+		}
+		return []Message{homeAssistantToMessage(payload)}, nil
+	})
+}
+
+// adapterHandler maps the payload onto events and stores them in a single transaction.
+// The events are handled by the source policy like any other events, with a source token
+// they get the registered source instead of the source of the adapter.
+func adapterHandler(db *sqlitedb.DB, cfg config.AppConfig, mapPayload func(c *gin.Context) ([]Message, error)) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		source := auth.FromContext(c).Source
+
+		if err := dumpRequestBody(c); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read request body"})
+			return
+		}
+
+		messages, err := mapPayload(c)
+		if err != nil {
+			logrus.Errorf("failed to map payload on %s: %v", c.FullPath(), err)
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+			return
+		}
+
+		items := make([]batchItem, len(messages))
+		for i, msg := range messages {
+			items[i].msg = msg
+			items[i].err = applySourcePolicy(db, &items[i].msg, source, cfg.UnknownSourcePolicy)
+		}
+
+		results, err := storeBatch(db, items)
+		if err != nil {
+			logrus.Errorf("failed to store events: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store events"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"msg": "ok", "items": results})
+	}
+}
+
+// alertsToMessages creates an event per alert. Alertmanager repeats notifications of
+// alerts that keep firing, these are collapsed into the earlier event.
+func alertsToMessages(source string, alerts []alert) []Message {
+	messages := make([]Message, 0, len(alerts))
+
+	for _, a := range alerts {
+		name := a.Labels["alertname"]
+		if name == "" {
+			name = "alert"
+		}
+
+		text := a.Annotations["summary"]
+		if text == "" {
+			text = a.Annotations["description"]
+		}
+
+		message := fmt.Sprintf("[%s] %s", strings.ToUpper(a.Status), name)
+		if text != "" {
+			message += ": " + text
+		}
+
+		category := a.Labels["category"]
+		if category == "" {
+			category = "alert"
+		}
+
+		severity := normalizeSeverity(a.Labels["severity"], severityWarning)
+		if a.Status == "resolved" {
+			severity = severityInfo
+		}
+
+		attributes := map[string]any{
+			"status":      a.Status,
+			"labels":      a.Labels,
+			"annotations": a.Annotations,
+			"starts_at":   a.StartsAt,
+		}
+		if !a.EndsAt.IsZero() && a.Status == "resolved" {
+			attributes["ends_at"] = a.EndsAt
+		}
+		for key, value := range map[string]string{
+			"generator_url": a.GeneratorURL,
+			"value":         a.ValueString,
+			"dashboard_url": a.DashboardURL,
+			"panel_url":     a.PanelURL,
+		} {
+			if value != "" {
+				attributes[key] = value
+			}
+		}
+
+		msg := Message{
+			Source:     source,
+			Category:   category,
+			Severity:   severity,
+			Message:    message,
+			Attributes: attributes,
+			Collapse:   true,
+		}
+
+		if a.Fingerprint != "" {
+			msg.DedupKey = fmt.Sprintf("%s:%s:%s:%d", source, a.Fingerprint, a.Status, a.StartsAt.Unix())
+		}
+
+		messages = append(messages, msg)
+	}
+
+	return messages
+}
+
+func legacyGrafanaToMessage(p alertmanagerPayload) Message {
+	title := p.Title
+	if title == "" {
+		title = p.RuleName
+	}
+
+	message := title
+	if p.Message != "" {
+		message += ": " + p.Message
+	}
+
+	severity := severityWarning
+	switch p.State {
+	case "ok", "paused", "pending":
+		severity = severityInfo
+	case "alerting":
+		severity = normalizeSeverity(p.Tags["severity"], severityWarning)
+	}
+
+	attributes := map[string]any{"state": p.State}
+	if p.RuleURL != "" {
+		attributes["rule_url"] = p.RuleURL
+	}
+	if len(p.Tags) > 0 {
+		attributes["tags"] = p.Tags
+	}
+	if len(p.EvalMatches) > 0 {
+		attributes["eval_matches"] = p.EvalMatches
+	}
+
+	return Message{
+		Source:     "grafana",
+		Category:   "alert",
+		Severity:   severity,
+		Message:    message,
+		Attributes: attributes,
+		Collapse:   true,
+	}
+}
+
+func homeAssistantToMessage(p homeAssistantPayload) Message {
+	msg := Message{
+		Source:   "home-assistant",
+		Category: p.Category,
+		Severity: normalizeSeverity(p.Severity, severityInfo),
+	}
+
+	// state change of an entity
+	if p.EntityID != "" {
+		name := p.FriendlyName
+		if name == "" {
+			name = p.EntityID
+		}
+
+		if msg.Category == "" {
+			msg.Category, _, _ = strings.Cut(p.EntityID, ".")
+		}
+
+		msg.Message = fmt.Sprintf("%s is %s", name, p.State)
+		if p.OldState != "" {
+			msg.Message = fmt.Sprintf("%s changed from %s to %s", name, p.OldState, p.State)
+		}
+
+		msg.Attributes = map[string]any{}
+		for key, value := range p.Attributes {
+			msg.Attributes[key] = value
+		}
+		msg.Attributes["entity_id"] = p.EntityID
+		msg.Attributes["state"] = p.State
+		if p.OldState != "" {
+			msg.Attributes["old_state"] = p.OldState
+		}
+
+		if severity, ok := p.Attributes["severity"].(string); ok && p.Severity == "" {
+			msg.Severity = normalizeSeverity(severity, severityInfo)
+		}
+		return msg
+	}
+
+	// notification
+	msg.Message = p.Message
+	if p.Title != "" {
+		msg.Message = fmt.Sprintf("%s: %s", p.Title, p.Message)
+	}
+
+	if msg.Category == "" {
+		msg.Category = "notification"
+		if category, ok := p.Data["category"].(string); ok && category != "" {
+			msg.Category = category
+		}
+	}
+
+	if severity, ok := p.Data["severity"].(string); ok && p.Severity == "" {
+		msg.Severity = normalizeSeverity(severity, severityInfo)
+	}
+
+	if len(p.Data) > 0 {
+		msg.Attributes = p.Data
+	}
+
+	return msg
+}
+
+// normalizeSeverity maps the many severity names in use onto critical, warning and info
+func normalizeSeverity(severity string, fallback string) string {
+	switch strings.ToLower(strings.TrimSpace(severity)) {
+	case "critical", "crit", "error", "high", "page", "disaster", "emergency", "alert":
+		return severityCritical
+	case "warning", "warn", "medium", "average":
+		return severityWarning
+	case "info", "information", "low", "none", "ok", "debug":
+		return severityInfo
+	default:
+		return fallback
+	}
+}
@@ -0,0 +1,175 @@
+package homepage
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rogierlommers/home/internal/auth"
+	"github.com/rogierlommers/home/internal/config"
+	"github.com/rogierlommers/home/internal/sqlitedb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const alertmanagerFiring = `{
+	"version": "4",
+	"status": "firing",
+	"receiver": "home",
+	"alerts": [
+		{
+			"status": "firing",
+			"labels": {"alertname": "DiskFull", "severity": "critical", "instance": "nas:9100"},
+			"annotations": {"summary": "disk on nas is 95% full"},
+			"startsAt": "2025-01-01T12:00:00Z",
+			"endsAt": "0001-01-01T00:00:00Z",
+			"generatorURL": "http://prometheus/graph",
+			"fingerprint": "c8f1"
+		},
+		{
+			"status": "resolved",
+			"labels": {"alertname": "HighLoad", "category": "server"},
+			"annotations": {"description": "load is back to normal"},
+			"startsAt": "2025-01-01T11:00:00Z",
+			"endsAt": "2025-01-01T11:30:00Z",
+			"fingerprint": "a1b2"
+		}
+	]
+}`
+
+func TestAlertsToMessages(t *testing.T) {
+	var payload alertmanagerPayload
+	require.NoError(t, json.Unmarshal([]byte(alertmanagerFiring), &payload))
+
+	messages := alertsToMessages("alertmanager", payload.Alerts)
+	require.Len(t, messages, 2)
+
+	assert.Equal(t, "alertmanager", messages[0].Source)
+	assert.Equal(t, "alert", messages[0].Category)
+	assert.Equal(t, severityCritical, messages[0].Severity)
+	assert.Equal(t, "[FIRING] DiskFull: disk on nas is 95% full", messages[0].Message)
+	assert.Equal(t, "http://prometheus/graph", messages[0].Attributes["generator_url"])
+	assert.NotEmpty(t, messages[0].DedupKey)
+
+	assert.Equal(t, "server", messages[1].Category)
+	assert.Equal(t, severityInfo, messages[1].Severity)
+	assert.Equal(t, "[RESOLVED] HighLoad: load is back to normal", messages[1].Message)
+}
+
+func TestLegacyGrafanaToMessage(t *testing.T) {
+	var payload alertmanagerPayload
+	require.NoError(t, json.Unmarshal([]byte(`{
+		"title": "[Alerting] Freezer temperature",
+		"ruleName": "Freezer temperature",
+		"state": "alerting",
+		"message": "freezer is above -15",
+		"tags": {"severity": "high"},
+		"evalMatches": [{"metric": "freezer", "value": -12}]
+	}`), &payload))
+
+	msg := legacyGrafanaToMessage(payload)
+	assert.Equal(t, "grafana", msg.Source)
+	assert.Equal(t, severityCritical, msg.Severity)
+	assert.Equal(t, "[Alerting] Freezer temperature: freezer is above -15", msg.Message)
+}
+
+func TestHomeAssistantToMessage(t *testing.T) {
+	tests := []struct {
+		name             string
+		payload          string
+		expectedMessage  string
+		expectedCategory string
+		expectedSeverity string
+	}{
+		{
+			name:             "state change",
+			payload:          `{"entity_id": "binary_sensor.front_door", "friendly_name": "Front door", "state": "on", "old_state": "off", "attributes": {"device_class": "door"}}`,
+			expectedMessage:  "Front door changed from off to on",
+			expectedCategory: "binary_sensor",
+			expectedSeverity: severityInfo,
+		},
+		{
+			name:             "notification",
+			payload:          `{"title": "Washing machine", "message": "done", "data": {"severity": "warning", "category": "appliance"}}`,
+			expectedMessage:  "Washing machine: done",
+			expectedCategory: "appliance",
+			expectedSeverity: severityWarning,
+		},
+		{
+			name:             "notification without title",
+			payload:          `{"message": "smoke detected", "severity": "critical"}`,
+			expectedMessage:  "smoke detected",
+			expectedCategory: "notification",
+			expectedSeverity: severityCritical,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var payload homeAssistantPayload
+			require.NoError(t, json.Unmarshal([]byte(tt.payload), &payload))
+
+			msg := homeAssistantToMessage(payload)
+			assert.Equal(t, "home-assistant", msg.Source)
+			assert.Equal(t, tt.expectedMessage, msg.Message)
+			assert.Equal(t, tt.expectedCategory, msg.Category)
+			assert.Equal(t, tt.expectedSeverity, msg.Severity)
+		})
+	}
+}
+
+func TestAlertmanagerIncoming(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	db := newTestDB(t)
+
+	cfg := config.AppConfig{XHomeAPIKey: "supersecretkey", UnknownSourcePolicy: config.SourcePolicyAccept}
+	router := newTestRouter(cfg, db)
+	router.Group("/api/events", auth.APIKey(auth.ScopeEvents).OrSourceToken()).POST("/alertmanager", alertmanagerIncoming(db, cfg))
+
+	post := func(authorization string) int {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", "/api/events/alertmanager", strings.NewReader(alertmanagerFiring))
+		req.Header.Set("Authorization", authorization)
+		router.Engine().ServeHTTP(w, req)
+		return w.Code
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, post("Bearer wrong"))
+	assert.Equal(t, http.StatusOK, post("Bearer supersecretkey"))
+
+	// a repeated notification is not stored twice
+	assert.Equal(t, http.StatusOK, post("Bearer supersecretkey"))
+	assert.Len(t, getEvents(db, 10, eventFilter{}), 2)
+}
+
+func TestAdapterSourcePolicy(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	db := newTestDB(t)
+
+	_, token, err := db.AddEventSource(sqlitedb.EventSource{Name: "prometheus", ExpectedCategories: "alert"})
+	require.NoError(t, err)
+
+	cfg := config.AppConfig{XHomeAPIKey: "supersecretkey", UnknownSourcePolicy: config.SourcePolicyReject}
+	router := newTestRouter(cfg, db)
+	router.Group("/api/events", auth.APIKey(auth.ScopeEvents).OrSourceToken()).POST("/alertmanager", alertmanagerIncoming(db, cfg))
+
+	post := func(header, value string) {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", "/api/events/alertmanager", strings.NewReader(alertmanagerFiring))
+		req.Header.Set(header, value)
+		router.Engine().ServeHTTP(w, req)
+		require.Equal(t, http.StatusOK, w.Code)
+	}
+
+	// with the api key the adapter is an unknown source, which is rejected
+	post("Authorization", "Bearer supersecretkey")
+	assert.Empty(t, getEvents(db, 10, eventFilter{}))
+
+	post(auth.SourceTokenHeader, token)
+	events := getEvents(db, 10, eventFilter{})
+	require.Len(t, events, 1)
+	assert.Equal(t, "prometheus", events[0].Source)
+}
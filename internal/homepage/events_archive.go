@@ -0,0 +1,83 @@
+package homepage
+
+import (
+	"compress/gzip"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/rogierlommers/home/internal/sqlitedb"
+)
+
+// events older than this are archived and deleted by the daily cleanup
+const eventRetention = 30 * 24 * time.Hour
+
+// archiveEvents writes all events added before the given moment to a gzip compressed
+// NDJSON file in dir. Restored events are already in an archive, so they are left out.
+// The file is written under a temporary name and renamed when complete, so a partial
+// archive is never mistaken for a complete one.
+func archiveEvents(db *sqlitedb.DB, dir string, before time.Time) (string, int, error) {
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return "", 0, fmt.Errorf("failed to create archive directory: %v", err)
+	}
+
+	name := filepath.Join(dir, fmt.Sprintf("events-%s.ndjson.gz", time.Now().Format("20060102-150405")))
+
+	f, err := os.CreateTemp(dir, ".events-*.ndjson.gz")
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to create archive: %v", err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	gz := gzip.NewWriter(f)
+	count, err := writeEventsNDJSON(db, gz, time.Time{}, before, true)
+	if err != nil {
+		return "", count, fmt.Errorf("failed to write archive: %v", err)
+	}
+
+	if count == 0 {
+		return "", 0, nil
+	}
+
+	if err := gz.Close(); err != nil {
+		return "", count, fmt.Errorf("failed to compress archive: %v", err)
+	}
+
+	if err := f.Sync(); err != nil {
+		return "", count, fmt.Errorf("failed to sync archive: %v", err)
+	}
+
+	if err := f.Close(); err != nil {
+		return "", count, fmt.Errorf("failed to close archive: %v", err)
+	}
+
+	if err := os.Rename(f.Name(), name); err != nil {
+		return "", count, fmt.Errorf("failed to rename archive: %v", err)
+	}
+
+	return name, count, nil
+}
+
+// cleanupOldEvents archives (when an archive directory is configured) and deletes
+// expired events. Nothing is deleted when archiving fails.
+func cleanupOldEvents(db *sqlitedb.DB, archiveDir string, now time.Time) (string, int, error) {
+	before := now.Add(-eventRetention)
+
+	var archive string
+	if archiveDir != "" {
+		var err error
+		archive, _, err = archiveEvents(db, archiveDir, before)
+		if err != nil {
+			return "", 0, err
+		}
+	}
+
+	deleted, err := db.DeleteOldEvents(before)
+	if err != nil {
+		return archive, 0, err
+	}
+
+	return archive, deleted, nil
+}
@@ -0,0 +1,70 @@
+package homepage
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCleanupOldEventsArchives(t *testing.T) {
+	db := newTestDB(t)
+	dir := t.TempDir()
+	now := time.Now()
+
+	for _, msg := range []Message{
+		{Source: "script", Message: "expired", Category: "sensor", Added: now.AddDate(0, 0, -40)},
+		{Source: "script", Message: "recent", Category: "sensor", Added: now.AddDate(0, 0, -1)},
+	} {
+		_, _, err := storeEvent(db.Conn, msg)
+		assert.NoError(t, err)
+	}
+
+	archive, deleted, err := cleanupOldEvents(db, dir, now)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, deleted)
+	assert.Equal(t, dir, filepath.Dir(archive))
+
+	events := getEvents(db, 10, eventFilter{})
+	assert.Len(t, events, 1)
+	assert.Equal(t, "recent", events[0].Message)
+
+	// the gzip compressed archive can be imported again
+	f, err := os.Open(archive)
+	assert.NoError(t, err)
+	defer f.Close()
+
+	imported, _, err := restoreEvents(db, f)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, imported)
+	assert.Len(t, getEvents(db, 10, eventFilter{}), 2)
+
+	// no temporary files are left behind
+	entries, err := os.ReadDir(dir)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 1)
+
+	// the restored event is kept for the retention, counted from the import
+	archive, deleted, err = cleanupOldEvents(db, dir, now.Add(time.Hour))
+	assert.NoError(t, err)
+	assert.Equal(t, 0, deleted)
+	assert.Empty(t, archive)
+	assert.Len(t, getEvents(db, 10, eventFilter{}), 2)
+
+	// then it expires, without being archived a second time
+	archive, deleted, err = cleanupOldEvents(db, dir, now.Add(eventRetention+24*time.Hour))
+	assert.NoError(t, err)
+	assert.Equal(t, 2, deleted)
+	assert.Empty(t, getEvents(db, 10, eventFilter{}))
+
+	f, err = os.Open(archive)
+	assert.NoError(t, err)
+	defer f.Close()
+
+	imported, _, err = restoreEvents(db, f)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, imported)
+	assert.Equal(t, "recent", getEvents(db, 10, eventFilter{})[0].Message)
+}
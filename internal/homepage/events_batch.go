@@ -0,0 +1,193 @@
+package homepage
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rogierlommers/home/internal/auth"
+	"github.com/rogierlommers/home/internal/config"
+	"github.com/rogierlommers/home/internal/sqlitedb"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	maxBatchBytes = 5 << 20 // protect the sqlite file against huge requests
+	maxBatchItems = 5000
+
+	batchStatusInvalid = "invalid"
+)
+
+// curl -X POST "http://localhost:3000/api/events/batch" -H "X-HOME-API-KEY: supersecretkey" -H "Content-Type: application/x-ndjson" --data-binary @events.ndjson
+// curl -X POST "http://localhost:3000/api/events/batch" -H "X-HOME-API-KEY: supersecretkey" -H "Content-Type: application/json" -d '[{"source":"script","message":"hihi","category":"sensor","added":"2025-01-01T12:00:00Z"}]'
+
+// batchItem is a single decoded item of a batch, including a decode error if any
+type batchItem struct {
+	msg Message
+	err error
+}
+
+// BatchResult reports what happened with a single item of a batch
+type BatchResult struct {
+	Index  int    `json:"index"`
+	Status string `json:"status"`
+	ID     int64  `json:"id,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+func eventsIncomingBatch(db *sqlitedb.DB, cfg config.AppConfig) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		source := auth.FromContext(c).Source
+
+		body := http.MaxBytesReader(c.Writer, c.Request.Body, maxBatchBytes)
+		items, err := parseBatch(body)
+		if err != nil {
+			var maxBytesErr *http.MaxBytesError
+			if errors.As(err, &maxBytesErr) {
+				c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": fmt.Sprintf("batch exceeds %d bytes", maxBatchBytes)})
+				return
+			}
+
+			logrus.Errorf("failed to parse batch: %v", err)
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		// the source is derived from the token, rejected items are reported as invalid
+		for i := range items {
+			if items[i].err == nil {
+				items[i].err = applySourcePolicy(db, &items[i].msg, source, cfg.UnknownSourcePolicy)
+			}
+		}
+
+		results, err := storeBatch(db, items)
+		if err != nil {
+			logrus.Errorf("failed to store batch: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store events"})
+			return
+		}
+
+		counts := map[string]int{}
+		for _, r := range results {
+			counts[r.Status]++
+		}
+
+		logrus.Debugf("batch of %d events processed: %v", len(results), counts)
+		c.JSON(http.StatusOK, gin.H{
+			"created":   counts[eventStatusCreated],
+			"duplicate": counts[eventStatusDuplicate],
+			"collapsed": counts[eventStatusCollapsed],
+			"failed":    counts[batchStatusInvalid],
+			"items":     results,
+		})
+	}
+}
+
+// parseBatch accepts either a JSON array of messages or a NDJSON stream,
+// items that cannot be decoded are reported instead of failing the batch
+func parseBatch(r io.Reader) ([]batchItem, error) {
+	br := bufio.NewReader(r)
+
+	first, err := peekNonSpace(br)
+	if err != nil {
+		if err == io.EOF {
+			return nil, fmt.Errorf("empty batch")
+		}
+		return nil, err
+	}
+
+	var raw []json.RawMessage
+	if first == '[' {
+		if err := json.NewDecoder(br).Decode(&raw); err != nil {
+			return nil, fmt.Errorf("invalid JSON array: %w", err)
+		}
+	} else {
+		scanner := bufio.NewScanner(br)
+		scanner.Buffer(make([]byte, 64*1024), maxBatchBytes)
+		for scanner.Scan() {
+			line := bytes.TrimSpace(scanner.Bytes())
+			if len(line) == 0 {
+				continue
+			}
+			raw = append(raw, json.RawMessage(bytes.Clone(line)))
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(raw) == 0 {
+		return nil, fmt.Errorf("empty batch")
+	}
+
+	if len(raw) > maxBatchItems {
+		return nil, fmt.Errorf("batch contains %d items, maximum is %d", len(raw), maxBatchItems)
+	}
+
+	items := make([]batchItem, len(raw))
+	for i, r := range raw {
+		if err := json.Unmarshal(r, &items[i].msg); err != nil {
+			items[i].err = fmt.Errorf("invalid item: %v", err)
+			continue
+		}
+
+		if strings.TrimSpace(items[i].msg.Message) == "" {
+			items[i].err = fmt.Errorf("message is required")
+		}
+	}
+
+	return items, nil
+}
+
+// storeBatch inserts all valid items within a single transaction
+func storeBatch(db *sqlitedb.DB, items []batchItem) ([]BatchResult, error) {
+	tx, err := db.Conn.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	results := make([]BatchResult, len(items))
+	for i, item := range items {
+		results[i].Index = i
+
+		if item.err != nil {
+			results[i].Status = batchStatusInvalid
+			results[i].Error = item.err.Error()
+			continue
+		}
+
+		id, status, err := storeEvent(tx, item.msg)
+		if err != nil {
+			return nil, err
+		}
+
+		results[i].Status = status
+		results[i].ID = id
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return results, nil
+}
+
+func peekNonSpace(br *bufio.Reader) (byte, error) {
+	for {
+		b, err := br.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+
+		if b != ' ' && b != '\t' && b != '\r' && b != '\n' {
+			return b, br.UnreadByte()
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package homepage
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseBatch(t *testing.T) {
+	tests := []struct {
+		name          string
+		body          string
+		expectedItems int
+		invalidItems  int
+		expectedError bool
+	}{
+		{
+			name:          "json array",
+			body:          `[{"source":"a","message":"one"},{"source":"b","message":"two"}]`,
+			expectedItems: 2,
+		},
+		{
+			name:          "ndjson stream",
+			body:          "{\"source\":\"a\",\"message\":\"one\"}\n\n{\"source\":\"b\",\"message\":\"two\"}\n",
+			expectedItems: 2,
+		},
+		{
+			name:          "ndjson with broken line",
+			body:          "{\"source\":\"a\",\"message\":\"one\"}\n{broken\n{\"source\":\"b\"}\n",
+			expectedItems: 3,
+			invalidItems:  2,
+		},
+		{
+			name:          "invalid array",
+			body:          `[{"source":"a"`,
+			expectedError: true,
+		},
+		{
+			name:          "empty body",
+			body:          "  \n",
+			expectedError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			items, err := parseBatch(strings.NewReader(tt.body))
+
+			if tt.expectedError {
+				assert.Error(t, err)
+				return
+			}
+
+			assert.NoError(t, err)
+			assert.Len(t, items, tt.expectedItems)
+
+			invalid := 0
+			for _, item := range items {
+				if item.err != nil {
+					invalid++
+				}
+			}
+			assert.Equal(t, tt.invalidItems, invalid)
+		})
+	}
+}
+
+func TestStoreBatch(t *testing.T) {
+	db := newTestDB(t)
+
+	added := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	items, err := parseBatch(strings.NewReader(`[
+		{"source":"script","message":"backlog","category":"sensor","added":"2025-01-01T13:00:00+01:00"},
+		{"source":"script","category":"sensor"}
+	]`))
+	assert.NoError(t, err)
+
+	results, err := storeBatch(db, items)
+	assert.NoError(t, err)
+	assert.Equal(t, eventStatusCreated, results[0].Status)
+	assert.Equal(t, batchStatusInvalid, results[1].Status)
+
+	events := getEvents(db, 10, eventFilter{})
+	assert.Len(t, events, 1)
+	assert.True(t, added.Equal(events[0].Added), "expected %s, got %s", added, events[0].Added)
+}
@@ -0,0 +1,337 @@
+package homepage
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rogierlommers/home/internal/sqlitedb"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// exported rows are flushed to the client in chunks of this size
+	exportFlushEvery = 500
+
+	// imports are limited like batches, archives of a day are far smaller
+	maxImportBytes     = 5 << 20
+	maxImportLineBytes = 1 << 20
+)
+
+// curl "http://localhost:3000/api/events/export?format=csv&from=2025-01-01&to=2025-02-01" -H "X-HOME-API-KEY: supersecretkey"
+// curl "http://localhost:3000/api/events/export?format=ndjson" -H "X-HOME-API-KEY: supersecretkey" > events.ndjson
+// curl -X POST "http://localhost:3000/api/events/import" -H "X-HOME-API-KEY: supersecretkey" --data-binary @events-20250101-160000.ndjson.gz
+
+// csvHeader lists the columns of a csv export
+var csvHeader = []string{"id", "added", "source", "category", "severity", "message", "attributes",
+	"repeat_count", "last_seen", "acknowledged_at", "acknowledged_by", "quarantined"}
+
+func exportEvents(db *sqlitedb.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		format := c.DefaultQuery("format", "ndjson")
+		if format != "csv" && format != "ndjson" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "format must be csv or ndjson"})
+			return
+		}
+
+		from, err := parseExportTime(c.Query("from"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid from: %v", err)})
+			return
+		}
+
+		to, err := parseExportTime(c.Query("to"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid to: %v", err)})
+			return
+		}
+
+		contentType := "application/x-ndjson"
+		if format == "csv" {
+			contentType = "text/csv"
+		}
+
+		c.Header("Content-Type", contentType)
+		c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="events.%s"`, format))
+		c.Status(http.StatusOK)
+
+		var count int
+		if format == "csv" {
+			count, err = writeEventsCSV(db, c.Writer, from, to)
+		} else {
+			count, err = writeEventsNDJSON(db, c.Writer, from, to, false)
+		}
+
+		// headers are already sent, so the only option left is to log the error
+		if err != nil {
+			logrus.Errorf("failed to export events after %d rows: %v", count, err)
+			return
+		}
+
+		logrus.Debugf("exported %d events as %s", count, format)
+	}
+}
+
+// parseExportTime accepts RFC3339 timestamps and plain dates, an empty value means no bound
+func parseExportTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+
+	return time.Parse("2006-01-02", value)
+}
+
+// streamEvents calls fn for every event added within [from, to), ordered by id. A zero
+// time means no bound. With expiring set, restored events are left out, they are in an
+// archive already. Rows are read one by one, so memory usage does not grow with the result.
+func streamEvents(db *sqlitedb.DB, from, to time.Time, expiring bool, fn func(Message) error) (int, error) {
+	query := `SELECT ` + eventColumns + ` FROM events WHERE 1=1`
+	args := []any{}
+
+	if expiring {
+		query += ` AND restored_at IS NULL`
+	}
+
+	if !from.IsZero() {
+		query += ` AND added >= ?`
+		args = append(args, from.UTC().Format(sqlitedb.TimestampLayout))
+	}
+
+	if !to.IsZero() {
+		query += ` AND added < ?`
+		args = append(args, to.UTC().Format(sqlitedb.TimestampLayout))
+	}
+
+	query += ` ORDER BY id`
+
+	rows, err := db.Conn.Query(query, args...)
+	if err != nil {
+		return 0, fmt.Errorf("failed to query events: %v", err)
+	}
+	defer rows.Close()
+
+	count := 0
+	for rows.Next() {
+		msg, err := scanEvent(rows)
+		if err != nil {
+			return count, fmt.Errorf("failed to scan event row: %v", err)
+		}
+
+		if err := fn(msg); err != nil {
+			return count, err
+		}
+		count++
+	}
+
+	return count, rows.Err()
+}
+
+func writeEventsNDJSON(db *sqlitedb.DB, w io.Writer, from, to time.Time, expiring bool) (int, error) {
+	bw := bufio.NewWriter(w)
+	encoder := json.NewEncoder(bw)
+
+	count, err := streamEvents(db, from, to, expiring, func(msg Message) error {
+		return encoder.Encode(msg)
+	})
+	if err != nil {
+		return count, err
+	}
+
+	return count, bw.Flush()
+}
+
+func writeEventsCSV(db *sqlitedb.DB, w io.Writer, from, to time.Time) (int, error) {
+	writer := csv.NewWriter(w)
+	if err := writer.Write(csvHeader); err != nil {
+		return 0, err
+	}
+
+	written := 0
+	count, err := streamEvents(db, from, to, false, func(msg Message) error {
+		attributes, err := encodeAttributes(msg.Attributes)
+		if err != nil {
+			return err
+		}
+
+		record := []string{
+			strconv.Itoa(msg.ID),
+			msg.Added.UTC().Format(time.RFC3339),
+			msg.Source,
+			msg.Category,
+			msg.Severity,
+			msg.Message,
+			attributes.String,
+			strconv.Itoa(msg.RepeatCount),
+			formatOptionalTime(msg.LastSeen),
+			formatOptionalTime(msg.AcknowledgedAt),
+			msg.AcknowledgedBy,
+			strconv.FormatBool(msg.Quarantined),
+		}
+		if err := writer.Write(record); err != nil {
+			return err
+		}
+
+		// flush regularly, so large exports are streamed instead of buffered
+		written++
+		if written%exportFlushEvery == 0 {
+			writer.Flush()
+			return writer.Error()
+		}
+		return nil
+	})
+	if err != nil {
+		return count, err
+	}
+
+	writer.Flush()
+	return count, writer.Error()
+}
+
+func formatOptionalTime(t *time.Time) string {
+	if t == nil {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+func importEvents(db *sqlitedb.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		body := http.MaxBytesReader(c.Writer, c.Request.Body, maxImportBytes)
+		imported, skipped, err := restoreEvents(db, body)
+
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": fmt.Sprintf("import exceeds %d bytes", maxImportBytes)})
+			return
+		}
+		if err != nil {
+			logrus.Errorf("failed to import events: %v", err)
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("failed to import events: %v", err)})
+			return
+		}
+
+		logrus.Infof("imported %d events, skipped %d", imported, skipped)
+		c.JSON(http.StatusOK, gin.H{"imported": imported, "skipped": skipped})
+	}
+}
+
+// restoreEvents imports an NDJSON export or a gzip compressed archive in a single
+// transaction. Events keep their original id, events that still exist are skipped.
+// Restored events are history, so they do not trigger webhooks or auto-ack rules. The
+// cleanup deletes them when the retention has passed since the import, without
+// archiving them again.
+func restoreEvents(db *sqlitedb.DB, r io.Reader) (imported int, skipped int, err error) {
+	br := bufio.NewReader(r)
+
+	// archives are gzip compressed, recognise them by their magic bytes
+	if magic, _ := br.Peek(2); bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return 0, 0, err
+		}
+		defer gz.Close()
+		br = bufio.NewReader(gz)
+	}
+
+	tx, err := db.Conn.Begin()
+	if err != nil {
+		return 0, 0, err
+	}
+	defer tx.Rollback()
+
+	scanner := bufio.NewScanner(br)
+	scanner.Buffer(make([]byte, 64*1024), maxImportLineBytes)
+
+	line := 0
+	for scanner.Scan() {
+		line++
+
+		raw := bytes.TrimSpace(scanner.Bytes())
+		if len(raw) == 0 {
+			continue
+		}
+
+		// a line cut off by a failing read is not a syntax error of the import
+		var msg Message
+		if err := json.Unmarshal(raw, &msg); err != nil {
+			if scanner.Err() != nil {
+				return 0, 0, scanner.Err()
+			}
+			return 0, 0, fmt.Errorf("line %d: %v", line, err)
+		}
+
+		inserted, err := insertRestoredEvent(tx, msg)
+		if err != nil {
+			return 0, 0, fmt.Errorf("line %d: %v", line, err)
+		}
+
+		if inserted {
+			imported++
+		} else {
+			skipped++
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return 0, 0, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, 0, err
+	}
+
+	return imported, skipped, nil
+}
+
+func insertRestoredEvent(tx *sql.Tx, msg Message) (bool, error) {
+	attributes, err := encodeAttributes(msg.Attributes)
+	if err != nil {
+		return false, err
+	}
+
+	if msg.Added.IsZero() {
+		return false, fmt.Errorf("event without added timestamp")
+	}
+
+	if msg.RepeatCount < 1 {
+		msg.RepeatCount = 1
+	}
+
+	result, err := tx.Exec(`INSERT OR IGNORE INTO events
+		(id, source, message, category, severity, attributes, added, repeat_count, last_seen, acknowledged_at, acknowledged_by, quarantined, restored_at)
+		VALUES (NULLIF(?, 0), ?, ?, ?, NULLIF(?, ''), ?, ?, ?, ?, ?, NULLIF(?, ''), ?, CURRENT_TIMESTAMP)`,
+		msg.ID, msg.Source, msg.Message, msg.Category, msg.Severity, attributes,
+		msg.Added.UTC().Format(sqlitedb.TimestampLayout), msg.RepeatCount,
+		optionalTimestamp(msg.LastSeen), optionalTimestamp(msg.AcknowledgedAt), msg.AcknowledgedBy, msg.Quarantined)
+	if err != nil {
+		return false, err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return affected > 0, nil
+}
+
+func optionalTimestamp(t *time.Time) any {
+	if t == nil {
+		return nil
+	}
+	return t.UTC().Format(sqlitedb.TimestampLayout)
+}
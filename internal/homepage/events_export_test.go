@@ -0,0 +1,76 @@
+package homepage
+
+import (
+	"bytes"
+	"encoding/csv"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExportImportRoundtrip(t *testing.T) {
+	db := newTestDB(t)
+
+	added := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	for _, msg := range []Message{
+		{Source: "script", Message: "one", Category: "sensor", Added: added, Attributes: map[string]any{"temperature": 21.5}},
+		{Source: "script", Message: "two", Category: "alarm", Severity: severityCritical, Added: added.Add(time.Hour)},
+		{Source: "script", Message: "three", Category: "sensor", Added: added.AddDate(0, 1, 0)},
+	} {
+		_, _, err := storeEvent(db.Conn, msg)
+		assert.NoError(t, err)
+	}
+
+	var ndjson bytes.Buffer
+	count, err := writeEventsNDJSON(db, &ndjson, added, added.AddDate(0, 0, 1), false)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, count)
+
+	var records bytes.Buffer
+	_, err = writeEventsCSV(db, &records, time.Time{}, time.Time{})
+	assert.NoError(t, err)
+	rows, err := csv.NewReader(&records).ReadAll()
+	assert.NoError(t, err)
+	assert.Len(t, rows, 4)
+	assert.Equal(t, csvHeader, rows[0])
+	assert.Equal(t, `{"temperature":21.5}`, rows[1][6])
+
+	restored := newTestDB(t)
+	imported, skipped, err := restoreEvents(restored, bytes.NewReader(ndjson.Bytes()))
+	assert.NoError(t, err)
+	assert.Equal(t, 2, imported)
+	assert.Equal(t, 0, skipped)
+
+	// importing the same export twice does not create duplicates
+	imported, skipped, err = restoreEvents(restored, bytes.NewReader(ndjson.Bytes()))
+	assert.NoError(t, err)
+	assert.Equal(t, 0, imported)
+	assert.Equal(t, 2, skipped)
+
+	events := getEvents(restored, 10, eventFilter{})
+	assert.Len(t, events, 2)
+	assert.Equal(t, "two", events[0].Message)
+	assert.Equal(t, severityCritical, events[0].Severity)
+	assert.True(t, added.Equal(events[1].Added))
+	assert.Equal(t, 21.5, events[1].Attributes["temperature"])
+}
+
+func TestImportEventsLimit(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	db := newTestDB(t)
+
+	router := gin.New()
+	router.POST("/api/events/import", importEvents(db))
+
+	line := `{"source":"script","added":"2025-01-01T12:00:00Z","message":"` + strings.Repeat("x", 1000) + `"}` + "\n"
+	body := strings.Repeat(line, maxImportBytes/len(line)+1)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/api/events/import", strings.NewReader(body)))
+	assert.Equal(t, 413, w.Code)
+	assert.Empty(t, getEvents(db, 10, eventFilter{}))
+}
@@ -0,0 +1,255 @@
+package homepage
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rogierlommers/home/internal/auth"
+	"github.com/rogierlommers/home/internal/config"
+	"github.com/rogierlommers/home/internal/sqlitedb"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestDB(t *testing.T) *sqlitedb.DB {
+	db := sqlitedb.InitDatabase(config.AppConfig{Database: filepath.Join(t.TempDir(), "test.db")})
+	t.Cleanup(db.Close)
+	return db
+}
+
+// newTestRouter returns a router that enforces route policies the way the app does
+func newTestRouter(cfg config.AppConfig, db *sqlitedb.DB) *auth.Router {
+	engine := gin.New()
+	engine.UseRawPath = true
+	return auth.NewRouter(engine, auth.New(cfg, db))
+}
+
+func TestStoreEventDedup(t *testing.T) {
+	db := newTestDB(t)
+	msg := Message{Source: "home-assistant", Message: "door open", Category: "alarm", DedupKey: "retry-1"}
+
+	first, status, err := storeEvent(db.Conn, msg)
+	assert.NoError(t, err)
+	assert.Equal(t, eventStatusCreated, status)
+
+	second, status, err := storeEvent(db.Conn, msg)
+	assert.NoError(t, err)
+	assert.Equal(t, eventStatusDuplicate, status)
+	assert.Equal(t, first, second)
+
+	msg.DedupKey = "retry-2"
+	_, status, err = storeEvent(db.Conn, msg)
+	assert.NoError(t, err)
+	assert.Equal(t, eventStatusCreated, status)
+
+	assert.Len(t, getEvents(db, 10, eventFilter{}), 2)
+}
+
+func TestStoreEventDedupBackfill(t *testing.T) {
+	db := newTestDB(t)
+
+	// an event that happened long ago is still a duplicate when it is sent again
+	msg := Message{Source: "sensor", Message: "reading", DedupKey: "backfill-1", Added: time.Now().Add(-48 * time.Hour)}
+
+	first, status, err := storeEvent(db.Conn, msg)
+	assert.NoError(t, err)
+	assert.Equal(t, eventStatusCreated, status)
+
+	second, status, err := storeEvent(db.Conn, msg)
+	assert.NoError(t, err)
+	assert.Equal(t, eventStatusDuplicate, status)
+	assert.Equal(t, first, second)
+}
+
+func TestStoreEventDedupConcurrent(t *testing.T) {
+	db := newTestDB(t)
+	msg := Message{Source: "home-assistant", Message: "door open", DedupKey: "retry-1"}
+
+	var (
+		wg      sync.WaitGroup
+		ids     = make([]int64, 10)
+		created atomic.Int32
+	)
+	for i := range ids {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			id, status, err := storeEvent(db.Conn, msg)
+			assert.NoError(t, err)
+			if status == eventStatusCreated {
+				created.Add(1)
+			}
+			ids[i] = id
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, int32(1), created.Load())
+	for _, id := range ids {
+		assert.Equal(t, ids[0], id)
+	}
+	assert.Len(t, getEvents(db, 10, eventFilter{}), 1)
+}
+
+func TestStoreEventCollapse(t *testing.T) {
+	db := newTestDB(t)
+	msg := Message{Source: "home-assistant", Message: "door open", Category: "alarm", Collapse: true}
+
+	for i := 0; i < 3; i++ {
+		_, _, err := storeEvent(db.Conn, msg)
+		assert.NoError(t, err)
+	}
+
+	// a different message is not collapsed
+	msg.Message = "door closed"
+	_, status, err := storeEvent(db.Conn, msg)
+	assert.NoError(t, err)
+	assert.Equal(t, eventStatusCreated, status)
+
+	events := getEvents(db, 10, eventFilter{})
+	assert.Len(t, events, 2)
+	assert.Equal(t, 1, events[0].RepeatCount)
+	assert.Equal(t, 3, events[1].RepeatCount)
+	assert.NotNil(t, events[1].LastSeen)
+}
+
+func TestAutoAcknowledge(t *testing.T) {
+	db := newTestDB(t)
+
+	_, err := db.AddAutoAckRule(sqlitedb.AutoAckRule{Category: "cleanup"})
+	assert.NoError(t, err)
+
+	assert.NoError(t, AddEvent(db, Message{Source: "system", Message: "removed old file", Category: "cleanup"}))
+	assert.NoError(t, AddEvent(db, Message{Source: "home-assistant", Message: "door open", Category: "alarm"}))
+
+	unread := getEvents(db, 10, eventFilter{Unread: true})
+	assert.Len(t, unread, 1)
+	assert.Equal(t, "alarm", unread[0].Category)
+
+	count, err := db.CountUnreadEvents()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count.Unread)
+
+	acknowledged, err := db.AcknowledgeEvents(sqlitedb.AckFilter{Category: "alarm"}, "tester")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, acknowledged)
+
+	events := getEvents(db, 10, eventFilter{})
+	assert.Equal(t, "tester", events[0].AcknowledgedBy)
+	assert.Equal(t, sqlitedb.AutoAckBy, events[1].AcknowledgedBy)
+}
+
+func TestAggregateEvents(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	db := newTestDB(t)
+
+	router := gin.New()
+	router.GET("/api/events/aggregate", aggregateEvents(db))
+
+	base := time.Now().UTC().Truncate(time.Hour).Add(-2 * time.Hour)
+	for _, msg := range []Message{
+		{Source: "script", Message: "a", Category: "sensor", Added: base.Add(5 * time.Minute), Attributes: map[string]any{"temperature": 20}},
+		{Source: "script", Message: "b", Category: "sensor", Added: base.Add(10 * time.Minute), Attributes: map[string]any{"temperature": 22.5}},
+		{Source: "other", Message: "c", Category: "sensor", Added: base.Add(15 * time.Minute)},
+		{Source: "script", Message: "d", Category: "sensor", Added: base.Add(65 * time.Minute), Attributes: map[string]any{"temperature": "warm"}},
+		{Source: "script", Message: "e", Category: "alarm", Added: base.Add(70 * time.Minute)},
+		{Source: "script", Message: "expired", Category: "sensor", Added: base.AddDate(0, 0, -3)},
+	} {
+		_, _, err := storeEvent(db.Conn, msg)
+		assert.NoError(t, err)
+	}
+
+	aggregate := func(query string) (int, []sqlitedb.EventAggregate) {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", "/api/events/aggregate?"+query, nil))
+
+		var aggregates []sqlitedb.EventAggregate
+		if w.Code == 200 {
+			assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &aggregates))
+		}
+		return w.Code, aggregates
+	}
+
+	first := base.Format(time.RFC3339)
+	second := base.Add(time.Hour).Format(time.RFC3339)
+
+	// events are bucketed per hour, then grouped per category and source
+	code, aggregates := aggregate("interval=hour&attribute=temperature")
+	assert.Equal(t, 200, code)
+	if assert.Len(t, aggregates, 4) {
+		assert.Equal(t, sqlitedb.EventAggregate{Bucket: first, Category: "sensor", Source: "other", Count: 1}, aggregates[0])
+
+		assert.Equal(t, first, aggregates[1].Bucket)
+		assert.Equal(t, "script", aggregates[1].Source)
+		assert.Equal(t, 2, aggregates[1].Count)
+		assert.Equal(t, 20.0, *aggregates[1].Min)
+		assert.Equal(t, 22.5, *aggregates[1].Max)
+		assert.Equal(t, 21.25, *aggregates[1].Avg)
+
+		assert.Equal(t, sqlitedb.EventAggregate{Bucket: second, Category: "alarm", Source: "script", Count: 1}, aggregates[2])
+
+		// values that are not numeric are counted, but not averaged
+		assert.Equal(t, sqlitedb.EventAggregate{Bucket: second, Category: "sensor", Source: "script", Count: 1}, aggregates[3])
+	}
+
+	code, aggregates = aggregate("interval=hour&category=sensor&source=script")
+	assert.Equal(t, 200, code)
+	if assert.Len(t, aggregates, 2) {
+		assert.Equal(t, 2, aggregates[0].Count)
+		assert.Nil(t, aggregates[0].Avg)
+	}
+
+	// an empty range is an empty list, not null
+	code, aggregates = aggregate("interval=minute&since=10m")
+	assert.Equal(t, 200, code)
+	assert.NotNil(t, aggregates)
+	assert.Empty(t, aggregates)
+
+	code, _ = aggregate("interval=week")
+	assert.Equal(t, 400, code)
+
+	code, _ = aggregate("attribute=a'b")
+	assert.Equal(t, 400, code)
+}
+
+func TestAcknowledgeEventsFilter(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	db := newTestDB(t)
+
+	router := gin.New()
+	router.POST("/api/events/ack", acknowledgeEvents(db, config.AppConfig{}))
+
+	for _, category := range []string{"sensor", "alarm", "alarm"} {
+		assert.NoError(t, AddEvent(db, Message{Source: "script", Message: "event", Category: category}))
+	}
+
+	ack := func(body string) int {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("POST", "/api/events/ack", strings.NewReader(body)))
+		return w.Code
+	}
+
+	unread := func() int {
+		count, err := db.CountUnreadEvents()
+		assert.NoError(t, err)
+		return count.Unread
+	}
+
+	// requests without a filter leave the unread events alone
+	for _, body := range []string{"", "{}", `{"ids": []}`, `{"all": false}`} {
+		assert.Equal(t, 400, ack(body), body)
+	}
+	assert.Equal(t, 3, unread())
+
+	assert.Equal(t, 200, ack(`{"category": "sensor"}`))
+	assert.Equal(t, 2, unread())
+
+	assert.Equal(t, 200, ack(`{"all": true}`))
+	assert.Equal(t, 0, unread())
+}
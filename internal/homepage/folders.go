@@ -0,0 +1,127 @@
+package homepage
+
+import (
+	"errors"
+	"net/http"
+	"path"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rogierlommers/home/internal/storage"
+	"github.com/sirupsen/logrus"
+)
+
+// Folders in the file storage. Folders are kept in the index like files, files in
+// a folder are named by their path, such as "invoices/2024/march.pdf".
+//
+// curl -X POST "http://localhost:3000/api/folders" -H "X-HOME-API-KEY: supersecretkey" -d '{"path": "invoices/2024"}'
+// curl -X PATCH "http://localhost:3000/api/folders" -H "X-HOME-API-KEY: supersecretkey" -d '{"path": "invoices", "new_path": "archive/invoices"}'
+// curl -X DELETE "http://localhost:3000/api/folders?path=archive&recursive=true" -H "X-HOME-API-KEY: supersecretkey"
+// curl -X POST "http://localhost:3000/api/files/report.pdf/move" -H "X-HOME-API-KEY: supersecretkey" -d '{"folder": "invoices/2024"}'
+
+type folderRequest struct {
+	Path    string `json:"path"`
+	NewPath string `json:"new_path"`
+}
+
+type moveRequest struct {
+	Folder string `json:"folder"`
+}
+
+// breadcrumbs returns the folders from the upload target down to the folder
+func breadcrumbs(folder string) []storage.Folder {
+	crumbs := []storage.Folder{{Name: "Files", Path: ""}}
+	if folder == "" {
+		return crumbs
+	}
+
+	var parents []storage.Folder
+	for p := folder; p != "."; p = path.Dir(p) {
+		parents = append([]storage.Folder{{Name: path.Base(p), Path: p}}, parents...)
+	}
+
+	return append(crumbs, parents...)
+}
+
+func createFolder(store *storage.Store) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var request folderRequest
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.String(400, "Invalid folder: %v", err)
+			return
+		}
+
+		folder, err := store.CreateFolder(request.Path)
+		if err != nil {
+			folderFailed(c, err)
+			return
+		}
+
+		c.JSON(201, gin.H{"status": "ok", "path": folder})
+	}
+}
+
+// renameFolder renames or moves a folder, the files in it keep their share links
+func renameFolder(store *storage.Store) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var request folderRequest
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.String(400, "Invalid folder: %v", err)
+			return
+		}
+
+		folder, err := store.RenameFolder(request.Path, request.NewPath)
+		if err != nil {
+			folderFailed(c, err)
+			return
+		}
+
+		c.JSON(200, gin.H{"status": "ok", "path": folder})
+	}
+}
+
+// deleteFolder deletes an empty folder, or a folder with everything in it when recursive is set
+func deleteFolder(store *storage.Store) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		folder := c.Query("path")
+		if err := store.DeleteFolder(folder, c.Query("recursive") == "true"); err != nil {
+			folderFailed(c, err)
+			return
+		}
+
+		c.JSON(200, gin.H{"status": "ok", "path": folder})
+	}
+}
+
+// moveFile moves a file into another folder, the empty folder is the upload target
+func moveFile(store *storage.Store) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var request moveRequest
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.String(400, "Invalid move: %v", err)
+			return
+		}
+
+		file, err := store.MoveFile(c.Param("filename"), request.Folder)
+		if err != nil {
+			folderFailed(c, err)
+			return
+		}
+
+		c.JSON(200, newFileResponse(file))
+	}
+}
+
+// folderFailed answers with the status that matches the error of a folder operation
+func folderFailed(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, storage.ErrNotFound):
+		c.String(http.StatusNotFound, err.Error())
+	case errors.Is(err, storage.ErrExists), errors.Is(err, storage.ErrFolderNotEmpty):
+		c.String(http.StatusConflict, err.Error())
+	case errors.Is(err, storage.ErrInvalidName), errors.Is(err, storage.ErrTraversal):
+		c.String(http.StatusBadRequest, err.Error())
+	default:
+		logrus.Errorf("folder operation failed: %v", err)
+		c.String(500, "Failed to update folders")
+	}
+}
@@ -0,0 +1,93 @@
+package homepage
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rogierlommers/home/internal/config"
+	"github.com/rogierlommers/home/internal/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFolders(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	db := newTestDB(t)
+	files := storage.New(config.AppConfig{UploadTarget: t.TempDir(), FileCleanUpInDys: 7}, db)
+
+	_, err := files.Save("report.pdf", strings.NewReader("report"), storage.Upload{})
+	require.NoError(t, err)
+
+	router := gin.New()
+	router.UseRawPath = true
+	router.GET("/api/filelist", fileList(files))
+	router.POST("/api/folders", createFolder(files))
+	router.PATCH("/api/folders", renameFolder(files))
+	router.DELETE("/api/folders", deleteFolder(files))
+	router.POST("/api/files/:filename/move", moveFile(files))
+
+	request := func(method, url, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(method, url, strings.NewReader(body)))
+		return w
+	}
+
+	w := request("POST", "/api/folders", `{"path": "invoices/2024"}`)
+	require.Equal(t, 201, w.Code)
+	assert.Equal(t, 400, request("POST", "/api/folders", `{"path": "../outside"}`).Code)
+	assert.Equal(t, 400, request("POST", "/api/folders", `{"path": ".hidden"}`).Code)
+
+	w = request("POST", "/api/files/report.pdf/move", `{"folder": "invoices/2024"}`)
+	require.Equal(t, 200, w.Code)
+
+	var moved fileResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &moved))
+	assert.Equal(t, "invoices/2024/report.pdf", moved.Name)
+	assert.Equal(t, 404, request("POST", "/api/files/report.pdf/move", `{"folder": "invoices"}`).Code)
+
+	var list struct {
+		Folder      string           `json:"folder"`
+		Breadcrumbs []storage.Folder `json:"breadcrumbs"`
+		Folders     []storage.Folder `json:"folders"`
+		Files       []fileResponse   `json:"files"`
+	}
+
+	w = request("GET", "/api/filelist?folder=invoices/2024", "")
+	require.Equal(t, 200, w.Code)
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &list))
+	assert.Equal(t, "invoices/2024", list.Folder)
+	assert.Equal(t, []storage.Folder{{Name: "Files"}, {Name: "invoices", Path: "invoices"}, {Name: "2024", Path: "invoices/2024"}}, list.Breadcrumbs)
+	assert.Empty(t, list.Folders)
+	require.Len(t, list.Files, 1)
+	assert.Equal(t, "invoices/2024/report.pdf", list.Files[0].Name)
+
+	// a search looks in all folders
+	w = request("GET", "/api/filelist?q=report", "")
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &list))
+	require.Len(t, list.Files, 1)
+
+	assert.Equal(t, 404, request("GET", "/api/filelist?folder=missing", "").Code)
+	assert.Equal(t, 400, request("GET", "/api/filelist?folder=../etc", "").Code)
+
+	// files in folders are addressed with an encoded slash
+	w = request("POST", "/api/files/invoices%2F2024%2Freport.pdf/move", `{"folder": ""}`)
+	require.Equal(t, 200, w.Code)
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &moved))
+	assert.Equal(t, "report.pdf", moved.Name)
+
+	w = request("PATCH", "/api/folders", `{"path": "invoices", "new_path": "archive/invoices"}`)
+	require.Equal(t, 200, w.Code)
+	assert.Equal(t, 404, request("PATCH", "/api/folders", `{"path": "invoices", "new_path": "other"}`).Code)
+
+	assert.Equal(t, 409, request("DELETE", "/api/folders?path=archive", "").Code)
+	assert.Equal(t, 200, request("DELETE", "/api/folders?path=archive&recursive=true", "").Code)
+	assert.Equal(t, 404, request("DELETE", "/api/folders?path=archive", "").Code)
+}
+
+func TestBreadcrumbs(t *testing.T) {
+	assert.Equal(t, []storage.Folder{{Name: "Files"}}, breadcrumbs(""))
+	assert.Equal(t, []storage.Folder{{Name: "Files"}, {Name: "a", Path: "a"}, {Name: "b", Path: "a/b"}}, breadcrumbs("a/b"))
+}
@@ -0,0 +1,195 @@
+package homepage
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rogierlommers/home/internal/mailer"
+	"github.com/rogierlommers/home/internal/sqlitedb"
+	"github.com/sirupsen/logrus"
+)
+
+const heartbeatCheckInterval = time.Minute
+
+// curl -X POST "http://localhost:3000/api/heartbeats" -H "X-HOME-API-KEY: supersecretkey" -d '{"name": "home-assistant", "interval_minutes": 15}'
+// curl -X POST "http://localhost:3000/api/heartbeat/home-assistant" -H "X-HOME-API-KEY: supersecretkey"
+
+// heartbeatChecker detects monitors that went silent or came back, notifications
+// are stored as events and mailed
+type heartbeatChecker struct {
+	db     *sqlitedb.DB
+	notify func(subject, body string) error
+}
+
+func newHeartbeatChecker(db *sqlitedb.DB, m *mailer.Mailer) *heartbeatChecker {
+	return &heartbeatChecker{
+		db: db,
+		notify: func(subject, body string) error {
+			return m.SendMail(subject, mailer.PrivateMail, body, nil)
+		},
+	}
+}
+
+// start checks the heartbeats in the background, until ctx is done
+func (h *heartbeatChecker) start(ctx context.Context, wg *sync.WaitGroup) {
+	wg.Go(func() {
+		logrus.Infof("checking heartbeats every %s", heartbeatCheckInterval)
+
+		ticker := time.NewTicker(heartbeatCheckInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-ticker.C:
+				h.check(now)
+			}
+		}
+	})
+}
+
+// check compares all monitors with their deadline and handles status changes
+func (h *heartbeatChecker) check(now time.Time) {
+	monitors, err := h.db.GetHeartbeatMonitors()
+	if err != nil {
+		logrus.Errorf("failed to get heartbeat monitors: %v", err)
+		return
+	}
+
+	for _, m := range monitors {
+		silent := now.After(m.Deadline())
+
+		switch {
+		case silent && m.Status != sqlitedb.HeartbeatDown:
+			lastSeen := "never"
+			if m.LastSeen != nil {
+				lastSeen = m.LastSeen.Local().Format(time.DateTime)
+			}
+
+			h.changeStatus(m, sqlitedb.HeartbeatDown, Message{
+				Source:   "heartbeat",
+				Category: "critical",
+				Severity: severityCritical,
+				Message:  fmt.Sprintf("%s has been silent for more than %d minutes, last seen: %s", m.Name, m.IntervalMinutes, lastSeen),
+			})
+
+		case !silent && m.Status == sqlitedb.HeartbeatDown:
+			h.changeStatus(m, sqlitedb.HeartbeatUp, Message{
+				Source:   "heartbeat",
+				Category: "recovery",
+				Severity: severityInfo,
+				Message:  fmt.Sprintf("%s is back after %s", m.Name, now.Sub(m.StatusSince).Round(time.Minute)),
+			})
+
+		case !silent && m.Status == sqlitedb.HeartbeatUnknown:
+			if err := h.db.SetHeartbeatStatus(m.Name, sqlitedb.HeartbeatUp); err != nil {
+				logrus.Errorf("failed to update heartbeat status of %s: %v", m.Name, err)
+			}
+		}
+	}
+}
+
+func (h *heartbeatChecker) changeStatus(m sqlitedb.HeartbeatMonitor, status string, event Message) {
+	if err := h.db.SetHeartbeatStatus(m.Name, status); err != nil {
+		logrus.Errorf("failed to update heartbeat status of %s: %v", m.Name, err)
+		return
+	}
+
+	logrus.Infof("heartbeat %s is %s", m.Name, status)
+	if err := AddEvent(h.db, event); err != nil {
+		logrus.Errorf("failed to log heartbeat event: %v", err)
+	}
+
+	subject := fmt.Sprintf("heartbeat %s is %s", m.Name, status)
+	if err := h.notify(subject, event.Message); err != nil {
+		logrus.Errorf("failed to send heartbeat notification: %v", err)
+	}
+}
+
+func displayHeartbeatsPage(c *gin.Context) {
+	htmlBytes, err := staticFS.ReadFile("static_html/heartbeats.html")
+	if err != nil {
+		logrus.Errorf("Error reading static html: %v", err)
+		c.String(500, "Failed to load heartbeats page")
+		return
+	}
+
+	c.Header("Content-Type", "text/html")
+	c.String(200, string(htmlBytes))
+}
+
+func displayHeartbeats(db *sqlitedb.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		monitors, err := db.GetHeartbeatMonitors()
+		if err != nil {
+			logrus.Errorf("Failed to get heartbeat monitors: %v", err)
+			c.String(500, "Failed to retrieve heartbeat monitors")
+			return
+		}
+
+		type monitorStatus struct {
+			sqlitedb.HeartbeatMonitor
+			Deadline time.Time `json:"deadline"`
+		}
+
+		statuses := make([]monitorStatus, 0, len(monitors))
+		for _, m := range monitors {
+			statuses = append(statuses, monitorStatus{HeartbeatMonitor: m, Deadline: m.Deadline()})
+		}
+
+		c.IndentedJSON(200, statuses)
+	}
+}
+
+func addHeartbeat(db *sqlitedb.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var m sqlitedb.HeartbeatMonitor
+		if err := c.BindJSON(&m); err != nil {
+			c.String(400, "Invalid request payload")
+			return
+		}
+
+		if err := db.AddHeartbeatMonitor(m.Name, m.IntervalMinutes); err != nil {
+			logrus.Errorf("Failed to add heartbeat monitor: %v", err)
+			c.String(400, "Failed to add heartbeat monitor: %v", err)
+			return
+		}
+
+		c.JSON(201, gin.H{"name": m.Name, "interval_minutes": m.IntervalMinutes})
+	}
+}
+
+func deleteHeartbeat(db *sqlitedb.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if err := db.DeleteHeartbeatMonitor(c.Param("name")); err != nil {
+			logrus.Errorf("Failed to delete heartbeat monitor: %v", err)
+			c.String(500, "Failed to delete heartbeat monitor")
+			return
+		}
+
+		c.JSON(200, gin.H{"status": "ok", "deleted": c.Param("name")})
+	}
+}
+
+func pingHeartbeat(db *sqlitedb.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		found, err := db.PingHeartbeat(c.Param("name"))
+		if err != nil {
+			logrus.Errorf("Failed to record heartbeat: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to record heartbeat"})
+			return
+		}
+
+		if !found {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Unknown heartbeat monitor"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"msg": "ok"})
+	}
+}
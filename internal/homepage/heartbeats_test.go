@@ -0,0 +1,54 @@
+package homepage
+
+import (
+	"testing"
+	"time"
+
+	"github.com/rogierlommers/home/internal/sqlitedb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHeartbeatChecker(t *testing.T) {
+	db := newTestDB(t)
+	require.NoError(t, db.AddHeartbeatMonitor("home-assistant", 15))
+
+	var notifications []string
+	checker := &heartbeatChecker{
+		db: db,
+		notify: func(subject, body string) error {
+			notifications = append(notifications, subject)
+			return nil
+		},
+	}
+
+	status := func() string {
+		monitors, err := db.GetHeartbeatMonitors()
+		require.NoError(t, err)
+		return monitors[0].Status
+	}
+
+	// within the interval nothing happens, the monitor is considered up
+	checker.check(time.Now())
+	assert.Equal(t, sqlitedb.HeartbeatUp, status())
+	assert.Empty(t, notifications)
+
+	// silent for too long
+	checker.check(time.Now().Add(20 * time.Minute))
+	assert.Equal(t, sqlitedb.HeartbeatDown, status())
+	assert.Equal(t, []string{"heartbeat home-assistant is down"}, notifications)
+
+	// still down, no second notification
+	checker.check(time.Now().Add(30 * time.Minute))
+	assert.Len(t, notifications, 1)
+
+	// an event of the source counts as heartbeat
+	require.NoError(t, AddEvent(db, Message{Source: "home-assistant", Message: "hihi", Category: "sensor"}))
+	checker.check(time.Now())
+	assert.Equal(t, sqlitedb.HeartbeatUp, status())
+	assert.Equal(t, "heartbeat home-assistant is up", notifications[1])
+
+	events := getEvents(db, 10, eventFilter{})
+	assert.Equal(t, "recovery", events[0].Category)
+	assert.Equal(t, "critical", events[2].Category)
+}
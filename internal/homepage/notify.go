@@ -6,11 +6,6 @@ import (
 )
 
 func displayNotify(c *gin.Context) {
-	if !isAuthenticated(c) {
-		c.Redirect(302, "/login")
-		return
-	}
-
 	htmlBytes, err := staticFS.ReadFile("static_html/notify.html")
 	if err != nil {
 		logrus.Errorf("Error reading static html: %v", err)
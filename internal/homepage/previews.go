@@ -0,0 +1,227 @@
+package homepage
+
+import (
+	"bytes"
+	"errors"
+	"html/template"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rogierlommers/home/internal/sqlitedb"
+	"github.com/rogierlommers/home/internal/storage"
+	"github.com/sirupsen/logrus"
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/extension"
+)
+
+// Thumbnails and previews of stored files, used by the storage page.
+//
+// curl -o thumb.jpg "http://localhost:3000/api/files/holiday.jpg/thumbnail" -H "X-HOME-API-KEY: supersecretkey"
+// curl "http://localhost:3000/api/files/readme.md/preview" -H "X-HOME-API-KEY: supersecretkey"
+
+const (
+	// text files are previewed up to this size
+	maxTextPreview = 1 << 20
+
+	// rendered previews cannot load scripts or anything else from elsewhere
+	previewPolicy = "default-src 'none'; style-src 'unsafe-inline'; img-src 'self' data: https:"
+)
+
+// browsers show these types themselves, other types could run scripts (html, svg) or
+// cannot be shown at all
+var inlineTypes = map[string]bool{
+	"application/pdf": true,
+	"image/jpeg":      true,
+	"image/png":       true,
+	"image/gif":       true,
+	"image/webp":      true,
+	"image/avif":      true,
+	"image/bmp":       true,
+	"audio/mpeg":      true,
+	"audio/ogg":       true,
+	"audio/wav":       true,
+	"audio/flac":      true,
+	"video/mp4":       true,
+	"video/webm":      true,
+	"video/ogg":       true,
+}
+
+var markdown = goldmark.New(goldmark.WithExtensions(extension.GFM))
+
+// fileResponse is an indexed file with the links to its thumbnail and preview
+type fileResponse struct {
+	sqlitedb.File
+	Thumbnail string `json:"thumbnail,omitempty"`
+	Preview   string `json:"preview,omitempty"`
+}
+
+// textPreview is the data of the page that shows text and markdown files
+type textPreview struct {
+	Name      string
+	Body      template.HTML
+	Truncated bool
+}
+
+func newFileResponse(f sqlitedb.File) fileResponse {
+	response := fileResponse{File: f}
+	base := "/api/files/" + url.PathEscape(f.Name)
+
+	// the hash in the link makes browsers fetch a new thumbnail when the file changes
+	if storage.HasThumbnail(f.ContentType) {
+		response.Thumbnail = base + "/thumbnail?v=" + f.SHA256
+	}
+
+	if canPreview(f) {
+		response.Preview = base + "/preview"
+	}
+
+	return response
+}
+
+func canPreview(f sqlitedb.File) bool {
+	mediaType := storage.MediaType(f.ContentType)
+	return inlineTypes[mediaType] || strings.HasPrefix(mediaType, "text/") || isMarkdown(f)
+}
+
+// isMarkdown looks at the extension as well, markdown is detected as plain text
+func isMarkdown(f sqlitedb.File) bool {
+	switch strings.ToLower(filepath.Ext(f.Name)) {
+	case ".md", ".markdown":
+		return true
+	}
+	return storage.MediaType(f.ContentType) == "text/markdown"
+}
+
+// thumbnailFile serves the thumbnail of an image or pdf
+func thumbnailFile(store *storage.Store, db *sqlitedb.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		file, ok := lookupFile(c, db)
+		if !ok {
+			return
+		}
+
+		thumb, err := store.Thumbnail(*file)
+		if errors.Is(err, storage.ErrNoThumbnail) {
+			c.String(404, "No thumbnail for %s", file.Name)
+			return
+		}
+		if err != nil {
+			logrus.Errorf("failed to make thumbnail of %s: %v", file.Name, err)
+			c.String(404, "No thumbnail for %s", file.Name)
+			return
+		}
+
+		defer thumb.Close()
+
+		c.Header("Cache-Control", "private, max-age=31536000, immutable")
+		c.Header("Content-Type", "image/jpeg")
+		http.ServeContent(c.Writer, c.Request, file.Name+".jpg", file.Uploaded, thumb)
+	}
+}
+
+// previewFile shows a file in the browser. Markdown is rendered as html, other text is
+// shown as is, and files that browsers can show themselves are served inline.
+func previewFile(store *storage.Store, db *sqlitedb.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		file, ok := lookupFile(c, db)
+		if !ok {
+			return
+		}
+
+		if !canPreview(*file) {
+			c.String(415, "No preview for %s", storage.MediaType(file.ContentType))
+			return
+		}
+
+		f, _, err := store.Open(file.Name)
+		if err != nil {
+			openFailed(c, file.Name, err)
+			return
+		}
+		defer f.Close()
+
+		c.Header("X-Content-Type-Options", "nosniff")
+
+		if inlineTypes[storage.MediaType(file.ContentType)] {
+
+			c.Header("Content-Type", file.ContentType)
+			c.Header("Content-Disposition", mime.FormatMediaType("inline", map[string]string{"filename": filepath.Base(file.Name)}))
+			http.ServeContent(c.Writer, c.Request, file.Name, file.Uploaded, f)
+			return
+		}
+
+		renderTextPreview(c, *file, f)
+	}
+}
+
+// renderTextPreview shows a text file in a html page, markdown is rendered. The html
+// that markdown may contain is not rendered.
+func renderTextPreview(c *gin.Context, file sqlitedb.File, r io.Reader) {
+	content, err := io.ReadAll(io.LimitReader(r, maxTextPreview+1))
+	if err != nil {
+		c.String(500, "Failed to read file")
+		return
+	}
+
+	page := textPreview{Name: file.Name, Truncated: len(content) > maxTextPreview}
+	if page.Truncated {
+		content = content[:maxTextPreview]
+	}
+
+	if isMarkdown(file) {
+		var buf bytes.Buffer
+		if err := markdown.Convert(content, &buf); err != nil {
+			logrus.Errorf("failed to render markdown of %s: %v", file.Name, err)
+			c.String(500, "Failed to render markdown")
+			return
+		}
+		page.Body = template.HTML(buf.String())
+	} else {
+		page.Body = template.HTML("<pre>" + template.HTMLEscapeString(string(content)) + "</pre>")
+	}
+
+	htmlBytes, err := staticFS.ReadFile("static_html/preview.html")
+	if err != nil {
+		logrus.Errorf("Error reading static html: %v", err)
+		c.String(500, "Failed to read preview template")
+		return
+	}
+
+	tmpl, err := template.New("preview.html").Parse(string(htmlBytes))
+	if err != nil {
+		logrus.Errorf("Error parsing template: %v", err)
+		c.String(500, "Failed to parse preview template")
+		return
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, page); err != nil {
+		logrus.Errorf("Error executing template: %v", err)
+		c.String(500, "Failed to render preview")
+		return
+	}
+
+	c.Header("Content-Security-Policy", previewPolicy)
+	c.Data(200, "text/html; charset=utf-8", buf.Bytes())
+}
+
+// lookupFile returns the index entry of the file in the path, or writes the error response
+func lookupFile(c *gin.Context, db *sqlitedb.DB) (*sqlitedb.File, bool) {
+	file, err := db.GetFile(c.Param("filename"))
+	if err != nil {
+		c.String(500, "Failed to find file")
+		return nil, false
+	}
+
+	if file == nil {
+		c.String(404, "File not found")
+		return nil, false
+	}
+
+	return file, true
+}
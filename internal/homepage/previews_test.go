@@ -0,0 +1,69 @@
+package homepage
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rogierlommers/home/internal/config"
+	"github.com/rogierlommers/home/internal/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPreviews(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	db := newTestDB(t)
+	files := storage.New(config.AppConfig{UploadTarget: t.TempDir(), FileCleanUpInDys: 7}, db)
+
+	var img bytes.Buffer
+	require.NoError(t, png.Encode(&img, image.NewRGBA(image.Rect(0, 0, 20, 10))))
+
+	size := img.Len()
+	photo, err := files.Save("my photo.png", &img, storage.Upload{})
+	require.NoError(t, err)
+	notes, err := files.Save("notes.md", strings.NewReader("# notes"), storage.Upload{})
+	require.NoError(t, err)
+	archive, err := files.Save("backup.bin", bytes.NewReader([]byte{0, 1, 2, 3}), storage.Upload{})
+	require.NoError(t, err)
+
+	response := newFileResponse(photo)
+	assert.Equal(t, "/api/files/my%20photo.png/thumbnail?v="+photo.SHA256, response.Thumbnail)
+	assert.Equal(t, "/api/files/my%20photo.png/preview", response.Preview)
+
+	response = newFileResponse(notes)
+	assert.Empty(t, response.Thumbnail)
+	assert.Equal(t, "/api/files/notes.md/preview", response.Preview)
+
+	response = newFileResponse(archive)
+	assert.Empty(t, response.Thumbnail)
+	assert.Empty(t, response.Preview)
+
+	router := gin.New()
+	router.GET("/api/files/:filename/thumbnail", thumbnailFile(files, db))
+	router.GET("/api/files/:filename/preview", previewFile(files, db))
+
+	get := func(url string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", url, nil))
+		return w
+	}
+
+	w := get("/api/files/my%20photo.png/preview")
+	require.Equal(t, 200, w.Code)
+	assert.Equal(t, "image/png", w.Header().Get("Content-Type"))
+	assert.Equal(t, `inline; filename="my photo.png"`, w.Header().Get("Content-Disposition"))
+	assert.Equal(t, size, w.Body.Len())
+
+	w = get("/api/files/my%20photo.png/thumbnail")
+	require.Equal(t, 200, w.Code)
+	assert.Equal(t, "image/jpeg", w.Header().Get("Content-Type"))
+
+	assert.Equal(t, 415, get("/api/files/backup.bin/preview").Code)
+	assert.Equal(t, 404, get("/api/files/backup.bin/thumbnail").Code)
+	assert.Equal(t, 404, get("/api/files/missing.png/preview").Code)
+}
@@ -0,0 +1,57 @@
+package homepage
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/dustin/go-humanize"
+	"github.com/rogierlommers/home/internal/sqlitedb"
+	"github.com/rogierlommers/home/internal/storage"
+	"github.com/sirupsen/logrus"
+)
+
+// storage usage above this percentage of the quota, or of the disk without quota, is reported
+const storageWarningPercent = 80
+
+// storageWarning remembers per store if the usage was above the threshold, so crossing it is reported once
+var storageWarning = struct {
+	sync.Mutex
+	above map[*storage.Store]bool
+}{above: map[*storage.Store]bool{}}
+
+// checkStorageUsage adds a warning event when the storage usage crosses the threshold
+func checkStorageUsage(files *storage.Store, db *sqlitedb.DB) {
+	usage, err := files.Usage()
+	if err != nil {
+		logrus.Errorf("failed to get storage usage: %v", err)
+		return
+	}
+
+	storageWarning.Lock()
+	crossed := usage.Percent >= storageWarningPercent && !storageWarning.above[files]
+	storageWarning.above[files] = usage.Percent >= storageWarningPercent
+	storageWarning.Unlock()
+
+	if !crossed {
+		return
+	}
+
+	message := fmt.Sprintf("storage is %.0f%% full, %s used by %d files", usage.Percent, humanize.IBytes(uint64(usage.Used)), usage.Files)
+	if usage.Quota > 0 {
+		message += fmt.Sprintf(" of the %s quota", humanize.IBytes(uint64(usage.Quota)))
+	}
+	if usage.DiskTotal > 0 {
+		message += fmt.Sprintf(", %s free on disk", humanize.IBytes(usage.DiskFree))
+	}
+
+	event := Message{
+		Source:   "system",
+		Category: "storage",
+		Severity: severityWarning,
+		Message:  message,
+	}
+
+	if err := AddEvent(db, event); err != nil {
+		logrus.Errorf("failed to log storage warning: %v", err)
+	}
+}
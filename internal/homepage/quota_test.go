@@ -0,0 +1,123 @@
+package homepage
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"mime/multipart"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rogierlommers/home/internal/config"
+	"github.com/rogierlommers/home/internal/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUploadQuota(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	db := newTestDB(t)
+	cfg := config.AppConfig{UploadTarget: t.TempDir(), FileCleanUpInDys: 7, StorageQuotaMB: 1}
+	files := storage.New(cfg, db)
+
+	router := gin.New()
+	router.POST("/api/upload", uploadFiles(files, cfg, nil, db))
+	router.GET("/api/stats", statsHandler(db, files))
+
+	upload := func(size int, chunked bool) int {
+		var body bytes.Buffer
+		form := multipart.NewWriter(&body)
+		require.NoError(t, form.WriteField("onlyUpload", "true"))
+		part, err := form.CreateFormFile("files", "data.bin")
+		require.NoError(t, err)
+		_, err = part.Write(make([]byte, size))
+		require.NoError(t, err)
+		require.NoError(t, form.Close())
+
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", "/api/upload", &body)
+		req.Header.Set("Content-Type", form.FormDataContentType())
+		if chunked {
+			req.Body = io.NopCloser(io.MultiReader(&body))
+			req.ContentLength = -1
+		}
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	// the request is refused on its length, before the form is read
+	assert.Equal(t, 413, upload(2<<20, false))
+
+	// without a length, the request is cut off while the form is read
+	assert.Equal(t, 413, upload(3<<20, true))
+
+	assert.Equal(t, 200, upload(900<<10, false))
+	assert.Equal(t, 413, upload(200<<10, true))
+
+	// crossing 80% of the quota was reported once
+	warnings := getEvents(db, 10, eventFilter{Category: "storage"})
+	require.Len(t, warnings, 1)
+	assert.Equal(t, severityWarning, warnings[0].Severity)
+	assert.True(t, strings.HasPrefix(warnings[0].Message, "storage is 88% full"), warnings[0].Message)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/api/stats", nil))
+	require.Equal(t, 200, w.Code)
+
+	var response struct {
+		Storage storage.Usage `json:"storage"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Equal(t, 1, response.Storage.Files)
+	assert.Equal(t, int64(900<<10), response.Storage.Used)
+	assert.Equal(t, int64(1<<20), response.Storage.Quota)
+}
+
+func TestUploadRejected(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	db := newTestDB(t)
+	cfg := config.AppConfig{UploadTarget: t.TempDir(), FileCleanUpInDys: 7, StorageDeniedTypes: "application/x-elf"}
+	files := storage.New(cfg, db)
+
+	router := gin.New()
+	router.POST("/api/upload", uploadFiles(files, cfg, nil, db))
+
+	upload := func(name, content string) *httptest.ResponseRecorder {
+		var body bytes.Buffer
+		form := multipart.NewWriter(&body)
+		require.NoError(t, form.WriteField("onlyUpload", "true"))
+		part, err := form.CreateFormFile("files", name)
+		require.NoError(t, err)
+		_, err = part.Write([]byte(content))
+		require.NoError(t, err)
+		require.NoError(t, form.Close())
+
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", "/api/upload", &body)
+		req.Header.Set("Content-Type", form.FormDataContentType())
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	assert.Equal(t, 200, upload("notes.txt", "hello").Code)
+
+	w := upload("invoice.pdf", "hello")
+	assert.Equal(t, 415, w.Code)
+	assert.Contains(t, w.Body.String(), "does not match the extension")
+
+	assert.Equal(t, 415, upload("tool", "\x7fELF\x02\x01\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02\x00\x3e\x00").Code)
+
+	list, err := files.List("")
+	require.NoError(t, err)
+	assert.Len(t, list, 1)
+
+	// every refused upload is recorded
+	warnings := getEvents(db, 10, eventFilter{Category: "storage"})
+	require.Len(t, warnings, 2)
+	assert.Equal(t, severityWarning, warnings[1].Severity)
+	assert.Equal(t, "upload of invoice.pdf through storage refused: content is text/plain, which does not match the extension", warnings[1].Message)
+	assert.Equal(t, "storage", warnings[1].Attributes["entry_point"])
+	assert.Equal(t, "text/plain; charset=utf-8", warnings[1].Attributes["content_type"])
+}
@@ -1,55 +1,143 @@
 package homepage
 
 import (
+	"context"
 	"embed"
+	"sync"
 
-	"github.com/gin-gonic/gin"
+	"github.com/rogierlommers/home/internal/auth"
 	"github.com/rogierlommers/home/internal/config"
 	"github.com/rogierlommers/home/internal/mailer"
 	"github.com/rogierlommers/home/internal/sqlitedb"
+	"github.com/rogierlommers/home/internal/storage"
 )
 
 var staticFS embed.FS
 
-func Add(router *gin.Engine, cfg config.AppConfig, mailer *mailer.Mailer, staticHtmlFS embed.FS, db *sqlitedb.DB) {
+// Add registers the routes and starts the background work, which stops when ctx is
+// done. Wait for the returned group before the database is closed.
+func Add(ctx context.Context, router *auth.Router, cfg config.AppConfig, mailer *mailer.Mailer, staticHtmlFS embed.FS, db *sqlitedb.DB) *sync.WaitGroup {
+	var background sync.WaitGroup
 
 	// make the embedded filesystem available
 	staticFS = staticHtmlFS
 
 	// landing page and authorization
-	router.GET("/", displayLoginPage)
-	router.POST("/api/login", login(cfg))
-	router.GET("/api/logout", logout())
+	public := router.Group("/", auth.Public())
+	public.GET("/", displayLoginPage)
+	public.POST("/api/login", login(cfg, router.Authenticator()))
+	public.GET("/api/logout", logout())
+
+	// html pages, visitors without a session are sent to the login page
+	pages := router.Group("/", auth.Page())
+
+	// api endpoints used by the pages only
+	session := router.Group("/api", auth.Session())
 
 	// statistics
-	router.GET("/api/stats", statsHandler(db))
-	router.GET("/statistics", displayStatistics)
+	files := storage.New(cfg, db)
+	pages.GET("/statistics", displayStatistics)
+	stats := router.Group("/api", auth.SessionOrAPIKey(auth.ScopeStats))
+	stats.GET("/stats", statsHandler(db, files))
 
 	// bookmarks
-	router.GET("/bookmarks", displayBookmarks)
-	router.GET("/bookmarks/edit", displayEditBookmarks)
-	router.GET("/api/bookmarks", getBookmarks(db, cfg.XHomeAPIKey))
-	router.GET("/api/categories", displayCategories(db))
-	router.GET("/api/bookmarks/export", createImportScript(db, cfg.XHomeAPIKey))
-	router.POST("/api/bookmarks", addBookmark(db, cfg.XHomeAPIKey))
-	router.PUT("/api/bookmarks/:id", editBookmark(db))
-	router.DELETE("/api/bookmarks/:id", deleteBookmark(db))
+	pages.GET("/bookmarks", displayBookmarks)
+	pages.GET("/bookmarks/edit", displayEditBookmarks)
+	bookmarks := router.Group("/api", auth.SessionOrAPIKey(auth.ScopeBookmarks))
+	bookmarks.GET("/bookmarks", getBookmarks(db))
+	bookmarks.GET("/bookmarks/export", createImportScript(db))
+	bookmarks.POST("/bookmarks", addBookmark(db))
+	session.GET("/categories", displayCategories(db))
+	session.PUT("/bookmarks/:id", editBookmark(db))
+	session.DELETE("/bookmarks/:id", deleteBookmark(db))
 
 	// notify
-	router.GET("/notify", displayNotify)
+	pages.GET("/notify", displayNotify)
 
 	// file storage
-	router.GET("/storage", displayStorage(cfg))
-	router.GET("/api/filelist", fileList(cfg))
-	router.GET("/api/download/:filename", downloadFile(cfg))
-	router.POST("/api/upload", uploadFiles(cfg, mailer, db))
+	pages.GET("/storage", displayStorage(cfg))
+	storageAPI := router.Group("/api", auth.SessionOrAPIKey(auth.ScopeFiles))
+	storageAPI.GET("/filelist", fileList(files))
+	storageAPI.GET("/download/*path", downloadFile(files))
+	storageAPI.GET("/files/archive", downloadArchive(files, db))
+	storageAPI.POST("/upload", uploadFiles(files, cfg, mailer, db))
+	storageAPI.GET("/files/expiring", expiringFiles(db))
+	storageAPI.POST("/files/verify", verifyFilesHandler(files, db))
+	storageAPI.POST("/files/:filename/pin", pinFile(db, true))
+	storageAPI.DELETE("/files/:filename/pin", pinFile(db, false))
+	storageAPI.GET("/files/:filename/thumbnail", thumbnailFile(files, db))
+	storageAPI.GET("/files/:filename/preview", previewFile(files, db))
+	storageAPI.POST("/files/:filename/move", moveFile(files))
+	storageAPI.POST("/folders", createFolder(files))
+	storageAPI.PATCH("/folders", renameFolder(files))
+	storageAPI.DELETE("/folders", deleteFolder(files))
+
+	// share links, the links themselves are public
+	storageAPI.POST("/files/:filename/shares", createShare(db, cfg))
+	storageAPI.GET("/shares", displayShares(db, cfg))
+	storageAPI.DELETE("/shares/:id", revokeShare(db))
+	public.GET("/s/:token", displaySharePage(db, files, cfg.ShareSecret))
+	public.POST("/s/:token", downloadShare(db, files, cfg.ShareSecret))
+
+	// resumable uploads, clients discover the protocol before authenticating
+	uploads := newTusStore(files)
+	public.OPTIONS("/api/tus", tusOptions())
+	storageAPI.POST("/tus", tusCreate(uploads, cfg, mailer, db))
+	storageAPI.HEAD("/tus/:id", tusHead(uploads))
+	storageAPI.PATCH("/tus/:id", tusPatch(uploads, cfg, mailer, db))
+	storageAPI.DELETE("/tus/:id", tusDelete(uploads))
+
+	// network drive
+	addWebDAV(router, files, cfg, mailer, db)
 
 	// events
-	router.GET("/events", serveEventsHTML())
-	router.POST("/api/events", eventsIncomingMessage(mailer, db, cfg.XHomeAPIKey))
-	router.GET("/api/events", displayEvents(db))
-	router.GET("/api/events/categories", displayEventsCategories(db))
+	pages.GET("/events", serveEventsHTML())
+	ingest := router.Group("/api/events", auth.APIKey(auth.ScopeEvents).OrSourceToken())
+	ingest.POST("", eventsIncomingMessage(mailer, db, cfg))
+	ingest.POST("/batch", eventsIncomingBatch(db, cfg))
+	ingest.POST("/alertmanager", alertmanagerIncoming(db, cfg))
+	ingest.POST("/grafana", grafanaIncoming(db, cfg))
+	ingest.POST("/homeassistant", homeAssistantIncoming(db, cfg))
+	events := router.Group("/api/events", auth.SessionOrAPIKey(auth.ScopeEvents))
+	events.GET("/export", exportEvents(db))
+	events.POST("/import", importEvents(db))
+	events.GET("/unread", unreadEvents(db))
+	events.POST("/ack", acknowledgeEvents(db, cfg))
+	events.POST("/:id/ack", acknowledgeEvent(db, cfg))
+	events.DELETE("/:id/ack", unacknowledgeEvent(db, cfg))
+	events.POST("/:id/release", releaseEvent(db))
+	events.GET("/sources", displayEventSources(db))
+	session.GET("/events", displayEvents(db))
+	session.GET("/events/categories", displayEventsCategories(db))
+	session.GET("/events/aggregate", aggregateEvents(db))
+	session.GET("/events/autoack", displayAutoAckRules(db))
+	session.POST("/events/autoack", addAutoAckRule(db))
+	session.DELETE("/events/autoack/:id", deleteAutoAckRule(db))
+	session.POST("/events/sources", addEventSource(db))
+	session.POST("/events/sources/:id/token", rotateEventSourceToken(db))
+	session.DELETE("/events/sources/:id", deleteEventSource(db))
+
+	// webhooks
+	pages.GET("/webhooks", displayWebhooksPage)
+	session.GET("/webhooks", displayWebhooks(db))
+	session.POST("/webhooks", addWebhook(db))
+	session.PUT("/webhooks/:id/enabled", enableWebhook(db))
+	session.DELETE("/webhooks/:id", deleteWebhook(db))
+	session.GET("/webhooks/:id/deliveries", displayWebhookDeliveries(db))
+	newWebhookDispatcher(db).start(ctx, &background)
+
+	// heartbeats
+	pages.GET("/heartbeats", displayHeartbeatsPage)
+	heartbeats := router.Group("/api", auth.SessionOrAPIKey(auth.ScopeHeartbeats))
+	heartbeats.GET("/heartbeats", displayHeartbeats(db))
+	heartbeats.POST("/heartbeats", addHeartbeat(db))
+	heartbeats.DELETE("/heartbeats/:name", deleteHeartbeat(db))
+	pings := router.Group("/api", auth.APIKey(auth.ScopeHeartbeats))
+	pings.POST("/heartbeat/:name", pingHeartbeat(db))
+	newHeartbeatChecker(db, mailer).start(ctx, &background)
 
 	// cleanup
-	scheduleCleanup(cfg, db)
+	scheduleCleanup(ctx, &background, cfg, db, files, uploads)
+
+	return &background
 }
@@ -0,0 +1,401 @@
+package homepage
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"html/template"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/gin-gonic/gin"
+	"github.com/rogierlommers/home/internal/config"
+	"github.com/rogierlommers/home/internal/sqlitedb"
+	"github.com/rogierlommers/home/internal/storage"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Share links give people outside of the household access to a single file. A link
+// is "/s/<public id>.<signature>", the signature is a HMAC of the public id so links
+// cannot be guessed. A share expires, and can have a password and a download limit.
+//
+// curl -X POST "http://localhost:3000/api/files/report.pdf/shares" -H "X-HOME-API-KEY: supersecretkey" -d '{"expires_in": "1d", "password": "secret", "max_downloads": 3}'
+// curl "http://localhost:3000/api/shares" -H "X-HOME-API-KEY: supersecretkey"
+// curl -X DELETE "http://localhost:3000/api/shares/1" -H "X-HOME-API-KEY: supersecretkey"
+// curl -OJ -X POST "http://localhost:3000/s/<token>" -d "password=secret"
+
+const (
+	// shares without an explicit expiry are valid for a week
+	defaultShareExpiry = 7 * 24 * time.Hour
+
+	// number of bytes of the HMAC used as signature
+	shareSignatureLength = 16
+
+	// repeated views and refusals of a share are recorded once in this window
+	shareEventWindow = 10 * time.Minute
+)
+
+var shareEvents = &eventLimiter{window: shareEventWindow, last: map[string]time.Time{}}
+
+type shareRequest struct {
+	ExpiresIn    string `json:"expires_in"`
+	Password     string `json:"password"`
+	MaxDownloads int    `json:"max_downloads"`
+}
+
+// shareResponse is a share with its link, the link is derived from the public id
+type shareResponse struct {
+	sqlitedb.FileShare
+	URL string `json:"url"`
+}
+
+// sharePage is the data of the public landing page of a share
+type sharePage struct {
+	Name          string
+	Size          string
+	Expires       string
+	DownloadsLeft string
+	NeedsPassword bool
+	Error         string
+}
+
+func createShare(db *sqlitedb.DB, cfg config.AppConfig) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if cfg.ShareSecret == "" {
+			c.String(503, "Share links require SHARE_SECRET or X_HOME_API_KEY to be configured")
+			return
+		}
+
+		var request shareRequest
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.String(400, "Invalid share: %v", err)
+			return
+		}
+
+		expiresIn, err := storage.ParseRetention(request.ExpiresIn)
+		if err != nil || expiresIn == storage.Forever {
+			c.String(400, "Invalid expiry %q, a share has to expire", request.ExpiresIn)
+			return
+		}
+		if expiresIn == 0 {
+			expiresIn = defaultShareExpiry
+		}
+
+		if request.MaxDownloads < 0 {
+			c.String(400, "Invalid max_downloads")
+			return
+		}
+
+		filename := c.Param("filename")
+		file, err := db.GetFile(filename)
+		if err != nil {
+			c.String(500, "Failed to find file")
+			return
+		}
+		if file == nil {
+			c.String(404, "File not found")
+			return
+		}
+
+		share := sqlitedb.FileShare{
+			PublicID:     newSharePublicID(),
+			FileName:     file.Name,
+			Expires:      time.Now().UTC().Add(expiresIn).Truncate(time.Second),
+			MaxDownloads: request.MaxDownloads,
+		}
+
+		if request.Password != "" {
+			hash, err := bcrypt.GenerateFromPassword([]byte(request.Password), bcrypt.DefaultCost)
+			if err != nil {
+				c.String(400, "Invalid password: %v", err)
+				return
+			}
+			share.PasswordHash = string(hash)
+		}
+
+		share.ID, err = db.AddFileShare(share)
+		if err != nil {
+			c.String(500, "Failed to create share")
+			return
+		}
+
+		logShareEvent(db, fmt.Sprintf("share %d of %s created, expires %s", share.ID, share.FileName, share.Expires.Format(time.RFC3339)))
+		c.JSON(201, shareResponse{FileShare: share, URL: shareURL(cfg, signShare(cfg.ShareSecret, share.PublicID))})
+	}
+}
+
+func displayShares(db *sqlitedb.DB, cfg config.AppConfig) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		shares, err := db.GetFileShares()
+		if err != nil {
+			c.JSON(500, gin.H{"error": "Failed to list shares"})
+			return
+		}
+
+		response := []shareResponse{}
+		for _, share := range shares {
+			response = append(response, shareResponse{FileShare: share, URL: shareURL(cfg, signShare(cfg.ShareSecret, share.PublicID))})
+		}
+
+		c.JSON(200, gin.H{"shares": response})
+	}
+}
+
+func revokeShare(db *sqlitedb.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			c.String(400, "Invalid share id")
+			return
+		}
+
+		found, err := db.RevokeFileShare(id)
+		if err != nil {
+			c.String(500, "Failed to revoke share")
+			return
+		}
+
+		if !found {
+			c.String(404, "Share not found")
+			return
+		}
+
+		logShareEvent(db, fmt.Sprintf("share %d revoked", id))
+		c.JSON(200, gin.H{"status": "ok", "revokedID": id})
+	}
+}
+
+// displaySharePage shows the public landing page of a share
+func displaySharePage(db *sqlitedb.DB, store *storage.Store, secret string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		share, file, status, reason := resolveShare(c, db, store, secret)
+		if status != 200 {
+			renderSharePage(c, status, sharePage{Error: reason})
+			return
+		}
+
+		logShareEventOnce(db, share.PublicID+":viewed", fmt.Sprintf("share %d of %s viewed from %s", share.ID, share.FileName, c.ClientIP()))
+
+		page := sharePage{
+			Name:          filepath.Base(share.FileName),
+			Expires:       share.Expires.Local().Format("2006-01-02 15:04"),
+			DownloadsLeft: "unlimited",
+			NeedsPassword: share.HasPassword(),
+			Size:          humanize.Bytes(uint64(file.Size)),
+		}
+
+		if share.MaxDownloads > 0 {
+			page.DownloadsLeft = strconv.Itoa(share.MaxDownloads - share.Downloads)
+		}
+
+		renderSharePage(c, 200, page)
+	}
+}
+
+// downloadShare serves the file of a share after checking the password and the download limit
+func downloadShare(db *sqlitedb.DB, store *storage.Store, secret string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		share, _, status, reason := resolveShare(c, db, store, secret)
+		if status != 200 {
+			renderSharePage(c, status, sharePage{Error: reason})
+			return
+		}
+
+		if share.HasPassword() {
+			if err := bcrypt.CompareHashAndPassword([]byte(share.PasswordHash), []byte(c.PostForm("password"))); err != nil {
+				logShareEventOnce(db, share.PublicID+":password", fmt.Sprintf("share %d of %s: wrong password from %s", share.ID, share.FileName, c.ClientIP()))
+				renderSharePage(c, 403, sharePage{Name: filepath.Base(share.FileName), NeedsPassword: true, Error: "Wrong password"})
+				return
+			}
+		}
+
+		// the download is only counted once the file can be served
+		content, file, err := store.Open(share.FileName)
+		if err != nil {
+			logrus.Errorf("failed to open shared file %s: %v", share.FileName, err)
+			renderSharePage(c, 410, sharePage{Error: "This file is no longer available"})
+			return
+		}
+		defer content.Close()
+
+		counted, err := db.CountShareDownload(share.ID, time.Now())
+		if err != nil {
+			c.String(500, "Failed to download file")
+			return
+		}
+
+		if !counted {
+			logShareEventOnce(db, share.PublicID+":limit", fmt.Sprintf("share %d of %s: download refused for %s, limit reached", share.ID, share.FileName, c.ClientIP()))
+			renderSharePage(c, 410, sharePage{Error: "This link has been used the maximum number of times"})
+			return
+		}
+
+		logShareEvent(db, fmt.Sprintf("share %d of %s downloaded from %s (%d)", share.ID, share.FileName, c.ClientIP(), share.Downloads+1))
+		c.Header("Content-Type", file.ContentType)
+		c.Header("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filepath.Base(file.Name)}))
+		http.ServeContent(c.Writer, c.Request, file.Name, file.Uploaded, content)
+	}
+}
+
+// resolveShare checks the token of the request. It returns the share and its file, or the
+// status and the reason why the share cannot be used.
+func resolveShare(c *gin.Context, db *sqlitedb.DB, store *storage.Store, secret string) (*sqlitedb.FileShare, *sqlitedb.File, int, string) {
+	// anyone can request links, only requests of existing shares are recorded as events
+	publicID, ok := verifyShare(secret, c.Param("token"))
+	if !ok {
+		logrus.Warnf("invalid share link requested from %s", c.ClientIP())
+		return nil, nil, 404, "This link does not exist"
+	}
+
+	share, err := db.GetFileShareByPublicID(publicID)
+	if err != nil {
+		return nil, nil, 500, "Failed to load the link"
+	}
+
+	var reason string
+	switch {
+	case share == nil:
+		logrus.Warnf("unknown share link requested from %s", c.ClientIP())
+		return nil, nil, 404, "This link does not exist"
+	case share.Revoked:
+		reason = "This link has been revoked"
+	case time.Now().After(share.Expires):
+		reason = "This link has expired"
+	case share.LimitReached():
+		reason = "This link has been used the maximum number of times"
+	}
+
+	if reason != "" {
+		logShareEventOnce(db, share.PublicID+":"+reason, fmt.Sprintf("share %d of %s requested from %s: %s", share.ID, share.FileName, c.ClientIP(), strings.ToLower(reason)))
+		return share, nil, 410, reason
+	}
+
+	content, file, err := store.Open(share.FileName)
+	if err != nil {
+		logShareEventOnce(db, share.PublicID+":gone", fmt.Sprintf("share %d of %s requested from %s: file is gone", share.ID, share.FileName, c.ClientIP()))
+		return share, nil, 410, "This file is no longer available"
+	}
+	content.Close()
+
+	return share, &file, 200, ""
+}
+
+func renderSharePage(c *gin.Context, status int, page sharePage) {
+	htmlBytes, err := staticFS.ReadFile("static_html/share.html")
+	if err != nil {
+		logrus.Errorf("Error reading static html: %v", err)
+		c.String(status, page.Error)
+		return
+	}
+
+	tmpl, err := template.New("share.html").Parse(string(htmlBytes))
+	if err != nil {
+		logrus.Errorf("Error parsing template: %v", err)
+		c.String(500, "Failed to parse share template")
+		return
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, page); err != nil {
+		logrus.Errorf("Error executing template: %v", err)
+		c.String(500, "Failed to render share page")
+		return
+	}
+
+	c.Header("Content-Type", "text/html")
+	c.String(status, buf.String())
+}
+
+func logShareEvent(db *sqlitedb.DB, message string) {
+	event := Message{
+		Source:   "system",
+		Category: "share",
+		Message:  message,
+	}
+
+	if err := AddEvent(db, event); err != nil {
+		logrus.Errorf("failed to log share event: %v", err)
+	}
+}
+
+// logShareEventOnce records an event at most once per shareEventWindow for the key, as
+// anyone with a link can repeat the request. Repeats are only logged.
+func logShareEventOnce(db *sqlitedb.DB, key, message string) {
+	if !shareEvents.allow(key, time.Now()) {
+		logrus.Infof("%s (not recorded again)", message)
+		return
+	}
+	logShareEvent(db, message)
+}
+
+// eventLimiter remembers when an event was recorded last for a key
+type eventLimiter struct {
+	mu     sync.Mutex
+	window time.Duration
+	last   map[string]time.Time
+}
+
+func (l *eventLimiter) allow(key string, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if last, found := l.last[key]; found && now.Sub(last) < l.window {
+		return false
+	}
+
+	for k, last := range l.last {
+		if now.Sub(last) >= l.window {
+			delete(l.last, k)
+		}
+	}
+	l.last[key] = now
+	return true
+}
+
+// shareURL returns the link of a share, absolute when PUBLIC_URL is configured. The host
+// of the request is not used, clients can send any host.
+func shareURL(cfg config.AppConfig, token string) string {
+	return cfg.PublicURL + "/s/" + token
+}
+
+func newSharePublicID() string {
+	b := make([]byte, 12)
+	_, _ = rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// signShare returns the token of a share: the public id and its signature
+func signShare(secret, publicID string) string {
+	return publicID + "." + base64.RawURLEncoding.EncodeToString(shareSignature(secret, publicID))
+}
+
+// verifyShare checks the signature of a token and returns the public id
+func verifyShare(secret, token string) (string, bool) {
+	publicID, signature, found := strings.Cut(token, ".")
+	if !found || secret == "" {
+		return "", false
+	}
+
+	decoded, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil {
+		return "", false
+	}
+
+	return publicID, hmac.Equal(decoded, shareSignature(secret, publicID))
+}
+
+func shareSignature(secret, publicID string) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte("share:" + publicID))
+	return mac.Sum(nil)[:shareSignatureLength]
+}
@@ -0,0 +1,183 @@
+package homepage
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rogierlommers/home/internal/auth"
+	"github.com/rogierlommers/home/internal/config"
+	"github.com/rogierlommers/home/internal/sqlitedb"
+	"github.com/rogierlommers/home/internal/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newShareRouter(t *testing.T) (*gin.Engine, *sqlitedb.DB) {
+	gin.SetMode(gin.TestMode)
+
+	cfg := config.AppConfig{XHomeAPIKey: "supersecretkey", ShareSecret: "sharesecret", PublicURL: "https://home.example.com", UploadTarget: t.TempDir(), FileCleanUpInDys: 7}
+	db := newTestDB(t)
+	files := storage.New(cfg, db)
+
+	_, err := files.Save("report.pdf", strings.NewReader("quarterly numbers"), storage.Upload{})
+	require.NoError(t, err)
+
+	router := newTestRouter(cfg, db)
+
+	api := router.Group("/api", auth.SessionOrAPIKey(auth.ScopeFiles))
+	api.POST("/files/:filename/shares", createShare(db, cfg))
+	api.DELETE("/shares/:id", revokeShare(db))
+
+	public := router.Group("/", auth.Public())
+	public.GET("/s/:token", displaySharePage(db, files, cfg.ShareSecret))
+	public.POST("/s/:token", downloadShare(db, files, cfg.ShareSecret))
+
+	return router.Engine(), db
+}
+
+func createTestShare(t *testing.T, router *gin.Engine, body string) shareResponse {
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "/api/files/report.pdf/shares", strings.NewReader(body))
+	req.Header.Set("X-HOME-API-KEY", "supersecretkey")
+	router.ServeHTTP(w, req)
+	require.Equal(t, 201, w.Code, w.Body.String())
+
+	var share shareResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &share))
+	return share
+}
+
+func downloadTestShare(router *gin.Engine, path, password string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("POST", path, strings.NewReader(url.Values{"password": {password}}.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func TestShareDownload(t *testing.T) {
+	router, db := newShareRouter(t)
+
+	share := createTestShare(t, router, `{"expires_in": "1d", "password": "secret", "max_downloads": 1}`)
+	link, err := url.Parse(share.URL)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(link.Path, "/s/"))
+
+	// links point to the configured url, not to the host of the request
+	assert.Equal(t, "home.example.com", link.Host)
+
+	// repeated views are recorded once, after the creation
+	for range 3 {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", link.Path, nil))
+		assert.Equal(t, 200, w.Code)
+	}
+	assert.Len(t, getEvents(db, 20, eventFilter{Category: "share"}), 2)
+
+	w := httptest.NewRecorder()
+
+	w = downloadTestShare(router, link.Path, "wrong")
+	assert.Equal(t, 403, w.Code)
+
+	w = downloadTestShare(router, link.Path, "secret")
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "quarterly numbers", w.Body.String())
+
+	// the maximum number of downloads is reached
+	w = downloadTestShare(router, link.Path, "secret")
+	assert.Equal(t, 410, w.Code)
+
+	// creation, view, wrong password, download and refusal are all logged
+	events := getEvents(db, 20, eventFilter{Category: "share"})
+	assert.Len(t, events, 5)
+}
+
+func TestShareRejectsTamperedAndRevokedLinks(t *testing.T) {
+	router, db := newShareRouter(t)
+
+	share := createTestShare(t, router, `{}`)
+	link, err := url.Parse(share.URL)
+	require.NoError(t, err)
+
+	// a share without expiry is valid for a week
+	assert.WithinDuration(t, time.Now().Add(defaultShareExpiry), share.Expires, time.Minute)
+
+	publicID, _, _ := strings.Cut(strings.TrimPrefix(link.Path, "/s/"), ".")
+	for _, path := range []string{"/s/" + publicID, "/s/" + publicID + ".AAAAAAAAAAAAAAAAAAAAAA", "/s/garbage"} {
+		w := downloadTestShare(router, path, "")
+		assert.Equal(t, 404, w.Code, path)
+	}
+
+	// invalid links are not recorded, anyone can request them
+	assert.Len(t, getEvents(db, 20, eventFilter{Category: "share"}), 1)
+
+	w := downloadTestShare(router, link.Path, "")
+	assert.Equal(t, 200, w.Code)
+
+	w = httptest.NewRecorder()
+	req := httptest.NewRequest("DELETE", "/api/shares/"+strconv.Itoa(share.ID), nil)
+	req.Header.Set("X-HOME-API-KEY", "supersecretkey")
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+
+	w = downloadTestShare(router, link.Path, "")
+	assert.Equal(t, 410, w.Code)
+}
+
+func TestShareValidation(t *testing.T) {
+	router, _ := newShareRouter(t)
+
+	for body, expected := range map[string]int{
+		`{"expires_in": "forever"}`: 400,
+		`{"max_downloads": -1}`:     400,
+	} {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", "/api/files/report.pdf/shares", strings.NewReader(body))
+		req.Header.Set("X-HOME-API-KEY", "supersecretkey")
+		router.ServeHTTP(w, req)
+		assert.Equal(t, expected, w.Code, body)
+	}
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "/api/files/missing.pdf/shares", strings.NewReader(`{}`))
+	req.Header.Set("X-HOME-API-KEY", "supersecretkey")
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 404, w.Code)
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/api/files/report.pdf/shares", strings.NewReader(`{}`)))
+	assert.Equal(t, 401, w.Code)
+}
+
+func TestShareDownloadOfMissingFile(t *testing.T) {
+	router, db := newShareRouter(t)
+
+	share := sqlitedb.FileShare{PublicID: newSharePublicID(), FileName: "missing.pdf", Expires: time.Now().Add(time.Hour), MaxDownloads: 1}
+	_, err := db.AddFileShare(share)
+	require.NoError(t, err)
+
+	w := downloadTestShare(router, "/s/"+signShare("sharesecret", share.PublicID), "")
+	assert.Equal(t, 410, w.Code)
+
+	// the failed download did not use up the link
+	stored, err := db.GetFileShareByPublicID(share.PublicID)
+	require.NoError(t, err)
+	assert.Equal(t, 0, stored.Downloads)
+}
+
+func TestShareExpired(t *testing.T) {
+	router, db := newShareRouter(t)
+
+	share := sqlitedb.FileShare{PublicID: newSharePublicID(), FileName: "report.pdf", Expires: time.Now().Add(-time.Minute)}
+	_, err := db.AddFileShare(share)
+	require.NoError(t, err)
+
+	w := downloadTestShare(router, "/s/"+signShare("sharesecret", share.PublicID), "")
+	assert.Equal(t, 410, w.Code)
+}
@@ -0,0 +1,164 @@
+package homepage
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rogierlommers/home/internal/config"
+	"github.com/rogierlommers/home/internal/sqlitedb"
+	"github.com/sirupsen/logrus"
+)
+
+// curl -X POST "http://localhost:3000/api/events" -H "X-HOME-SOURCE-TOKEN: 3f5c..." -d '{"message": "door open", "category": "alarm"}'
+
+var errSourceRejected = errors.New("events of unknown sources are rejected")
+
+// applySourcePolicy derives the source of the message from the registered source. Messages
+// without a registered source, or with a category the source does not expect, are handled
+// according to the unknown source policy: accepted, quarantined or rejected.
+//
+// Without a source token, the source of the message comes from the body or the adapter
+// and is only trusted with the accept policy. Messages that name a registered source
+// without its token are never trusted, they are quarantined or, with the reject
+// policy, rejected.
+func applySourcePolicy(db *sqlitedb.DB, msg *Message, source *sqlitedb.EventSource, policy string) error {
+	msg.Quarantined = false
+
+	if source != nil {
+		msg.Source = source.Name
+		if msg.Category == "" {
+			msg.Category = source.DefaultCategory()
+		}
+
+		if source.ExpectsCategory(msg.Category) {
+			return nil
+		}
+	}
+
+	if source == nil && policy == config.SourcePolicyAccept && msg.Source != "" {
+		claimed, err := db.GetEventSourceByName(msg.Source)
+		if err != nil {
+			return fmt.Errorf("failed to look up source %s: %w", msg.Source, err)
+		}
+		if claimed != nil {
+			policy = config.SourcePolicyQuarantine
+		}
+	}
+
+	switch policy {
+	case config.SourcePolicyReject:
+		if source != nil {
+			return fmt.Errorf("source %s does not expect category %q", source.Name, msg.Category)
+		}
+		return errSourceRejected
+	case config.SourcePolicyQuarantine:
+		msg.Quarantined = true
+	}
+
+	return nil
+}
+
+// IngestEvent stores an event that arrived through mqtt. The broker authenticates the
+// publishers, so the source named by the topic is trusted and treated as the registered
+// source with that name. Sources that are not registered are handled according to the
+// unknown source policy.
+func IngestEvent(db *sqlitedb.DB, policy string, msg Message) error {
+	source, err := db.GetEventSourceByName(msg.Source)
+	if err != nil {
+		return fmt.Errorf("failed to look up source %s: %w", msg.Source, err)
+	}
+
+	if err := applySourcePolicy(db, &msg, source, policy); err != nil {
+		return err
+	}
+
+	_, _, err = storeEvent(db.Conn, msg)
+	return err
+}
+
+func displayEventSources(db *sqlitedb.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		sources, err := db.GetEventSources()
+		if err != nil {
+			logrus.Errorf("Failed to get event sources: %v", err)
+			c.String(500, "Failed to retrieve event sources")
+			return
+		}
+
+		c.IndentedJSON(200, sources)
+	}
+}
+
+func addEventSource(db *sqlitedb.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var source sqlitedb.EventSource
+		if err := c.BindJSON(&source); err != nil {
+			logrus.Errorf("Failed to bind JSON: %v", err)
+			c.String(400, "Invalid request payload")
+			return
+		}
+
+		id, token, err := db.AddEventSource(source)
+		if err != nil {
+			logrus.Errorf("Failed to add event source: %v", err)
+			c.String(400, "Failed to add event source: %v", err)
+			return
+		}
+
+		// the token is only shown once
+		c.IndentedJSON(201, gin.H{"id": id, "name": source.Name, "token": token})
+	}
+}
+
+func rotateEventSourceToken(db *sqlitedb.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := convertToInt(c.Param("id"))
+		token, err := db.RotateEventSourceToken(id)
+		if err == sql.ErrNoRows {
+			c.String(404, "Event source not found")
+			return
+		}
+		if err != nil {
+			logrus.Errorf("Failed to rotate token of event source %d: %v", id, err)
+			c.String(500, "Failed to rotate token")
+			return
+		}
+
+		c.JSON(200, gin.H{"id": id, "token": token})
+	}
+}
+
+func deleteEventSource(db *sqlitedb.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := convertToInt(c.Param("id"))
+		if err := db.DeleteEventSource(id); err != nil {
+			logrus.Errorf("Failed to delete event source: %v", err)
+			c.String(500, "Failed to delete event source")
+			return
+		}
+
+		c.JSON(200, gin.H{"status": "ok", "deletedID": id})
+	}
+}
+
+func releaseEvent(db *sqlitedb.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid event id"})
+			return
+		}
+
+		released, err := db.ReleaseEvent(id)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to release event"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"id": id, "released": released})
+	}
+}
@@ -0,0 +1,185 @@
+package homepage
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rogierlommers/home/internal/auth"
+	"github.com/rogierlommers/home/internal/config"
+	"github.com/rogierlommers/home/internal/sqlitedb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestApplySourcePolicy(t *testing.T) {
+	db := newTestDB(t)
+	registered := &sqlitedb.EventSource{Name: "doorbell", ExpectedCategories: "alarm,visitor"}
+	_, _, err := db.AddEventSource(*registered)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name                string
+		source              *sqlitedb.EventSource
+		policy              string
+		msg                 Message
+		expectedSource      string
+		expectedCategory    string
+		expectedQuarantined bool
+		expectedError       bool
+	}{
+		{
+			name:             "token overrides source of body",
+			source:           registered,
+			policy:           config.SourcePolicyReject,
+			msg:              Message{Source: "spoofed", Category: "visitor"},
+			expectedSource:   "doorbell",
+			expectedCategory: "visitor",
+		},
+		{
+			name:             "default category of source",
+			source:           registered,
+			policy:           config.SourcePolicyReject,
+			msg:              Message{},
+			expectedSource:   "doorbell",
+			expectedCategory: "alarm",
+		},
+		{
+			name:                "unexpected category is quarantined",
+			source:              registered,
+			policy:              config.SourcePolicyQuarantine,
+			msg:                 Message{Category: "sensor"},
+			expectedSource:      "doorbell",
+			expectedCategory:    "sensor",
+			expectedQuarantined: true,
+		},
+		{
+			name:          "unexpected category is rejected",
+			source:        registered,
+			policy:        config.SourcePolicyReject,
+			msg:           Message{Category: "sensor"},
+			expectedError: true,
+		},
+		{
+			name:             "unknown source is accepted",
+			policy:           config.SourcePolicyAccept,
+			msg:              Message{Source: "script", Category: "sensor", Quarantined: true},
+			expectedSource:   "script",
+			expectedCategory: "sensor",
+		},
+		{
+			name:                "unknown source is quarantined",
+			policy:              config.SourcePolicyQuarantine,
+			msg:                 Message{Source: "script", Category: "sensor"},
+			expectedSource:      "script",
+			expectedCategory:    "sensor",
+			expectedQuarantined: true,
+		},
+		{
+			name:                "registered source without token is quarantined",
+			policy:              config.SourcePolicyAccept,
+			msg:                 Message{Source: "doorbell", Category: "alarm"},
+			expectedSource:      "doorbell",
+			expectedCategory:    "alarm",
+			expectedQuarantined: true,
+		},
+		{
+			name:          "registered source without token is rejected",
+			policy:        config.SourcePolicyReject,
+			msg:           Message{Source: "doorbell", Category: "alarm"},
+			expectedError: true,
+		},
+		{
+			name:          "unknown source is rejected",
+			policy:        config.SourcePolicyReject,
+			msg:           Message{Source: "script"},
+			expectedError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := tt.msg
+			err := applySourcePolicy(db, &msg, tt.source, tt.policy)
+
+			if tt.expectedError {
+				assert.Error(t, err)
+				return
+			}
+
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expectedSource, msg.Source)
+			assert.Equal(t, tt.expectedCategory, msg.Category)
+			assert.Equal(t, tt.expectedQuarantined, msg.Quarantined)
+		})
+	}
+}
+
+func TestIngestEvent(t *testing.T) {
+	db := newTestDB(t)
+
+	_, _, err := db.AddEventSource(sqlitedb.EventSource{Name: "zigbee2mqtt", ExpectedCategories: "sensor"})
+	require.NoError(t, err)
+
+	// the source of the topic is the registered source
+	require.NoError(t, IngestEvent(db, config.SourcePolicyReject, Message{Source: "zigbee2mqtt", Message: "reading"}))
+	assert.Error(t, IngestEvent(db, config.SourcePolicyReject, Message{Source: "zigbee2mqtt", Category: "alarm", Message: "reading"}))
+	assert.ErrorIs(t, IngestEvent(db, config.SourcePolicyReject, Message{Source: "other", Message: "reading"}), errSourceRejected)
+	require.NoError(t, IngestEvent(db, config.SourcePolicyQuarantine, Message{Source: "other", Message: "reading"}))
+
+	events := getEvents(db, 10, eventFilter{})
+	require.Len(t, events, 1)
+	assert.Equal(t, "sensor", events[0].Category)
+	assert.Len(t, getEvents(db, 10, eventFilter{Quarantined: true}), 1)
+}
+
+func TestEventsIncomingWithSourceToken(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	db := newTestDB(t)
+
+	_, token, err := db.AddEventSource(sqlitedb.EventSource{Name: "doorbell", ExpectedCategories: "alarm"})
+	require.NoError(t, err)
+
+	cfg := config.AppConfig{XHomeAPIKey: "supersecretkey", UnknownSourcePolicy: config.SourcePolicyQuarantine}
+	router := newTestRouter(cfg, db)
+	router.Group("/api/events", auth.APIKey(auth.ScopeEvents).OrSourceToken()).POST("", eventsIncomingMessage(nil, db, cfg))
+
+	post := func(header, value, body string) int {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", "/api/events", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set(header, value)
+		router.Engine().ServeHTTP(w, req)
+		return w.Code
+	}
+
+	assert.Equal(t, http.StatusOK, post(auth.SourceTokenHeader, token, `{"source":"spoofed","message":"ring"}`))
+	assert.Equal(t, http.StatusUnauthorized, post(auth.SourceTokenHeader, "wrong", `{"message":"ring"}`))
+	assert.Equal(t, http.StatusOK, post("X-HOME-API-KEY", "supersecretkey", `{"source":"script","message":"hihi"}`))
+
+	events := getEvents(db, 10, eventFilter{})
+	require.Len(t, events, 1)
+	assert.Equal(t, "doorbell", events[0].Source)
+	assert.Equal(t, "alarm", events[0].Category)
+
+	quarantined := getEvents(db, 10, eventFilter{Quarantined: true})
+	require.Len(t, quarantined, 1)
+	assert.Equal(t, "script", quarantined[0].Source)
+
+	count, err := db.CountUnreadEvents()
+	require.NoError(t, err)
+	assert.Equal(t, 1, count.Unread)
+	assert.Equal(t, 1, count.Quarantined)
+
+	released, err := db.ReleaseEvent(quarantined[0].ID)
+	require.NoError(t, err)
+	assert.True(t, released)
+	assert.Len(t, getEvents(db, 10, eventFilter{}), 2)
+
+	sources, err := db.GetEventSources()
+	require.NoError(t, err)
+	require.Len(t, sources, 1)
+	assert.NotNil(t, sources[0].LastSeen)
+}
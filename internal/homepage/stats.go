@@ -3,15 +3,11 @@ package homepage
 import (
 	"github.com/gin-gonic/gin"
 	"github.com/rogierlommers/home/internal/sqlitedb"
+	"github.com/rogierlommers/home/internal/storage"
 	"github.com/sirupsen/logrus"
 )
 
 func displayStatistics(c *gin.Context) {
-	if !isAuthenticated(c) {
-		c.Redirect(302, "/login")
-		return
-	}
-
 	htmlBytes, err := staticFS.ReadFile("static_html/statistics.html")
 	if err != nil {
 		logrus.Errorf("Error reading static html: %v", err)
@@ -23,13 +19,20 @@ func displayStatistics(c *gin.Context) {
 	c.String(200, string(htmlBytes))
 }
 
-func statsHandler(db *sqlitedb.DB) gin.HandlerFunc {
+func statsHandler(db *sqlitedb.DB, files *storage.Store) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		counts, err := db.GetAllEntryCounts()
 		if err != nil {
 			c.JSON(500, gin.H{"error": "Failed to get stats"})
 			return
 		}
-		c.JSON(200, gin.H{"stats": counts})
+
+		usage, err := files.Usage()
+		if err != nil {
+			c.JSON(500, gin.H{"error": "Failed to get storage usage"})
+			return
+		}
+
+		c.JSON(200, gin.H{"stats": counts, "storage": usage})
 	}
 }
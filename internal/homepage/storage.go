@@ -2,30 +2,40 @@ package homepage
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
+	"mime"
 	"mime/multipart"
+	"net/http"
 	"os"
-	"path/filepath"
-	"sort"
+	"path"
+	"strings"
+	"sync"
 	"text/template"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/robfig/cron/v3"
+	"github.com/rogierlommers/home/internal/auth"
 	"github.com/rogierlommers/home/internal/config"
 	"github.com/rogierlommers/home/internal/mailer"
 	"github.com/rogierlommers/home/internal/sqlitedb"
+	"github.com/rogierlommers/home/internal/storage"
 	"github.com/sirupsen/logrus"
 )
 
+const (
+	// expired files are removed every day at 15:00
+	fileCleanupSchedule = "0 15 * * *"
+
+	// the content of all files is hashed again every sunday night
+	fileVerifySchedule = "0 3 * * 0"
+)
+
 func displayStorage(cfg config.AppConfig) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		if !isAuthenticated(c) {
-			c.Redirect(302, "/login")
-			return
-		}
-
 		// Read the template file from the embedded FS
 		htmlBytes, err := staticFS.ReadFile("static_html/storage.html")
 		if err != nil {
@@ -59,11 +69,36 @@ func displayStorage(cfg config.AppConfig) gin.HandlerFunc {
 	}
 }
 
-func uploadFiles(cfg config.AppConfig, mailer *mailer.Mailer, stats *sqlitedb.DB) gin.HandlerFunc {
+// maxFormOverhead is the room for the fields and part headers of an upload form, on top
+// of the files in it
+const maxFormOverhead = 1 << 20
+
+func uploadFiles(store *storage.Store, cfg config.AppConfig, mailer *mailer.Mailer, stats *sqlitedb.DB) gin.HandlerFunc {
 	return func(c *gin.Context) {
+		// refuse uploads that do not fit before reading them, large forms are buffered on disk
+		if err := store.Check(c.Request.ContentLength); err != nil {
+			uploadFailed(c, err)
+			return
+		}
+
+		// bodies without a length are cut off when the files no longer fit, before the
+		// form is buffered on disk
+		limit, err := store.UploadLimit()
+		if err != nil {
+			uploadFailed(c, err)
+			return
+		}
+		if limit.Bytes >= 0 {
+			c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, limit.Bytes+maxFormOverhead)
+		}
 
 		// Parse the multipart form, with a max memory of 32 MB
 		if err := c.Request.ParseMultipartForm(32 << 20); err != nil {
+			var maxBytesErr *http.MaxBytesError
+			if errors.As(err, &maxBytesErr) {
+				uploadFailed(c, limit.Err)
+				return
+			}
 			c.String(400, "Failed to parse multipart form: %v", err)
 			return
 		}
@@ -72,9 +107,22 @@ func uploadFiles(cfg config.AppConfig, mailer *mailer.Mailer, stats *sqlitedb.DB
 		onlyUpload := c.PostForm("onlyUpload")
 		logrus.Debugf("only upload: %s", onlyUpload)
 
+		upload := uploadedBy(c, cfg)
+		retention, err := storage.ParseRetention(c.PostForm("retention"))
+		if err != nil {
+			c.String(400, "Invalid retention: %v", err)
+			return
+		}
+		upload.Retention = retention
+
+		upload.Folder, err = storage.CleanFolder(c.PostForm("folder"))
+		if err != nil {
+			c.String(400, "Invalid folder: %v", err)
+			return
+		}
+
 		// Retrieve files from form data (multiple files)
 		var uploaded []string
-		var err error
 
 		form := c.Request.MultipartForm
 		files := form.File["files"]
@@ -82,9 +130,11 @@ func uploadFiles(cfg config.AppConfig, mailer *mailer.Mailer, stats *sqlitedb.DB
 		if len(files) == 0 {
 			logrus.Debugf("No files uploaded")
 		} else {
-			uploaded, err = handleUploads(files, cfg)
+			uploaded, err = handleUploads(store, files, upload)
+			checkStorageUsage(store, stats)
+			storage.LogRejected(EventLog(stats), err)
 			if err != nil {
-				c.String(500, "Failed to upload files: %v", err)
+				uploadFailed(c, err)
 				return
 			}
 		}
@@ -97,149 +147,318 @@ func uploadFiles(cfg config.AppConfig, mailer *mailer.Mailer, stats *sqlitedb.DB
 			}
 		}
 
-		// start sending here
-		var subject, message, target, statsSource string
+		notification := uploadNotification{
+			OnlyUpload: onlyUpload == "true",
+			Subject:    c.PostForm("subject"),
+			Message:    c.PostForm("message"),
+			Target:     c.PostForm("targetEmail"),
+		}
+		notifyUploaded(mailer, store, stats, cfg, uploaded, notification)
 
-		if onlyUpload == "true" {
-			statsSource = "upload_only_upload"
-			logrus.Debugf("%d files uploaded without notification email", len(uploaded))
+		c.String(200, "Files uploaded successfully: %v | notify: %s", uploaded, onlyUpload)
+	}
+}
 
-		} else {
-			message = c.PostForm("message")
-			subject = c.PostForm("subject")
-			target = c.PostForm("targetEmail")
+// uploadFailed answers 413 when a file does not fit in the storage, and 415 when the
+// file policy refuses it
+func uploadFailed(c *gin.Context, err error) {
+	if storage.NoSpace(err) {
+		c.String(http.StatusRequestEntityTooLarge, "Upload refused: %v", err)
+		return
+	}
 
-			logrus.Debugf("subject: %s", subject)
-			logrus.Debugf("message: %s", message)
-			logrus.Debugf("target: %s", target)
+	if errors.Is(err, storage.ErrRejected) {
+		c.String(http.StatusUnsupportedMediaType, "Upload refused: %v", err)
+		return
+	}
 
-			// send mail
-			statsSource = fmt.Sprintf("upload_and_notify_%s", target)
+	logrus.Errorf("failed to upload files: %v", err)
+	c.String(500, "Failed to upload files: %v", err)
+}
 
-			// Send email asynchronously
-			go func() {
-				if err := mailer.SendMail(subject, target, message, uploaded); err != nil {
-					logrus.Errorf("Failed to send notification email: %v", err)
-				} else {
-					logrus.Info("Notification email sent")
-				}
-			}()
-		}
+// EventLog returns the events for other packages that record system events
+func EventLog(db *sqlitedb.DB) storage.EventLog {
+	return systemEvents{db: db}
+}
 
-		// increase stats
-		if err := stats.IncrementEntry(statsSource); err != nil {
-			logrus.Errorf("failed to increment upload_no_notify stat: %v", err)
-		}
+// systemEvents stores the events of other packages as events of the system
+type systemEvents struct {
+	db *sqlitedb.DB
+}
 
-		c.String(200, "Files uploaded successfully: %v | notify: %s", uploaded, onlyUpload)
+func (e systemEvents) AddSystemEvent(category, severity, message string, attributes map[string]any) error {
+	return AddEvent(e.db, Message{Source: "system", Category: category, Severity: severity, Message: message, Attributes: attributes})
+}
+
+// uploadNotification holds the form fields that determine what happens after an upload
+type uploadNotification struct {
+	OnlyUpload bool
+	Subject    string
+	Message    string
+	Target     string
+}
+
+// notifyUploaded sends the uploaded files by mail, unless only an upload was requested.
+// Whether the mail was sent is recorded as event.
+func notifyUploaded(m *mailer.Mailer, store *storage.Store, stats *sqlitedb.DB, cfg config.AppConfig, uploaded []string, n uploadNotification) {
+	var statsSource string
+
+	if n.OnlyUpload {
+		statsSource = "upload_only_upload"
+		logrus.Debugf("%d files uploaded without notification email", len(uploaded))
+
+	} else {
+		logrus.Debugf("subject: %s", n.Subject)
+		logrus.Debugf("message: %s", n.Message)
+		logrus.Debugf("target: %s", n.Target)
+
+		// send mail
+		statsSource = fmt.Sprintf("upload_and_notify_%s", n.Target)
+
+		mail := newUploadMail(store, stats, cfg, uploaded, n)
+
+		// Send email asynchronously
+		go func() {
+			recordUploadMail(stats, n, mail, mail.send(m, n))
+		}()
+	}
+
+	// increase stats
+	if err := stats.IncrementEntry(statsSource); err != nil {
+		logrus.Errorf("failed to increment upload_no_notify stat: %v", err)
+	}
+}
+
+// mailAttachments attaches stored files to a mail, they are read while the mail is sent
+func mailAttachments(store *storage.Store, names []string) []mailer.Attachment {
+	attachments := make([]mailer.Attachment, 0, len(names))
+	for _, name := range names {
+		attachments = append(attachments, mailer.Attachment{
+			Name: path.Base(name),
+			Open: func() (io.ReadCloser, error) {
+				content, _, err := store.Open(name)
+				return content, err
+			},
+		})
 	}
+	return attachments
 }
 
-func handleUploads(files []*multipart.FileHeader, cfg config.AppConfig) ([]string, error) {
+func handleUploads(store *storage.Store, files []*multipart.FileHeader, u storage.Upload) ([]string, error) {
 	var uploaded []string
 	for _, header := range files {
 		file, err := header.Open()
 		if err != nil {
 			return nil, fmt.Errorf("failed to open file: %w", err)
 		}
-		defer file.Close()
 
-		dstPath := filepath.Join(cfg.UploadTarget, header.Filename)
-		out, err := os.Create(dstPath)
+		// the name may differ from the uploaded name, existing files are never overwritten
+		stored, err := store.Save(header.Filename, file, u)
+		file.Close()
 		if err != nil {
-			return nil, fmt.Errorf("failed to create file: %v", err)
+			return nil, fmt.Errorf("failed to save file %q: %w", header.Filename, err)
 		}
-		defer out.Close()
 
-		if _, err := io.Copy(out, file); err != nil {
-			return nil, fmt.Errorf("failed to save file: %v", err)
-		}
-
-		logrus.Debugf("uploaded file: %s", dstPath)
-		uploaded = append(uploaded, header.Filename)
+		logrus.Debugf("uploaded file: %s (%s, %s)", stored.Name, stored.ContentType, stored.SHA256)
+		uploaded = append(uploaded, stored.Name)
 	}
 
 	logrus.Debugf("received %d files for upload", len(files))
 	return uploaded, nil
 }
 
-func fileList(cfg config.AppConfig) gin.HandlerFunc {
+// uploadedBy describes who uploads a file: the logged in user or a client using the API key
+func uploadedBy(c *gin.Context, cfg config.AppConfig) storage.Upload {
+	switch auth.FromContext(c).Method {
+	case auth.MethodSession, auth.MethodBasicAuth:
+		if cfg.Username != "" {
+			return storage.Upload{Uploader: cfg.Username, Source: sqlitedb.FileSourceStorage}
+		}
+		return storage.Upload{Uploader: "session", Source: sqlitedb.FileSourceStorage}
+	case auth.MethodAPIKey:
+		return storage.Upload{Uploader: "api", Source: sqlitedb.FileSourceAPI}
+	default:
+		return storage.Upload{Uploader: c.ClientIP(), Source: sqlitedb.FileSourceStorage}
+	}
+}
+
+// fileList returns the subfolders and files of the folder parameter, the upload target
+// when it is empty. The optional q parameter searches the names and content types of
+// the files in all folders, newest first.
+//
+// curl "http://localhost:3000/api/filelist?folder=invoices/2024" -H "X-HOME-API-KEY: supersecretkey"
+func fileList(store *storage.Store) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		entries, err := os.ReadDir(cfg.UploadTarget)
+		folder, err := storage.CleanFolder(c.Query("folder"))
 		if err != nil {
-			c.JSON(500, gin.H{"error": "Failed to list files"})
+			c.JSON(400, gin.H{"error": fmt.Sprintf("Invalid folder: %v", err)})
 			return
 		}
 
-		type fileInfo struct {
-			Name    string    `json:"name"`
-			Size    int64     `json:"size"`
-			ModTime time.Time `json:"modTime"`
-		}
-		var files []fileInfo
+		var (
+			folders []storage.Folder
+			files   []sqlitedb.File
+		)
 
-		for _, entry := range entries {
-			if !entry.IsDir() {
-				info, err := entry.Info()
-				if err != nil {
-					continue
-				}
+		if q := c.Query("q"); q != "" {
+			folders = []storage.Folder{}
+			files, err = store.List(q)
+		} else {
+			folders, files, err = store.ListFolder(folder)
+		}
 
-				files = append(files, fileInfo{
-					Name:    entry.Name(),
-					Size:    info.Size(),
-					ModTime: info.ModTime(),
-				})
-			}
+		if errors.Is(err, storage.ErrNotFound) {
+			c.JSON(404, gin.H{"error": "Folder not found"})
+			return
+		}
+		if err != nil {
+			c.JSON(500, gin.H{"error": "Failed to list files"})
+			return
 		}
 
-		// Sort files by ModTime (descending: newest first)
-		sort.Slice(files, func(i, j int) bool {
-			return files[i].ModTime.After(files[j].ModTime)
-		})
+		response := []fileResponse{}
+		for _, f := range files {
+			response = append(response, newFileResponse(f))
+		}
 
-		c.JSON(200, gin.H{"files": files})
+		c.JSON(200, gin.H{"folder": folder, "breadcrumbs": breadcrumbs(folder), "folders": folders, "files": response})
 	}
 }
 
-func downloadFile(cfg config.AppConfig) gin.HandlerFunc {
+// expiringFiles returns the files that will be deleted at the next cleanup run
+func expiringFiles(db *sqlitedb.DB) gin.HandlerFunc {
 	return func(c *gin.Context) {
+		next := nextFileCleanup(time.Now())
 
-		filename := filepath.Base(c.Param("filename")) // sanitize input
-		logrus.Debugf("requested download of file: %s", filename)
-		if filename == "" {
-			c.String(400, "Filename query parameter is required")
+		files, err := db.GetExpiredFiles(next)
+		if err != nil {
+			c.JSON(500, gin.H{"error": "Failed to list expiring files"})
 			return
 		}
 
-		filePath := filepath.Join(cfg.UploadTarget, filename)
-		if _, err := os.Stat(filePath); os.IsNotExist(err) {
+		c.JSON(200, gin.H{"next_cleanup": next, "files": files})
+	}
+}
+
+// pinFile pins or unpins a file, pinned files are not deleted when they expire
+//
+// curl -X POST "http://localhost:3000/api/files/report.pdf/pin" -H "X-HOME-API-KEY: supersecretkey"
+// curl -X DELETE "http://localhost:3000/api/files/report.pdf/pin" -H "X-HOME-API-KEY: supersecretkey"
+func pinFile(db *sqlitedb.DB, pinned bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		filename := c.Param("filename")
+		found, err := db.SetFilePinned(filename, pinned)
+		if err != nil {
+			c.String(500, "Failed to pin file")
+			return
+		}
+
+		if !found {
 			c.String(404, "File not found")
-			logrus.Errorf("file not found: %s", filePath)
 			return
 		}
 
-		c.FileAttachment(filePath, filename)
+		c.JSON(200, gin.H{"status": "ok", "name": filename, "pinned": pinned})
 	}
 }
 
-func scheduleCleanup(cfg config.AppConfig, db *sqlitedb.DB) {
+// downloadFile serves a stored file. Range requests let players seek in audio and video,
+// and the hash of the content is the ETag, so a file that did not change is not sent
+// again. With inline=1 the browser shows the file instead of saving it.
+//
+// curl -OJ "http://localhost:3000/api/download/holiday.mp4" -H "X-HOME-API-KEY: supersecretkey"
+// curl -OJ "http://localhost:3000/api/download/invoices/2024/march.pdf" -H "X-HOME-API-KEY: supersecretkey"
+// curl -o part.mp4 "http://localhost:3000/api/download/holiday.mp4?inline=1" -H "Range: bytes=0-1023" -H "X-HOME-API-KEY: supersecretkey"
+func downloadFile(store *storage.Store) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// files in folders are downloaded by their path
+		filename := strings.TrimPrefix(c.Param("path"), "/")
+		logrus.Debugf("requested download of file: %s", filename)
+
+		content, file, err := store.Open(filename)
+		if err != nil {
+			openFailed(c, filename, err)
+			return
+		}
+		defer content.Close()
+
+		// types that could run scripts in the page are always downloaded
+		disposition := "attachment"
+		if c.Query("inline") == "1" && inlineTypes[storage.MediaType(file.ContentType)] {
+			disposition = "inline"
+		}
+
+		c.Header("ETag", `"`+file.SHA256+`"`)
+		c.Header("Content-Type", file.ContentType)
+		c.Header("X-Content-Type-Options", "nosniff")
+		c.Header("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": path.Base(file.Name)}))
+		http.ServeContent(c.Writer, c.Request, file.Name, file.Uploaded, content)
+	}
+}
+
+// openFailed answers with the status that matches the error of opening a stored file
+func openFailed(c *gin.Context, name string, err error) {
+	switch {
+	case errors.Is(err, storage.ErrNotFound):
+		c.String(404, "File not found")
+	case errors.Is(err, storage.ErrInvalidName), errors.Is(err, storage.ErrTraversal):
+		c.String(400, "Invalid filename: %v", err)
+	default:
+		logrus.Errorf("failed to open %s: %v", name, err)
+		c.String(500, "Failed to read file")
+	}
+}
+
+// scheduleCleanup runs the maintenance jobs until ctx is done, jobs that are running
+// then are waited for
+func scheduleCleanup(ctx context.Context, wg *sync.WaitGroup, cfg config.AppConfig, db *sqlitedb.DB, files *storage.Store, uploads *tusStore) {
 	c := cron.New()
 
+	// pick up files that were added or removed outside of the app. The first run moves
+	// plain files into blobs, so it is done before the files are served.
+	reconcileFiles(files, db)
+	go checkStorageUsage(files, db)
+	_, err := c.AddFunc("@hourly", func() {
+		reconcileFiles(files, db)
+		checkStorageUsage(files, db)
+	})
+	if err != nil {
+		logrus.Errorf("failed to schedule reconcile: %v", err)
+		return
+	}
+
 	// schedule to run every day at 15:00
-	_, err := c.AddFunc("0 15 * * *", func() {
-		// cleanup files older than cfg.CleanUpInDys days
-		cleanupOldFiles(cfg.UploadTarget, time.Duration(cfg.FileCleanUpInDys)*24*time.Hour, db)
+	_, err = c.AddFunc(fileCleanupSchedule, func() {
+		// cleanup files of which the retention period has passed
+		cleanupOldFiles(files, db, time.Now())
+
+		// remove resumable uploads that were abandoned
+		if removed := uploads.cleanupExpired(time.Now()); removed > 0 {
+			logrus.Infof("removed %d expired incomplete uploads", removed)
+		}
 	})
 	if err != nil {
 		logrus.Errorf("failed to schedule cleanup: %v", err)
 		return
 	}
 
+	// find content that was damaged on disk
+	_, err = c.AddFunc(fileVerifySchedule, func() {
+		if _, err := verifyFiles(files, db); err != nil {
+			logrus.Errorf("failed to verify files: %v", err)
+		}
+	})
+	if err != nil {
+		logrus.Errorf("failed to schedule verify: %v", err)
+		return
+	}
+
 	// schedule to run every day at 16:00
 	_, err = c.AddFunc("0 16 * * *", func() {
-		// cleanup old events
-		deleted, err := db.DeleteOldEvents()
+		pruneWebhookDeliveries(db, time.Now())
+
+		// archive and cleanup old events
+		archive, deleted, err := cleanupOldEvents(db, cfg.EventsArchiveDir, time.Now())
 		if err != nil {
 			logrus.Errorf("failed to cleanup old events: %v", err)
 			return
@@ -251,7 +470,11 @@ func scheduleCleanup(cfg config.AppConfig, db *sqlitedb.DB) {
 			Message:  fmt.Sprintf("daily cleanup deleted %d events ", deleted),
 		}
 
-		if err := addEvent(db, event); err != nil {
+		if archive != "" {
+			event.Message += fmt.Sprintf("(archived to %s)", archive)
+		}
+
+		if err := AddEvent(db, event); err != nil {
 			logrus.Errorf("failed to log cleanup event: %v", err)
 		}
 	})
@@ -260,47 +483,157 @@ func scheduleCleanup(cfg config.AppConfig, db *sqlitedb.DB) {
 		return
 	}
 
-	logrus.Infof("scheduled %d-daily cleanup of old stuff", cfg.FileCleanUpInDys)
+	// files expire on their own retention, the configured days only apply to new files
+	logrus.Infof("scheduled cleanup of expired and unpinned files at %q, new files are kept for %d days by default", fileCleanupSchedule, cfg.FileCleanUpInDys)
 	c.Start()
+
+	wg.Go(func() {
+		<-ctx.Done()
+		<-c.Stop().Done()
+	})
 }
 
-func cleanupOldFiles(dir string, maxAge time.Duration, db *sqlitedb.DB) {
-	now := time.Now()
+// nextFileCleanup returns when the cleanup of expired files runs next
+func nextFileCleanup(now time.Time) time.Time {
+	schedule, err := cron.ParseStandard(fileCleanupSchedule)
+	if err != nil {
+		logrus.Errorf("invalid cleanup schedule: %v", err)
+		return now
+	}
+	return schedule.Next(now)
+}
 
-	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return nil // skip error, continue
+// cleanupOldFiles removes the files that expired according to the index, pinned files are kept
+func cleanupOldFiles(files *storage.Store, db *sqlitedb.DB, now time.Time) {
+	// the index has to be up to date, files removed by hand are no errors
+	reconcileFiles(files, db)
+
+	expired, err := db.GetExpiredFiles(now)
+	if err != nil {
+		logrus.Errorf("error during cleanup: %v", err)
+		return
+	}
+
+	for _, file := range expired {
+		if err := files.Remove(file.Name); err != nil {
+			logrus.Errorf("failed to remove file %s: %v", file.Name, err)
+			db.IncrementEntry("cleanup_errors")
+			continue
 		}
 
-		if info.IsDir() {
-			return nil
+		logrus.Infof("removed old file: %s", file.Name)
+		msg := Message{
+			Source:   "system",
+			Category: "cleanup",
+			Message:  fmt.Sprintf("removed old file: %s", file.Name),
 		}
 
-		if now.Sub(info.ModTime()) > maxAge {
-			if removeErr := os.Remove(path); removeErr != nil {
-				logrus.Errorf("failed to remove file %s: %v", path, removeErr)
-				db.IncrementEntry("cleanup_errors")
-			} else {
-				logrus.Infof("removed old file: %s", path)
-				msg := Message{
-					Source:   "system",
-					Category: "cleanup",
-					Message:  fmt.Sprintf("removed old file: %s", filepath.Base(path)),
-				}
+		if err := AddEvent(db, msg); err != nil {
+			logrus.Errorf("failed to log cleanup event: %v", err)
+		}
 
-				if err := addEvent(db, msg); err != nil {
-					logrus.Errorf("failed to log cleanup event: %v", err)
-				}
+		db.IncrementEntry("cleanup_files_removed")
+	}
+}
 
-				db.IncrementEntry("cleanup_files_removed")
-			}
-		} else {
-			logrus.Debugf("file %s is not old enough to delete", path)
+// reconcileFiles updates the file index and logs an event when it did not match the disk
+func reconcileFiles(files *storage.Store, db *sqlitedb.DB) {
+	result, err := files.Reconcile()
+	if err != nil {
+		logrus.Errorf("failed to reconcile files: %v", err)
+		return
+	}
+
+	if removed, err := files.PruneThumbnails(); err != nil {
+		logrus.Errorf("failed to prune thumbnails: %v", err)
+	} else if removed > 0 {
+		logrus.Infof("removed %d thumbnails of deleted files", removed)
+	}
+
+	if removed, err := files.PruneBlobs(); err != nil {
+		logrus.Errorf("failed to prune blobs: %v", err)
+	} else if removed > 0 {
+		logrus.Infof("removed %d unused blobs", removed)
+	}
+
+	var changes []string
+	for _, c := range []struct {
+		what  string
+		names []string
+	}{
+		{"added, found on disk", result.Added},
+		{"changed, found on disk", result.Changed},
+		{"removed, content is gone", result.Removed},
+		{"moved into deduplicated storage", result.Migrated},
+	} {
+		if len(c.names) > 0 {
+			changes = append(changes, fmt.Sprintf("%s: %s", c.what, strings.Join(c.names, ", ")))
 		}
-		return nil
-	})
+	}
+
+	if len(changes) == 0 {
+		return
+	}
+
+	msg := Message{
+		Source:   "system",
+		Category: "storage",
+		Message:  "file index updated, " + strings.Join(changes, "; "),
+	}
+
+	if err := AddEvent(db, msg); err != nil {
+		logrus.Errorf("failed to log reconcile event: %v", err)
+	}
+}
 
+// verifyFiles hashes the content of all files again and logs a warning event when
+// content was damaged or is gone
+func verifyFiles(files *storage.Store, db *sqlitedb.DB) (storage.VerifyResult, error) {
+	result, err := files.Verify()
 	if err != nil {
-		logrus.Errorf("error during cleanup: %v", err)
+		return result, err
+	}
+
+	logrus.Infof("verified %d blobs, %d files corrupt, %d missing", result.Checked, len(result.Corrupt), len(result.Missing))
+
+	var problems []string
+	if len(result.Corrupt) > 0 {
+		problems = append(problems, "corrupt: "+strings.Join(result.Corrupt, ", "))
+	}
+	if len(result.Missing) > 0 {
+		problems = append(problems, "missing: "+strings.Join(result.Missing, ", "))
+	}
+
+	if len(problems) == 0 {
+		return result, nil
+	}
+
+	msg := Message{
+		Source:   "system",
+		Category: "storage",
+		Severity: severityWarning,
+		Message:  "file verification failed, " + strings.Join(problems, "; "),
+	}
+
+	if err := AddEvent(db, msg); err != nil {
+		logrus.Errorf("failed to log verify event: %v", err)
+	}
+
+	return result, nil
+}
+
+// verifyFilesHandler verifies the stored files on request, it takes a while for a large store
+//
+// curl -X POST "http://localhost:3000/api/files/verify" -H "X-HOME-API-KEY: supersecretkey"
+func verifyFilesHandler(files *storage.Store, db *sqlitedb.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		result, err := verifyFiles(files, db)
+		if err != nil {
+			logrus.Errorf("failed to verify files: %v", err)
+			c.String(500, "Failed to verify files")
+			return
+		}
+
+		c.JSON(200, result)
 	}
 }
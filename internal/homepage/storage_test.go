@@ -0,0 +1,224 @@
+package homepage
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rogierlommers/home/internal/config"
+	"github.com/rogierlommers/home/internal/sqlitedb"
+	"github.com/rogierlommers/home/internal/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileList(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	db := newTestDB(t)
+	files := storage.New(config.AppConfig{UploadTarget: t.TempDir(), FileCleanUpInDys: 7}, db)
+
+	for _, name := range []string{"holiday.txt", "invoice.txt"} {
+		_, err := files.Save(name, strings.NewReader(name), storage.Upload{Source: sqlitedb.FileSourceStorage})
+		require.NoError(t, err)
+	}
+
+	router := gin.New()
+	router.GET("/api/filelist", fileList(files))
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/api/filelist?q=invoice", nil))
+	require.Equal(t, 200, w.Code)
+
+	var response struct {
+		Files []sqlitedb.File `json:"files"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	require.Len(t, response.Files, 1)
+	assert.Equal(t, "invoice.txt", response.Files[0].Name)
+	assert.Equal(t, sqlitedb.FileSourceStorage, response.Files[0].Source)
+}
+
+func TestCleanupOldFiles(t *testing.T) {
+	db := newTestDB(t)
+	files := storage.New(config.AppConfig{UploadTarget: t.TempDir(), FileCleanUpInDys: 7}, db)
+
+	_, err := files.Save("old.txt", strings.NewReader("old"), storage.Upload{})
+	require.NoError(t, err)
+
+	// a file copied into the directory by hand expires based on its modification time
+	copied := filepath.Join(files.Dir(), "copied.txt")
+	require.NoError(t, os.WriteFile(copied, []byte("copied"), 0o644))
+	longAgo := time.Now().Add(-30 * 24 * time.Hour)
+	require.NoError(t, os.Chtimes(copied, longAgo, longAgo))
+
+	cleanupOldFiles(files, db, time.Now())
+
+	_, err = os.Stat(copied)
+	assert.True(t, os.IsNotExist(err))
+	_, _, err = files.Open("copied.txt")
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+	content, _, err := files.Open("old.txt")
+	require.NoError(t, err)
+	content.Close()
+
+	cleanupOldFiles(files, db, time.Now().Add(8*24*time.Hour))
+
+	_, _, err = files.Open("old.txt")
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+
+	remaining, err := files.List("")
+	require.NoError(t, err)
+	assert.Empty(t, remaining)
+
+	// the file copied by hand was reported by the reconcile
+	assert.Len(t, getEvents(db, 10, eventFilter{Category: "storage"}), 1)
+}
+
+func TestPinnedFilesAreKept(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	db := newTestDB(t)
+	files := storage.New(config.AppConfig{UploadTarget: t.TempDir(), FileCleanUpInDys: 7}, db)
+
+	for _, name := range []string{"pinned.txt", "expired.txt"} {
+		_, err := files.Save(name, strings.NewReader(name), storage.Upload{Retention: time.Hour})
+		require.NoError(t, err)
+	}
+	_, err := files.Save("forever.txt", strings.NewReader("forever"), storage.Upload{Retention: storage.Forever})
+	require.NoError(t, err)
+
+	router := gin.New()
+	router.POST("/api/files/:filename/pin", pinFile(db, true))
+
+	pin := func(name string) int {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", "/api/files/"+name+"/pin", nil)
+		req.Header.Set("X-HOME-API-KEY", "supersecretkey")
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+	assert.Equal(t, 200, pin("pinned.txt"))
+	assert.Equal(t, 404, pin("missing.txt"))
+
+	expiring, err := db.GetExpiredFiles(time.Now().Add(2 * time.Hour))
+	require.NoError(t, err)
+	require.Len(t, expiring, 1)
+	assert.Equal(t, "expired.txt", expiring[0].Name)
+
+	cleanupOldFiles(files, db, time.Now().Add(365*24*time.Hour))
+
+	remaining, err := files.List("")
+	require.NoError(t, err)
+	var names []string
+	for _, f := range remaining {
+		names = append(names, f.Name)
+	}
+	assert.ElementsMatch(t, []string{"pinned.txt", "forever.txt"}, names)
+}
+
+func TestNextFileCleanup(t *testing.T) {
+	morning := time.Date(2025, 6, 1, 9, 0, 0, 0, time.Local)
+	assert.Equal(t, time.Date(2025, 6, 1, 15, 0, 0, 0, time.Local), nextFileCleanup(morning))
+
+	evening := time.Date(2025, 6, 1, 18, 0, 0, 0, time.Local)
+	assert.Equal(t, time.Date(2025, 6, 2, 15, 0, 0, 0, time.Local), nextFileCleanup(evening))
+}
+
+func TestDownloadFile(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	db := newTestDB(t)
+	files := storage.New(config.AppConfig{UploadTarget: t.TempDir(), FileCleanUpInDys: 7}, db)
+
+	file, err := files.Save("song.txt", strings.NewReader("0123456789"), storage.Upload{})
+	require.NoError(t, err)
+
+	router := gin.New()
+	router.GET("/api/download/*path", downloadFile(files))
+
+	get := func(url string, headers map[string]string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", url, nil)
+		for key, value := range headers {
+			req.Header.Set(key, value)
+		}
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	w := get("/api/download/song.txt", nil)
+	require.Equal(t, 200, w.Code)
+	assert.Equal(t, "0123456789", w.Body.String())
+	assert.Equal(t, `"`+file.SHA256+`"`, w.Header().Get("ETag"))
+	assert.Equal(t, "bytes", w.Header().Get("Accept-Ranges"))
+	assert.Equal(t, `attachment; filename=song.txt`, w.Header().Get("Content-Disposition"))
+
+	w = get("/api/download/song.txt", map[string]string{"Range": "bytes=2-5"})
+	require.Equal(t, 206, w.Code)
+	assert.Equal(t, "2345", w.Body.String())
+	assert.Equal(t, "bytes 2-5/10", w.Header().Get("Content-Range"))
+
+	w = get("/api/download/song.txt", map[string]string{"If-None-Match": `"` + file.SHA256 + `"`})
+	assert.Equal(t, 304, w.Code)
+	assert.Empty(t, w.Body.String())
+
+	// text could be html, it is only shown inline for types that cannot run scripts
+	w = get("/api/download/song.txt?inline=1", nil)
+	assert.Equal(t, `attachment; filename=song.txt`, w.Header().Get("Content-Disposition"))
+
+	assert.Equal(t, 404, get("/api/download/missing.txt", nil).Code)
+
+	// files in folders are downloaded by their path, under their own name
+	_, err = files.Save("march.pdf", strings.NewReader("march"), storage.Upload{Folder: "invoices/2024"})
+	require.NoError(t, err)
+
+	w = get("/api/download/invoices/2024/march.pdf", nil)
+	require.Equal(t, 200, w.Code)
+	assert.Equal(t, "march", w.Body.String())
+	assert.Equal(t, `attachment; filename=march.pdf`, w.Header().Get("Content-Disposition"))
+
+	assert.Equal(t, 400, get("/api/download/invoices/../../secret", nil).Code)
+}
+
+func TestVerifyFiles(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	db := newTestDB(t)
+	files := storage.New(config.AppConfig{UploadTarget: t.TempDir(), FileCleanUpInDys: 7}, db)
+
+	_, err := files.Save("fine.txt", strings.NewReader("fine"), storage.Upload{})
+	require.NoError(t, err)
+	damaged, err := files.Save("damaged.txt", strings.NewReader("damaged"), storage.Upload{})
+	require.NoError(t, err)
+
+	router := gin.New()
+	router.POST("/api/files/verify", verifyFilesHandler(files, db))
+
+	verify := func() storage.VerifyResult {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("POST", "/api/files/verify", nil))
+		require.Equal(t, 200, w.Code)
+
+		var result storage.VerifyResult
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &result))
+		return result
+	}
+
+	result := verify()
+	assert.Equal(t, 2, result.Checked)
+	assert.Empty(t, result.Corrupt)
+	assert.Empty(t, getEvents(db, 10, eventFilter{Category: "storage"}))
+
+	blob := filepath.Join(files.Dir(), ".blobs", damaged.SHA256[:2], damaged.SHA256)
+	require.NoError(t, os.WriteFile(blob, []byte("bit rot"), 0o644))
+
+	result = verify()
+	assert.Equal(t, []string{"damaged.txt"}, result.Corrupt)
+
+	events := getEvents(db, 10, eventFilter{Category: "storage"})
+	require.Len(t, events, 1)
+	assert.Equal(t, severityWarning, events[0].Severity)
+	assert.Contains(t, events[0].Message, "damaged.txt")
+}
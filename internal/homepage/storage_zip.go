@@ -0,0 +1,120 @@
+package homepage
+
+import (
+	"archive/zip"
+	"fmt"
+	"io"
+	"mime"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rogierlommers/home/internal/sqlitedb"
+	"github.com/rogierlommers/home/internal/storage"
+	"github.com/sirupsen/logrus"
+)
+
+// Several files can be downloaded at once as a zip archive. The archive is made while
+// it is sent, so it never has to fit in memory or on disk.
+//
+// curl -o files.zip "http://localhost:3000/api/files/archive?name=report.pdf&name=holiday.jpg" -H "X-HOME-API-KEY: supersecretkey"
+
+// maximum number of files in one archive
+const maxArchiveFiles = 1000
+
+// content that is compressed already is stored as is, deflating it again only costs time
+var compressedTypes = map[string]bool{
+	"application/zip":              true,
+	"application/gzip":             true,
+	"application/x-7z-compressed":  true,
+	"application/x-rar-compressed": true,
+	"application/pdf":              true,
+}
+
+// downloadArchive streams a zip of the files selected with the name parameter
+func downloadArchive(store *storage.Store, db *sqlitedb.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		names := c.QueryArray("name")
+		if len(names) == 0 {
+			c.String(400, "No files selected")
+			return
+		}
+		if len(names) > maxArchiveFiles {
+			c.String(400, "Too many files, at most %d can be downloaded at once", maxArchiveFiles)
+			return
+		}
+
+		// all files are checked before the first byte is sent, errors cannot be reported later
+		var files []sqlitedb.File
+		seen := map[string]bool{}
+		for _, name := range names {
+			if seen[name] {
+				continue
+			}
+			seen[name] = true
+
+			file, err := db.GetFile(name)
+			if err != nil {
+				c.String(500, "Failed to find file")
+				return
+			}
+			if file == nil {
+				c.String(404, "File not found: %s", name)
+				return
+			}
+			files = append(files, *file)
+		}
+
+		archiveName := fmt.Sprintf("files-%s.zip", time.Now().Format("20060102-150405"))
+		c.Header("Content-Type", "application/zip")
+		c.Header("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": archiveName}))
+		c.Status(200)
+
+		zw := zip.NewWriter(c.Writer)
+		for _, file := range files {
+			if err := addToArchive(zw, store, file); err != nil {
+				// the response has started, all that can be done is ending it early
+				logrus.Errorf("failed to add %s to archive: %v", file.Name, err)
+				return
+			}
+		}
+
+		if err := zw.Close(); err != nil {
+			logrus.Errorf("failed to finish archive: %v", err)
+		}
+	}
+}
+
+func addToArchive(zw *zip.Writer, store *storage.Store, file sqlitedb.File) error {
+	f, _, err := store.Open(file.Name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	header := &zip.FileHeader{
+		Name:     file.Name,
+		Modified: file.Uploaded,
+		Method:   zip.Deflate,
+	}
+	header.SetMode(0o644)
+	if isCompressed(file.ContentType) {
+		header.Method = zip.Store
+	}
+
+	w, err := zw.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(w, f)
+	return err
+}
+
+func isCompressed(contentType string) bool {
+	mediaType := storage.MediaType(contentType)
+	return compressedTypes[mediaType] ||
+		(strings.HasPrefix(mediaType, "image/") && mediaType != "image/svg+xml") ||
+		strings.HasPrefix(mediaType, "audio/") ||
+		strings.HasPrefix(mediaType, "video/")
+}
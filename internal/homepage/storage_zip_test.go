@@ -0,0 +1,59 @@
+package homepage
+
+import (
+	"archive/zip"
+	"bytes"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rogierlommers/home/internal/config"
+	"github.com/rogierlommers/home/internal/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDownloadArchive(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	db := newTestDB(t)
+	files := storage.New(config.AppConfig{UploadTarget: t.TempDir(), FileCleanUpInDys: 7}, db)
+
+	for _, name := range []string{"a.txt", "b.txt"} {
+		_, err := files.Save(name, strings.NewReader("content of "+name), storage.Upload{})
+		require.NoError(t, err)
+	}
+
+	router := gin.New()
+	router.GET("/api/files/archive", downloadArchive(files, db))
+
+	get := func(url string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", url, nil))
+		return w
+	}
+
+	w := get("/api/files/archive?name=a.txt&name=b.txt&name=a.txt")
+	require.Equal(t, 200, w.Code)
+	assert.Equal(t, "application/zip", w.Header().Get("Content-Type"))
+	assert.Contains(t, w.Header().Get("Content-Disposition"), "attachment")
+
+	archive, err := zip.NewReader(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len()))
+	require.NoError(t, err)
+	require.Len(t, archive.File, 2)
+
+	for i, name := range []string{"a.txt", "b.txt"} {
+		assert.Equal(t, name, archive.File[i].Name)
+
+		rc, err := archive.File[i].Open()
+		require.NoError(t, err)
+		content, err := io.ReadAll(rc)
+		rc.Close()
+		require.NoError(t, err)
+		assert.Equal(t, "content of "+name, string(content))
+	}
+
+	assert.Equal(t, 400, get("/api/files/archive").Code)
+	assert.Equal(t, 404, get("/api/files/archive?name=a.txt&name=missing.txt").Code)
+}
@@ -0,0 +1,676 @@
+package homepage
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rogierlommers/home/internal/config"
+	"github.com/rogierlommers/home/internal/mailer"
+	"github.com/rogierlommers/home/internal/sqlitedb"
+	"github.com/rogierlommers/home/internal/storage"
+	"github.com/sirupsen/logrus"
+)
+
+// Resumable uploads, implementing the core of the tus 1.0 protocol (https://tus.io/protocols/resumable-upload)
+// with the creation, termination, checksum and expiration extensions.
+//
+// The metadata of an upload (Upload-Metadata header, base64 encoded values) may contain:
+//   - filename: name of the file, required
+//   - folder: folder to store the file in, "/" between folders
+//   - checksum: "sha256 <hex or base64>" of the complete file, verified on completion
+//   - onlyUpload, subject, message, targetEmail, retention: same as the form fields of /api/upload
+//
+// curl -i -X POST "http://localhost:3000/api/tus" -H "X-HOME-API-KEY: supersecretkey" -H "Tus-Resumable: 1.0.0" -H "Upload-Length: 11" -H "Upload-Metadata: filename aGVsbG8udHh0,onlyUpload dHJ1ZQ=="
+// curl -i -X PATCH "http://localhost:3000/api/tus/<id>" -H "X-HOME-API-KEY: supersecretkey" -H "Tus-Resumable: 1.0.0" -H "Upload-Offset: 0" -H "Content-Type: application/offset+octet-stream" --data-binary "hello world"
+
+const (
+	tusVersion            = "1.0.0"
+	tusExtensions         = "creation,termination,checksum,expiration"
+	tusChecksumAlgorithms = "sha1,sha256"
+	tusMaxSize            = 50 << 30 // 50 GB
+	tusContentType        = "application/offset+octet-stream"
+
+	// incomplete uploads are kept in this directory under the upload target
+	tusDir = ".tus"
+
+	// incomplete uploads without progress for this long are removed
+	tusExpiry = 24 * time.Hour
+
+	statusChecksumMismatch = 460
+)
+
+var (
+	tusID = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+	errChecksumMismatch = errors.New("checksum mismatch")
+)
+
+// tusUpload is the state of a resumable upload. It is stored as JSON next to the
+// data of the upload, the offset is the size of the data file.
+type tusUpload struct {
+	ID       string            `json:"id"`
+	Size     int64             `json:"size"`
+	Metadata map[string]string `json:"metadata"`
+	Created  time.Time         `json:"created"`
+}
+
+// tusStore keeps incomplete uploads and makes sure an upload is not patched
+// by two requests at the same time
+type tusStore struct {
+	dir   string
+	files *storage.Store
+
+	mu     sync.Mutex
+	locked map[string]bool
+}
+
+func newTusStore(files *storage.Store) *tusStore {
+	return &tusStore{
+		dir:    filepath.Join(files.Dir(), tusDir),
+		files:  files,
+		locked: map[string]bool{},
+	}
+}
+
+func (s *tusStore) lock(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.locked[id] {
+		return false
+	}
+	s.locked[id] = true
+	return true
+}
+
+func (s *tusStore) unlock(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.locked, id)
+}
+
+func (s *tusStore) infoPath(id string) string {
+	return filepath.Join(s.dir, id+".info")
+}
+
+func (s *tusStore) dataPath(id string) string {
+	return filepath.Join(s.dir, id+".bin")
+}
+
+func (s *tusStore) create(size int64, metadata map[string]string) (tusUpload, error) {
+	if err := os.MkdirAll(s.dir, 0o750); err != nil {
+		return tusUpload{}, fmt.Errorf("failed to create upload directory: %v", err)
+	}
+
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return tusUpload{}, err
+	}
+
+	upload := tusUpload{
+		ID:       hex.EncodeToString(b),
+		Size:     size,
+		Metadata: metadata,
+		Created:  time.Now().UTC(),
+	}
+
+	info, err := json.Marshal(upload)
+	if err != nil {
+		return tusUpload{}, err
+	}
+
+	if err := os.WriteFile(s.infoPath(upload.ID), info, 0o640); err != nil {
+		return tusUpload{}, fmt.Errorf("failed to store upload info: %v", err)
+	}
+
+	data, err := os.OpenFile(s.dataPath(upload.ID), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o640)
+	if err != nil {
+		return tusUpload{}, fmt.Errorf("failed to create upload: %v", err)
+	}
+
+	return upload, data.Close()
+}
+
+// get returns the upload and its current offset, os.ErrNotExist when there is no such upload
+func (s *tusStore) get(id string) (tusUpload, int64, error) {
+	var upload tusUpload
+
+	// the id ends up in a path, so only accept ids we generated ourselves
+	if !tusID.MatchString(id) {
+		return upload, 0, os.ErrNotExist
+	}
+
+	info, err := os.ReadFile(s.infoPath(id))
+	if err != nil {
+		return upload, 0, err
+	}
+
+	if err := json.Unmarshal(info, &upload); err != nil {
+		return upload, 0, fmt.Errorf("invalid upload info: %v", err)
+	}
+
+	stat, err := os.Stat(s.dataPath(id))
+	if err != nil {
+		return upload, 0, err
+	}
+
+	return upload, stat.Size(), nil
+}
+
+func (s *tusStore) remove(id string) error {
+	if err := os.Remove(s.dataPath(id)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	if err := os.Remove(s.infoPath(id)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+// expires returns when the upload is removed if no more data arrives
+func (s *tusStore) expires(id string) time.Time {
+	stat, err := os.Stat(s.dataPath(id))
+	if err != nil {
+		// info without data is left behind by an interrupted completion
+		if stat, err = os.Stat(s.infoPath(id)); err != nil {
+			return time.Now()
+		}
+	}
+	return stat.ModTime().Add(tusExpiry)
+}
+
+// finish verifies the checksum of a complete upload and moves it into the upload target
+func (s *tusStore) finish(upload tusUpload, u storage.Upload) (string, error) {
+	if checksum := upload.Metadata["checksum"]; checksum != "" {
+		h, expected, err := parseChecksum(checksum)
+		if err != nil {
+			return "", err
+		}
+
+		data, err := os.Open(s.dataPath(upload.ID))
+		if err != nil {
+			return "", err
+		}
+		defer data.Close()
+
+		if _, err := io.Copy(h, data); err != nil {
+			return "", fmt.Errorf("failed to calculate checksum: %v", err)
+		}
+
+		if !bytes.Equal(h.Sum(nil), expected) {
+			return "", errChecksumMismatch
+		}
+	}
+
+	file, err := s.files.Move(s.dataPath(upload.ID), upload.Metadata["filename"], u)
+	if err != nil {
+		return "", fmt.Errorf("failed to move upload: %v", err)
+	}
+
+	if err := os.Remove(s.infoPath(upload.ID)); err != nil {
+		logrus.Errorf("failed to remove info of upload %s: %v", upload.ID, err)
+	}
+
+	return file.Name, nil
+}
+
+// room returns how many bytes incomplete uploads may still append together. The data
+// they hold counts towards the quota, so concurrent uploads cannot all fill it.
+func (s *tusStore) room() (storage.Limit, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil && !os.IsNotExist(err) {
+		return storage.Limit{}, err
+	}
+
+	var pending int64
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), ".bin") {
+			continue
+		}
+		if info, err := entry.Info(); err == nil {
+			pending += info.Size()
+		}
+	}
+
+	return s.files.PendingLimit(pending)
+}
+
+// cleanupExpired removes incomplete uploads that have not made progress for a while
+func (s *tusStore) cleanupExpired(now time.Time) int {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logrus.Errorf("failed to list incomplete uploads: %v", err)
+		}
+		return 0
+	}
+
+	removed := 0
+	for _, entry := range entries {
+		id, found := strings.CutSuffix(entry.Name(), ".info")
+		if !found || !tusID.MatchString(id) {
+			continue
+		}
+
+		if now.Before(s.expires(id)) || !s.lock(id) {
+			continue
+		}
+
+		if err := s.remove(id); err != nil {
+			logrus.Errorf("failed to remove expired upload %s: %v", id, err)
+		} else {
+			removed++
+		}
+		s.unlock(id)
+	}
+
+	return removed
+}
+
+// tusPreflight checks the protocol version, shared by all tus handlers
+func tusPreflight(c *gin.Context) bool {
+	c.Header("Tus-Resumable", tusVersion)
+
+	if c.GetHeader("Tus-Resumable") != tusVersion {
+		c.Header("Tus-Version", tusVersion)
+		c.String(http.StatusPreconditionFailed, "Unsupported tus version")
+		return false
+	}
+
+	return true
+}
+
+func tusOptions() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Header("Tus-Resumable", tusVersion)
+		c.Header("Tus-Version", tusVersion)
+		c.Header("Tus-Extension", tusExtensions)
+		c.Header("Tus-Max-Size", strconv.FormatInt(tusMaxSize, 10))
+		c.Header("Tus-Checksum-Algorithm", tusChecksumAlgorithms)
+		c.Status(http.StatusNoContent)
+	}
+}
+
+func tusCreate(store *tusStore, cfg config.AppConfig, mailer *mailer.Mailer, db *sqlitedb.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !tusPreflight(c) {
+			return
+		}
+
+		size, err := strconv.ParseInt(c.GetHeader("Upload-Length"), 10, 64)
+		if err != nil || size < 0 {
+			c.String(http.StatusBadRequest, "Invalid Upload-Length")
+			return
+		}
+
+		if size > tusMaxSize {
+			c.String(http.StatusRequestEntityTooLarge, "Upload exceeds %d bytes", tusMaxSize)
+			return
+		}
+
+		// uploads can be in progress at the same time, the quota is checked again when one completes
+		if err := store.files.Check(size); err != nil {
+			uploadFailed(c, err)
+			return
+		}
+
+		metadata, err := parseTusMetadata(c.GetHeader("Upload-Metadata"))
+		if err != nil {
+			c.String(http.StatusBadRequest, "Invalid Upload-Metadata: %v", err)
+			return
+		}
+
+		filename, err := storage.SanitizeName(metadata["filename"])
+		if err != nil {
+			c.String(http.StatusBadRequest, "Invalid filename metadata: %v", err)
+			return
+		}
+
+		if _, err := storage.CleanFolder(metadata["folder"]); err != nil {
+			c.String(http.StatusBadRequest, "Invalid folder metadata: %v", err)
+			return
+		}
+
+		if checksum := metadata["checksum"]; checksum != "" {
+			if _, _, err := parseChecksum(checksum); err != nil {
+				c.String(http.StatusBadRequest, "Invalid checksum metadata: %v", err)
+				return
+			}
+		}
+
+		if _, err := storage.ParseRetention(metadata["retention"]); err != nil {
+			c.String(http.StatusBadRequest, "Invalid retention metadata: %v", err)
+			return
+		}
+
+		upload, err := store.create(size, metadata)
+		if err != nil {
+			logrus.Errorf("failed to create upload: %v", err)
+			c.String(500, "Failed to create upload")
+			return
+		}
+
+		logrus.Debugf("created upload %s of %d bytes for %s", upload.ID, size, filename)
+		c.Header("Location", "/api/tus/"+upload.ID)
+		c.Header("Upload-Expires", store.expires(upload.ID).UTC().Format(http.TimeFormat))
+
+		// an empty file is complete right away
+		if size == 0 {
+			if !completeUpload(c, store, upload, cfg, mailer, db) {
+				return
+			}
+		}
+
+		c.Status(http.StatusCreated)
+	}
+}
+
+func tusHead(store *tusStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !tusPreflight(c) {
+			return
+		}
+
+		c.Header("Cache-Control", "no-store")
+
+		upload, offset, err := store.get(c.Param("id"))
+		if err != nil {
+			tusError(c, err)
+			return
+		}
+
+		c.Header("Upload-Offset", strconv.FormatInt(offset, 10))
+		c.Header("Upload-Length", strconv.FormatInt(upload.Size, 10))
+		c.Header("Upload-Expires", store.expires(upload.ID).UTC().Format(http.TimeFormat))
+		c.Status(http.StatusOK)
+	}
+}
+
+func tusPatch(store *tusStore, cfg config.AppConfig, mailer *mailer.Mailer, db *sqlitedb.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !tusPreflight(c) {
+			return
+		}
+
+		if c.ContentType() != tusContentType {
+			c.String(http.StatusUnsupportedMediaType, "Content-Type must be %s", tusContentType)
+			return
+		}
+
+		id := c.Param("id")
+		if !store.lock(id) {
+			c.String(http.StatusLocked, "Upload is in use")
+			return
+		}
+		defer store.unlock(id)
+
+		upload, offset, err := store.get(id)
+		if err != nil {
+			tusError(c, err)
+			return
+		}
+
+		requested, err := strconv.ParseInt(c.GetHeader("Upload-Offset"), 10, 64)
+		if err != nil {
+			c.String(http.StatusBadRequest, "Invalid Upload-Offset")
+			return
+		}
+
+		if requested != offset {
+			c.Header("Upload-Offset", strconv.FormatInt(offset, 10))
+			c.String(http.StatusConflict, "Upload-Offset does not match, current offset is %d", offset)
+			return
+		}
+
+		if c.Request.ContentLength > upload.Size-offset {
+			c.String(http.StatusRequestEntityTooLarge, "Chunk exceeds the length of the upload")
+			return
+		}
+
+		// every chunk has to fit in the quota and on disk, other uploads may have taken
+		// the room that was there when this upload was created
+		room, err := store.room()
+		if err != nil {
+			tusError(c, err)
+			return
+		}
+		chunkLimit := upload.Size - offset
+		if room.Bytes >= 0 && room.Bytes < chunkLimit {
+			chunkLimit = room.Bytes
+			if c.Request.ContentLength > chunkLimit {
+				uploadFailed(c, room.Err)
+				return
+			}
+		}
+
+		var (
+			chunkHash hash.Hash
+			expected  []byte
+		)
+		if checksum := c.GetHeader("Upload-Checksum"); checksum != "" {
+			if chunkHash, expected, err = parseChecksum(checksum); err != nil {
+				c.String(http.StatusBadRequest, "Invalid Upload-Checksum: %v", err)
+				return
+			}
+		}
+
+		written, err := appendChunk(store.dataPath(id), c.Request.Body, chunkLimit, chunkHash)
+
+		// a chunk without a length that does not fit is cut off at the room that is left
+		if err == nil && chunkLimit < upload.Size-offset && written == chunkLimit {
+			if n, _ := c.Request.Body.Read(make([]byte, 1)); n > 0 {
+				err = room.Err
+			}
+		}
+
+		// without a checksum, everything received so far is kept so the client can resume
+		if chunkHash != nil && (err != nil || !bytes.Equal(chunkHash.Sum(nil), expected)) {
+			if truncErr := os.Truncate(store.dataPath(id), offset); truncErr != nil {
+				logrus.Errorf("failed to discard chunk of upload %s: %v", id, truncErr)
+			}
+
+			if err == nil {
+				c.String(statusChecksumMismatch, "Checksum mismatch")
+				return
+			}
+			written = 0
+		}
+
+		offset += written
+		c.Header("Upload-Offset", strconv.FormatInt(offset, 10))
+		c.Header("Upload-Expires", store.expires(id).UTC().Format(http.TimeFormat))
+
+		if storage.NoSpace(err) {
+			uploadFailed(c, err)
+			return
+		}
+
+		if err != nil {
+			logrus.Errorf("failed to receive chunk of upload %s at offset %d: %v", id, offset, err)
+			c.String(500, "Failed to store chunk")
+			return
+		}
+
+		if offset == upload.Size {
+			if !completeUpload(c, store, upload, cfg, mailer, db) {
+				return
+			}
+		}
+
+		c.Status(http.StatusNoContent)
+	}
+}
+
+func tusDelete(store *tusStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !tusPreflight(c) {
+			return
+		}
+
+		id := c.Param("id")
+		if !store.lock(id) {
+			c.String(http.StatusLocked, "Upload is in use")
+			return
+		}
+		defer store.unlock(id)
+
+		if _, _, err := store.get(id); err != nil {
+			tusError(c, err)
+			return
+		}
+
+		if err := store.remove(id); err != nil {
+			logrus.Errorf("failed to remove upload %s: %v", id, err)
+			c.String(500, "Failed to remove upload")
+			return
+		}
+
+		c.Status(http.StatusNoContent)
+	}
+}
+
+// completeUpload finishes the upload and hands the file to the notify flow. When
+// the checksum does not match, the upload is removed and has to start over.
+func completeUpload(c *gin.Context, store *tusStore, upload tusUpload, cfg config.AppConfig, mailer *mailer.Mailer, db *sqlitedb.DB) bool {
+	// the retention and the folder were validated when the upload was created
+	u := uploadedBy(c, cfg)
+	u.Retention, _ = storage.ParseRetention(upload.Metadata["retention"])
+	u.Folder, _ = storage.CleanFolder(upload.Metadata["folder"])
+
+	filename, err := store.finish(upload, u)
+	checkStorageUsage(store.files, db)
+	if err == errChecksumMismatch {
+		logrus.Errorf("checksum of upload %s does not match, removing it", upload.ID)
+		if err := store.remove(upload.ID); err != nil {
+			logrus.Errorf("failed to remove upload %s: %v", upload.ID, err)
+		}
+		c.String(statusChecksumMismatch, "Checksum mismatch")
+		return false
+	}
+
+	if storage.NoSpace(err) || errors.Is(err, storage.ErrRejected) {
+		logrus.Errorf("upload %s is refused, removing it: %v", upload.ID, err)
+		storage.LogRejected(EventLog(db), err)
+		if err := store.remove(upload.ID); err != nil {
+			logrus.Errorf("failed to remove upload %s: %v", upload.ID, err)
+		}
+		uploadFailed(c, err)
+		return false
+	}
+
+	if err != nil {
+		logrus.Errorf("failed to finish upload %s: %v", upload.ID, err)
+		c.String(500, "Failed to finish upload")
+		return false
+	}
+
+	logrus.Debugf("upload %s complete, stored as %s", upload.ID, filename)
+
+	notifyUploaded(mailer, store.files, db, cfg, []string{filename}, uploadNotification{
+		OnlyUpload: upload.Metadata["onlyUpload"] == "true",
+		Subject:    upload.Metadata["subject"],
+		Message:    upload.Metadata["message"],
+		Target:     upload.Metadata["targetEmail"],
+	})
+
+	return true
+}
+
+// appendChunk appends at most limit bytes of the body to the data file
+func appendChunk(path string, body io.Reader, limit int64, h hash.Hash) (int64, error) {
+	data, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0o640)
+	if err != nil {
+		return 0, err
+	}
+
+	var w io.Writer = data
+	if h != nil {
+		w = io.MultiWriter(data, h)
+	}
+
+	written, err := io.Copy(w, io.LimitReader(body, limit))
+	if closeErr := data.Close(); err == nil {
+		err = closeErr
+	}
+
+	return written, err
+}
+
+func tusError(c *gin.Context, err error) {
+	if os.IsNotExist(err) {
+		c.String(http.StatusNotFound, "Upload not found")
+		return
+	}
+
+	logrus.Errorf("failed to read upload: %v", err)
+	c.String(500, "Failed to read upload")
+}
+
+// parseTusMetadata decodes "key base64value,key2 base64value2"
+func parseTusMetadata(header string) (map[string]string, error) {
+	metadata := map[string]string{}
+
+	for _, pair := range strings.Split(header, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		key, encoded, _ := strings.Cut(pair, " ")
+		value, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("value of %s is not base64 encoded", key)
+		}
+
+		metadata[key] = string(value)
+	}
+
+	return metadata, nil
+}
+
+// parseChecksum parses "<algorithm> <checksum>", the checksum is base64 (as the tus
+// checksum extension prescribes) or hex encoded
+func parseChecksum(checksum string) (hash.Hash, []byte, error) {
+	algorithm, encoded, _ := strings.Cut(strings.TrimSpace(checksum), " ")
+
+	var h hash.Hash
+	switch strings.ToLower(algorithm) {
+	case "sha1":
+		h = sha1.New()
+	case "sha256":
+		h = sha256.New()
+	default:
+		return nil, nil, fmt.Errorf("unsupported checksum algorithm %q", algorithm)
+	}
+
+	if expected, err := hex.DecodeString(encoded); err == nil && len(expected) == h.Size() {
+		return h, expected, nil
+	}
+
+	expected, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(expected) != h.Size() {
+		return nil, nil, fmt.Errorf("invalid %s checksum", algorithm)
+	}
+
+	return h, expected, nil
+}
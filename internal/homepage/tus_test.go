@@ -0,0 +1,243 @@
+package homepage
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rogierlommers/home/internal/auth"
+	"github.com/rogierlommers/home/internal/config"
+	"github.com/rogierlommers/home/internal/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTusRouter(t *testing.T) (*gin.Engine, *tusStore, string) {
+	return newTusRouterWithConfig(t, config.AppConfig{})
+}
+
+func newTusRouterWithConfig(t *testing.T, cfg config.AppConfig) (*gin.Engine, *tusStore, string) {
+	gin.SetMode(gin.TestMode)
+
+	cfg.XHomeAPIKey = "supersecretkey"
+	cfg.UploadTarget = t.TempDir()
+	db := newTestDB(t)
+	store := newTusStore(storage.New(cfg, db))
+
+	router := newTestRouter(cfg, db)
+	router.Group("/api", auth.Public()).OPTIONS("/tus", tusOptions())
+
+	tus := router.Group("/api", auth.SessionOrAPIKey(auth.ScopeFiles))
+	tus.POST("/tus", tusCreate(store, cfg, nil, db))
+	tus.HEAD("/tus/:id", tusHead(store))
+	tus.PATCH("/tus/:id", tusPatch(store, cfg, nil, db))
+	tus.DELETE("/tus/:id", tusDelete(store))
+
+	return router.Engine(), store, cfg.UploadTarget
+}
+
+func tusRequest(router *gin.Engine, method, url string, headers map[string]string, body string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(method, url, strings.NewReader(body))
+	req.Header.Set("X-HOME-API-KEY", "supersecretkey")
+	req.Header.Set("Tus-Resumable", tusVersion)
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func tusMetadata(pairs ...string) string {
+	var encoded []string
+	for i := 0; i < len(pairs); i += 2 {
+		encoded = append(encoded, pairs[i]+" "+base64.StdEncoding.EncodeToString([]byte(pairs[i+1])))
+	}
+	return strings.Join(encoded, ",")
+}
+
+func TestTusResumableUpload(t *testing.T) {
+	router, store, _ := newTusRouter(t)
+
+	content := "hello resumable world"
+	sum := sha256.Sum256([]byte(content))
+
+	w := tusRequest(router, "POST", "/api/tus", map[string]string{
+		"Upload-Length":   "21",
+		"Upload-Metadata": tusMetadata("filename", "hello.txt", "onlyUpload", "true", "checksum", "sha256 "+hex.EncodeToString(sum[:])),
+	}, "")
+	require.Equal(t, http.StatusCreated, w.Code)
+	location := w.Header().Get("Location")
+	require.NotEmpty(t, location)
+
+	patch := func(offset, chunk string) *httptest.ResponseRecorder {
+		return tusRequest(router, "PATCH", location, map[string]string{
+			"Upload-Offset": offset,
+			"Content-Type":  tusContentType,
+		}, chunk)
+	}
+
+	// first chunk
+	w = patch("0", content[:6])
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.Equal(t, "6", w.Header().Get("Upload-Offset"))
+
+	// a retry of an earlier chunk is refused, the client resumes from the offset of HEAD
+	w = patch("0", content[:6])
+	assert.Equal(t, http.StatusConflict, w.Code)
+
+	w = tusRequest(router, "HEAD", location, nil, "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "6", w.Header().Get("Upload-Offset"))
+	assert.Equal(t, "21", w.Header().Get("Upload-Length"))
+
+	// a chunk with a wrong checksum is discarded
+	w = tusRequest(router, "PATCH", location, map[string]string{
+		"Upload-Offset":   "6",
+		"Content-Type":    tusContentType,
+		"Upload-Checksum": "sha256 " + base64.StdEncoding.EncodeToString(sum[:]),
+	}, content[6:])
+	assert.Equal(t, statusChecksumMismatch, w.Code)
+
+	w = patch("6", content[6:])
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.Equal(t, "21", w.Header().Get("Upload-Offset"))
+
+	stored, _, err := store.files.Open("hello.txt")
+	require.NoError(t, err)
+	defer stored.Close()
+	storedContent, err := io.ReadAll(stored)
+	require.NoError(t, err)
+	assert.Equal(t, content, string(storedContent))
+
+	indexed, err := store.files.List("hello")
+	require.NoError(t, err)
+	require.Len(t, indexed, 1)
+	assert.Equal(t, hex.EncodeToString(sum[:]), indexed[0].SHA256)
+	assert.Equal(t, "api", indexed[0].Uploader)
+
+	// the upload is gone once complete
+	w = tusRequest(router, "HEAD", location, nil, "")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestTusChunkQuota(t *testing.T) {
+	router, store, _ := newTusRouterWithConfig(t, config.AppConfig{StorageQuotaMB: 1})
+
+	create := func() string {
+		w := tusRequest(router, "POST", "/api/tus", map[string]string{
+			"Upload-Length":   "819200",
+			"Upload-Metadata": tusMetadata("filename", "data.bin", "onlyUpload", "true"),
+		}, "")
+		require.Equal(t, http.StatusCreated, w.Code)
+		return w.Header().Get("Location")
+	}
+
+	patch := func(location string, size int, chunked bool) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("PATCH", location, strings.NewReader(strings.Repeat("x", size)))
+		req.Header.Set("X-HOME-API-KEY", "supersecretkey")
+		req.Header.Set("Tus-Resumable", tusVersion)
+		req.Header.Set("Upload-Offset", "0")
+		req.Header.Set("Content-Type", tusContentType)
+		if chunked {
+			req.ContentLength = -1
+		}
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	// both uploads fit the quota on their own, so both are accepted
+	first, second := create(), create()
+	assert.Equal(t, http.StatusNoContent, patch(first, 600<<10, false).Code)
+
+	// the data of the first upload takes room, the second no longer fits
+	assert.Equal(t, http.StatusRequestEntityTooLarge, patch(second, 600<<10, false).Code)
+
+	// a chunk without a length is cut off at the room that is left
+	w := patch(second, 600<<10, true)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+	assert.Equal(t, "434176", w.Header().Get("Upload-Offset"))
+
+	room, err := store.room()
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), room.Bytes)
+}
+
+func TestTusChecksumMismatchOnCompletion(t *testing.T) {
+	router, _, target := newTusRouter(t)
+
+	w := tusRequest(router, "POST", "/api/tus", map[string]string{
+		"Upload-Length":   "5",
+		"Upload-Metadata": tusMetadata("filename", "broken.bin", "onlyUpload", "true", "checksum", "sha256 "+strings.Repeat("00", 32)),
+	}, "")
+	require.Equal(t, http.StatusCreated, w.Code)
+	location := w.Header().Get("Location")
+
+	w = tusRequest(router, "PATCH", location, map[string]string{
+		"Upload-Offset": "0",
+		"Content-Type":  tusContentType,
+	}, "12345")
+	assert.Equal(t, statusChecksumMismatch, w.Code)
+
+	_, err := os.Stat(filepath.Join(target, "broken.bin"))
+	assert.True(t, os.IsNotExist(err))
+
+	w = tusRequest(router, "HEAD", location, nil, "")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestTusProtocolErrors(t *testing.T) {
+	router, store, _ := newTusRouter(t)
+
+	w := tusRequest(router, "OPTIONS", "/api/tus", nil, "")
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.Contains(t, w.Header().Get("Tus-Extension"), "checksum")
+
+	w = tusRequest(router, "POST", "/api/tus", map[string]string{"Tus-Resumable": "0.2.2", "Upload-Length": "5"}, "")
+	assert.Equal(t, http.StatusPreconditionFailed, w.Code)
+
+	w = tusRequest(router, "POST", "/api/tus", map[string]string{"Upload-Length": "5", "Upload-Metadata": tusMetadata("filename", "..")}, "")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = tusRequest(router, "POST", "/api/tus", map[string]string{"Upload-Length": "5", "Upload-Metadata": tusMetadata("filename", "a.txt", "folder", "../etc")}, "")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = tusRequest(router, "HEAD", "/api/tus/..%2F..%2Fetc", nil, "")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	// abandoned uploads expire
+	w = tusRequest(router, "POST", "/api/tus", map[string]string{"Upload-Length": "5", "Upload-Metadata": tusMetadata("filename", "a.txt")}, "")
+	require.Equal(t, http.StatusCreated, w.Code)
+	assert.Equal(t, 0, store.cleanupExpired(time.Now()))
+	assert.Equal(t, 1, store.cleanupExpired(time.Now().Add(tusExpiry+time.Minute)))
+
+	w = tusRequest(router, "DELETE", w.Header().Get("Location"), nil, "")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestParseChecksum(t *testing.T) {
+	sum := sha256.Sum256([]byte("abc"))
+
+	for _, checksum := range []string{
+		"sha256 " + hex.EncodeToString(sum[:]),
+		"sha256 " + base64.StdEncoding.EncodeToString(sum[:]),
+	} {
+		h, expected, err := parseChecksum(checksum)
+		require.NoError(t, err)
+		_, _ = io.WriteString(h, "abc")
+		assert.Equal(t, expected, h.Sum(nil))
+	}
+
+	_, _, err := parseChecksum("md5 900150983cd24fb0d6963f7d28e17f72")
+	assert.Error(t, err)
+}
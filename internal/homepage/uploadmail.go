@@ -0,0 +1,134 @@
+package homepage
+
+import (
+	"fmt"
+	"path"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/rogierlommers/home/internal/config"
+	"github.com/rogierlommers/home/internal/mailer"
+	"github.com/rogierlommers/home/internal/sqlitedb"
+	"github.com/rogierlommers/home/internal/storage"
+	"github.com/sirupsen/logrus"
+)
+
+// Uploaded files are mailed as attachments, unless together they are larger than
+// MAIL_ATTACHMENT_LIMIT_MB, as mail servers refuse large mails. Those are mailed as
+// share links instead, which are listed on the shares page and can be revoked there.
+
+// links in notification mails are valid for a week, or until the file expires
+const mailLinkExpiry = defaultShareExpiry
+
+// uploadMail is the notification mail of uploaded files
+type uploadMail struct {
+	files       []string
+	size        int64
+	attachments []mailer.Attachment
+	links       []mailer.Link // instead of attachments, for files that are too large
+}
+
+// newUploadMail attaches the uploaded files to the mail, or creates links to them when
+// they are too large
+func newUploadMail(store *storage.Store, db *sqlitedb.DB, cfg config.AppConfig, uploaded []string, n uploadNotification) uploadMail {
+	mail := uploadMail{files: uploaded}
+
+	var files []sqlitedb.File
+	for _, name := range uploaded {
+		file, err := db.GetFile(name)
+		if err != nil || file == nil {
+			logrus.Errorf("failed to find uploaded file %s: %v", name, err)
+			continue
+		}
+		files = append(files, *file)
+		mail.size += file.Size
+	}
+
+	switch {
+	case len(files) == 0 || mail.size <= int64(cfg.MailAttachmentLimitMB)<<20:
+	case cfg.ShareSecret == "":
+		logrus.Errorf("uploaded files are too large to attach, but links require SHARE_SECRET or X_HOME_API_KEY to be configured")
+	case cfg.PublicURL == "":
+		logrus.Errorf("uploaded files are too large to attach, but links require PUBLIC_URL to be configured")
+	default:
+		links, err := mailLinks(db, cfg.ShareSecret, cfg.PublicURL, files, time.Now())
+		if err == nil {
+			mail.links = links
+			return mail
+		}
+		logrus.Errorf("failed to create links to the uploaded files, attaching them: %v", err)
+	}
+
+	mail.attachments = mailAttachments(store, uploaded)
+	return mail
+}
+
+// mailLinks shares the files, the links point to the base url
+func mailLinks(db *sqlitedb.DB, secret, baseURL string, files []sqlitedb.File, now time.Time) ([]mailer.Link, error) {
+	links := make([]mailer.Link, 0, len(files))
+	for _, file := range files {
+		share := sqlitedb.FileShare{
+			PublicID: newSharePublicID(),
+			FileName: file.Name,
+			Expires:  now.UTC().Add(mailLinkExpiry).Truncate(time.Second),
+		}
+		if file.Expires != nil && file.Expires.Before(share.Expires) {
+			share.Expires = *file.Expires
+		}
+
+		id, err := db.AddFileShare(share)
+		if err != nil {
+			return nil, fmt.Errorf("failed to share %s: %w", file.Name, err)
+		}
+		logShareEvent(db, fmt.Sprintf("share %d of %s created for a notification mail, expires %s", id, file.Name, share.Expires.Format(time.RFC3339)))
+
+		links = append(links, mailer.Link{
+			Name:        path.Base(file.Name),
+			URL:         baseURL + "/s/" + signShare(secret, share.PublicID),
+			Size:        file.Size,
+			ContentType: storage.MediaType(file.ContentType),
+			Expires:     share.Expires,
+		})
+	}
+	return links, nil
+}
+
+func (u uploadMail) send(m *mailer.Mailer, n uploadNotification) error {
+	if len(u.links) > 0 {
+		return m.SendMailWithLinks(n.Subject, n.Target, n.Message, u.links)
+	}
+	return m.SendMail(n.Subject, n.Target, n.Message, u.attachments)
+}
+
+// recordUploadMail records the result of sending the notification mail as event
+func recordUploadMail(db *sqlitedb.DB, n uploadNotification, mail uploadMail, err error) {
+	delivery := "attachments"
+	if len(mail.links) > 0 {
+		delivery = "links"
+	}
+
+	msg := Message{
+		Source:   "system",
+		Category: "mail",
+		Severity: severityInfo,
+		Message:  fmt.Sprintf("notification mail with %d files (%s) sent to %s as %s", len(mail.files), humanize.IBytes(uint64(mail.size)), n.Target, delivery),
+		Attributes: map[string]any{
+			"subject":  n.Subject,
+			"target":   n.Target,
+			"files":    mail.files,
+			"size":     mail.size,
+			"delivery": delivery,
+		},
+	}
+
+	if err != nil {
+		logrus.Errorf("Failed to send notification email: %v", err)
+		msg.Severity = severityWarning
+		msg.Message = fmt.Sprintf("failed to send notification mail with %d files (%s) to %s as %s: %v", len(mail.files), humanize.IBytes(uint64(mail.size)), n.Target, delivery, err)
+		msg.Attributes["error"] = err.Error()
+	}
+
+	if err := AddEvent(db, msg); err != nil {
+		logrus.Errorf("failed to log notification mail: %v", err)
+	}
+}
@@ -0,0 +1,85 @@
+package homepage
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rogierlommers/home/internal/config"
+	"github.com/rogierlommers/home/internal/mailer"
+	"github.com/rogierlommers/home/internal/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUploadMail(t *testing.T) {
+	db := newTestDB(t)
+	cfg := config.AppConfig{UploadTarget: t.TempDir(), FileCleanUpInDys: 7, MailAttachmentLimitMB: 1, ShareSecret: "secret", PublicURL: "https://home.example.com"}
+	files := storage.New(cfg, db)
+	notification := uploadNotification{Target: mailer.PrivateMail}
+
+	small, err := files.Save("small.txt", strings.NewReader("small"), storage.Upload{})
+	require.NoError(t, err)
+	large, err := files.Save("large.txt", strings.NewReader(strings.Repeat("large", 300<<10)), storage.Upload{Retention: 24 * time.Hour})
+	require.NoError(t, err)
+
+	// small uploads are attached
+	mail := newUploadMail(files, db, cfg, []string{small.Name}, notification)
+	assert.Len(t, mail.attachments, 1)
+	assert.Empty(t, mail.links)
+	assert.Equal(t, int64(5), mail.size)
+
+	// larger ones are shared, the links expire with the files
+	mail = newUploadMail(files, db, cfg, []string{small.Name, large.Name}, notification)
+	assert.Empty(t, mail.attachments)
+	require.Len(t, mail.links, 2)
+
+	assert.WithinDuration(t, time.Now().Add(mailLinkExpiry), mail.links[0].Expires, 5*time.Second)
+
+	link := mail.links[1]
+	assert.Equal(t, "large.txt", link.Name)
+	assert.Equal(t, large.Size, link.Size)
+	assert.Equal(t, "text/plain", link.ContentType)
+	assert.Equal(t, *large.Expires, link.Expires)
+	assert.True(t, strings.HasPrefix(link.URL, "https://home.example.com/s/"), link.URL)
+
+	publicID, ok := verifyShare(cfg.ShareSecret, strings.TrimPrefix(link.URL, "https://home.example.com/s/"))
+	require.True(t, ok)
+	share, err := db.GetFileShareByPublicID(publicID)
+	require.NoError(t, err)
+	require.NotNil(t, share)
+	assert.Equal(t, "large.txt", share.FileName)
+
+	// links cannot be signed without a secret
+	cfg.ShareSecret = ""
+	mail = newUploadMail(files, db, cfg, []string{large.Name}, notification)
+	assert.Len(t, mail.attachments, 1)
+	assert.Empty(t, mail.links)
+}
+
+func TestUploadMailResult(t *testing.T) {
+	db := newTestDB(t)
+	cfg := config.AppConfig{UploadTarget: t.TempDir(), FileCleanUpInDys: 7, MailAttachmentLimitMB: 20}
+	files := storage.New(cfg, db)
+
+	stored, err := files.Save("report.txt", strings.NewReader("report"), storage.Upload{})
+	require.NoError(t, err)
+
+	// without a mail server the mail cannot be sent, which is recorded
+	notification := uploadNotification{Subject: "report", Target: mailer.WorkMail}
+	mail := newUploadMail(files, db, cfg, []string{stored.Name}, notification)
+	recordUploadMail(db, notification, mail, mail.send(mailer.NewMailer(cfg), notification))
+
+	events := getEvents(db, 10, eventFilter{Category: "mail"})
+	require.Len(t, events, 1)
+	assert.Equal(t, severityWarning, events[0].Severity)
+	assert.True(t, strings.HasPrefix(events[0].Message, "failed to send notification mail with 1 files (6 B) to work as attachments: "), events[0].Message)
+	assert.Equal(t, "attachments", events[0].Attributes["delivery"])
+	assert.NotEmpty(t, events[0].Attributes["error"])
+
+	recordUploadMail(db, notification, mail, nil)
+	events = getEvents(db, 10, eventFilter{Category: "mail"})
+	require.Len(t, events, 2)
+	assert.Equal(t, severityInfo, events[0].Severity)
+	assert.Equal(t, "notification mail with 1 files (6 B) sent to work as attachments", events[0].Message)
+}
@@ -0,0 +1,117 @@
+package homepage
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rogierlommers/home/internal/auth"
+	"github.com/rogierlommers/home/internal/config"
+	"github.com/rogierlommers/home/internal/mailer"
+	"github.com/rogierlommers/home/internal/sqlitedb"
+	"github.com/rogierlommers/home/internal/storage"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/net/webdav"
+)
+
+// the storage is mounted as network drive under this path
+const davPrefix = "/dav"
+
+// methods of the webdav protocol, RFC 4918
+var davMethods = []string{"OPTIONS", "GET", "HEAD", "PUT", "DELETE", "MKCOL", "COPY", "MOVE", "LOCK", "UNLOCK", "PROPFIND", "PROPPATCH"}
+
+// addWebDAV serves the storage as network drive, for clients that log in with basic
+// auth or an api key
+func addWebDAV(router *auth.Router, files *storage.Store, cfg config.AppConfig, mailer *mailer.Mailer, db *sqlitedb.DB) {
+	dav := router.Group(davPrefix, auth.APIKey(auth.ScopeFiles).WithBasicAuth())
+	handler := webDAV(files, cfg, mailer, db, webdav.NewMemLS())
+
+	for _, method := range davMethods {
+		dav.Handle(method, "", handler)
+		dav.Handle(method, "/*path", handler)
+	}
+}
+
+// webDAV serves the folders and files of the storage. Files that are written are stored
+// like uploads through the storage page: they are screened by the file policy, count
+// towards the quota, expire after the default retention and go through the notify flow.
+// Files that are replaced keep their retention. Clients that can set headers ask for a
+// notification mail with X-Notify-Target, X-Notify-Subject and X-Notify-Message.
+//
+// curl -u rogier:password -T invoice.pdf http://localhost:3000/dav/invoices/invoice.pdf
+// curl -u rogier:password -T invoice.pdf -H "X-Notify-Target: work" -H "X-Notify-Subject: invoice" http://localhost:3000/dav/invoices/invoice.pdf
+// curl -X PROPFIND -H "Depth: 1" -H "X-HOME-API-KEY: supersecretkey" http://localhost:3000/dav/invoices/
+func webDAV(store *storage.Store, cfg config.AppConfig, mailer *mailer.Mailer, stats *sqlitedb.DB, locks webdav.LockSystem) gin.HandlerFunc {
+	handler := &webdav.Handler{
+		Prefix:     davPrefix,
+		FileSystem: store.WebDAV(storage.Upload{Source: sqlitedb.FileSourceWebDAV}),
+		LockSystem: locks,
+		Logger:     logDAVRequest(store, cfg, mailer, stats),
+	}
+
+	return func(c *gin.Context) {
+		// refuse files that do not fit before reading them
+		if c.Request.Method == "PUT" {
+			if err := store.Check(c.Request.ContentLength); err != nil {
+				uploadFailed(c, err)
+				return
+			}
+		}
+
+		upload := uploadedBy(c, cfg)
+		upload.Source = sqlitedb.FileSourceWebDAV
+
+		handler.ServeHTTP(c.Writer, c.Request.WithContext(storage.WithUpload(c.Request.Context(), upload)))
+	}
+}
+
+// davNotification asks for a notification mail when the client names a target, other
+// files are only uploaded
+func davNotification(r *http.Request) uploadNotification {
+	target := r.Header.Get("X-Notify-Target")
+	return uploadNotification{
+		OnlyUpload: target == "",
+		Subject:    r.Header.Get("X-Notify-Subject"),
+		Message:    r.Header.Get("X-Notify-Message"),
+		Target:     target,
+	}
+}
+
+// logDAVRequest records stored files and refused uploads the same way as uploads
+// through the storage page
+func logDAVRequest(store *storage.Store, cfg config.AppConfig, mailer *mailer.Mailer, stats *sqlitedb.DB) func(*http.Request, error) {
+	return func(r *http.Request, err error) {
+		if err == nil {
+			switch r.Method {
+			case "PUT":
+				// written files are counted by the notify flow, like uploads through the storage page
+				checkStorageUsage(store, stats)
+				name := strings.Trim(path.Clean(strings.TrimPrefix(r.URL.Path, davPrefix)), "/")
+				notifyUploaded(mailer, store, stats, cfg, []string{name}, davNotification(r))
+			case "COPY":
+				// copies are no new uploads, they take up room all the same
+				checkStorageUsage(store, stats)
+				if err := stats.IncrementEntry("upload_webdav"); err != nil {
+					logrus.Errorf("failed to increment upload_webdav stat: %v", err)
+				}
+			}
+			return
+		}
+
+		switch {
+		case errors.Is(err, storage.ErrRejected):
+			storage.LogRejected(EventLog(stats), err)
+		case storage.NoSpace(err):
+			checkStorageUsage(store, stats)
+			logrus.Warnf("webdav %s %s refused: %v", r.Method, r.URL.Path, err)
+		case os.IsNotExist(err), os.IsExist(err), os.IsPermission(err):
+			// clients look for files that are not there, and try to store hidden files
+			logrus.Debugf("webdav %s %s: %v", r.Method, r.URL.Path, err)
+		default:
+			logrus.Errorf("webdav %s %s failed: %v", r.Method, r.URL.Path, err)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package homepage
+
+import (
+	"database/sql"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rogierlommers/home/internal/auth"
+	"github.com/rogierlommers/home/internal/config"
+	"github.com/rogierlommers/home/internal/mailer"
+	"github.com/rogierlommers/home/internal/sqlitedb"
+	"github.com/rogierlommers/home/internal/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWebDAV(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	db := newTestDB(t)
+	cfg := config.AppConfig{
+		UploadTarget:     t.TempDir(),
+		FileCleanUpInDys: 7,
+		Username:         "rogier",
+		Password:         "hunter2",
+		XHomeAPIKey:      "supersecretkey",
+	}
+	files := storage.New(cfg, db)
+
+	router := newTestRouter(cfg, db)
+	addWebDAV(router, files, cfg, mailer.NewMailer(cfg), db)
+
+	request := func(method, path, body string, credentials bool) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		if credentials {
+			req.SetBasicAuth("rogier", "hunter2")
+		}
+
+		w := httptest.NewRecorder()
+		router.Engine().ServeHTTP(w, req)
+		return w
+	}
+
+	// clients are asked to log in
+	w := request("PROPFIND", "/dav/", "", false)
+	assert.Equal(t, 401, w.Code)
+	assert.Equal(t, auth.BasicAuthRealm, w.Header().Get("WWW-Authenticate"))
+
+	assert.Equal(t, 207, request("PROPFIND", "/dav", "", true).Code)
+	assert.Equal(t, 201, request("MKCOL", "/dav/taxes", "", true).Code)
+	assert.Equal(t, 201, request("PUT", "/dav/taxes/2024.txt", "taxes", true).Code)
+
+	// stored like an upload through the storage page
+	file, err := db.GetFile("taxes/2024.txt")
+	require.NoError(t, err)
+	require.NotNil(t, file)
+	assert.Equal(t, "rogier", file.Uploader)
+	assert.Equal(t, sqlitedb.FileSourceWebDAV, file.Source)
+	require.NotNil(t, file.Expires)
+	assert.Equal(t, 7*24*time.Hour, file.Expires.Sub(file.Uploaded))
+
+	// without a target, the file is only uploaded, and counted once
+	count, err := db.GetEntryCount("upload_only_upload")
+	require.NoError(t, err)
+	assert.Equal(t, 1, count)
+	_, err = db.GetEntryCount("upload_webdav")
+	assert.ErrorIs(t, err, sql.ErrNoRows)
+
+	// refused files are recorded, webdav has no status for refused content
+	assert.Equal(t, 405, request("PUT", "/dav/taxes/2024.pdf", "not a pdf", true).Code)
+	warnings := getEvents(db, 10, eventFilter{Category: "storage"})
+	require.Len(t, warnings, 1)
+	assert.Equal(t, "upload of 2024.pdf through webdav refused: content is text/plain, which does not match the extension", warnings[0].Message)
+
+	w = request("GET", "/dav/taxes/2024.txt", "", true)
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "taxes", w.Body.String())
+
+	// copies are counted as webdav uploads only
+	req := httptest.NewRequest("COPY", "/dav/taxes/2024.txt", nil)
+	req.SetBasicAuth("rogier", "hunter2")
+	req.Header.Set("Destination", "/dav/taxes/2024-copy.txt")
+	w = httptest.NewRecorder()
+	router.Engine().ServeHTTP(w, req)
+	assert.Equal(t, 201, w.Code)
+
+	count, err = db.GetEntryCount("upload_webdav")
+	require.NoError(t, err)
+	assert.Equal(t, 1, count)
+	count, err = db.GetEntryCount("upload_only_upload")
+	require.NoError(t, err)
+	assert.Equal(t, 1, count)
+
+	// a target asks for a notification mail, which is recorded like mails of the storage page
+	req = httptest.NewRequest("PUT", "/dav/taxes/2025.txt", strings.NewReader("more taxes"))
+	req.SetBasicAuth("rogier", "hunter2")
+	req.Header.Set("X-Notify-Target", mailer.WorkMail)
+	req.Header.Set("X-Notify-Subject", "taxes")
+	w = httptest.NewRecorder()
+	router.Engine().ServeHTTP(w, req)
+	assert.Equal(t, 201, w.Code)
+
+	count, err = db.GetEntryCount("upload_and_notify_" + mailer.WorkMail)
+	require.NoError(t, err)
+	assert.Equal(t, 1, count)
+
+	assert.Eventually(t, func() bool {
+		return len(getEvents(db, 10, eventFilter{Category: "mail"})) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	mails := getEvents(db, 10, eventFilter{Category: "mail"})
+	require.Len(t, mails, 1)
+	assert.Equal(t, "taxes", mails[0].Attributes["subject"])
+	assert.Equal(t, []any{"taxes/2025.txt"}, mails[0].Attributes["files"])
+}
@@ -0,0 +1,300 @@
+package homepage
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rogierlommers/home/internal/sqlitedb"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	webhookPollInterval   = 10 * time.Second
+	webhookTimeout        = 10 * time.Second
+	webhookBatchSize      = 50
+	webhookMaxAttempts    = 8
+	webhookInitialBackoff = 30 * time.Second
+	webhookMaxBackoff     = 6 * time.Hour
+	webhookDeliveryLog    = 100
+
+	// finished deliveries are kept this long, for the delivery log
+	webhookDeliveryRetention = 30 * 24 * time.Hour
+
+	// SignatureHeader holds the hex encoded HMAC-SHA256 of the body, keyed with the webhook secret
+	SignatureHeader = "X-Home-Signature"
+)
+
+// enqueueWebhooks queues the event for all enabled webhooks whose filters match,
+// deliveries are stored in sqlite so they survive a restart
+func enqueueWebhooks(q querier, id int64, msg Message) error {
+	msg.ID = int(id)
+	if msg.Added.IsZero() {
+		msg.Added = time.Now().UTC().Truncate(time.Second)
+	}
+
+	// request specific fields are not part of the payload
+	msg.DedupKey = ""
+	msg.Collapse = false
+
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("failed to encode webhook payload: %v", err)
+	}
+
+	_, err = q.Exec(`
+		INSERT INTO webhook_deliveries (webhook_id, event_id, payload)
+		SELECT id, ?, ? FROM webhooks
+		WHERE enabled = 1
+		  AND (categories = '' OR instr(',' || categories || ',', ',' || ? || ',') > 0)
+		  AND (sources = '' OR instr(',' || sources || ',', ',' || ? || ',') > 0)
+	`, id, string(payload), msg.Category, msg.Source)
+	if err != nil {
+		return fmt.Errorf("failed to enqueue webhooks: %v", err)
+	}
+
+	return nil
+}
+
+// signPayload calculates the signature receivers use to verify a delivery
+func signPayload(secret string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// webhookBackoff doubles the wait time after every failed attempt
+func webhookBackoff(attempts int) time.Duration {
+	backoff := webhookInitialBackoff
+	for i := 1; i < attempts && backoff < webhookMaxBackoff; i++ {
+		backoff *= 2
+	}
+	return min(backoff, webhookMaxBackoff)
+}
+
+type webhookDispatcher struct {
+	db     *sqlitedb.DB
+	client *http.Client
+}
+
+func newWebhookDispatcher(db *sqlitedb.DB) *webhookDispatcher {
+	return &webhookDispatcher{
+		db:     db,
+		client: &http.Client{Timeout: webhookTimeout},
+	}
+}
+
+// start polls the delivery queue in the background, until ctx is done
+func (d *webhookDispatcher) start(ctx context.Context, wg *sync.WaitGroup) {
+	wg.Go(func() {
+		logrus.Infof("delivering webhooks every %s", webhookPollInterval)
+
+		ticker := time.NewTicker(webhookPollInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-ticker.C:
+				d.deliverDue(now)
+			}
+		}
+	})
+}
+
+// deliverDue attempts all deliveries that are due, returns the number of attempts
+func (d *webhookDispatcher) deliverDue(now time.Time) int {
+	deliveries, err := d.db.GetDueDeliveries(now, webhookBatchSize)
+	if err != nil {
+		logrus.Errorf("failed to get due webhook deliveries: %v", err)
+		return 0
+	}
+
+	for _, delivery := range deliveries {
+		statusCode, err := d.deliver(delivery)
+		if err == nil {
+			if err := d.db.DeliverySucceeded(delivery.ID, statusCode); err != nil {
+				logrus.Errorf("failed to mark %s as delivered: %v", delivery, err)
+			}
+			logrus.Debugf("%s succeeded with status %d", delivery, statusCode)
+			continue
+		}
+
+		var retryAt *time.Time
+		if attempts := delivery.Attempts + 1; attempts < webhookMaxAttempts {
+			next := now.Add(webhookBackoff(attempts))
+			retryAt = &next
+		}
+
+		logrus.Errorf("%s failed (attempt %d): %v", delivery, delivery.Attempts+1, err)
+		if err := d.db.DeliveryAttemptFailed(delivery.ID, statusCode, err.Error(), retryAt); err != nil {
+			logrus.Errorf("failed to record failed attempt of %s: %v", delivery, err)
+		}
+	}
+
+	return len(deliveries)
+}
+
+func (d *webhookDispatcher) deliver(delivery sqlitedb.WebhookDelivery) (int, error) {
+	payload := []byte(delivery.Payload)
+
+	req, err := http.NewRequest(http.MethodPost, delivery.URL, bytes.NewReader(payload))
+	if err != nil {
+		return 0, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "home-service-webhooks")
+	req.Header.Set("X-Home-Delivery", strconv.Itoa(delivery.ID))
+	req.Header.Set("X-Home-Event", strconv.Itoa(delivery.EventID))
+	req.Header.Set(SignatureHeader, signPayload(delivery.Secret, payload))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+
+	return resp.StatusCode, nil
+}
+
+// pruneWebhookDeliveries removes finished deliveries older than the retention
+func pruneWebhookDeliveries(db *sqlitedb.DB, now time.Time) {
+	pruned, err := db.PruneWebhookDeliveries(now.Add(-webhookDeliveryRetention))
+	if err != nil {
+		logrus.Errorf("failed to prune webhook deliveries: %v", err)
+		return
+	}
+	logrus.Infof("pruned %d webhook deliveries", pruned)
+}
+
+func displayWebhooksPage(c *gin.Context) {
+	htmlBytes, err := staticFS.ReadFile("static_html/webhooks.html")
+	if err != nil {
+		logrus.Errorf("Error reading static html: %v", err)
+		c.String(500, "Failed to load webhooks page")
+		return
+	}
+
+	c.Header("Content-Type", "text/html")
+	c.String(200, string(htmlBytes))
+}
+
+func displayWebhooks(db *sqlitedb.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		webhooks, err := db.GetWebhooks()
+		if err != nil {
+			logrus.Errorf("Failed to get webhooks: %v", err)
+			c.String(500, "Failed to retrieve webhooks")
+			return
+		}
+
+		// the secret is only shown when the webhook is created
+		for i := range webhooks {
+			webhooks[i].Secret = ""
+		}
+
+		c.IndentedJSON(200, webhooks)
+	}
+}
+
+func addWebhook(db *sqlitedb.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		w := sqlitedb.Webhook{Enabled: true}
+		if err := c.BindJSON(&w); err != nil {
+			logrus.Errorf("Failed to bind JSON: %v", err)
+			c.String(400, "Invalid request payload")
+			return
+		}
+
+		if u, err := url.Parse(w.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			c.String(400, "Invalid webhook url")
+			return
+		}
+
+		// generate a secret when none is given
+		if w.Secret == "" {
+			secret := make([]byte, 32)
+			if _, err := rand.Read(secret); err != nil {
+				c.String(500, "Failed to generate secret")
+				return
+			}
+			w.Secret = hex.EncodeToString(secret)
+		}
+
+		id, err := db.AddWebhook(w)
+		if err != nil {
+			logrus.Errorf("Failed to add webhook: %v", err)
+			c.String(500, "Failed to add webhook")
+			return
+		}
+
+		w.ID = id
+		c.IndentedJSON(201, w)
+	}
+}
+
+func enableWebhook(db *sqlitedb.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var body struct {
+			Enabled bool `json:"enabled"`
+		}
+		if err := c.BindJSON(&body); err != nil {
+			c.String(400, "Invalid request payload")
+			return
+		}
+
+		id := convertToInt(c.Param("id"))
+		if err := db.SetWebhookEnabled(id, body.Enabled); err != nil {
+			logrus.Errorf("Failed to update webhook: %v", err)
+			c.String(500, "Failed to update webhook")
+			return
+		}
+
+		c.JSON(200, gin.H{"id": id, "enabled": body.Enabled})
+	}
+}
+
+func deleteWebhook(db *sqlitedb.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := convertToInt(c.Param("id"))
+		if err := db.DeleteWebhook(id); err != nil {
+			logrus.Errorf("Failed to delete webhook: %v", err)
+			c.String(500, "Failed to delete webhook")
+			return
+		}
+
+		c.JSON(200, gin.H{"status": "ok", "deletedID": id})
+	}
+}
+
+func displayWebhookDeliveries(db *sqlitedb.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		deliveries, err := db.GetWebhookDeliveries(convertToInt(c.Param("id")), webhookDeliveryLog)
+		if err != nil {
+			logrus.Errorf("Failed to get webhook deliveries: %v", err)
+			c.String(500, "Failed to retrieve webhook deliveries")
+			return
+		}
+
+		c.IndentedJSON(200, deliveries)
+	}
+}
@@ -0,0 +1,158 @@
+package homepage
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rogierlommers/home/internal/sqlitedb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWebhookDelivery(t *testing.T) {
+	db := newTestDB(t)
+
+	type received struct {
+		signature string
+		body      []byte
+	}
+	deliveries := make(chan received, 10)
+
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		deliveries <- received{signature: r.Header.Get(SignatureHeader), body: body}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer receiver.Close()
+
+	_, err := db.AddWebhook(sqlitedb.Webhook{Name: "alarms", URL: receiver.URL, Secret: "s3cret", Categories: "alarm, critical", Enabled: true})
+	require.NoError(t, err)
+
+	require.NoError(t, AddEvent(db, Message{Source: "home-assistant", Message: "door open", Category: "alarm"}))
+	require.NoError(t, AddEvent(db, Message{Source: "home-assistant", Message: "21.5", Category: "sensor"}))
+
+	dispatcher := newWebhookDispatcher(db)
+	assert.Equal(t, 1, dispatcher.deliverDue(time.Now()))
+
+	r := <-deliveries
+	assert.Equal(t, signPayload("s3cret", r.body), r.signature)
+
+	var msg Message
+	require.NoError(t, json.Unmarshal(r.body, &msg))
+	assert.Equal(t, "door open", msg.Message)
+	assert.Equal(t, 1, msg.ID)
+
+	// nothing left to deliver
+	assert.Equal(t, 0, dispatcher.deliverDue(time.Now()))
+
+	log, err := db.GetWebhookDeliveries(1, 10)
+	require.NoError(t, err)
+	assert.Len(t, log, 1)
+	assert.Equal(t, sqlitedb.DeliveryDelivered, log[0].Status)
+	assert.Equal(t, http.StatusNoContent, log[0].StatusCode)
+}
+
+func TestWebhookRetries(t *testing.T) {
+	db := newTestDB(t)
+
+	calls := 0
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer receiver.Close()
+
+	id, err := db.AddWebhook(sqlitedb.Webhook{Name: "broken", URL: receiver.URL, Secret: "s3cret", Enabled: true})
+	require.NoError(t, err)
+	require.NoError(t, AddEvent(db, Message{Source: "home-assistant", Message: "door open", Category: "alarm"}))
+
+	dispatcher := newWebhookDispatcher(db)
+	now := time.Now()
+	assert.Equal(t, 1, dispatcher.deliverDue(now))
+
+	// the retry is not due yet
+	assert.Equal(t, 0, dispatcher.deliverDue(now))
+
+	log, err := db.GetWebhookDeliveries(id, 10)
+	require.NoError(t, err)
+	assert.Equal(t, sqlitedb.DeliveryPending, log[0].Status)
+	assert.Equal(t, 1, log[0].Attempts)
+	assert.Equal(t, http.StatusInternalServerError, log[0].StatusCode)
+
+	// keep retrying until the delivery gives up
+	for i := 1; i < webhookMaxAttempts; i++ {
+		now = now.Add(webhookMaxBackoff)
+		assert.Equal(t, 1, dispatcher.deliverDue(now))
+	}
+	assert.Equal(t, 0, dispatcher.deliverDue(now.Add(webhookMaxBackoff)))
+	assert.Equal(t, webhookMaxAttempts, calls)
+
+	log, err = db.GetWebhookDeliveries(id, 10)
+	require.NoError(t, err)
+	assert.Equal(t, sqlitedb.DeliveryFailed, log[0].Status)
+	assert.Equal(t, webhookMaxAttempts, log[0].Attempts)
+}
+
+func TestWebhookBackoff(t *testing.T) {
+	assert.Equal(t, webhookInitialBackoff, webhookBackoff(1))
+	assert.Equal(t, 2*webhookInitialBackoff, webhookBackoff(2))
+	assert.Equal(t, 4*webhookInitialBackoff, webhookBackoff(3))
+	assert.Equal(t, webhookMaxBackoff, webhookBackoff(50))
+}
+
+func TestPruneWebhookDeliveries(t *testing.T) {
+	db := newTestDB(t)
+
+	id, err := db.AddWebhook(sqlitedb.Webhook{Name: "all", URL: "http://localhost", Secret: "s3cret", Enabled: true})
+	require.NoError(t, err)
+
+	for i := 0; i < 3; i++ {
+		require.NoError(t, AddEvent(db, Message{Source: "home-assistant", Message: "door open"}))
+	}
+
+	// an old delivered, an old pending and a recent failed delivery
+	old := time.Now().Add(-webhookDeliveryRetention - time.Hour).UTC().Format(sqlitedb.TimestampLayout)
+	_, err = db.Conn.Exec(`UPDATE webhook_deliveries SET status = ?, created = ? WHERE id = 1`, sqlitedb.DeliveryDelivered, old)
+	require.NoError(t, err)
+	_, err = db.Conn.Exec(`UPDATE webhook_deliveries SET created = ? WHERE id = 2`, old)
+	require.NoError(t, err)
+	_, err = db.Conn.Exec(`UPDATE webhook_deliveries SET status = ? WHERE id = 3`, sqlitedb.DeliveryFailed)
+	require.NoError(t, err)
+
+	pruneWebhookDeliveries(db, time.Now())
+
+	log, err := db.GetWebhookDeliveries(id, 10)
+	require.NoError(t, err)
+	require.Len(t, log, 2)
+	assert.Equal(t, 3, log[0].ID)
+	assert.Equal(t, 2, log[1].ID)
+}
+
+func TestWebhookSecretOnlyOnCreate(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	db := newTestDB(t)
+
+	router := gin.New()
+	router.POST("/api/webhooks", addWebhook(db))
+	router.GET("/api/webhooks", displayWebhooks(db))
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/api/webhooks", strings.NewReader(`{"name": "alarms", "url": "https://example.com/hook"}`)))
+	require.Equal(t, 201, w.Code)
+
+	var created sqlitedb.Webhook
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &created))
+	assert.Len(t, created.Secret, 64)
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/api/webhooks", nil))
+	require.Equal(t, 200, w.Code)
+	assert.NotContains(t, w.Body.String(), created.Secret)
+	assert.NotContains(t, w.Body.String(), `"secret"`)
+}
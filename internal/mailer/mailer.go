@@ -3,11 +3,13 @@ package mailer
 import (
 	"fmt"
 	"html"
+	"io"
 	"os"
-	"path"
 	"strconv"
 	"strings"
+	"time"
 
+	"github.com/dustin/go-humanize"
 	"github.com/rogierlommers/home/internal/config"
 	"github.com/sirupsen/logrus"
 	"gopkg.in/gomail.v2"
@@ -18,6 +20,21 @@ const (
 	WorkMail    = "work"
 )
 
+// Attachment is a file attached to a mail, its content is read while the mail is sent
+type Attachment struct {
+	Name string
+	Open func() (io.ReadCloser, error)
+}
+
+// Link is a download link listed in a mail, for files that are too large to attach
+type Link struct {
+	Name        string
+	URL         string
+	Size        int64
+	ContentType string
+	Expires     time.Time
+}
+
 type Mailer struct {
 	targetEmailPrivate string
 	targetEmailWork    string
@@ -55,7 +72,16 @@ func NewMailer(cfg config.AppConfig) *Mailer {
 	}
 }
 
-func (m *Mailer) SendMail(subject string, target string, body string, attachments []string) error {
+func (m *Mailer) SendMail(subject string, target string, body string, attachments []Attachment) error {
+	return m.send(subject, target, defineBody(subject, body), attachments)
+}
+
+// SendMailWithLinks sends a mail with the download links listed below the body
+func (m *Mailer) SendMailWithLinks(subject string, target string, body string, links []Link) error {
+	return m.send(subject, target, defineBody(subject, body)+linksBody(links), nil)
+}
+
+func (m *Mailer) send(subject string, target string, body string, attachments []Attachment) error {
 	mailer := gomail.NewMessage()
 	mailer.SetHeader("From", m.fromEmail)
 
@@ -70,14 +96,21 @@ func (m *Mailer) SendMail(subject string, target string, body string, attachment
 	}
 
 	// add attachments
-	for _, v := range attachments {
-		incomingFile := path.Join(m.cfg.UploadTarget, v)
-		checkIfFileExists(incomingFile)
-		mailer.Attach(incomingFile)
+	for _, a := range attachments {
+		mailer.Attach(a.Name, gomail.SetCopyFunc(func(w io.Writer) error {
+			content, err := a.Open()
+			if err != nil {
+				return fmt.Errorf("failed to open attachment %s: %w", a.Name, err)
+			}
+			defer content.Close()
+
+			_, err = io.Copy(w, content)
+			return err
+		}))
 	}
 
 	mailer.SetHeader("Subject", fmt.Sprintf("☑️ %s", subject))
-	mailer.SetBody("text/html", defineBody(subject, body))
+	mailer.SetBody("text/html", body)
 
 	d := gomail.NewDialer(m.smtpHost, m.smtpPort, m.smtpUsername, m.smtpPassword)
 	d.SSL = false
@@ -99,10 +132,15 @@ func defineBody(s string, b string) string {
 	return strings.ReplaceAll(escaped, "\n", "<br/>")
 }
 
-func checkIfFileExists(v string) {
-	if _, err := os.Stat(v); os.IsNotExist(err) {
-		logrus.Errorf("file does not exist: %s", v)
-	} else {
-		logrus.Debugf("file exists: %s", v)
+// linksBody lists download links with the size and type of the files
+func linksBody(links []Link) string {
+	var b strings.Builder
+	b.WriteString("<br/><br/><ul>")
+	for _, l := range links {
+		fmt.Fprintf(&b, `<li><a href="%s">%s</a> (%s, %s), available until %s</li>`,
+			html.EscapeString(l.URL), html.EscapeString(l.Name), humanize.IBytes(uint64(l.Size)),
+			html.EscapeString(l.ContentType), l.Expires.Local().Format("2006-01-02 15:04"))
 	}
+	b.WriteString("</ul>")
+	return b.String()
 }
@@ -0,0 +1,179 @@
+package mqttclient
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/rogierlommers/home/internal/config"
+	"github.com/rogierlommers/home/internal/homepage"
+	"github.com/rogierlommers/home/internal/sqlitedb"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultCategory      = "mqtt"
+	connectRetryInterval = 10 * time.Second
+	maxReconnectInterval = 5 * time.Minute
+	qos                  = 1
+)
+
+// Subscription maps a topic filter onto the category of the events it produces
+type Subscription struct {
+	Topic    string
+	Category string
+}
+
+type Client struct {
+	db            *sqlitedb.DB
+	policy        string // for events of unknown sources
+	client        mqtt.Client
+	subscriptions []Subscription
+}
+
+// NewClient connects to the configured broker and subscribes to all configured topics,
+// incoming messages are stored as events. Connection failures are retried with backoff.
+func NewClient(cfg config.AppConfig, db *sqlitedb.DB) (*Client, error) {
+	subscriptions, err := parseTopics(cfg.MQTTTopics)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(subscriptions) == 0 {
+		return nil, fmt.Errorf("no mqtt topics configured")
+	}
+
+	c := &Client{
+		db:            db,
+		policy:        cfg.UnknownSourcePolicy,
+		subscriptions: subscriptions,
+	}
+
+	opts := mqtt.NewClientOptions().
+		AddBroker(cfg.MQTTBroker).
+		SetClientID(cfg.MQTTClientID).
+		SetUsername(cfg.MQTTUsername).
+		SetPassword(cfg.MQTTPassword).
+		SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetConnectRetryInterval(connectRetryInterval).
+		SetMaxReconnectInterval(maxReconnectInterval).
+		SetOnConnectHandler(c.subscribe).
+		SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+			logrus.Errorf("lost connection to mqtt broker %s: %v", cfg.MQTTBroker, err)
+		}).
+		SetReconnectingHandler(func(_ mqtt.Client, _ *mqtt.ClientOptions) {
+			logrus.Infof("reconnecting to mqtt broker %s", cfg.MQTTBroker)
+		})
+
+	c.client = mqtt.NewClient(opts)
+
+	// with connect retry enabled, the token only completes once connected
+	c.client.Connect()
+	logrus.Infof("connecting to mqtt broker %s, subscribing to %d topics", cfg.MQTTBroker, len(subscriptions))
+
+	return c, nil
+}
+
+// Close disconnects from the broker
+func (c *Client) Close() {
+	c.client.Disconnect(250)
+}
+
+// subscribe is called on every (re)connect, as subscriptions do not survive a clean session
+func (c *Client) subscribe(client mqtt.Client) {
+	logrus.Info("connected to mqtt broker")
+
+	for _, s := range c.subscriptions {
+		token := client.Subscribe(s.Topic, qos, c.handler(s))
+		if token.Wait() && token.Error() != nil {
+			logrus.Errorf("failed to subscribe to mqtt topic %s: %v", s.Topic, token.Error())
+			continue
+		}
+		logrus.Debugf("subscribed to mqtt topic %s", s.Topic)
+	}
+}
+
+func (c *Client) handler(s Subscription) mqtt.MessageHandler {
+	return func(_ mqtt.Client, m mqtt.Message) {
+
+		// retained messages are replayed on every reconnect, they were stored before
+		if m.Retained() {
+			logrus.Debugf("skipping retained mqtt message on %s", m.Topic())
+			return
+		}
+
+		msg := toMessage(m.Topic(), m.Payload(), s.Category)
+		if err := homepage.IngestEvent(c.db, c.policy, msg); err != nil {
+			logrus.Errorf("failed to store mqtt message from %s: %v", m.Topic(), err)
+		}
+	}
+}
+
+// toMessage maps a topic and payload onto an event. The source is the first
+// segment of the topic. A JSON object payload becomes the attributes, a scalar
+// JSON payload (e.g. a temperature) is stored as the "value" attribute.
+func toMessage(topic string, payload []byte, category string) homepage.Message {
+	msg := homepage.Message{
+		Source:   strings.SplitN(topic, "/", 2)[0],
+		Category: category,
+		Message:  topic,
+	}
+
+	trimmed := bytes.TrimSpace(payload)
+	if len(trimmed) == 0 {
+		return msg
+	}
+
+	var value any
+	if err := json.Unmarshal(trimmed, &value); err != nil {
+		msg.Message = string(trimmed)
+		return msg
+	}
+
+	switch v := value.(type) {
+	case map[string]any:
+		msg.Attributes = v
+		if text, ok := v["message"].(string); ok && text != "" {
+			msg.Message = text
+		}
+	case string:
+		msg.Message = v
+	default:
+		msg.Attributes = map[string]any{"value": v}
+	}
+
+	return msg
+}
+
+// parseTopics parses a comma separated list of topic filters, each optionally
+// followed by the category for its events: "zigbee2mqtt/+=sensor,home/alarm/#=alarm"
+func parseTopics(s string) ([]Subscription, error) {
+	var subscriptions []Subscription
+
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		topic, category, _ := strings.Cut(entry, "=")
+		topic = strings.TrimSpace(topic)
+		category = strings.TrimSpace(category)
+
+		if topic == "" {
+			return nil, fmt.Errorf("invalid mqtt topic definition: %q", entry)
+		}
+
+		if category == "" {
+			category = defaultCategory
+		}
+
+		subscriptions = append(subscriptions, Subscription{Topic: topic, Category: category})
+	}
+
+	return subscriptions, nil
+}
@@ -0,0 +1,133 @@
+package mqttclient
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	server "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"github.com/mochi-mqtt/server/v2/listeners"
+	"github.com/rogierlommers/home/internal/config"
+	"github.com/rogierlommers/home/internal/sqlitedb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseTopics(t *testing.T) {
+	subscriptions, err := parseTopics("zigbee2mqtt/+=sensor, home/alarm/#=alarm ,shellies/#")
+	assert.NoError(t, err)
+	assert.Equal(t, []Subscription{
+		{Topic: "zigbee2mqtt/+", Category: "sensor"},
+		{Topic: "home/alarm/#", Category: "alarm"},
+		{Topic: "shellies/#", Category: defaultCategory},
+	}, subscriptions)
+
+	_, err = parseTopics("=sensor")
+	assert.Error(t, err)
+}
+
+func TestToMessage(t *testing.T) {
+	tests := []struct {
+		name               string
+		topic              string
+		payload            string
+		expectedSource     string
+		expectedMessage    string
+		expectedAttributes map[string]any
+	}{
+		{
+			name:               "json object",
+			topic:              "zigbee2mqtt/living_room",
+			payload:            `{"temperature": 21.5, "humidity": 40}`,
+			expectedSource:     "zigbee2mqtt",
+			expectedMessage:    "zigbee2mqtt/living_room",
+			expectedAttributes: map[string]any{"temperature": 21.5, "humidity": float64(40)},
+		},
+		{
+			name:               "json object with message",
+			topic:              "home/alarm/door",
+			payload:            `{"message": "front door opened", "open": true}`,
+			expectedSource:     "home",
+			expectedMessage:    "front door opened",
+			expectedAttributes: map[string]any{"message": "front door opened", "open": true},
+		},
+		{
+			name:               "numeric payload",
+			topic:              "sensors/garden/temperature",
+			payload:            "12.3",
+			expectedSource:     "sensors",
+			expectedMessage:    "sensors/garden/temperature",
+			expectedAttributes: map[string]any{"value": 12.3},
+		},
+		{
+			name:            "plain text payload",
+			topic:           "shellies/washer",
+			payload:         "washing machine done",
+			expectedSource:  "shellies",
+			expectedMessage: "washing machine done",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := toMessage(tt.topic, []byte(tt.payload), "sensor")
+			assert.Equal(t, tt.expectedSource, msg.Source)
+			assert.Equal(t, tt.expectedMessage, msg.Message)
+			assert.Equal(t, "sensor", msg.Category)
+			assert.Equal(t, tt.expectedAttributes, msg.Attributes)
+		})
+	}
+}
+
+func TestClientIngestsEvents(t *testing.T) {
+	address := freeAddress(t)
+
+	// in-process broker
+	broker := server.New(&server.Options{InlineClient: true})
+	require.NoError(t, broker.AddHook(new(auth.AllowHook), nil))
+	require.NoError(t, broker.AddListener(listeners.NewTCP(listeners.Config{ID: "test", Address: address})))
+	go broker.Serve()
+	defer broker.Close()
+
+	db := sqlitedb.InitDatabase(config.AppConfig{Database: filepath.Join(t.TempDir(), "test.db")})
+	defer db.Close()
+
+	client, err := NewClient(config.AppConfig{
+		MQTTBroker:   "tcp://" + address,
+		MQTTClientID: "home-service-test",
+		MQTTTopics:   "zigbee2mqtt/+=sensor",
+	}, db)
+	require.NoError(t, err)
+	defer client.Close()
+
+	// wait until subscribed, the broker drops messages without subscribers
+	require.Eventually(t, func() bool {
+		return client.client.IsConnectionOpen() && len(broker.Topics.Subscribers("zigbee2mqtt/kitchen").Subscriptions) > 0
+	}, 5*time.Second, 20*time.Millisecond)
+
+	require.NoError(t, broker.Publish("zigbee2mqtt/kitchen", []byte(`{"temperature": 19.5}`), false, 0))
+	require.NoError(t, broker.Publish("other/topic", []byte(`ignored`), false, 0))
+
+	var source, category, attributes string
+	assert.Eventually(t, func() bool {
+		err := db.Conn.QueryRow(`SELECT source, category, attributes FROM events`).Scan(&source, &category, &attributes)
+		return err == nil
+	}, 5*time.Second, 20*time.Millisecond)
+
+	assert.Equal(t, "zigbee2mqtt", source)
+	assert.Equal(t, "sensor", category)
+	assert.JSONEq(t, `{"temperature": 19.5}`, attributes)
+
+	var count int
+	assert.NoError(t, db.Conn.QueryRow(`SELECT COUNT(*) FROM events`).Scan(&count))
+	assert.Equal(t, 1, count)
+}
+
+func freeAddress(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	return l.Addr().String()
+}
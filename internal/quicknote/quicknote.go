@@ -1,21 +1,25 @@
 package quicknote
 
 import (
+	"bufio"
 	"bytes"
 	"embed"
+	"errors"
 	"fmt"
 	"html/template"
 	"io"
 	"net/http"
-	"os"
+	"path"
 	"path/filepath"
 	"strings"
 
 	"github.com/dustin/go-humanize"
 	"github.com/gin-gonic/gin"
+	"github.com/rogierlommers/home/internal/auth"
 	"github.com/rogierlommers/home/internal/config"
 	"github.com/rogierlommers/home/internal/mailer"
 	"github.com/rogierlommers/home/internal/sqlitedb"
+	"github.com/rogierlommers/home/internal/storage"
 	"github.com/sirupsen/logrus"
 )
 
@@ -44,12 +48,16 @@ type TextInput struct {
 }
 
 // NewQuicknote initializes quicknote routes
-func NewQuicknote(router *gin.Engine, cfg config.AppConfig, m *mailer.Mailer, stats *sqlitedb.DB, staticHtmlFS embed.FS) {
+func NewQuicknote(router *auth.Router, cfg config.AppConfig, m *mailer.Mailer, stats *sqlitedb.DB, events storage.EventLog, staticHtmlFS embed.FS) {
 	staticFS = staticHtmlFS
-	router.POST("/api/notes/send", sendMailHandler(m, cfg, stats))
+
+	notes := router.Group("/api/notes", auth.SessionOrAPIKey(auth.ScopeNotes))
+	notes.POST("/send", sendMailHandler(m, cfg, stats, events))
 }
 
-func sendMailHandler(m *mailer.Mailer, cfg config.AppConfig, stats *sqlitedb.DB) gin.HandlerFunc {
+func sendMailHandler(m *mailer.Mailer, cfg config.AppConfig, stats *sqlitedb.DB, events storage.EventLog) gin.HandlerFunc {
+	store := storage.New(cfg, stats)
+
 	return func(c *gin.Context) {
 		inputType := c.GetHeader("x-input-type")
 		testHeader := c.GetHeader("x-test")
@@ -57,7 +65,7 @@ func sendMailHandler(m *mailer.Mailer, cfg config.AppConfig, stats *sqlitedb.DB)
 
 		var (
 			title         string
-			fileOnDisk    string
+			stored        sqlitedb.File
 			hasAttachment bool
 			err           error
 		)
@@ -73,7 +81,16 @@ func sendMailHandler(m *mailer.Mailer, cfg config.AppConfig, stats *sqlitedb.DB)
 			hasAttachment = false
 
 		case InputTypeFile:
-			title, fileOnDisk, err = handleFileInput(c, cfg.UploadTarget)
+			title, stored, err = handleFileInput(c, store)
+			if storage.NoSpace(err) {
+				c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": err.Error()})
+				return
+			}
+			if errors.Is(err, storage.ErrRejected) {
+				storage.LogRejected(events, err)
+				c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": err.Error()})
+				return
+			}
 			if err != nil {
 				logrus.Errorf("Failed to handle file input: %v", err)
 				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to process file"})
@@ -93,16 +110,22 @@ func sendMailHandler(m *mailer.Mailer, cfg config.AppConfig, stats *sqlitedb.DB)
 		}
 
 		// Send email
-		htmlContent, err := renderEmailTemplate(title, fileOnDisk, hasAttachment)
+		htmlContent, err := renderEmailTemplate(title, stored, hasAttachment)
 		if err != nil {
 			logrus.Errorf("Failed to render email template: %v", err)
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to prepare email"})
 			return
 		}
 
-		var attachments []string
+		var attachments []mailer.Attachment
 		if hasAttachment {
-			attachments = []string{filepath.Base(fileOnDisk)}
+			attachments = []mailer.Attachment{{
+				Name: path.Base(stored.Name),
+				Open: func() (io.ReadCloser, error) {
+					content, _, err := store.Open(stored.Name)
+					return content, err
+				},
+			}}
 		}
 
 		// Update statistics and prepare response
@@ -111,9 +134,8 @@ func sendMailHandler(m *mailer.Mailer, cfg config.AppConfig, stats *sqlitedb.DB)
 
 		if hasAttachment {
 			statsSource = StatSourceWithAttachment
-			fileSize := getFileSize(fileOnDisk)
 			responseMessage = fmt.Sprintf("Note with attachment %s sent (%s)",
-				filepath.Base(fileOnDisk), humanize.Bytes(fileSize))
+				path.Base(stored.Name), humanize.Bytes(uint64(stored.Size)))
 		}
 
 		if err := stats.IncrementEntry(statsSource); err != nil {
@@ -144,31 +166,45 @@ func handleTextInput(c *gin.Context) (string, error) {
 }
 
 // handleFileInput processes file-based quicknotes
-func handleFileInput(c *gin.Context, uploadTarget string) (string, string, error) {
+func handleFileInput(c *gin.Context, store *storage.Store) (string, sqlitedb.File, error) {
 	filename := c.GetHeader("x-filename")
 	if filename == "" {
-		return "", "", fmt.Errorf("missing x-filename header")
+		return "", sqlitedb.File{}, fmt.Errorf("missing x-filename header")
 	}
 
-	bodyBytes, err := io.ReadAll(c.Request.Body)
+	// refuse files that do not fit before reading them
+	if err := store.Check(c.Request.ContentLength); err != nil {
+		return "", sqlitedb.File{}, err
+	}
+
+	// bodies without a length are cut off when they no longer fit, one byte later than
+	// the limit so the store reports which limit was hit
+	limit, err := store.FileLimit()
 	if err != nil {
-		return "", "", fmt.Errorf("failed to read request body: %w", err)
+		return "", sqlitedb.File{}, err
+	}
+	if limit.Bytes >= 0 {
+		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, limit.Bytes+1)
 	}
 
-	if len(bodyBytes) == 0 {
-		return "", "", fmt.Errorf("empty file content")
+	body := bufio.NewReader(c.Request.Body)
+	if _, err := body.Peek(1); err == io.EOF {
+		return "", sqlitedb.File{}, fmt.Errorf("empty file content")
+	} else if err != nil {
+		return "", sqlitedb.File{}, fmt.Errorf("failed to read request body: %w", err)
 	}
 
-	fileOnDisk := filepath.Join(uploadTarget, filename)
-	if err := os.WriteFile(fileOnDisk, bodyBytes, 0644); err != nil {
-		return "", "", fmt.Errorf("failed to write file: %w", err)
+	upload := storage.Upload{Uploader: c.ClientIP(), Source: sqlitedb.FileSourceQuicknote}
+	stored, err := store.Save(filename, body, upload)
+	if err != nil {
+		return "", sqlitedb.File{}, fmt.Errorf("failed to write file: %w", err)
 	}
 
-	return filename, fileOnDisk, nil
+	return filename, stored, nil
 }
 
 // renderEmailTemplate generates HTML content for the email
-func renderEmailTemplate(title, fileOnDisk string, hasAttachment bool) (string, error) {
+func renderEmailTemplate(title string, stored sqlitedb.File, hasAttachment bool) (string, error) {
 	htmlBytes, err := staticFS.ReadFile("static_html/quicknote_received.html")
 	if err != nil {
 		return "", fmt.Errorf("failed to read template file: %w", err)
@@ -189,7 +225,7 @@ func renderEmailTemplate(title, fileOnDisk string, hasAttachment bool) (string,
 	}
 
 	if hasAttachment {
-		data.Attachment = createAttachmentInfo(fileOnDisk)
+		data.Attachment = createAttachmentInfo(stored)
 	}
 
 	var buf bytes.Buffer
@@ -201,21 +237,11 @@ func renderEmailTemplate(title, fileOnDisk string, hasAttachment bool) (string,
 }
 
 // createAttachmentInfo creates attachment metadata
-func createAttachmentInfo(fileOnDisk string) *AttachmentInfo {
-	fileInfo, err := os.Stat(fileOnDisk)
-	if err != nil {
-		logrus.Errorf("Failed to get file info for %s: %v", fileOnDisk, err)
-		return &AttachmentInfo{
-			Filename: filepath.Base(fileOnDisk),
-			Size:     "Unknown",
-			Type:     "Unknown",
-		}
-	}
-
+func createAttachmentInfo(stored sqlitedb.File) *AttachmentInfo {
 	return &AttachmentInfo{
-		Filename: filepath.Base(fileOnDisk),
-		Size:     humanize.Bytes(uint64(fileInfo.Size())),
-		Type:     getFileType(fileOnDisk),
+		Filename: path.Base(stored.Name),
+		Size:     humanize.Bytes(uint64(stored.Size)),
+		Type:     getFileType(stored.ContentType, stored.Name),
 	}
 }
 
@@ -227,40 +253,30 @@ func determineTargetEmail(content string) string {
 	return mailer.PrivateMail
 }
 
-// getFileSize safely gets file size
-func getFileSize(filename string) uint64 {
-	fileInfo, err := os.Stat(filename)
-	if err != nil {
-		logrus.Errorf("Failed to get file size for %s: %v", filename, err)
-		return 0
-	}
-	return uint64(fileInfo.Size())
-}
-
-// getFileType determines file type from extension
-func getFileType(filename string) string {
-	ext := strings.ToLower(filepath.Ext(filename))
-	switch ext {
-	case ".jpg", ".jpeg":
+// getFileType describes the type of a file by its content type, as sniffed when it was
+// stored. Other types are described by the extension.
+func getFileType(contentType, filename string) string {
+	switch storage.MediaType(contentType) {
+	case "image/jpeg":
 		return "JPEG Image"
-	case ".png":
+	case "image/png":
 		return "PNG Image"
-	case ".gif":
+	case "image/gif":
 		return "GIF Image"
-	case ".pdf":
+	case "application/pdf":
 		return "PDF Document"
-	case ".txt":
+	case "text/plain":
 		return "Text File"
-	case ".doc", ".docx":
+	case "application/msword", "application/vnd.openxmlformats-officedocument.wordprocessingml.document":
 		return "Word Document"
-	case ".zip":
+	case "application/zip":
 		return "ZIP Archive"
-	default:
-		if ext != "" {
-			return strings.ToUpper(ext[1:]) + " File"
-		}
-		return "Unknown File"
 	}
+
+	if ext := filepath.Ext(filename); ext != "" {
+		return strings.ToUpper(ext[1:]) + " File"
+	}
+	return "Unknown File"
 }
 
 // stripWorkPrefix removes work prefix from content
@@ -2,15 +2,26 @@ package quicknote
 
 import (
 	"bytes"
+	"io"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/gin-gonic/gin"
+	"github.com/rogierlommers/home/internal/config"
 	"github.com/rogierlommers/home/internal/mailer"
+	"github.com/rogierlommers/home/internal/sqlitedb"
+	"github.com/rogierlommers/home/internal/storage"
 	"github.com/stretchr/testify/assert"
 )
 
+func newTestStore(t *testing.T, dir string) *storage.Store {
+	db := sqlitedb.InitDatabase(config.AppConfig{Database: filepath.Join(t.TempDir(), "test.db")})
+	t.Cleanup(db.Close)
+	return storage.New(config.AppConfig{UploadTarget: dir, FileCleanUpInDys: 7}, db)
+}
+
 func TestHandleFileInput(t *testing.T) {
 	gin.SetMode(gin.TestMode)
 
@@ -18,6 +29,7 @@ func TestHandleFileInput(t *testing.T) {
 	tmpDir, err := os.MkdirTemp("", "quicknote_test")
 	assert.NoError(t, err)
 	defer os.RemoveAll(tmpDir)
+	store := newTestStore(t, tmpDir)
 
 	tests := []struct {
 		name          string
@@ -43,6 +55,12 @@ func TestHandleFileInput(t *testing.T) {
 			content:       []byte{},
 			expectedError: true,
 		},
+		{
+			name:          "path traversal",
+			filename:      "../../etc/x",
+			content:       []byte("test content"),
+			expectedError: true,
+		},
 	}
 
 	for _, tt := range tests {
@@ -56,28 +74,93 @@ func TestHandleFileInput(t *testing.T) {
 			}
 			c.Request = req
 
-			title, fileOnDisk, err := handleFileInput(c, tmpDir)
+			title, stored, err := handleFileInput(c, store)
 
 			if tt.expectedError {
 				assert.Error(t, err)
 			} else {
 				assert.NoError(t, err)
 				assert.Equal(t, tt.filename, title)
-				assert.Contains(t, fileOnDisk, tt.filename)
-
-				// Verify file was created
-				_, statErr := os.Stat(fileOnDisk)
-				assert.NoError(t, statErr)
+				assert.Equal(t, tt.filename, stored.Name)
 
 				// Verify file content
-				fileContent, readErr := os.ReadFile(fileOnDisk)
-				assert.NoError(t, readErr)
-				assert.Equal(t, tt.content, fileContent)
+				content, _, openErr := store.Open(stored.Name)
+				if assert.NoError(t, openErr) {
+					fileContent, readErr := io.ReadAll(content)
+					content.Close()
+					assert.NoError(t, readErr)
+					assert.Equal(t, tt.content, fileContent)
+				}
 			}
 		})
 	}
 }
 
+func TestHandleFileInputCollision(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	store := newTestStore(t, t.TempDir())
+
+	var stored []string
+	for _, content := range []string{"first", "second"} {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request = httptest.NewRequest("POST", "/", bytes.NewBufferString(content))
+		c.Request.Header.Set("X-filename", "note.txt")
+
+		_, file, err := handleFileInput(c, store)
+		assert.NoError(t, err)
+		stored = append(stored, file.Name)
+	}
+
+	assert.Equal(t, []string{"note.txt", "note (1).txt"}, stored)
+
+	files, err := store.List("note")
+	assert.NoError(t, err)
+	if assert.Len(t, files, 2) {
+		assert.Equal(t, sqlitedb.FileSourceQuicknote, files[0].Source)
+	}
+}
+
+func TestHandleFileInputLimit(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	db := sqlitedb.InitDatabase(config.AppConfig{Database: filepath.Join(t.TempDir(), "test.db")})
+	t.Cleanup(db.Close)
+	store := storage.New(config.AppConfig{UploadTarget: t.TempDir(), StorageMaxUploadMB: 1}, db)
+
+	// a body without a length is read until it no longer fits
+	body := &countingReader{r: io.LimitReader(zeros{}, 8<<20)}
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest("POST", "/", nil)
+	c.Request.Body = io.NopCloser(body)
+	c.Request.ContentLength = -1
+	c.Request.Header.Set("X-filename", "large.bin")
+
+	_, _, err := handleFileInput(c, store)
+	assert.ErrorIs(t, err, storage.ErrTooLarge)
+	assert.Less(t, body.n, int64(2<<20))
+
+	files, err := store.List("")
+	assert.NoError(t, err)
+	assert.Empty(t, files)
+}
+
+type zeros struct{}
+
+func (zeros) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
 func TestDetermineTargetEmail(t *testing.T) {
 	tests := []struct {
 		name     string
@@ -152,25 +235,26 @@ func TestStripWorkPrefix(t *testing.T) {
 
 func TestGetFileType(t *testing.T) {
 	tests := []struct {
-		filename string
-		expected string
+		contentType string
+		filename    string
+		expected    string
 	}{
-		{"test.jpg", "JPEG Image"},
-		{"test.jpeg", "JPEG Image"},
-		{"test.png", "PNG Image"},
-		{"test.gif", "GIF Image"},
-		{"test.pdf", "PDF Document"},
-		{"test.txt", "Text File"},
-		{"test.doc", "Word Document"},
-		{"test.docx", "Word Document"},
-		{"test.zip", "ZIP Archive"},
-		{"test.unknown", "UNKNOWN File"},
-		{"test", "Unknown File"},
+		{"image/jpeg", "test.jpg", "JPEG Image"},
+		{"image/jpeg", "photo", "JPEG Image"},
+		{"image/png", "test.png", "PNG Image"},
+		{"image/gif", "test.gif", "GIF Image"},
+		{"application/pdf", "test.pdf", "PDF Document"},
+		{"text/plain; charset=utf-8", "test.txt", "Text File"},
+		{"application/msword", "test.doc", "Word Document"},
+		{"application/vnd.openxmlformats-officedocument.wordprocessingml.document", "test.docx", "Word Document"},
+		{"application/zip", "test.zip", "ZIP Archive"},
+		{"application/octet-stream", "test.unknown", "UNKNOWN File"},
+		{"application/octet-stream", "test", "Unknown File"},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.filename, func(t *testing.T) {
-			result := getFileType(tt.filename)
+			result := getFileType(tt.contentType, tt.filename)
 			assert.Equal(t, tt.expected, result)
 		})
 	}
@@ -180,7 +264,7 @@ func TestGetFileType(t *testing.T) {
 func BenchmarkGetFileType(b *testing.B) {
 	filename := "test.jpg"
 	for i := 0; i < b.N; i++ {
-		getFileType(filename)
+		getFileType("image/jpeg", filename)
 	}
 }
 
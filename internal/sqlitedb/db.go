@@ -2,6 +2,7 @@ package sqlitedb
 
 import (
 	"database/sql"
+	"fmt"
 
 	"github.com/rogierlommers/home/internal/config"
 	"github.com/sirupsen/logrus"
@@ -13,7 +14,8 @@ type DB struct {
 }
 
 func InitDatabase(cfg config.AppConfig) *DB {
-	db, err := sql.Open("sqlite", cfg.Database)
+	// writers wait for each other for a while, instead of failing right away
+	db, err := sql.Open("sqlite", cfg.Database+"?_pragma=busy_timeout(5000)")
 	if err != nil {
 		logrus.Fatalf("failed to open db: %v", err)
 	}
@@ -46,9 +48,118 @@ func InitDatabase(cfg config.AppConfig) *DB {
             source TEXT,
             message TEXT NOT NULL,
             category TEXT,
-            added TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+            added TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+            received TIMESTAMP,
+            attributes TEXT,
+            dedup_key TEXT,
+            repeat_count INTEGER NOT NULL DEFAULT 1,
+            last_seen TIMESTAMP,
+            acknowledged_at TIMESTAMP,
+            acknowledged_by TEXT,
+            severity TEXT,
+            quarantined BOOLEAN NOT NULL DEFAULT 0,
+            restored_at TIMESTAMP
         );
 
+        CREATE TABLE IF NOT EXISTS event_autoack_rules (
+            id INTEGER PRIMARY KEY AUTOINCREMENT,
+            category TEXT NOT NULL DEFAULT '',
+            source TEXT NOT NULL DEFAULT '',
+            created TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+        );
+
+        CREATE TABLE IF NOT EXISTS webhooks (
+            id INTEGER PRIMARY KEY AUTOINCREMENT,
+            name TEXT NOT NULL,
+            url TEXT NOT NULL,
+            secret TEXT NOT NULL,
+            categories TEXT NOT NULL DEFAULT '',
+            sources TEXT NOT NULL DEFAULT '',
+            enabled BOOLEAN NOT NULL DEFAULT 1,
+            created TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+        );
+
+        CREATE TABLE IF NOT EXISTS webhook_deliveries (
+            id INTEGER PRIMARY KEY AUTOINCREMENT,
+            webhook_id INTEGER NOT NULL,
+            event_id INTEGER NOT NULL,
+            payload TEXT NOT NULL,
+            status TEXT NOT NULL DEFAULT 'pending',
+            attempts INTEGER NOT NULL DEFAULT 0,
+            next_attempt TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+            status_code INTEGER,
+            error TEXT,
+            created TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+            delivered_at TIMESTAMP,
+            FOREIGN KEY (webhook_id) REFERENCES webhooks(id)
+        );
+
+        CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_pending
+        ON webhook_deliveries (status, next_attempt);
+
+        CREATE TABLE IF NOT EXISTS heartbeat_monitors (
+            id INTEGER PRIMARY KEY AUTOINCREMENT,
+            name TEXT UNIQUE NOT NULL,
+            interval_minutes INTEGER NOT NULL,
+            last_seen TIMESTAMP,
+            status TEXT NOT NULL DEFAULT 'unknown',
+            status_since TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+            created TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+        );
+
+        CREATE TABLE IF NOT EXISTS event_sources (
+            id INTEGER PRIMARY KEY AUTOINCREMENT,
+            name TEXT UNIQUE NOT NULL,
+            description TEXT NOT NULL DEFAULT '',
+            expected_categories TEXT NOT NULL DEFAULT '',
+            owner TEXT NOT NULL DEFAULT '',
+            token_hash TEXT UNIQUE NOT NULL,
+            last_seen TIMESTAMP,
+            created TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+        );
+
+        CREATE TABLE IF NOT EXISTS files (
+            id INTEGER PRIMARY KEY AUTOINCREMENT,
+            stored_name TEXT UNIQUE NOT NULL,
+            original_name TEXT NOT NULL,
+            content_type TEXT NOT NULL DEFAULT '',
+            sha256 TEXT NOT NULL DEFAULT '',
+            size INTEGER NOT NULL DEFAULT 0,
+            uploader TEXT NOT NULL DEFAULT '',
+            source TEXT NOT NULL DEFAULT '',
+            uploaded TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+            expires TIMESTAMP,
+            pinned BOOLEAN NOT NULL DEFAULT 0,
+            folder TEXT NOT NULL DEFAULT ''
+        );
+
+        CREATE INDEX IF NOT EXISTS idx_files_expires
+        ON files (expires);
+
+        CREATE TABLE IF NOT EXISTS file_shares (
+            id INTEGER PRIMARY KEY AUTOINCREMENT,
+            public_id TEXT UNIQUE NOT NULL,
+            file_name TEXT NOT NULL,
+            password_hash TEXT NOT NULL DEFAULT '',
+            expires TIMESTAMP NOT NULL,
+            max_downloads INTEGER NOT NULL DEFAULT 0,
+            downloads INTEGER NOT NULL DEFAULT 0,
+            revoked BOOLEAN NOT NULL DEFAULT 0,
+            created TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+        );
+
+        CREATE INDEX IF NOT EXISTS idx_file_shares_file_name
+        ON file_shares (file_name);
+
+        CREATE TABLE IF NOT EXISTS folders (
+            path TEXT PRIMARY KEY,
+            parent TEXT NOT NULL,
+            created TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+        );
+
+        CREATE INDEX IF NOT EXISTS idx_folders_parent
+        ON folders (parent);
+
         CREATE INDEX IF NOT EXISTS idx_ha_events_categories
         ON events (category);
 
@@ -58,6 +169,44 @@ func InitDatabase(cfg config.AppConfig) *DB {
 		logrus.Fatalf("failed to create table: %v", err)
 	}
 
+	// columns added after the initial release of a table
+	addColumn(db, "events", "attributes", "TEXT")
+	addColumn(db, "events", "dedup_key", "TEXT")
+	addColumn(db, "events", "repeat_count", "INTEGER NOT NULL DEFAULT 1")
+	addColumn(db, "events", "last_seen", "TIMESTAMP")
+	addColumn(db, "events", "acknowledged_at", "TIMESTAMP")
+	addColumn(db, "events", "acknowledged_by", "TEXT")
+	addColumn(db, "events", "severity", "TEXT")
+	addColumn(db, "events", "quarantined", "BOOLEAN NOT NULL DEFAULT 0")
+	addColumn(db, "events", "received", "TIMESTAMP")
+	addColumn(db, "events", "restored_at", "TIMESTAMP")
+	addColumn(db, "files", "pinned", "BOOLEAN NOT NULL DEFAULT 0")
+	addColumn(db, "files", "folder", "TEXT NOT NULL DEFAULT ''")
+
+	_, err = db.Exec(`
+        CREATE INDEX IF NOT EXISTS idx_events_added
+        ON events (added);
+
+        CREATE INDEX IF NOT EXISTS idx_events_dedup_key
+        ON events (dedup_key);
+
+        CREATE INDEX IF NOT EXISTS idx_events_source
+        ON events (source);
+
+        CREATE INDEX IF NOT EXISTS idx_events_acknowledged_at
+        ON events (acknowledged_at);
+
+        CREATE INDEX IF NOT EXISTS idx_files_folder
+        ON files (folder);
+
+        CREATE INDEX IF NOT EXISTS idx_files_sha256
+        ON files (sha256);
+        `)
+
+	if err != nil {
+		logrus.Fatalf("failed to create index: %v", err)
+	}
+
 	logrus.Debugf("Database initialized, file: %s", cfg.Database)
 
 	createCategories(db)
@@ -86,6 +235,49 @@ func createCategories(db *sql.DB) {
 
 }
 
+// addColumn adds a column to an existing table when it is not there yet,
+// so databases created by older versions are migrated on startup
+func addColumn(db *sql.DB, table, column, definition string) {
+	if hasColumn(db, table, column) {
+		return
+	}
+
+	if _, err := db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition)); err != nil {
+		logrus.Fatalf("failed to add column %s to %s: %v", column, table, err)
+	}
+
+	logrus.Infof("added column %s to table %s", column, table)
+}
+
+func hasColumn(db *sql.DB, table, column string) bool {
+	rows, err := db.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		logrus.Fatalf("failed to read table info for %s: %v", table, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			cid        int
+			name       string
+			columnType string
+			notNull    bool
+			defaultVal sql.NullString
+			primaryKey int
+		)
+
+		if err := rows.Scan(&cid, &name, &columnType, &notNull, &defaultVal, &primaryKey); err != nil {
+			logrus.Fatalf("failed to scan table info for %s: %v", table, err)
+		}
+
+		if name == column {
+			return true
+		}
+	}
+
+	return false
+}
+
 func (s *DB) Close() {
 	if err := s.Conn.Close(); err != nil {
 		logrus.Errorf("failed to close stats db: %v", err)
@@ -1,6 +1,44 @@
 package sqlitedb
 
-import "github.com/sirupsen/logrus"
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// TimestampLayout is the layout sqlite uses for CURRENT_TIMESTAMP, timestamps
+// written by the application use the same layout so they compare correctly
+const TimestampLayout = "2006-01-02 15:04:05"
+
+// bucketFormats maps an aggregation interval onto a strftime format
+var bucketFormats = map[string]string{
+	"minute": "%Y-%m-%dT%H:%M:00Z",
+	"hour":   "%Y-%m-%dT%H:00:00Z",
+	"day":    "%Y-%m-%dT00:00:00Z",
+}
+
+// EventAggregate holds the statistics of all events within one time bucket
+// for a single category and source combination
+type EventAggregate struct {
+	Bucket   string   `json:"bucket"`
+	Category string   `json:"category"`
+	Source   string   `json:"source"`
+	Count    int      `json:"count"`
+	Min      *float64 `json:"min,omitempty"`
+	Max      *float64 `json:"max,omitempty"`
+	Avg      *float64 `json:"avg,omitempty"`
+}
+
+// AggregateOptions defines how events are grouped and filtered
+type AggregateOptions struct {
+	Interval  string    // minute, hour or day
+	Attribute string    // optional numeric attribute to calculate min/max/avg for
+	Category  string    // optional category filter
+	Source    string    // optional source filter
+	Since     time.Time // only events added after this moment
+}
 
 func (s *DB) GetEventsCategories() ([]string, error) {
 	var eventCategories []string
@@ -29,9 +67,81 @@ func (s *DB) GetEventsCategories() ([]string, error) {
 	return eventCategories, nil
 }
 
-func (s *DB) DeleteOldEvents() (int, error) {
-	// delete all events older than 30 days
-	result, err := s.Conn.Exec("DELETE FROM events WHERE added < datetime('now', '-30 days')")
+// AggregateEvents buckets events per interval, category and source. All
+// calculations are done by sqlite, so only the buckets are loaded in memory.
+func (s *DB) AggregateEvents(opts AggregateOptions) ([]EventAggregate, error) {
+	format, ok := bucketFormats[opts.Interval]
+	if !ok {
+		return nil, fmt.Errorf("unsupported interval: %q", opts.Interval)
+	}
+
+	// only numeric values of the attribute are taken into account
+	numeric := "NULL"
+	args := []any{format}
+	if opts.Attribute != "" {
+		path := fmt.Sprintf("$.%q", opts.Attribute)
+		numeric = "CASE WHEN json_type(attributes, ?) IN ('integer', 'real') THEN json_extract(attributes, ?) END"
+		args = append(args, path, path, path, path, path, path)
+	}
+
+	query := fmt.Sprintf(`
+		SELECT strftime(?, added) AS bucket,
+		       COALESCE(category, '') AS category,
+		       COALESCE(source, '') AS source,
+		       COUNT(*),
+		       MIN(%[1]s), MAX(%[1]s), AVG(%[1]s)
+		FROM events
+		WHERE added >= ?`, numeric)
+	args = append(args, opts.Since.UTC().Format(TimestampLayout))
+
+	if opts.Category != "" {
+		query += ` AND category = ?`
+		args = append(args, opts.Category)
+	}
+
+	if opts.Source != "" {
+		query += ` AND source = ?`
+		args = append(args, opts.Source)
+	}
+
+	query += ` GROUP BY bucket, category, source ORDER BY bucket ASC, category ASC, source ASC`
+
+	rows, err := s.Conn.Query(query, args...)
+	if err != nil {
+		logrus.Errorf("Failed to aggregate events: %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	aggregates := []EventAggregate{}
+	for rows.Next() {
+		var (
+			a                    EventAggregate
+			lowest, highest, avg sql.NullFloat64
+		)
+
+		if err := rows.Scan(&a.Bucket, &a.Category, &a.Source, &a.Count, &lowest, &highest, &avg); err != nil {
+			logrus.Errorf("Failed to scan aggregate row: %v", err)
+			return nil, err
+		}
+
+		a.Min = nullFloat(lowest)
+		a.Max = nullFloat(highest)
+		a.Avg = nullFloat(avg)
+		aggregates = append(aggregates, a)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return aggregates, nil
+}
+
+// DeleteOldEvents deletes all events added before the given moment. Restored events
+// expire from the moment they were restored instead.
+func (s *DB) DeleteOldEvents(before time.Time) (int, error) {
+	result, err := s.Conn.Exec("DELETE FROM events WHERE COALESCE(restored_at, added) < ?", before.UTC().Format(TimestampLayout))
 	if err != nil {
 		logrus.Errorf("Failed to delete old events: %v", err)
 		return 0, err
@@ -45,3 +155,10 @@ func (s *DB) DeleteOldEvents() (int, error) {
 
 	return int(rowsAffected), nil
 }
+
+func nullFloat(f sql.NullFloat64) *float64 {
+	if !f.Valid {
+		return nil
+	}
+	return &f.Float64
+}
@@ -0,0 +1,181 @@
+package sqlitedb
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// AutoAckBy is recorded as acknowledger for events matching an auto-ack rule
+const AutoAckBy = "auto-ack rule"
+
+// AckFilter selects the unacknowledged events to acknowledge in bulk, empty
+// fields are ignored. All has to be set to acknowledge without any filter.
+type AckFilter struct {
+	IDs      []int  `json:"ids"`
+	Category string `json:"category"`
+	Source   string `json:"source"`
+	BeforeID int    `json:"before_id"`
+	All      bool   `json:"all"`
+}
+
+// Empty reports if the filter selects nothing, and does not ask for all events either
+func (f AckFilter) Empty() bool {
+	return !f.All && len(f.IDs) == 0 && f.Category == "" && f.Source == "" && f.BeforeID <= 0
+}
+
+// UnreadCount holds the number of unacknowledged events, in total and per category
+type UnreadCount struct {
+	Unread      int            `json:"unread"`
+	Categories  map[string]int `json:"categories"`
+	Quarantined int            `json:"quarantined"`
+}
+
+// AutoAckRule acknowledges new events that match its category and source on arrival,
+// an empty category or source matches everything
+type AutoAckRule struct {
+	ID       int       `json:"id"`
+	Category string    `json:"category"`
+	Source   string    `json:"source"`
+	Created  time.Time `json:"created"`
+}
+
+// AcknowledgeEvent marks a single event as acknowledged, returns false when the
+// event does not exist or was acknowledged before
+func (s *DB) AcknowledgeEvent(id int, by string) (bool, error) {
+	result, err := s.Conn.Exec(`
+		UPDATE events SET acknowledged_at = CURRENT_TIMESTAMP, acknowledged_by = ?
+		WHERE id = ? AND acknowledged_at IS NULL
+	`, by, id)
+	if err != nil {
+		logrus.Errorf("Failed to acknowledge event %d: %v", id, err)
+		return false, err
+	}
+
+	affected, err := result.RowsAffected()
+	return affected > 0, err
+}
+
+// UnacknowledgeEvent moves an event back to the inbox
+func (s *DB) UnacknowledgeEvent(id int) error {
+	_, err := s.Conn.Exec(`UPDATE events SET acknowledged_at = NULL, acknowledged_by = NULL WHERE id = ?`, id)
+	if err != nil {
+		logrus.Errorf("Failed to unacknowledge event %d: %v", id, err)
+	}
+	return err
+}
+
+// AcknowledgeEvents marks all unacknowledged events matching the filter as acknowledged
+func (s *DB) AcknowledgeEvents(filter AckFilter, by string) (int, error) {
+	query := `UPDATE events SET acknowledged_at = CURRENT_TIMESTAMP, acknowledged_by = ? WHERE acknowledged_at IS NULL`
+	args := []any{by}
+
+	if len(filter.IDs) > 0 {
+		query += ` AND id IN (?` + strings.Repeat(",?", len(filter.IDs)-1) + `)`
+		for _, id := range filter.IDs {
+			args = append(args, id)
+		}
+	}
+
+	if filter.Category != "" {
+		query += ` AND category = ?`
+		args = append(args, filter.Category)
+	}
+
+	if filter.Source != "" {
+		query += ` AND source = ?`
+		args = append(args, filter.Source)
+	}
+
+	if filter.BeforeID > 0 {
+		query += ` AND id <= ?`
+		args = append(args, filter.BeforeID)
+	}
+
+	result, err := s.Conn.Exec(query, args...)
+	if err != nil {
+		logrus.Errorf("Failed to acknowledge events: %v", err)
+		return 0, err
+	}
+
+	affected, err := result.RowsAffected()
+	return int(affected), err
+}
+
+// CountUnreadEvents counts all unacknowledged events, quarantined events are counted separately
+func (s *DB) CountUnreadEvents() (UnreadCount, error) {
+	count := UnreadCount{Categories: map[string]int{}}
+
+	err := s.Conn.QueryRow(`SELECT COUNT(*) FROM events WHERE quarantined = 1 AND acknowledged_at IS NULL`).Scan(&count.Quarantined)
+	if err != nil {
+		logrus.Errorf("Failed to count quarantined events: %v", err)
+		return count, err
+	}
+
+	rows, err := s.Conn.Query(`
+		SELECT COALESCE(category, ''), COUNT(*) FROM events
+		WHERE acknowledged_at IS NULL AND quarantined = 0
+		GROUP BY category
+	`)
+	if err != nil {
+		logrus.Errorf("Failed to count unread events: %v", err)
+		return count, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			category string
+			n        int
+		)
+
+		if err := rows.Scan(&category, &n); err != nil {
+			return count, err
+		}
+
+		count.Categories[category] = n
+		count.Unread += n
+	}
+
+	return count, rows.Err()
+}
+
+func (s *DB) GetAutoAckRules() ([]AutoAckRule, error) {
+	rows, err := s.Conn.Query(`SELECT id, category, source, created FROM event_autoack_rules ORDER BY id ASC`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rules := []AutoAckRule{}
+	for rows.Next() {
+		var r AutoAckRule
+		if err := rows.Scan(&r.ID, &r.Category, &r.Source, &r.Created); err != nil {
+			return nil, err
+		}
+		rules = append(rules, r)
+	}
+
+	return rules, rows.Err()
+}
+
+func (s *DB) AddAutoAckRule(rule AutoAckRule) (int, error) {
+	if rule.Category == "" && rule.Source == "" {
+		return 0, fmt.Errorf("a rule needs a category, a source or both")
+	}
+
+	result, err := s.Conn.Exec(`INSERT INTO event_autoack_rules (category, source) VALUES (?, ?)`, rule.Category, rule.Source)
+	if err != nil {
+		return 0, err
+	}
+
+	id, err := result.LastInsertId()
+	return int(id), err
+}
+
+func (s *DB) DeleteAutoAckRule(id int) error {
+	_, err := s.Conn.Exec(`DELETE FROM event_autoack_rules WHERE id = ?`, id)
+	return err
+}
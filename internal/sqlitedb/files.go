@@ -0,0 +1,278 @@
+package sqlitedb
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// sources of stored files
+const (
+	FileSourceStorage   = "storage"
+	FileSourceQuicknote = "quicknote"
+	FileSourceAPI       = "api"
+	FileSourceWebDAV    = "webdav"
+	FileSourceExternal  = "external" // found on disk, not uploaded through the app
+)
+
+// File is the index entry of a stored file. The name is the path of the file, with "/"
+// between folders. The content is the blob named after the hash, files with the same
+// content share a blob.
+type File struct {
+	ID           int        `json:"id"`
+	Name         string     `json:"name"`
+	Folder       string     `json:"folder"` // empty for files in the upload target itself
+	OriginalName string     `json:"original_name"`
+	ContentType  string     `json:"content_type"`
+	SHA256       string     `json:"sha256"`
+	Size         int64      `json:"size"`
+	Uploader     string     `json:"uploader"`
+	Source       string     `json:"source"`
+	Uploaded     time.Time  `json:"uploaded"`
+	Expires      *time.Time `json:"expires,omitempty"` // nil when the file is kept forever
+	Pinned       bool       `json:"pinned"`            // pinned files are never cleaned up
+}
+
+const fileColumns = `id, stored_name, folder, original_name, content_type, sha256, size, uploader, source, uploaded, expires, pinned`
+
+// SaveFile adds a file to the index, or replaces the entry of a file with the same stored name
+func (s *DB) SaveFile(f File) error {
+	if f.Uploaded.IsZero() {
+		f.Uploaded = time.Now()
+	}
+
+	_, err := s.Conn.Exec(`
+		INSERT INTO files (stored_name, folder, original_name, content_type, sha256, size, uploader, source, uploaded, expires, pinned)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (stored_name) DO UPDATE SET
+			folder = excluded.folder, original_name = excluded.original_name, content_type = excluded.content_type,
+			sha256 = excluded.sha256, size = excluded.size, uploader = excluded.uploader,
+			source = excluded.source, uploaded = excluded.uploaded, expires = excluded.expires,
+			pinned = excluded.pinned
+	`, f.Name, f.Folder, f.OriginalName, f.ContentType, f.SHA256, f.Size, f.Uploader, f.Source,
+		f.Uploaded.UTC().Format(TimestampLayout), optionalTimestamp(f.Expires), f.Pinned)
+	if err != nil {
+		logrus.Errorf("Failed to save file %s in index: %v", f.Name, err)
+	}
+	return err
+}
+
+// AddFile adds a file to the index, unless a file or folder with the same name exists.
+// It returns false when the name is taken.
+func (s *DB) AddFile(f File) (bool, error) {
+	if f.Uploaded.IsZero() {
+		f.Uploaded = time.Now()
+	}
+
+	result, err := s.Conn.Exec(`
+		INSERT INTO files (stored_name, folder, original_name, content_type, sha256, size, uploader, source, uploaded, expires, pinned)
+		SELECT ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?
+		WHERE NOT EXISTS (SELECT 1 FROM folders WHERE path = ?)
+		ON CONFLICT (stored_name) DO NOTHING
+	`, f.Name, f.Folder, f.OriginalName, f.ContentType, f.SHA256, f.Size, f.Uploader, f.Source,
+		f.Uploaded.UTC().Format(TimestampLayout), optionalTimestamp(f.Expires), f.Pinned, f.Name)
+	if err != nil {
+		logrus.Errorf("Failed to add file %s to index: %v", f.Name, err)
+		return false, err
+	}
+
+	affected, err := result.RowsAffected()
+	return affected > 0, err
+}
+
+// GetFiles returns all indexed files, newest first. The optional query matches
+// the stored name, original name and content type.
+func (s *DB) GetFiles(query string) ([]File, error) {
+	q := `SELECT ` + fileColumns + ` FROM files`
+	args := []any{}
+
+	if query = strings.TrimSpace(query); query != "" {
+		q += ` WHERE stored_name LIKE ? ESCAPE '\' OR original_name LIKE ? ESCAPE '\' OR content_type LIKE ? ESCAPE '\'`
+		pattern := "%" + escapeLike(query) + "%"
+		args = append(args, pattern, pattern, pattern)
+	}
+
+	q += ` ORDER BY uploaded DESC, id DESC`
+	return s.queryFiles(q, args...)
+}
+
+// GetFilesInFolder returns the files directly in the folder, sorted by name
+func (s *DB) GetFilesInFolder(folder string) ([]File, error) {
+	return s.queryFiles(`SELECT `+fileColumns+` FROM files WHERE folder = ? ORDER BY stored_name`, folder)
+}
+
+// GetFile returns the index entry of a stored file, or nil when it is not indexed
+func (s *DB) GetFile(name string) (*File, error) {
+	files, err := s.queryFiles(`SELECT `+fileColumns+` FROM files WHERE stored_name = ?`, name)
+	if err != nil || len(files) == 0 {
+		return nil, err
+	}
+	return &files[0], nil
+}
+
+// GetExpiredFiles returns all files that expired before the given moment, except pinned files
+func (s *DB) GetExpiredFiles(now time.Time) ([]File, error) {
+	return s.queryFiles(`SELECT `+fileColumns+` FROM files WHERE expires IS NOT NULL AND expires < ? AND NOT pinned ORDER BY expires`,
+		now.UTC().Format(TimestampLayout))
+}
+
+// GetFilesUsage returns the number of indexed files and the size of their content,
+// content shared by several files is counted once
+func (s *DB) GetFilesUsage() (int, int64, error) {
+	var (
+		count int
+		size  int64
+	)
+
+	err := s.Conn.QueryRow(`
+		SELECT (SELECT COUNT(*) FROM files),
+		       (SELECT COALESCE(SUM(size), 0) FROM (SELECT MAX(size) AS size FROM files GROUP BY sha256))
+	`).Scan(&count, &size)
+	return count, size, err
+}
+
+// CountFilesWithHash returns the number of files with the content of the hash
+func (s *DB) CountFilesWithHash(sha256 string) (int, error) {
+	var count int
+	err := s.Conn.QueryRow(`SELECT COUNT(*) FROM files WHERE sha256 = ?`, sha256).Scan(&count)
+	return count, err
+}
+
+// SetFilePinned pins or unpins a file. It returns false when the file is not indexed.
+func (s *DB) SetFilePinned(name string, pinned bool) (bool, error) {
+	result, err := s.Conn.Exec(`UPDATE files SET pinned = ? WHERE stored_name = ?`, pinned, name)
+	if err != nil {
+		logrus.Errorf("Failed to pin file %s: %v", name, err)
+		return false, err
+	}
+
+	affected, err := result.RowsAffected()
+	return affected > 0, err
+}
+
+// DeleteFile removes a file and its share links from the index
+func (s *DB) DeleteFile(name string) error {
+	if _, err := s.Conn.Exec(`DELETE FROM file_shares WHERE file_name = ?`, name); err != nil {
+		return err
+	}
+
+	_, err := s.Conn.Exec(`DELETE FROM files WHERE stored_name = ?`, name)
+	return err
+}
+
+// RenameFile moves the index entry and the share links of a file to a new name. It
+// returns false when a file or folder with the new name exists.
+func (s *DB) RenameFile(name, newName, folder string) (bool, error) {
+	tx, err := s.Conn.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`
+		UPDATE files SET stored_name = ?, folder = ? WHERE stored_name = ?
+		AND NOT EXISTS (SELECT 1 FROM files WHERE stored_name = ?)
+		AND NOT EXISTS (SELECT 1 FROM folders WHERE path = ?)
+	`, newName, folder, name, newName, newName)
+	if err != nil {
+		return false, err
+	}
+
+	if affected, err := result.RowsAffected(); err != nil || affected == 0 {
+		return false, err
+	}
+
+	if _, err := tx.Exec(`UPDATE file_shares SET file_name = ? WHERE file_name = ?`, newName, name); err != nil {
+		return false, err
+	}
+
+	return true, tx.Commit()
+}
+
+// RenameFolder moves a folder with its subfolders, and the index entries and share
+// links of all files in them, to a new folder
+func (s *DB) RenameFolder(folder, newFolder string) error {
+	tx, err := s.Conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// the prefix is replaced by cutting it off, so names containing the prefix elsewhere
+	// are left alone. substr and length count characters, not bytes. The prefix is
+	// compared as is, LIKE would ignore case and move "photos" along with "Photos".
+	prefix := folder + "/"
+	statements := []string{
+		`UPDATE files SET stored_name = ? || substr(stored_name, length(?) + 1) WHERE substr(stored_name, 1, length(?)) = ?`,
+		`UPDATE file_shares SET file_name = ? || substr(file_name, length(?) + 1) WHERE substr(file_name, 1, length(?)) = ?`,
+	}
+	for _, statement := range statements {
+		if _, err := tx.Exec(statement, newFolder+"/", prefix, prefix, prefix); err != nil {
+			return err
+		}
+	}
+
+	statements = []string{
+		`UPDATE files SET folder = ? || substr(folder, length(?) + 1) WHERE folder = ? OR substr(folder, 1, length(?)) = ?`,
+		`UPDATE folders SET path = ? || substr(path, length(?) + 1) WHERE path = ? OR substr(path, 1, length(?)) = ?`,
+		`UPDATE folders SET parent = ? || substr(parent, length(?) + 1) WHERE parent = ? OR substr(parent, 1, length(?)) = ?`,
+	}
+	for _, statement := range statements {
+		if _, err := tx.Exec(statement, newFolder, folder, folder, prefix, prefix); err != nil {
+			return err
+		}
+	}
+
+	// the folder itself may have moved to another parent, which has to exist
+	if _, err := tx.Exec(`UPDATE folders SET parent = ? WHERE path = ?`, parentFolder(newFolder), newFolder); err != nil {
+		return err
+	}
+	if err := addFolder(tx, parentFolder(newFolder)); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *DB) queryFiles(query string, args ...any) ([]File, error) {
+	rows, err := s.Conn.Query(query, args...)
+	if err != nil {
+		logrus.Errorf("Failed to query files: %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	files := []File{}
+	for rows.Next() {
+		var (
+			f       File
+			expires sql.NullTime
+		)
+
+		if err := rows.Scan(&f.ID, &f.Name, &f.Folder, &f.OriginalName, &f.ContentType, &f.SHA256, &f.Size,
+			&f.Uploader, &f.Source, &f.Uploaded, &expires, &f.Pinned); err != nil {
+			logrus.Errorf("Failed to scan file row: %v", err)
+			return nil, err
+		}
+
+		if expires.Valid {
+			f.Expires = &expires.Time
+		}
+		files = append(files, f)
+	}
+
+	return files, rows.Err()
+}
+
+func optionalTimestamp(t *time.Time) any {
+	if t == nil {
+		return nil
+	}
+	return t.UTC().Format(TimestampLayout)
+}
+
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
@@ -0,0 +1,123 @@
+package sqlitedb
+
+import (
+	"database/sql"
+	"path"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Folders of the file storage. A folder is stored with its parent, the upload target
+// itself is the empty path and has no row.
+
+// AddFolder adds a folder and the folders above it, existing folders are left alone.
+// It returns false when a file with the name of one of the folders exists.
+func (s *DB) AddFolder(folder string) (bool, error) {
+	tx, err := s.Conn.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	for p := folder; p != ""; p = parentFolder(p) {
+		var taken bool
+		if err := tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM files WHERE stored_name = ?)`, p).Scan(&taken); err != nil {
+			return false, err
+		}
+		if taken {
+			return false, nil
+		}
+	}
+
+	if err := addFolder(tx, folder); err != nil {
+		logrus.Errorf("Failed to add folder %s: %v", folder, err)
+		return false, err
+	}
+
+	return true, tx.Commit()
+}
+
+// GetFolders returns the paths of the folders directly in the parent, sorted by name
+func (s *DB) GetFolders(parent string) ([]string, error) {
+	rows, err := s.Conn.Query(`SELECT path FROM folders WHERE parent = ? ORDER BY path COLLATE NOCASE`, parent)
+	if err != nil {
+		logrus.Errorf("Failed to query folders: %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	folders := []string{}
+	for rows.Next() {
+		var folder string
+		if err := rows.Scan(&folder); err != nil {
+			return nil, err
+		}
+		folders = append(folders, folder)
+	}
+
+	return folders, rows.Err()
+}
+
+// FolderExists reports if the folder exists, the upload target always does
+func (s *DB) FolderExists(folder string) (bool, error) {
+	if folder == "" {
+		return true, nil
+	}
+
+	var exists bool
+	err := s.Conn.QueryRow(`SELECT EXISTS (SELECT 1 FROM folders WHERE path = ?)`, folder).Scan(&exists)
+	return exists, err
+}
+
+// DeleteFolder removes a folder, its subfolders and the files in them with their share
+// links. It returns the removed files, so their content can be cleaned up.
+func (s *DB) DeleteFolder(folder string) ([]File, error) {
+	// LIKE ignores case, the prefix is compared as is so "Photos" leaves "photos" alone
+	prefix := folder + "/"
+
+	files, err := s.queryFiles(`SELECT `+fileColumns+` FROM files WHERE substr(stored_name, 1, length(?)) = ?`, prefix, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := s.Conn.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	statements := []string{
+		`DELETE FROM file_shares WHERE substr(file_name, 1, length(?)) = ?`,
+		`DELETE FROM files WHERE substr(stored_name, 1, length(?)) = ?`,
+		`DELETE FROM folders WHERE substr(path, 1, length(?)) = ?`,
+	}
+	for _, statement := range statements {
+		if _, err := tx.Exec(statement, prefix, prefix); err != nil {
+			return nil, err
+		}
+	}
+
+	if _, err := tx.Exec(`DELETE FROM folders WHERE path = ?`, folder); err != nil {
+		return nil, err
+	}
+
+	return files, tx.Commit()
+}
+
+// addFolder adds the folder and the folders above it
+func addFolder(tx *sql.Tx, folder string) error {
+	for p := folder; p != ""; p = parentFolder(p) {
+		if _, err := tx.Exec(`INSERT OR IGNORE INTO folders (path, parent) VALUES (?, ?)`, p, parentFolder(p)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parentFolder returns the folder above a folder or file, empty for the upload target
+func parentFolder(name string) string {
+	if parent := path.Dir(name); parent != "." {
+		return parent
+	}
+	return ""
+}
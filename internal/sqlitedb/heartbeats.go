@@ -0,0 +1,98 @@
+package sqlitedb
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+const (
+	HeartbeatUnknown = "unknown"
+	HeartbeatUp      = "up"
+	HeartbeatDown    = "down"
+)
+
+// HeartbeatMonitor expects its source to post an event or ping at least every interval
+type HeartbeatMonitor struct {
+	ID              int        `json:"id"`
+	Name            string     `json:"name"`
+	IntervalMinutes int        `json:"interval_minutes"`
+	LastSeen        *time.Time `json:"last_seen,omitempty"`
+	Status          string     `json:"status"`
+	StatusSince     time.Time  `json:"status_since"`
+	Created         time.Time  `json:"created"`
+}
+
+// Deadline is the moment the monitor goes down when nothing arrives
+func (m HeartbeatMonitor) Deadline() time.Time {
+	since := m.Created
+	if m.LastSeen != nil {
+		since = *m.LastSeen
+	}
+	return since.Add(time.Duration(m.IntervalMinutes) * time.Minute)
+}
+
+func (s *DB) GetHeartbeatMonitors() ([]HeartbeatMonitor, error) {
+	rows, err := s.Conn.Query(`
+		SELECT id, name, interval_minutes, last_seen, status, status_since, created
+		FROM heartbeat_monitors ORDER BY name ASC
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	monitors := []HeartbeatMonitor{}
+	for rows.Next() {
+		var (
+			m        HeartbeatMonitor
+			lastSeen sql.NullTime
+		)
+
+		if err := rows.Scan(&m.ID, &m.Name, &m.IntervalMinutes, &lastSeen, &m.Status, &m.StatusSince, &m.Created); err != nil {
+			return nil, err
+		}
+
+		if lastSeen.Valid {
+			m.LastSeen = &lastSeen.Time
+		}
+		monitors = append(monitors, m)
+	}
+
+	return monitors, rows.Err()
+}
+
+func (s *DB) AddHeartbeatMonitor(name string, intervalMinutes int) error {
+	if name == "" || intervalMinutes <= 0 {
+		return fmt.Errorf("a monitor needs a name and a positive interval")
+	}
+
+	_, err := s.Conn.Exec(`
+		INSERT INTO heartbeat_monitors (name, interval_minutes) VALUES (?, ?)
+		ON CONFLICT (name) DO UPDATE SET interval_minutes = excluded.interval_minutes
+	`, name, intervalMinutes)
+	return err
+}
+
+func (s *DB) DeleteHeartbeatMonitor(name string) error {
+	_, err := s.Conn.Exec(`DELETE FROM heartbeat_monitors WHERE name = ?`, name)
+	return err
+}
+
+// PingHeartbeat records a sign of life, returns false for unknown monitors
+func (s *DB) PingHeartbeat(name string) (bool, error) {
+	result, err := s.Conn.Exec(`UPDATE heartbeat_monitors SET last_seen = CURRENT_TIMESTAMP WHERE name = ?`, name)
+	if err != nil {
+		return false, err
+	}
+
+	affected, err := result.RowsAffected()
+	return affected > 0, err
+}
+
+func (s *DB) SetHeartbeatStatus(name string, status string) error {
+	_, err := s.Conn.Exec(`
+		UPDATE heartbeat_monitors SET status = ?, status_since = CURRENT_TIMESTAMP WHERE name = ?
+	`, status, name)
+	return err
+}
@@ -0,0 +1,118 @@
+package sqlitedb
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// FileShare is a public link to a stored file. The link contains the public id and
+// a signature, the optional password is stored as bcrypt hash.
+type FileShare struct {
+	ID           int       `json:"id"`
+	PublicID     string    `json:"-"`
+	FileName     string    `json:"file_name"`
+	PasswordHash string    `json:"-"`
+	Expires      time.Time `json:"expires"`
+	MaxDownloads int       `json:"max_downloads"` // zero is unlimited
+	Downloads    int       `json:"downloads"`
+	Revoked      bool      `json:"revoked"`
+	Created      time.Time `json:"created"`
+}
+
+// HasPassword reports if the share is protected with a password
+func (f FileShare) HasPassword() bool {
+	return f.PasswordHash != ""
+}
+
+// LimitReached reports if the share has been downloaded the maximum number of times
+func (f FileShare) LimitReached() bool {
+	return f.MaxDownloads > 0 && f.Downloads >= f.MaxDownloads
+}
+
+const fileShareColumns = `id, public_id, file_name, password_hash, expires, max_downloads, downloads, revoked, created`
+
+func (s *DB) AddFileShare(share FileShare) (int, error) {
+	result, err := s.Conn.Exec(`
+		INSERT INTO file_shares (public_id, file_name, password_hash, expires, max_downloads, created)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`, share.PublicID, share.FileName, share.PasswordHash, share.Expires.UTC().Format(TimestampLayout),
+		share.MaxDownloads, time.Now().UTC().Format(TimestampLayout))
+	if err != nil {
+		logrus.Errorf("Failed to add share of %s: %v", share.FileName, err)
+		return 0, err
+	}
+
+	id, err := result.LastInsertId()
+	return int(id), err
+}
+
+// GetFileShares returns all shares that are not revoked, newest first
+func (s *DB) GetFileShares() ([]FileShare, error) {
+	return s.queryFileShares(`SELECT ` + fileShareColumns + ` FROM file_shares WHERE NOT revoked ORDER BY created DESC, id DESC`)
+}
+
+// GetFileShareByPublicID returns the share, or nil when it does not exist
+func (s *DB) GetFileShareByPublicID(publicID string) (*FileShare, error) {
+	shares, err := s.queryFileShares(`SELECT `+fileShareColumns+` FROM file_shares WHERE public_id = ?`, publicID)
+	if err != nil || len(shares) == 0 {
+		return nil, err
+	}
+	return &shares[0], nil
+}
+
+// RevokeFileShare disables a share. It returns false when the share does not exist.
+func (s *DB) RevokeFileShare(id int) (bool, error) {
+	result, err := s.Conn.Exec(`UPDATE file_shares SET revoked = 1 WHERE id = ?`, id)
+	if err != nil {
+		return false, err
+	}
+
+	affected, err := result.RowsAffected()
+	return affected > 0, err
+}
+
+// CountShareDownload registers a download of the share. It returns false when the
+// share may no longer be downloaded, the check and the update are a single statement
+// so concurrent downloads cannot exceed the maximum.
+func (s *DB) CountShareDownload(id int, now time.Time) (bool, error) {
+	result, err := s.Conn.Exec(`
+		UPDATE file_shares SET downloads = downloads + 1
+		WHERE id = ? AND NOT revoked AND expires > ? AND (max_downloads = 0 OR downloads < max_downloads)
+	`, id, now.UTC().Format(TimestampLayout))
+	if err != nil {
+		return false, err
+	}
+
+	affected, err := result.RowsAffected()
+	return affected > 0, err
+}
+
+func (s *DB) queryFileShares(query string, args ...any) ([]FileShare, error) {
+	rows, err := s.Conn.Query(query, args...)
+	if err != nil {
+		logrus.Errorf("Failed to query shares: %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	shares := []FileShare{}
+	for rows.Next() {
+		var (
+			share   FileShare
+			created sql.NullTime
+		)
+
+		if err := rows.Scan(&share.ID, &share.PublicID, &share.FileName, &share.PasswordHash, &share.Expires,
+			&share.MaxDownloads, &share.Downloads, &share.Revoked, &created); err != nil {
+			logrus.Errorf("Failed to scan share row: %v", err)
+			return nil, err
+		}
+
+		share.Created = created.Time
+		shares = append(shares, share)
+	}
+
+	return shares, rows.Err()
+}
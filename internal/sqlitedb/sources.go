@@ -0,0 +1,194 @@
+package sqlitedb
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// EventSource is a registered producer of events. Sources authenticate with their
+// own token, only the sha256 hash of the token is stored.
+type EventSource struct {
+	ID                 int        `json:"id"`
+	Name               string     `json:"name"`
+	Description        string     `json:"description"`
+	ExpectedCategories string     `json:"expected_categories"`
+	Owner              string     `json:"owner"`
+	LastSeen           *time.Time `json:"last_seen,omitempty"`
+	Created            time.Time  `json:"created"`
+}
+
+// ExpectsCategory reports if the source is allowed to post events of the category,
+// a source without expected categories may post any category
+func (e EventSource) ExpectsCategory(category string) bool {
+	if e.ExpectedCategories == "" {
+		return true
+	}
+
+	for _, expected := range strings.Split(e.ExpectedCategories, ",") {
+		if expected == category {
+			return true
+		}
+	}
+	return false
+}
+
+// DefaultCategory is the category of events posted without one
+func (e EventSource) DefaultCategory() string {
+	category, _, _ := strings.Cut(e.ExpectedCategories, ",")
+	return category
+}
+
+func (s *DB) GetEventSources() ([]EventSource, error) {
+	rows, err := s.Conn.Query(`
+		SELECT id, name, description, expected_categories, owner, last_seen, created
+		FROM event_sources ORDER BY name ASC
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sources := []EventSource{}
+	for rows.Next() {
+		source, err := scanEventSource(rows)
+		if err != nil {
+			logrus.Errorf("Failed to scan event source row: %v", err)
+			return nil, err
+		}
+		sources = append(sources, source)
+	}
+
+	return sources, rows.Err()
+}
+
+// GetEventSourceByToken returns the source the token belongs to, or nil when the token is unknown
+func (s *DB) GetEventSourceByToken(token string) (*EventSource, error) {
+	return s.getEventSource(`token_hash = ?`, hashToken(token))
+}
+
+// GetEventSourceByName returns the registered source with the name, or nil when there is none
+func (s *DB) GetEventSourceByName(name string) (*EventSource, error) {
+	return s.getEventSource(`name = ?`, name)
+}
+
+func (s *DB) getEventSource(where string, arg any) (*EventSource, error) {
+	rows, err := s.Conn.Query(`
+		SELECT id, name, description, expected_categories, owner, last_seen, created
+		FROM event_sources WHERE `+where, arg)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		return nil, rows.Err()
+	}
+
+	source, err := scanEventSource(rows)
+	if err != nil {
+		return nil, err
+	}
+	return &source, nil
+}
+
+// AddEventSource registers a source and returns its id and token. The token
+// cannot be retrieved afterwards, only rotated.
+func (s *DB) AddEventSource(e EventSource) (int, string, error) {
+	e.Name = strings.TrimSpace(e.Name)
+	if e.Name == "" {
+		return 0, "", fmt.Errorf("name is required")
+	}
+
+	token, err := newToken()
+	if err != nil {
+		return 0, "", err
+	}
+
+	result, err := s.Conn.Exec(`
+		INSERT INTO event_sources (name, description, expected_categories, owner, token_hash)
+		VALUES (?, ?, ?, ?, ?)
+	`, e.Name, e.Description, normalizeList(e.ExpectedCategories), e.Owner, hashToken(token))
+	if err != nil {
+		return 0, "", err
+	}
+
+	id, err := result.LastInsertId()
+	return int(id), token, err
+}
+
+// RotateEventSourceToken replaces the token of a source, the old token stops working immediately
+func (s *DB) RotateEventSourceToken(id int) (string, error) {
+	token, err := newToken()
+	if err != nil {
+		return "", err
+	}
+
+	result, err := s.Conn.Exec(`UPDATE event_sources SET token_hash = ? WHERE id = ?`, hashToken(token), id)
+	if err != nil {
+		return "", err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return "", err
+	}
+
+	if affected == 0 {
+		return "", sql.ErrNoRows
+	}
+
+	return token, nil
+}
+
+func (s *DB) DeleteEventSource(id int) error {
+	_, err := s.Conn.Exec(`DELETE FROM event_sources WHERE id = ?`, id)
+	return err
+}
+
+// ReleaseEvent moves a quarantined event into the regular list of events
+func (s *DB) ReleaseEvent(id int) (bool, error) {
+	result, err := s.Conn.Exec(`UPDATE events SET quarantined = 0 WHERE id = ? AND quarantined = 1`, id)
+	if err != nil {
+		logrus.Errorf("Failed to release event %d: %v", id, err)
+		return false, err
+	}
+
+	affected, err := result.RowsAffected()
+	return affected > 0, err
+}
+
+func scanEventSource(rows *sql.Rows) (EventSource, error) {
+	var (
+		e        EventSource
+		lastSeen sql.NullTime
+	)
+
+	if err := rows.Scan(&e.ID, &e.Name, &e.Description, &e.ExpectedCategories, &e.Owner, &lastSeen, &e.Created); err != nil {
+		return e, err
+	}
+
+	if lastSeen.Valid {
+		e.LastSeen = &lastSeen.Time
+	}
+	return e, nil
+}
+
+func newToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate token: %v", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,229 @@
+package sqlitedb
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	DeliveryFailed    = "failed"
+)
+
+// Webhook posts new events to an external url. Categories and sources are comma
+// separated filters, an empty filter matches everything.
+type Webhook struct {
+	ID         int       `json:"id"`
+	Name       string    `json:"name"`
+	URL        string    `json:"url"`
+	Secret     string    `json:"secret,omitempty"` // only returned when the webhook is created
+	Categories string    `json:"categories"`
+	Sources    string    `json:"sources"`
+	Enabled    bool      `json:"enabled"`
+	Created    time.Time `json:"created"`
+}
+
+// WebhookDelivery is a single event queued for delivery to a webhook
+type WebhookDelivery struct {
+	ID          int        `json:"id"`
+	WebhookID   int        `json:"webhook_id"`
+	EventID     int        `json:"event_id"`
+	Payload     string     `json:"-"`
+	Status      string     `json:"status"`
+	Attempts    int        `json:"attempts"`
+	NextAttempt time.Time  `json:"next_attempt"`
+	StatusCode  int        `json:"status_code,omitempty"`
+	Error       string     `json:"error,omitempty"`
+	Created     time.Time  `json:"created"`
+	DeliveredAt *time.Time `json:"delivered_at,omitempty"`
+
+	// target of the delivery, only filled for pending deliveries
+	URL    string `json:"-"`
+	Secret string `json:"-"`
+}
+
+func (s *DB) GetWebhooks() ([]Webhook, error) {
+	rows, err := s.Conn.Query(`SELECT id, name, url, secret, categories, sources, enabled, created FROM webhooks ORDER BY id ASC`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	webhooks := []Webhook{}
+	for rows.Next() {
+		var w Webhook
+		if err := rows.Scan(&w.ID, &w.Name, &w.URL, &w.Secret, &w.Categories, &w.Sources, &w.Enabled, &w.Created); err != nil {
+			logrus.Errorf("Failed to scan webhook row: %v", err)
+			return nil, err
+		}
+		webhooks = append(webhooks, w)
+	}
+
+	return webhooks, rows.Err()
+}
+
+func (s *DB) AddWebhook(w Webhook) (int, error) {
+	result, err := s.Conn.Exec(`
+		INSERT INTO webhooks (name, url, secret, categories, sources, enabled)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`, w.Name, w.URL, w.Secret, normalizeList(w.Categories), normalizeList(w.Sources), w.Enabled)
+	if err != nil {
+		return 0, err
+	}
+
+	id, err := result.LastInsertId()
+	return int(id), err
+}
+
+func (s *DB) SetWebhookEnabled(id int, enabled bool) error {
+	_, err := s.Conn.Exec(`UPDATE webhooks SET enabled = ? WHERE id = ?`, enabled, id)
+	return err
+}
+
+// DeleteWebhook removes the webhook including its delivery log
+func (s *DB) DeleteWebhook(id int) error {
+	tx, err := s.Conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM webhook_deliveries WHERE webhook_id = ?`, id); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(`DELETE FROM webhooks WHERE id = ?`, id); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// GetWebhookDeliveries returns the most recent deliveries of a webhook
+func (s *DB) GetWebhookDeliveries(webhookID int, limit int) ([]WebhookDelivery, error) {
+	rows, err := s.Conn.Query(`
+		SELECT id, webhook_id, event_id, status, attempts, next_attempt,
+		       COALESCE(status_code, 0), COALESCE(error, ''), created, delivered_at
+		FROM webhook_deliveries
+		WHERE webhook_id = ?
+		ORDER BY id DESC LIMIT ?
+	`, webhookID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deliveries := []WebhookDelivery{}
+	for rows.Next() {
+		var (
+			d           WebhookDelivery
+			deliveredAt sql.NullTime
+		)
+
+		if err := rows.Scan(&d.ID, &d.WebhookID, &d.EventID, &d.Status, &d.Attempts, &d.NextAttempt,
+			&d.StatusCode, &d.Error, &d.Created, &deliveredAt); err != nil {
+			logrus.Errorf("Failed to scan delivery row: %v", err)
+			return nil, err
+		}
+
+		if deliveredAt.Valid {
+			d.DeliveredAt = &deliveredAt.Time
+		}
+		deliveries = append(deliveries, d)
+	}
+
+	return deliveries, rows.Err()
+}
+
+// GetDueDeliveries returns pending deliveries of enabled webhooks that should be attempted now
+func (s *DB) GetDueDeliveries(now time.Time, limit int) ([]WebhookDelivery, error) {
+	rows, err := s.Conn.Query(`
+		SELECT d.id, d.webhook_id, d.event_id, d.payload, d.attempts, w.url, w.secret
+		FROM webhook_deliveries d
+		JOIN webhooks w ON w.id = d.webhook_id
+		WHERE d.status = ? AND d.next_attempt <= ? AND w.enabled = 1
+		ORDER BY d.id ASC LIMIT ?
+	`, DeliveryPending, now.UTC().Format(TimestampLayout), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var deliveries []WebhookDelivery
+	for rows.Next() {
+		var d WebhookDelivery
+		if err := rows.Scan(&d.ID, &d.WebhookID, &d.EventID, &d.Payload, &d.Attempts, &d.URL, &d.Secret); err != nil {
+			return nil, err
+		}
+		d.Status = DeliveryPending
+		deliveries = append(deliveries, d)
+	}
+
+	return deliveries, rows.Err()
+}
+
+// DeliverySucceeded marks a delivery as delivered
+func (s *DB) DeliverySucceeded(id int, statusCode int) error {
+	_, err := s.Conn.Exec(`
+		UPDATE webhook_deliveries
+		SET status = ?, attempts = attempts + 1, status_code = ?, error = NULL, delivered_at = CURRENT_TIMESTAMP
+		WHERE id = ?
+	`, DeliveryDelivered, statusCode, id)
+	return err
+}
+
+// DeliveryAttemptFailed records a failed attempt, the delivery is retried at retryAt
+// or marked as failed when there is no retry left
+func (s *DB) DeliveryAttemptFailed(id int, statusCode int, errMsg string, retryAt *time.Time) error {
+	status := DeliveryFailed
+	var next sql.NullString
+	if retryAt != nil {
+		status = DeliveryPending
+		next = sql.NullString{String: retryAt.UTC().Format(TimestampLayout), Valid: true}
+	}
+
+	var code sql.NullInt64
+	if statusCode != 0 {
+		code = sql.NullInt64{Int64: int64(statusCode), Valid: true}
+	}
+
+	_, err := s.Conn.Exec(`
+		UPDATE webhook_deliveries
+		SET status = ?, attempts = attempts + 1, status_code = ?, error = ?, next_attempt = COALESCE(?, next_attempt)
+		WHERE id = ?
+	`, status, code, errMsg, next, id)
+	return err
+}
+
+// PruneWebhookDeliveries deletes deliveries that were delivered or gave up before the
+// time, pending deliveries are kept
+func (s *DB) PruneWebhookDeliveries(before time.Time) (int64, error) {
+	result, err := s.Conn.Exec(`
+		DELETE FROM webhook_deliveries WHERE status != ? AND created < ?
+	`, DeliveryPending, before.UTC().Format(TimestampLayout))
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// normalizeList trims all entries of a comma separated list
+func normalizeList(s string) string {
+	var entries []string
+	for _, e := range strings.Split(s, ",") {
+		if e = strings.TrimSpace(e); e != "" {
+			entries = append(entries, e)
+		}
+	}
+	return strings.Join(entries, ",")
+}
+
+// String is used in log messages
+func (d WebhookDelivery) String() string {
+	return fmt.Sprintf("delivery %d of event %d to webhook %d", d.ID, d.EventID, d.WebhookID)
+}
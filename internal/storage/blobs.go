@@ -0,0 +1,252 @@
+package storage
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gabriel-vasile/mimetype"
+	"github.com/rogierlommers/home/internal/sqlitedb"
+)
+
+const (
+	// blobs are stored in this hidden directory of the store as ab/abcdef..., by hash
+	blobDir = ".blobs"
+
+	// temporary files that are older are left behind by a crash
+	staleTempAge = 24 * time.Hour
+)
+
+// blobLock is held while blobs are added or released, so a blob is never removed
+// between being stored and being indexed. It is shared by all stores, the homepage
+// and quicknote each have their own.
+var blobLock sync.Mutex
+
+// VerifyResult lists the files of which the content is damaged or gone
+type VerifyResult struct {
+	Checked int      `json:"checked"` // number of blobs hashed
+	Corrupt []string `json:"corrupt"` // content no longer matches the hash
+	Missing []string `json:"missing"` // content is gone
+}
+
+func (s *Store) blobPath(hash string) string {
+	return filepath.Join(s.dir, blobDir, hash[:2], hash)
+}
+
+// validHash reports if the hash is a sha256 in hex, the name of a blob
+func validHash(hash string) bool {
+	if len(hash) != sha256.Size*2 {
+		return false
+	}
+	_, err := hex.DecodeString(hash)
+	return err == nil
+}
+
+func (s *Store) openBlob(hash string) (io.ReadSeekCloser, error) {
+	if !validHash(hash) {
+		return nil, ErrNotFound
+	}
+
+	f, err := s.openContent(s.blobPath(hash))
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	return f, err
+}
+
+// writeTemp copies the content into a temporary file in the blob directory and fills
+// in content type, hash and size of the file. It returns the path of the temporary file.
+func (s *Store) writeTemp(content io.Reader, limit Limit, f *sqlitedb.File) (string, error) {
+	dir := filepath.Join(s.dir, blobDir)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", fmt.Errorf("failed to create storage directory: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(dir, ".tmp-*")
+	if err != nil {
+		return "", fmt.Errorf("failed to create file: %w", err)
+	}
+
+	w, err := s.contentWriter(tmp)
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return "", fmt.Errorf("failed to save file: %w", err)
+	}
+
+	// the content type is sniffed from the first bytes, the hash is calculated while copying
+	br := bufio.NewReaderSize(content, sniffLength)
+	head, _ := br.Peek(sniffLength)
+	h := sha256.New()
+
+	size, err := io.Copy(&limitedWriter{w: io.MultiWriter(w, h), limit: limit}, br)
+	if err == nil {
+		err = w.Close()
+	}
+	if err == nil {
+		err = tmp.Close()
+	} else {
+		tmp.Close()
+	}
+
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", fmt.Errorf("failed to save file: %w", err)
+	}
+
+	f.ContentType = mimetype.Detect(head).String()
+	f.SHA256 = hex.EncodeToString(h.Sum(nil))
+	f.Size = size
+	return tmp.Name(), nil
+}
+
+// addBlob moves the file, written by writeTemp, into place as the blob of the hash.
+// When the blob exists, the file is a duplicate and removed. Call with blobLock held.
+func (s *Store) addBlob(src, hash string) error {
+	plain := s.blobPath(hash)
+	blob := s.contentPath(plain)
+
+	if _, err := os.Stat(blob); err == nil {
+		return os.Remove(src)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(blob), 0o755); err != nil {
+		return fmt.Errorf("failed to create storage directory: %w", err)
+	}
+
+	if err := s.replaceContent(src, plain); err != nil {
+		return fmt.Errorf("failed to store file: %w", err)
+	}
+	return nil
+}
+
+// takeFile prepares a plain file on disk to be added as a blob, and fills in content
+// type, hash and size of the file. When files are encrypted, the content is encrypted
+// into a temporary file and the plain file is removed.
+func (s *Store) takeFile(src string, f *sqlitedb.File) (string, error) {
+	if s.keys == nil {
+		return src, describe(src, f)
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+
+	tmp, err := s.writeTemp(in, Limit{Bytes: -1}, f)
+	if err != nil {
+		return "", err
+	}
+	return tmp, os.Remove(src)
+}
+
+// release removes the blob when no file refers to it anymore. Call with blobLock held.
+func (s *Store) release(hash string) error {
+	if !validHash(hash) {
+		return nil
+	}
+
+	count, err := s.db.CountFilesWithHash(hash)
+	if err != nil || count > 0 {
+		return err
+	}
+
+	return s.removeContent(s.blobPath(hash))
+}
+
+// PruneBlobs removes blobs that no file refers to, and temporary files left behind
+func (s *Store) PruneBlobs() (int, error) {
+	blobLock.Lock()
+	defer blobLock.Unlock()
+
+	files, err := s.db.GetFiles("")
+	if err != nil {
+		return 0, err
+	}
+
+	hashes := map[string]bool{}
+	for _, f := range files {
+		hashes[f.SHA256] = true
+	}
+
+	removed := 0
+	err = filepath.WalkDir(filepath.Join(s.dir, blobDir), func(p string, entry os.DirEntry, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil || entry.IsDir() {
+			return err
+		}
+
+		// uploads in progress are written to temporary files
+		if strings.HasPrefix(entry.Name(), ".") {
+			info, err := entry.Info()
+			if err != nil || time.Since(info.ModTime()) < staleTempAge {
+				return nil
+			}
+		} else if hashes[strings.TrimSuffix(entry.Name(), encryptedSuffix)] {
+			return nil
+		}
+
+		if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		removed++
+		return nil
+	})
+
+	return removed, err
+}
+
+// Verify hashes the content of all files again, to find content that was damaged or
+// removed on disk
+func (s *Store) Verify() (VerifyResult, error) {
+	result := VerifyResult{Corrupt: []string{}, Missing: []string{}}
+
+	files, err := s.db.GetFiles("")
+	if err != nil {
+		return result, err
+	}
+
+	byHash := map[string][]string{}
+	for _, f := range files {
+		byHash[f.SHA256] = append(byHash[f.SHA256], f.Name)
+	}
+
+	for hash, names := range byHash {
+		f, err := s.openBlob(hash)
+		if errors.Is(err, ErrNotFound) {
+			result.Missing = append(result.Missing, names...)
+			continue
+		}
+
+		// encrypted content that was damaged does not decrypt anymore
+		h := sha256.New()
+		if err == nil {
+			_, err = io.Copy(h, f)
+			f.Close()
+		}
+		if err != nil && !errors.Is(err, errCorrupt) {
+			return result, fmt.Errorf("failed to hash %s: %w", hash, err)
+		}
+
+		result.Checked++
+		if err != nil || hex.EncodeToString(h.Sum(nil)) != hash {
+			result.Corrupt = append(result.Corrupt, names...)
+		}
+	}
+
+	sort.Strings(result.Corrupt)
+	sort.Strings(result.Missing)
+	return result, nil
+}
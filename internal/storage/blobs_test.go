@@ -0,0 +1,87 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDeduplication(t *testing.T) {
+	store := newTestStore(t, t.TempDir())
+
+	first, err := store.Save("screenshot.png", strings.NewReader("pixels"), Upload{})
+	require.NoError(t, err)
+	second, err := store.Save("screenshot.png", strings.NewReader("pixels"), Upload{Folder: "work"})
+	require.NoError(t, err)
+	other, err := store.Save("other.png", strings.NewReader("other pixels"), Upload{})
+	require.NoError(t, err)
+
+	assert.Equal(t, first.SHA256, second.SHA256)
+	assert.Equal(t, "pixels", readFile(t, store, "work/screenshot.png"))
+
+	blobs, err := filepath.Glob(filepath.Join(store.Dir(), blobDir, "*", "*"))
+	require.NoError(t, err)
+	assert.Len(t, blobs, 2)
+
+	// the content is kept as long as a file refers to it
+	require.NoError(t, store.Remove("screenshot.png"))
+	assert.FileExists(t, store.blobPath(first.SHA256))
+	assert.Equal(t, "pixels", readFile(t, store, "work/screenshot.png"))
+
+	require.NoError(t, store.Remove("work/screenshot.png"))
+	assert.NoFileExists(t, store.blobPath(first.SHA256))
+	assert.FileExists(t, store.blobPath(other.SHA256))
+}
+
+func TestPruneBlobs(t *testing.T) {
+	store := newTestStore(t, t.TempDir())
+
+	kept, err := store.Save("kept.txt", strings.NewReader("kept"), Upload{})
+	require.NoError(t, err)
+	gone, err := store.Save("gone.txt", strings.NewReader("gone"), Upload{})
+	require.NoError(t, err)
+
+	// an index entry removed without releasing its content, and files left by a crash
+	require.NoError(t, store.db.DeleteFile("gone.txt"))
+	stale := filepath.Join(store.Dir(), blobDir, ".tmp-stale")
+	writePlainFile(t, stale, "stale")
+	old := time.Now().Add(-2 * staleTempAge)
+	require.NoError(t, os.Chtimes(stale, old, old))
+	writing := filepath.Join(store.Dir(), blobDir, ".tmp-writing")
+	require.NoError(t, os.WriteFile(writing, []byte("writing"), 0o644))
+
+	removed, err := store.PruneBlobs()
+	require.NoError(t, err)
+	assert.Equal(t, 2, removed)
+	assert.FileExists(t, store.blobPath(kept.SHA256))
+	assert.NoFileExists(t, store.blobPath(gone.SHA256))
+	assert.NoFileExists(t, stale)
+	assert.FileExists(t, writing)
+}
+
+func TestVerify(t *testing.T) {
+	store := newTestStore(t, t.TempDir())
+
+	_, err := store.Save("fine.txt", strings.NewReader("fine"), Upload{})
+	require.NoError(t, err)
+	damaged, err := store.Save("damaged.txt", strings.NewReader("damaged"), Upload{})
+	require.NoError(t, err)
+	_, err = store.Save("copy of damaged.txt", strings.NewReader("damaged"), Upload{})
+	require.NoError(t, err)
+	lost, err := store.Save("lost.txt", strings.NewReader("lost"), Upload{})
+	require.NoError(t, err)
+
+	require.NoError(t, os.WriteFile(store.blobPath(damaged.SHA256), []byte("bit rot"), 0o644))
+	require.NoError(t, os.Remove(store.blobPath(lost.SHA256)))
+
+	result, err := store.Verify()
+	require.NoError(t, err)
+	assert.Equal(t, 2, result.Checked)
+	assert.Equal(t, []string{"copy of damaged.txt", "damaged.txt"}, result.Corrupt)
+	assert.Equal(t, []string{"lost.txt"}, result.Missing)
+}
@@ -0,0 +1,112 @@
+package storage
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// Uploads can be scanned for malware by a local ClamAV daemon. The content is streamed
+// to clamd while it is stored, with the INSTREAM command over the unix socket of clamd.
+//
+// CLAMAV_SOCKET=/var/run/clamav/clamd.ctl
+
+const (
+	// clamd refuses longer streams by default (StreamMaxLength), only the first part
+	// of larger files is scanned
+	maxScanSize = 25 << 20
+
+	clamTimeout = time.Minute
+)
+
+type clamAV struct {
+	socket string
+}
+
+// newScanner returns the scanner of the socket, nil without a socket
+func newScanner(socket string) *clamAV {
+	if socket == "" {
+		return nil
+	}
+	return &clamAV{socket: socket}
+}
+
+// stream starts a scan, the content is written to the returned stream
+func (c *clamAV) stream() (*clamStream, error) {
+	conn, err := net.DialTimeout("unix", c.socket, clamTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to clamav: %w", err)
+	}
+
+	conn.SetDeadline(time.Now().Add(clamTimeout))
+	if _, err := conn.Write([]byte("zINSTREAM\x00")); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to start scan: %w", err)
+	}
+
+	return &clamStream{conn: conn}, nil
+}
+
+// clamStream sends the content to clamd in chunks. Writing never fails, so the upload
+// itself is not interrupted, errors are reported by verdict.
+type clamStream struct {
+	conn net.Conn
+	sent int64
+	err  error
+}
+
+func (s *clamStream) Write(p []byte) (int, error) {
+	chunk := p[:min(int64(len(p)), maxScanSize-s.sent)]
+	if s.err != nil || len(chunk) == 0 {
+		return len(p), nil
+	}
+
+	// every chunk is prefixed with its length
+	frame := binary.BigEndian.AppendUint32(nil, uint32(len(chunk)))
+	s.conn.SetDeadline(time.Now().Add(clamTimeout))
+	if _, err := s.conn.Write(append(frame, chunk...)); err != nil {
+		s.err = fmt.Errorf("failed to send content to clamav: %w", err)
+	}
+
+	s.sent += int64(len(chunk))
+	return len(p), nil
+}
+
+// verdict ends the stream and returns the name of the malware that was found, empty
+// when the content is clean
+func (s *clamStream) verdict() (string, error) {
+	defer s.conn.Close()
+
+	if s.err != nil {
+		return "", s.err
+	}
+
+	s.conn.SetDeadline(time.Now().Add(clamTimeout))
+	if _, err := s.conn.Write([]byte{0, 0, 0, 0}); err != nil {
+		return "", fmt.Errorf("failed to finish scan: %w", err)
+	}
+
+	reply, err := bufio.NewReader(s.conn).ReadString(0)
+	if err != nil {
+		return "", fmt.Errorf("failed to read scan result: %w", err)
+	}
+
+	return parseClamReply(strings.TrimSuffix(reply, "\x00"))
+}
+
+// parseClamReply reads replies such as "stream: OK" and "stream: Eicar-Signature FOUND"
+func parseClamReply(reply string) (string, error) {
+	result := strings.TrimPrefix(reply, "stream: ")
+
+	switch {
+	case result == "OK":
+		return "", nil
+	case strings.HasSuffix(result, " FOUND"):
+		return strings.TrimSuffix(result, " FOUND"), nil
+	default:
+		return "", fmt.Errorf("clamav: %s", reply)
+	}
+}
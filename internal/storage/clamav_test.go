@@ -0,0 +1,108 @@
+package storage
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/rogierlommers/home/internal/config"
+	"github.com/rogierlommers/home/internal/sqlitedb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeClamd answers INSTREAM scans like clamd, content with "EICAR" is infected
+func fakeClamd(t *testing.T) string {
+	socket := filepath.Join(t.TempDir(), "clamd.ctl")
+	l, err := net.Listen("unix", socket)
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go scanStream(conn)
+		}
+	}()
+
+	return socket
+}
+
+func scanStream(conn net.Conn) {
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	if command, err := r.ReadString(0); err != nil || command != "zINSTREAM\x00" {
+		conn.Write([]byte("UNKNOWN COMMAND\x00"))
+		return
+	}
+
+	var content strings.Builder
+	for {
+		var size uint32
+		if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+			return
+		}
+		if size == 0 {
+			break
+		}
+		if _, err := io.CopyN(&content, r, int64(size)); err != nil {
+			return
+		}
+	}
+
+	if strings.Contains(content.String(), "EICAR") {
+		conn.Write([]byte("stream: Eicar-Test-Signature FOUND\x00"))
+		return
+	}
+	conn.Write([]byte("stream: OK\x00"))
+}
+
+func TestMalwareScan(t *testing.T) {
+	store := newPolicyStore(t, config.AppConfig{ClamAVSocket: fakeClamd(t)})
+	upload := Upload{Source: sqlitedb.FileSourceStorage}
+
+	_, err := store.Save("clean.txt", strings.NewReader("nothing to see"), upload)
+	require.NoError(t, err)
+
+	_, err = store.Save("infected.txt", strings.NewReader("X5O!P%@AP[4\\PZX54(P^)7CC)7}$EICAR"), upload)
+	var rejected *RejectedError
+	require.ErrorAs(t, err, &rejected)
+	assert.Equal(t, "malware found: Eicar-Test-Signature", rejected.Reason)
+
+	src := filepath.Join(t.TempDir(), "upload")
+	writePlainFile(t, src, "EICAR in a resumable upload")
+	_, err = store.Move(src, "resumed.txt", upload)
+	assert.ErrorIs(t, err, ErrRejected)
+
+	files, err := store.List("")
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+	assert.Equal(t, "clean.txt", files[0].Name)
+
+	// uploads are refused while the scanner is unavailable
+	offline := newPolicyStore(t, config.AppConfig{ClamAVSocket: filepath.Join(t.TempDir(), "missing.ctl")})
+	_, err = offline.Save("clean.txt", strings.NewReader("nothing to see"), upload)
+	assert.Error(t, err)
+	assert.NotErrorIs(t, err, ErrRejected)
+}
+
+func TestParseClamReply(t *testing.T) {
+	signature, err := parseClamReply("stream: OK")
+	require.NoError(t, err)
+	assert.Empty(t, signature)
+
+	signature, err = parseClamReply("stream: Win.Test.EICAR_HDB-1 FOUND")
+	require.NoError(t, err)
+	assert.Equal(t, "Win.Test.EICAR_HDB-1", signature)
+
+	_, err = parseClamReply("INSTREAM size limit exceeded. ERROR")
+	assert.Error(t, err)
+}
@@ -0,0 +1,562 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Files can be encrypted at rest with envelope encryption. Every file gets a random
+// data key, which is kept in the header of the file, encrypted with a master key that
+// is derived from the configured secret. Rotating the secret only encrypts the data
+// keys again.
+//
+// An encrypted file is stored with the ".enc" suffix and starts with the magic, the id of
+// the master key, a nonce and the encrypted data key. The content follows in chunks that
+// are each sealed with AES-GCM, so files are read and written without holding them in
+// memory and a range of a file can be read without decrypting all of it. The nonce of a
+// chunk is its number with a flag for the last chunk, so chunks cannot be reordered and
+// a truncated file is detected.
+//
+// Incomplete resumable uploads are kept plain, they are encrypted once they are complete.
+
+const (
+	encryptedSuffix = ".enc"
+	encryptionMagic = "HOMEENC1"
+
+	keyIDSize   = 8
+	dataKeySize = 32
+	nonceSize   = 12
+	tagSize     = 16
+
+	// size of the plain content of a chunk, a sealed chunk has the tag added
+	chunkSize       = 64 << 10
+	sealedChunkSize = chunkSize + tagSize
+
+	headerSize = len(encryptionMagic) + keyIDSize + nonceSize + dataKeySize + tagSize
+)
+
+var (
+	errCorrupt    = errors.New("encrypted content is damaged")
+	errUnknownKey = errors.New("content is encrypted with an unknown key")
+)
+
+type masterKey struct {
+	id   [keyIDSize]byte
+	aead cipher.AEAD
+}
+
+// keyring holds the master key that encrypts new files and the previous master keys,
+// which are only used to read files that were not rotated yet
+type keyring struct {
+	current masterKey
+	keys    map[[keyIDSize]byte]masterKey
+}
+
+// newKeyring derives the master keys from the secrets, without a secret files are not
+// encrypted and the keyring is nil
+func newKeyring(secret string, previous []string) (*keyring, error) {
+	if secret == "" {
+		return nil, nil
+	}
+
+	current, err := deriveKey(secret)
+	if err != nil {
+		return nil, err
+	}
+
+	k := &keyring{current: current, keys: map[[keyIDSize]byte]masterKey{current.id: current}}
+	for _, p := range previous {
+		if p == "" {
+			continue
+		}
+
+		key, err := deriveKey(p)
+		if err != nil {
+			return nil, err
+		}
+		k.keys[key.id] = key
+	}
+
+	return k, nil
+}
+
+// deriveKey derives a master key and its id from a secret with HKDF
+func deriveKey(secret string) (masterKey, error) {
+	var key masterKey
+
+	raw, err := hkdf.Key(sha256.New, []byte(secret), nil, "home storage master key", dataKeySize)
+	if err != nil {
+		return key, err
+	}
+
+	id, err := hkdf.Key(sha256.New, []byte(secret), nil, "home storage master key id", keyIDSize)
+	if err != nil {
+		return key, err
+	}
+
+	copy(key.id[:], id)
+	key.aead, err = newGCM(raw)
+	return key, err
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// newHeader makes a header with a new data key, sealed with the current master key
+func (k *keyring) newHeader() ([]byte, cipher.AEAD, error) {
+	dataKey := make([]byte, dataKeySize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, nil, err
+	}
+
+	header, err := k.sealHeader(dataKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	aead, err := newGCM(dataKey)
+	return header, aead, err
+}
+
+func (k *keyring) sealHeader(dataKey []byte) ([]byte, error) {
+	header := make([]byte, 0, headerSize)
+	header = append(header, encryptionMagic...)
+	header = append(header, k.current.id[:]...)
+	prefix := len(header)
+
+	nonce := make([]byte, nonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	header = append(header, nonce...)
+
+	// the magic and the key id are authenticated with the data key
+	return k.current.aead.Seal(header, nonce, dataKey, header[:prefix]), nil
+}
+
+// openHeader returns the data key of a header and the master key it was sealed with
+func (k *keyring) openHeader(header []byte) ([]byte, masterKey, error) {
+	if len(header) != headerSize || !bytes.HasPrefix(header, []byte(encryptionMagic)) {
+		return nil, masterKey{}, errCorrupt
+	}
+
+	prefix := len(encryptionMagic) + keyIDSize
+	var id [keyIDSize]byte
+	copy(id[:], header[len(encryptionMagic):prefix])
+
+	if k == nil {
+		return nil, masterKey{}, errUnknownKey
+	}
+	key, ok := k.keys[id]
+	if !ok {
+		return nil, masterKey{}, errUnknownKey
+	}
+
+	nonce := header[prefix : prefix+nonceSize]
+	dataKey, err := key.aead.Open(nil, nonce, header[prefix+nonceSize:], header[:prefix])
+	if err != nil {
+		return nil, key, errCorrupt
+	}
+	return dataKey, key, nil
+}
+
+// encrypt returns a writer that encrypts into w. Close writes the last chunk, it does
+// not close w.
+func (k *keyring) encrypt(w io.Writer) (io.WriteCloser, error) {
+	header, aead, err := k.newHeader()
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+
+	return &encryptWriter{w: w, aead: aead, buf: make([]byte, 0, chunkSize)}, nil
+}
+
+// decrypt returns a reader of the plain content of an encrypted file, which it closes
+func (k *keyring) decrypt(f *os.File) (io.ReadSeekCloser, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, headerSize)
+	if _, err := f.ReadAt(header, 0); err != nil {
+		return nil, errCorrupt
+	}
+
+	dataKey, _, err := k.openHeader(header)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	// every chunk is full except the last, which holds at least its tag
+	body := info.Size() - int64(headerSize)
+	chunks := (body + sealedChunkSize - 1) / sealedChunkSize
+	if chunks == 0 || body-(chunks-1)*sealedChunkSize < tagSize {
+		return nil, errCorrupt
+	}
+
+	return &decryptReader{
+		f:      f,
+		aead:   aead,
+		body:   body,
+		size:   body - chunks*tagSize,
+		chunks: chunks,
+		chunk:  -1,
+	}, nil
+}
+
+// rewrap seals the data key of an encrypted file with the current master key. It
+// returns false when that was done already. Only the header is written, it is smaller
+// than a disk sector.
+func (k *keyring) rewrap(f *os.File) (bool, error) {
+	header := make([]byte, headerSize)
+	if _, err := f.ReadAt(header, 0); err != nil {
+		return false, errCorrupt
+	}
+
+	dataKey, key, err := k.openHeader(header)
+	if err != nil {
+		return false, err
+	}
+	if key.id == k.current.id {
+		return false, nil
+	}
+
+	header, err = k.sealHeader(dataKey)
+	if err != nil {
+		return false, err
+	}
+
+	if _, err := f.WriteAt(header, 0); err != nil {
+		return false, err
+	}
+	return true, f.Sync()
+}
+
+func chunkNonce(chunk int64, last bool) []byte {
+	nonce := make([]byte, nonceSize)
+	binary.BigEndian.PutUint64(nonce[2:10], uint64(chunk))
+	if last {
+		nonce[nonceSize-1] = 1
+	}
+	return nonce
+}
+
+type encryptWriter struct {
+	w     io.Writer
+	aead  cipher.AEAD
+	buf   []byte // plain content of the chunk that is being filled
+	out   []byte
+	chunk int64
+}
+
+func (e *encryptWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		// a full chunk is only sealed when more follows, the last chunk is sealed by Close
+		if len(e.buf) == chunkSize {
+			if err := e.seal(false); err != nil {
+				return written, err
+			}
+		}
+
+		n := copy(e.buf[len(e.buf):chunkSize], p)
+		e.buf = e.buf[:len(e.buf)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+func (e *encryptWriter) Close() error {
+	return e.seal(true)
+}
+
+func (e *encryptWriter) seal(last bool) error {
+	e.out = e.aead.Seal(e.out[:0], chunkNonce(e.chunk, last), e.buf, nil)
+	if _, err := e.w.Write(e.out); err != nil {
+		return err
+	}
+
+	e.chunk++
+	e.buf = e.buf[:0]
+	return nil
+}
+
+type decryptReader struct {
+	f      *os.File
+	aead   cipher.AEAD
+	body   int64 // size of the sealed chunks
+	size   int64 // size of the plain content
+	chunks int64
+	offset int64
+
+	chunk  int64 // number of the chunk in plain, -1 for none
+	plain  []byte
+	sealed []byte
+}
+
+func (d *decryptReader) Read(p []byte) (int, error) {
+	if d.offset >= d.size {
+		return 0, io.EOF
+	}
+
+	chunk := d.offset / chunkSize
+	if chunk != d.chunk {
+		if err := d.load(chunk); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, d.plain[d.offset-chunk*chunkSize:])
+	d.offset += int64(n)
+	return n, nil
+}
+
+func (d *decryptReader) load(chunk int64) error {
+	start := chunk * sealedChunkSize
+	if d.sealed == nil {
+		d.sealed = make([]byte, sealedChunkSize)
+	}
+	d.sealed = d.sealed[:min(sealedChunkSize, d.body-start)]
+
+	if _, err := d.f.ReadAt(d.sealed, int64(headerSize)+start); err != nil {
+		return fmt.Errorf("failed to read chunk %d: %w", chunk, err)
+	}
+
+	plain, err := d.aead.Open(d.plain[:0], chunkNonce(chunk, chunk == d.chunks-1), d.sealed, nil)
+	if err != nil {
+		d.chunk = -1
+		return fmt.Errorf("chunk %d: %w", chunk, errCorrupt)
+	}
+
+	d.plain = plain
+	d.chunk = chunk
+	return nil
+}
+
+func (d *decryptReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += d.offset
+	case io.SeekEnd:
+		offset += d.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+
+	d.offset = offset
+	return offset, nil
+}
+
+func (d *decryptReader) Close() error {
+	return d.f.Close()
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// contentWriter returns a writer of the content of a new file of the store, encrypted
+// when a secret is configured
+func (s *Store) contentWriter(f *os.File) (io.WriteCloser, error) {
+	if s.keys == nil {
+		return nopWriteCloser{f}, nil
+	}
+	return s.keys.encrypt(f)
+}
+
+// contentPath returns the path under which a file of the store is written
+func (s *Store) contentPath(p string) string {
+	if s.keys == nil {
+		return p
+	}
+	return p + encryptedSuffix
+}
+
+// openContent opens a file of the store, encrypted files are decrypted while they are read
+func (s *Store) openContent(p string) (io.ReadSeekCloser, error) {
+	f, err := os.Open(p + encryptedSuffix)
+	if os.IsNotExist(err) {
+		plain, err := os.Open(p)
+		if err != nil {
+			return nil, err
+		}
+		return plain, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := s.keys.decrypt(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+// replaceContent moves a file written with contentWriter into place. The same file
+// written before encryption was switched on or off is removed.
+func (s *Store) replaceContent(src, p string) error {
+	if err := os.Rename(src, s.contentPath(p)); err != nil {
+		return err
+	}
+
+	other := p + encryptedSuffix
+	if s.keys != nil {
+		other = p
+	}
+	if err := os.Remove(other); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// removeContent removes a file of the store, encrypted or not
+func (s *Store) removeContent(p string) error {
+	for _, name := range []string{p, p + encryptedSuffix} {
+		if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// RotateResult counts the files handled by RotateKeys
+type RotateResult struct {
+	Rewrapped int // data key sealed with the current master key
+	Encrypted int // stored before encryption was switched on
+	Current   int // up to date already
+}
+
+// RotateKeys seals the data keys of all blobs and thumbnails with the current master
+// key, and encrypts the files that were stored before encryption was switched on.
+// Afterwards the previous secret is no longer needed.
+func (s *Store) RotateKeys() (RotateResult, error) {
+	var result RotateResult
+	if s.keys == nil {
+		return result, errors.New("no encryption key configured")
+	}
+
+	for _, dir := range []string{blobDir, thumbnailDir} {
+		err := filepath.WalkDir(filepath.Join(s.dir, dir), func(p string, entry os.DirEntry, err error) error {
+			if os.IsNotExist(err) {
+				return nil
+			}
+
+			// temporary files are skipped
+			if err != nil || entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+				return err
+			}
+
+			if !strings.HasSuffix(p, encryptedSuffix) {
+				if err := s.encryptFile(p); err != nil {
+					return fmt.Errorf("failed to encrypt %s: %w", p, err)
+				}
+				result.Encrypted++
+				return nil
+			}
+
+			rewrapped, err := s.rewrapFile(p)
+			if err != nil {
+				return fmt.Errorf("failed to rotate key of %s: %w", p, err)
+			}
+			if rewrapped {
+				result.Rewrapped++
+			} else {
+				result.Current++
+			}
+			return nil
+		})
+		if err != nil {
+			return result, err
+		}
+	}
+
+	return result, nil
+}
+
+func (s *Store) rewrapFile(p string) (bool, error) {
+	f, err := os.OpenFile(p, os.O_RDWR, 0)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	return s.keys.rewrap(f)
+}
+
+// encryptFile replaces a plain file of the store by the encrypted file
+func (s *Store) encryptFile(p string) error {
+	blobLock.Lock()
+	defer blobLock.Unlock()
+
+	in, err := os.Open(p)
+	if os.IsNotExist(err) {
+		// released in the meantime
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	tmp, err := os.CreateTemp(filepath.Dir(p), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	w, err := s.keys.encrypt(tmp)
+	if err == nil {
+		_, err = io.Copy(w, in)
+	}
+	if err == nil {
+		err = w.Close()
+	}
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return s.replaceContent(tmp.Name(), p)
+}
@@ -0,0 +1,148 @@
+package storage
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// withKeys returns the store with other encryption keys, on the same disk and index
+func withKeys(t *testing.T, store *Store, secret string, previous ...string) *Store {
+	keys, err := newKeyring(secret, previous)
+	require.NoError(t, err)
+
+	s := *store
+	s.keys = keys
+	return &s
+}
+
+func TestEncryptDecrypt(t *testing.T) {
+	keys, err := newKeyring("secret", nil)
+	require.NoError(t, err)
+
+	for _, size := range []int{0, 1, chunkSize - 1, chunkSize, chunkSize + 1, 3*chunkSize + 5} {
+		content := make([]byte, size)
+		for i := range content {
+			content[i] = byte(i * 7)
+		}
+
+		p := filepath.Join(t.TempDir(), "content.enc")
+		f, err := os.Create(p)
+		require.NoError(t, err)
+		w, err := keys.encrypt(f)
+		require.NoError(t, err)
+		_, err = io.Copy(w, bytes.NewReader(content))
+		require.NoError(t, err)
+		require.NoError(t, w.Close())
+		require.NoError(t, f.Close())
+
+		f, err = os.Open(p)
+		require.NoError(t, err)
+		r, err := keys.decrypt(f)
+		require.NoError(t, err)
+
+		decrypted, err := io.ReadAll(r)
+		require.NoError(t, err)
+		assert.Equal(t, content, decrypted, "size %d", size)
+
+		// ranges are read without decrypting all chunks
+		if size > chunkSize+2 {
+			_, err = r.Seek(chunkSize-2, io.SeekStart)
+			require.NoError(t, err)
+			part := make([]byte, 4)
+			_, err = io.ReadFull(r, part)
+			require.NoError(t, err)
+			assert.Equal(t, content[chunkSize-2:chunkSize+2], part)
+		}
+
+		end, err := r.Seek(0, io.SeekEnd)
+		require.NoError(t, err)
+		assert.Equal(t, int64(size), end)
+		require.NoError(t, r.Close())
+	}
+}
+
+func TestEncryptionAtRest(t *testing.T) {
+	dir := t.TempDir()
+	store := withKeys(t, newTestStore(t, dir), "secret")
+
+	file, err := store.Save("passport.txt", strings.NewReader("very personal"), Upload{})
+	require.NoError(t, err)
+	assert.Equal(t, "text/plain; charset=utf-8", file.ContentType)
+	assert.Equal(t, int64(13), file.Size)
+	assert.Equal(t, "very personal", readFile(t, store, "passport.txt"))
+
+	blob := store.blobPath(file.SHA256) + encryptedSuffix
+	assert.NoFileExists(t, store.blobPath(file.SHA256))
+	onDisk, err := os.ReadFile(blob)
+	require.NoError(t, err)
+	assert.NotContains(t, string(onDisk), "personal")
+
+	// without the key, or with another one, the content cannot be read
+	_, _, err = withKeys(t, store, "").Open("passport.txt")
+	assert.ErrorIs(t, err, errUnknownKey)
+	_, _, err = withKeys(t, store, "other").Open("passport.txt")
+	assert.ErrorIs(t, err, errUnknownKey)
+
+	// plain files copied into the upload target are encrypted when they are imported
+	writePlainFile(t, filepath.Join(dir, "copied.txt"), "copied")
+	_, err = store.Reconcile()
+	require.NoError(t, err)
+	assert.Equal(t, "copied", readFile(t, store, "copied.txt"))
+	assert.NoFileExists(t, filepath.Join(dir, "copied.txt"))
+
+	// damaged content is found by verify
+	onDisk[len(onDisk)-1] ^= 0xff
+	require.NoError(t, os.WriteFile(blob, onDisk, 0o644))
+
+	result, err := store.Verify()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"passport.txt"}, result.Corrupt)
+
+	// as is content that was cut off
+	require.NoError(t, os.WriteFile(blob, onDisk[:headerSize+4], 0o644))
+	result, err = store.Verify()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"passport.txt"}, result.Corrupt)
+}
+
+func TestRotateKeys(t *testing.T) {
+	plain := newTestStore(t, t.TempDir())
+
+	old, err := plain.Save("old.txt", strings.NewReader("stored before encryption"), Upload{})
+	require.NoError(t, err)
+
+	// files stored before encryption stay readable, new ones are encrypted
+	first := withKeys(t, plain, "first")
+	_, err = first.Save("first.txt", strings.NewReader("first key"), Upload{})
+	require.NoError(t, err)
+	assert.Equal(t, "stored before encryption", readFile(t, first, "old.txt"))
+	assert.FileExists(t, first.blobPath(old.SHA256))
+
+	// after a rotation, files of the previous key can be read until they are rotated
+	second := withKeys(t, plain, "second", "first")
+	assert.Equal(t, "first key", readFile(t, second, "first.txt"))
+
+	result, err := second.RotateKeys()
+	require.NoError(t, err)
+	assert.Equal(t, RotateResult{Rewrapped: 1, Encrypted: 1}, result)
+	assert.NoFileExists(t, second.blobPath(old.SHA256))
+
+	// the previous key is not needed anymore
+	rotated := withKeys(t, plain, "second")
+	assert.Equal(t, "stored before encryption", readFile(t, rotated, "old.txt"))
+	assert.Equal(t, "first key", readFile(t, rotated, "first.txt"))
+
+	result, err = rotated.RotateKeys()
+	require.NoError(t, err)
+	assert.Equal(t, RotateResult{Current: 2}, result)
+
+	_, err = plain.RotateKeys()
+	assert.Error(t, err)
+}
@@ -0,0 +1,277 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/rogierlommers/home/internal/sqlitedb"
+)
+
+var (
+	ErrNotFound       = errors.New("not found")
+	ErrExists         = errors.New("already exists")
+	ErrFolderNotEmpty = errors.New("folder is not empty")
+)
+
+// Folder is a folder in the store, folders only exist in the index
+type Folder struct {
+	Name string `json:"name"`
+	Path string `json:"path"`
+}
+
+// ListFolder returns the subfolders and the files directly in the folder
+func (s *Store) ListFolder(folder string) ([]Folder, []sqlitedb.File, error) {
+	folder, err := CleanFolder(folder)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	exists, err := s.db.FolderExists(folder)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !exists {
+		return nil, nil, fmt.Errorf("folder %s: %w", folder, ErrNotFound)
+	}
+
+	paths, err := s.db.GetFolders(folder)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	folders := []Folder{}
+	for _, p := range paths {
+		folders = append(folders, Folder{Name: path.Base(p), Path: p})
+	}
+
+	files, err := s.db.GetFilesInFolder(folder)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return folders, files, nil
+}
+
+// CreateFolder creates a folder, and the folders above it when they do not exist
+func (s *Store) CreateFolder(folder string) (string, error) {
+	folder, err := newFolderName(folder)
+	if err != nil {
+		return "", err
+	}
+	if folder == "" {
+		return "", ErrInvalidName
+	}
+
+	added, err := s.db.AddFolder(folder)
+	if err != nil {
+		return "", err
+	}
+	if !added {
+		return "", fmt.Errorf("%s: %w", folder, ErrExists)
+	}
+
+	return folder, nil
+}
+
+// RenameFolder renames or moves a folder with everything in it, the files keep their
+// share links
+func (s *Store) RenameFolder(folder, newFolder string) (string, error) {
+	folder, err := s.existingFolder(folder)
+	if err != nil {
+		return "", err
+	}
+
+	newFolder, err = newFolderName(newFolder)
+	if err != nil {
+		return "", err
+	}
+	if newFolder == "" {
+		return "", ErrInvalidName
+	}
+	if newFolder == folder || strings.HasPrefix(newFolder, folder+"/") {
+		return "", fmt.Errorf("cannot move %s into itself: %w", folder, ErrInvalidName)
+	}
+
+	taken, err := s.taken(newFolder)
+	if err != nil {
+		return "", err
+	}
+	if taken {
+		return "", fmt.Errorf("%s: %w", newFolder, ErrExists)
+	}
+
+	if err := s.db.RenameFolder(folder, newFolder); err != nil {
+		return "", fmt.Errorf("failed to rename folder: %w", err)
+	}
+
+	return newFolder, nil
+}
+
+// DeleteFolder deletes an empty folder. With recursive set, the folder is deleted with
+// all files and folders in it.
+func (s *Store) DeleteFolder(folder string, recursive bool) error {
+	folder, err := s.existingFolder(folder)
+	if err != nil {
+		return err
+	}
+
+	if !recursive {
+		folders, files, err := s.ListFolder(folder)
+		if err != nil {
+			return err
+		}
+		if len(folders) > 0 || len(files) > 0 {
+			return fmt.Errorf("%s: %w", folder, ErrFolderNotEmpty)
+		}
+	}
+
+	blobLock.Lock()
+	defer blobLock.Unlock()
+
+	files, err := s.db.DeleteFolder(folder)
+	if err != nil {
+		return err
+	}
+
+	for _, f := range files {
+		if err := s.release(f.SHA256); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// MoveFile moves a file into another folder. When the name is taken there, a number is
+// added like for uploads.
+func (s *Store) MoveFile(name, folder string) (sqlitedb.File, error) {
+	if err := checkName(name); err != nil {
+		return sqlitedb.File{}, err
+	}
+
+	file, err := s.db.GetFile(name)
+	if err != nil {
+		return sqlitedb.File{}, err
+	}
+	if file == nil {
+		return sqlitedb.File{}, fmt.Errorf("%s: %w", name, ErrNotFound)
+	}
+
+	folder, err = CleanFolder(folder)
+	if err != nil {
+		return sqlitedb.File{}, err
+	}
+	if folder == file.Folder {
+		return *file, nil
+	}
+
+	if folder, err = s.prepareFolder(folder); err != nil {
+		return sqlitedb.File{}, err
+	}
+
+	for n := 0; n < maxCollisions; n++ {
+		candidate := path.Join(folder, alternativeName(path.Base(name), n))
+
+		moved, err := s.db.RenameFile(name, candidate, folder)
+		if err != nil {
+			return sqlitedb.File{}, fmt.Errorf("failed to move file: %w", err)
+		}
+		if moved {
+			file.Name, file.Folder = candidate, folder
+			return *file, nil
+		}
+	}
+
+	return sqlitedb.File{}, fmt.Errorf("too many files named %s", path.Base(name))
+}
+
+// RenameFile renames a file, possibly into another folder. Unlike MoveFile, the new
+// name is used exactly, it has to be sanitised already and must not be taken.
+func (s *Store) RenameFile(name, newName string) (sqlitedb.File, error) {
+	if err := checkName(name); err != nil {
+		return sqlitedb.File{}, err
+	}
+	if err := newFileName(newName); err != nil {
+		return sqlitedb.File{}, err
+	}
+
+	file, err := s.db.GetFile(name)
+	if err != nil {
+		return sqlitedb.File{}, err
+	}
+	if file == nil {
+		return sqlitedb.File{}, fmt.Errorf("%s: %w", name, ErrNotFound)
+	}
+
+	folder, err := s.prepareFolder(folderOf(newName))
+	if err != nil {
+		return sqlitedb.File{}, err
+	}
+
+	renamed, err := s.db.RenameFile(name, newName, folder)
+	if err != nil {
+		return sqlitedb.File{}, fmt.Errorf("failed to rename file: %w", err)
+	}
+	if !renamed {
+		return sqlitedb.File{}, fmt.Errorf("%s: %w", newName, ErrExists)
+	}
+
+	file.Name, file.Folder = newName, folder
+	return *file, nil
+}
+
+// prepareFolder checks the folder that a file is stored in, it is created when it does
+// not exist
+func (s *Store) prepareFolder(folder string) (string, error) {
+	folder, err := CleanFolder(folder)
+	if err != nil {
+		return "", err
+	}
+
+	exists, err := s.db.FolderExists(folder)
+	if err != nil || exists {
+		return folder, err
+	}
+
+	return s.CreateFolder(folder)
+}
+
+func (s *Store) existingFolder(folder string) (string, error) {
+	folder, err := CleanFolder(folder)
+	if err != nil {
+		return "", err
+	}
+	if folder == "" {
+		return "", ErrInvalidName
+	}
+
+	exists, err := s.db.FolderExists(folder)
+	if err != nil {
+		return "", err
+	}
+	if !exists {
+		return "", fmt.Errorf("folder %s: %w", folder, ErrNotFound)
+	}
+
+	return folder, nil
+}
+
+// taken reports if a file or folder with the name exists
+func (s *Store) taken(name string) (bool, error) {
+	if exists, err := s.db.FolderExists(name); err != nil || exists {
+		return exists, err
+	}
+
+	file, err := s.db.GetFile(name)
+	return file != nil, err
+}
+
+// folderOf returns the folder of a stored name, empty for the upload target itself
+func folderOf(name string) string {
+	if folder := path.Dir(name); folder != "." {
+		return folder
+	}
+	return ""
+}
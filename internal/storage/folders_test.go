@@ -0,0 +1,290 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rogierlommers/home/internal/sqlitedb"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCleanFolder(t *testing.T) {
+	tests := map[string]string{
+		"":                "",
+		"/":               "",
+		"invoices":        "invoices",
+		"/invoices/2024/": "invoices/2024",
+		"my: folder":      "my: folder", // existing folders may have any name
+	}
+
+	for input, expected := range tests {
+		folder, err := CleanFolder(input)
+		assert.NoError(t, err, input)
+		assert.Equal(t, expected, folder, input)
+	}
+
+	for _, input := range []string{"..", "a/../b", "a//b", ".tus", "a/.thumbs", `a\b`} {
+		_, err := CleanFolder(input)
+		assert.Error(t, err, input)
+	}
+
+	_, err := newFolderName("my: folder")
+	assert.ErrorIs(t, err, ErrInvalidName)
+}
+
+func TestSaveInFolder(t *testing.T) {
+	store := newTestStore(t, t.TempDir())
+
+	file, err := store.Save("march.pdf", strings.NewReader("march"), Upload{Folder: "invoices/2024"})
+	require.NoError(t, err)
+	assert.Equal(t, "invoices/2024/march.pdf", file.Name)
+	assert.Equal(t, "invoices/2024", file.Folder)
+	assert.Equal(t, "march", readFile(t, store, "invoices/2024/march.pdf"))
+
+	// collisions are resolved within the folder
+	file, err = store.Save("march.pdf", strings.NewReader("again"), Upload{Folder: "invoices/2024"})
+	require.NoError(t, err)
+	assert.Equal(t, "invoices/2024/march (1).pdf", file.Name)
+
+	_, err = store.Save("x.txt", strings.NewReader("x"), Upload{Folder: "../outside"})
+	assert.ErrorIs(t, err, ErrTraversal)
+}
+
+func TestListFolder(t *testing.T) {
+	store := newTestStore(t, t.TempDir())
+
+	for _, u := range []struct{ name, folder string }{
+		{"root.txt", ""},
+		{"march.pdf", "invoices"},
+		{"april.pdf", "invoices/2024"},
+	} {
+		_, err := store.Save(u.name, strings.NewReader(u.name), Upload{Folder: u.folder})
+		require.NoError(t, err)
+	}
+	_, err := store.CreateFolder("Photos")
+	require.NoError(t, err)
+
+	folders, files, err := store.ListFolder("")
+	require.NoError(t, err)
+	assert.Equal(t, []Folder{{Name: "invoices", Path: "invoices"}, {Name: "Photos", Path: "Photos"}}, folders)
+	require.Len(t, files, 1)
+	assert.Equal(t, "root.txt", files[0].Name)
+
+	folders, files, err = store.ListFolder("invoices")
+	require.NoError(t, err)
+	assert.Equal(t, []Folder{{Name: "2024", Path: "invoices/2024"}}, folders)
+	require.Len(t, files, 1)
+	assert.Equal(t, "invoices/march.pdf", files[0].Name)
+
+	_, _, err = store.ListFolder("missing")
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestRenameFolder(t *testing.T) {
+	store := newTestStore(t, t.TempDir())
+
+	_, err := store.Save("march.pdf", strings.NewReader("march"), Upload{Folder: "invoices/2024"})
+	require.NoError(t, err)
+	_, err = store.Save("other.pdf", strings.NewReader("other"), Upload{Folder: "invoices-old"})
+	require.NoError(t, err)
+
+	_, err = store.db.AddFileShare(sqlitedb.FileShare{PublicID: "abc", FileName: "invoices/2024/march.pdf", Expires: time.Now().Add(time.Hour)})
+	require.NoError(t, err)
+
+	renamed, err := store.RenameFolder("invoices", "archive/invoices")
+	require.NoError(t, err)
+	assert.Equal(t, "archive/invoices", renamed)
+	assert.Equal(t, "march", readFile(t, store, "archive/invoices/2024/march.pdf"))
+
+	folders, _, err := store.ListFolder("archive/invoices")
+	require.NoError(t, err)
+	assert.Equal(t, []Folder{{Name: "2024", Path: "archive/invoices/2024"}}, folders)
+	_, _, err = store.ListFolder("invoices")
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	moved, err := store.db.GetFile("archive/invoices/2024/march.pdf")
+	require.NoError(t, err)
+	require.NotNil(t, moved)
+	assert.Equal(t, "archive/invoices/2024", moved.Folder)
+
+	share, err := store.db.GetFileShareByPublicID("abc")
+	require.NoError(t, err)
+	assert.Equal(t, "archive/invoices/2024/march.pdf", share.FileName)
+
+	// folders that only start with the same name are left alone
+	other, err := store.db.GetFile("invoices-old/other.pdf")
+	require.NoError(t, err)
+	assert.NotNil(t, other)
+
+	_, err = store.RenameFolder("archive", "archive/invoices/inside")
+	assert.ErrorIs(t, err, ErrInvalidName)
+	_, err = store.RenameFolder("archive/invoices", "invoices-old")
+	assert.ErrorIs(t, err, ErrExists)
+	_, err = store.RenameFolder("missing", "found")
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestRenameFolderCase(t *testing.T) {
+	store := newTestStore(t, t.TempDir())
+
+	_, err := store.Save("move.jpg", strings.NewReader("move"), Upload{Folder: "Photos"})
+	require.NoError(t, err)
+	_, err = store.Save("keep.jpg", strings.NewReader("keep"), Upload{Folder: "photos/2024"})
+	require.NoError(t, err)
+	_, err = store.db.AddFileShare(sqlitedb.FileShare{PublicID: "abc", FileName: "photos/2024/keep.jpg", Expires: time.Now().Add(time.Hour)})
+	require.NoError(t, err)
+
+	// folders whose names only differ in case are separate folders
+	_, err = store.RenameFolder("Photos", "Archive")
+	require.NoError(t, err)
+	assert.Equal(t, "move", readFile(t, store, "Archive/move.jpg"))
+
+	keep, err := store.db.GetFile("photos/2024/keep.jpg")
+	require.NoError(t, err)
+	require.NotNil(t, keep)
+	assert.Equal(t, "photos/2024", keep.Folder)
+
+	folders, _, err := store.ListFolder("photos")
+	require.NoError(t, err)
+	assert.Equal(t, []Folder{{Name: "2024", Path: "photos/2024"}}, folders)
+	_, _, err = store.ListFolder("Archive/2024")
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	share, err := store.db.GetFileShareByPublicID("abc")
+	require.NoError(t, err)
+	assert.Equal(t, "photos/2024/keep.jpg", share.FileName)
+}
+
+func TestDeleteFolder(t *testing.T) {
+	store := newTestStore(t, t.TempDir())
+
+	_, err := store.CreateFolder("empty")
+	require.NoError(t, err)
+	march, err := store.Save("march.pdf", strings.NewReader("march"), Upload{Folder: "invoices/2024"})
+	require.NoError(t, err)
+
+	require.NoError(t, store.DeleteFolder("empty", false))
+	_, _, err = store.ListFolder("empty")
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	assert.ErrorIs(t, store.DeleteFolder("invoices", false), ErrFolderNotEmpty)
+	require.NoError(t, store.DeleteFolder("invoices", true))
+	_, _, err = store.ListFolder("invoices/2024")
+	assert.ErrorIs(t, err, ErrNotFound)
+	assert.NoFileExists(t, store.blobPath(march.SHA256))
+
+	files, err := store.List("")
+	require.NoError(t, err)
+	assert.Empty(t, files)
+
+	assert.ErrorIs(t, store.DeleteFolder("invoices", true), ErrNotFound)
+	assert.ErrorIs(t, store.DeleteFolder("", true), ErrInvalidName)
+}
+
+func TestDeleteFolderCase(t *testing.T) {
+	store := newTestStore(t, t.TempDir())
+
+	_, err := store.Save("delete.jpg", strings.NewReader("delete"), Upload{Folder: "Photos"})
+	require.NoError(t, err)
+	keep, err := store.Save("keep.jpg", strings.NewReader("keep"), Upload{Folder: "photos/2024"})
+	require.NoError(t, err)
+	_, err = store.db.AddFileShare(sqlitedb.FileShare{PublicID: "abc", FileName: "photos/2024/keep.jpg", Expires: time.Now().Add(time.Hour)})
+	require.NoError(t, err)
+
+	// folders whose names only differ in case are separate folders
+	require.NoError(t, store.DeleteFolder("Photos", true))
+
+	_, err = store.PruneBlobs()
+	require.NoError(t, err)
+	assert.Equal(t, "keep", readFile(t, store, keep.Name))
+
+	folders, _, err := store.ListFolder("photos")
+	require.NoError(t, err)
+	assert.Equal(t, []Folder{{Name: "2024", Path: "photos/2024"}}, folders)
+
+	share, err := store.db.GetFileShareByPublicID("abc")
+	require.NoError(t, err)
+	assert.NotNil(t, share)
+}
+
+func TestMoveFile(t *testing.T) {
+	store := newTestStore(t, t.TempDir())
+
+	_, err := store.Save("report.pdf", strings.NewReader("first"), Upload{})
+	require.NoError(t, err)
+	_, err = store.Save("report.pdf", strings.NewReader("second"), Upload{Folder: "work"})
+	require.NoError(t, err)
+
+	moved, err := store.MoveFile("report.pdf", "work")
+	require.NoError(t, err)
+	assert.Equal(t, "work/report (1).pdf", moved.Name)
+	assert.Equal(t, "work", moved.Folder)
+	assert.Equal(t, "first", readFile(t, store, "work/report (1).pdf"))
+
+	_, _, err = store.Open("report.pdf")
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	// and back to the upload target, the name is kept
+	moved, err = store.MoveFile("work/report (1).pdf", "")
+	require.NoError(t, err)
+	assert.Equal(t, "report (1).pdf", moved.Name)
+	assert.Empty(t, moved.Folder)
+
+	_, err = store.MoveFile("missing.pdf", "work")
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestReconcileFolders(t *testing.T) {
+	store := newTestStore(t, t.TempDir())
+
+	writePlainFile(t, filepath.Join(store.Dir(), "photos", "2024", "beach.jpg"), "beach")
+	writePlainFile(t, filepath.Join(store.Dir(), ".thumbs", "abc.jpg"), "thumb")
+	require.NoError(t, os.MkdirAll(filepath.Join(store.Dir(), "empty"), 0o755))
+
+	result, err := store.Reconcile()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"photos/2024/beach.jpg"}, result.Added)
+
+	file, err := store.db.GetFile("photos/2024/beach.jpg")
+	require.NoError(t, err)
+	require.NotNil(t, file)
+	assert.Equal(t, "photos/2024", file.Folder)
+	assert.Equal(t, "beach.jpg", file.OriginalName)
+
+	// the directories are removed once they are imported, the folders stay
+	assert.NoDirExists(t, filepath.Join(store.Dir(), "photos"))
+	assert.FileExists(t, filepath.Join(store.Dir(), ".thumbs", "abc.jpg"))
+
+	folders, _, err := store.ListFolder("")
+	require.NoError(t, err)
+	assert.Equal(t, []Folder{{Name: "empty", Path: "empty"}, {Name: "photos", Path: "photos"}}, folders)
+}
+
+func TestRenameFile(t *testing.T) {
+	store := newTestStore(t, t.TempDir())
+
+	_, err := store.Save("report.pdf", strings.NewReader("report"), Upload{})
+	require.NoError(t, err)
+	_, err = store.Save("taken.pdf", strings.NewReader("taken"), Upload{})
+	require.NoError(t, err)
+
+	renamed, err := store.RenameFile("report.pdf", "work/2024/annual report.pdf")
+	require.NoError(t, err)
+	assert.Equal(t, "work/2024/annual report.pdf", renamed.Name)
+	assert.Equal(t, "work/2024", renamed.Folder)
+	assert.Equal(t, "report", readFile(t, store, "work/2024/annual report.pdf"))
+
+	_, err = store.RenameFile("work/2024/annual report.pdf", "taken.pdf")
+	assert.ErrorIs(t, err, ErrExists)
+	_, err = store.RenameFile("work/2024/annual report.pdf", "work")
+	assert.ErrorIs(t, err, ErrExists)
+	_, err = store.RenameFile("work/2024/annual report.pdf", "work/.hidden")
+	assert.ErrorIs(t, err, ErrInvalidName)
+	_, err = store.RenameFile("missing.pdf", "found.pdf")
+	assert.ErrorIs(t, err, ErrNotFound)
+}
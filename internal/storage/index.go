@@ -0,0 +1,251 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gabriel-vasile/mimetype"
+	"github.com/rogierlommers/home/internal/sqlitedb"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// plain files are only imported when they did not change for a while, so files that
+	// are still being copied into the upload target are left alone
+	importDelay = time.Minute
+)
+
+// ReconcileResult lists the differences between disk and index found by Reconcile
+type ReconcileResult struct {
+	Added    []string // plain files on disk that were not in the index
+	Migrated []string // plain files stored before blobs existed, now moved into blobs
+	Changed  []string // plain files that replaced the content of an indexed file
+	Removed  []string // in the index, but the content is gone
+}
+
+// List returns the indexed files, the optional query searches names and content types
+func (s *Store) List(query string) ([]sqlitedb.File, error) {
+	return s.db.GetFiles(query)
+}
+
+// Remove deletes a stored file and its index entry, the content is removed when no
+// other file has the same content
+func (s *Store) Remove(name string) error {
+	if err := checkName(name); err != nil {
+		return err
+	}
+
+	blobLock.Lock()
+	defer blobLock.Unlock()
+
+	file, err := s.db.GetFile(name)
+	if err != nil || file == nil {
+		return err
+	}
+
+	if err := s.db.DeleteFile(name); err != nil {
+		return err
+	}
+
+	return s.release(file.SHA256)
+}
+
+// Reconcile brings the index in line with the disk. Plain files in the upload target and
+// its directories, put there outside of the app or stored by older versions, are moved
+// into blobs and indexed under their path. Entries of which the content is gone are dropped.
+func (s *Store) Reconcile() (ReconcileResult, error) {
+	var (
+		result ReconcileResult
+		dirs   []string
+	)
+
+	err := filepath.WalkDir(s.dir, func(p string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if p == s.dir && os.IsNotExist(err) {
+				return filepath.SkipDir
+			}
+			return err
+		}
+
+		if p == s.dir {
+			return nil
+		}
+
+		// hidden entries hold the state of the app itself, such as blobs and incomplete uploads
+		if strings.HasPrefix(entry.Name(), ".") {
+			if entry.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		rel, err := filepath.Rel(s.dir, p)
+		if err != nil {
+			return nil
+		}
+		name := filepath.ToSlash(rel)
+
+		if entry.IsDir() {
+			if _, err := CleanFolder(name); err != nil {
+				return filepath.SkipDir
+			}
+			dirs = append(dirs, p)
+			_, err := s.db.AddFolder(name)
+			return err
+		}
+
+		info, err := entry.Info()
+		if err != nil || !info.Mode().IsRegular() || time.Since(info.ModTime()) < importDelay || checkName(name) != nil {
+			return nil
+		}
+
+		status, err := s.importFile(p, name, info)
+		if err != nil {
+			logrus.Errorf("failed to import %s: %v", name, err)
+			return nil
+		}
+
+		switch status {
+		case importAdded:
+			result.Added = append(result.Added, name)
+		case importMigrated:
+			result.Migrated = append(result.Migrated, name)
+		case importChanged:
+			result.Changed = append(result.Changed, name)
+		}
+		return nil
+	})
+	if err != nil {
+		return result, fmt.Errorf("failed to list files: %w", err)
+	}
+
+	// the directories are empty after the import, the folders are kept in the index.
+	// Directories that still hold files cannot be removed.
+	for i := len(dirs) - 1; i >= 0; i-- {
+		os.Remove(dirs[i])
+	}
+
+	indexed, err := s.db.GetFiles("")
+	if err != nil {
+		return result, err
+	}
+
+	for _, f := range indexed {
+		blob, err := s.openBlob(f.SHA256)
+		if err == nil {
+			blob.Close()
+			continue
+		}
+
+		// content that cannot be read, such as content encrypted with another key, is kept
+		if !errors.Is(err, ErrNotFound) {
+			logrus.Errorf("failed to open content of %s: %v", f.Name, err)
+			continue
+		}
+
+		if err := s.db.DeleteFile(f.Name); err != nil {
+			return result, err
+		}
+		result.Removed = append(result.Removed, f.Name)
+	}
+
+	return result, nil
+}
+
+type importStatus int
+
+const (
+	importAdded importStatus = iota
+	importMigrated
+	importChanged
+)
+
+// importFile moves a plain file into a blob. A file with the name of an indexed file
+// keeps the index entry, with the new content.
+func (s *Store) importFile(p, name string, info fs.FileInfo) (importStatus, error) {
+	blobLock.Lock()
+	defer blobLock.Unlock()
+
+	if _, err := s.db.AddFolder(folderOf(name)); err != nil {
+		return 0, err
+	}
+
+	file, err := s.db.GetFile(name)
+	if err != nil {
+		return 0, err
+	}
+
+	previous := ""
+	if file != nil {
+		previous = file.SHA256
+	} else {
+		uploaded := info.ModTime().UTC().Truncate(0)
+		file = &sqlitedb.File{
+			Name:         name,
+			Folder:       folderOf(name),
+			OriginalName: info.Name(),
+			Source:       sqlitedb.FileSourceExternal,
+			Uploaded:     uploaded,
+			Expires:      s.expiry(uploaded, 0),
+		}
+	}
+
+	src, err := s.takeFile(p, file)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := s.addBlob(src, file.SHA256); err != nil {
+		return 0, err
+	}
+
+	if err := s.db.SaveFile(*file); err != nil {
+		return 0, err
+	}
+
+	switch {
+	case previous == "":
+		return importAdded, nil
+	case previous == file.SHA256:
+		return importMigrated, nil
+	default:
+		return importChanged, s.release(previous)
+	}
+}
+
+// describe fills in content type, hash and size of a file on disk
+func describe(path string, f *sqlitedb.File) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	mtype, err := mimetype.DetectReader(file)
+	if err != nil {
+		return fmt.Errorf("failed to detect content type: %w", err)
+	}
+
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	h := sha256.New()
+	size, err := io.Copy(h, file)
+	if err != nil {
+		return fmt.Errorf("failed to hash file: %w", err)
+	}
+
+	f.ContentType = mtype.String()
+	f.SHA256 = hex.EncodeToString(h.Sum(nil))
+	f.Size = size
+	return nil
+}
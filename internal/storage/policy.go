@@ -0,0 +1,252 @@
+package storage
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/gabriel-vasile/mimetype"
+	"github.com/rogierlommers/home/internal/config"
+	"github.com/rogierlommers/home/internal/sqlitedb"
+	"github.com/sirupsen/logrus"
+)
+
+// ErrRejected is returned for files that the file policy refuses, the error is a
+// *RejectedError with the reason
+var ErrRejected = errors.New("file refused")
+
+// RejectedError describes why a file was refused
+type RejectedError struct {
+	Name        string
+	Source      string // entry point of the upload
+	ContentType string // as sniffed from the content
+	Reason      string
+}
+
+func (e *RejectedError) Error() string {
+	return fmt.Sprintf("%s refused: %s", e.Name, e.Reason)
+}
+
+func (e *RejectedError) Unwrap() error {
+	return ErrRejected
+}
+
+// EventLog records events about the storage. It is implemented by the package that
+// keeps the events, so the entry points of the storage do not depend on it.
+type EventLog interface {
+	AddSystemEvent(category, severity, message string, attributes map[string]any) error
+}
+
+// LogRejected records an event when the error is a file refused by the file policy,
+// other errors are ignored. Every entry point records refused files this way.
+func LogRejected(events EventLog, err error) {
+	var rejected *RejectedError
+	if !errors.As(err, &rejected) {
+		return
+	}
+
+	message := fmt.Sprintf("upload of %s through %s refused: %s", rejected.Name, rejected.Source, rejected.Reason)
+	attributes := map[string]any{
+		"name":         rejected.Name,
+		"entry_point":  rejected.Source,
+		"content_type": rejected.ContentType,
+		"reason":       rejected.Reason,
+	}
+
+	if err := events.AddSystemEvent("storage", "warning", message, attributes); err != nil {
+		logrus.Errorf("failed to log rejected file: %v", err)
+	}
+}
+
+// Policy decides which types of files an entry point accepts. Types are media types
+// such as "application/pdf", or "image/*" for all images.
+type Policy struct {
+	Allow []string // when set, only these types are accepted
+	Deny  []string
+}
+
+// extensionTypes are the types that the content of a file with the extension has to
+// have. Extensions that are missing are not checked, their formats cannot be told apart
+// reliably or are plain text.
+var extensionTypes = map[string]string{
+	".pdf":  "application/pdf",
+	".jpg":  "image/jpeg",
+	".jpeg": "image/jpeg",
+	".png":  "image/png",
+	".gif":  "image/gif",
+	".webp": "image/webp",
+	".svg":  "image/svg+xml",
+	".zip":  "application/zip",
+	".gz":   "application/gzip",
+	".doc":  "application/msword",
+	".xls":  "application/vnd.ms-excel",
+	".docx": "application/vnd.openxmlformats-officedocument.wordprocessingml.document",
+	".xlsx": "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+	".pptx": "application/vnd.openxmlformats-officedocument.presentationml.presentation",
+	".txt":  "text/plain",
+	".csv":  "text/plain",
+	".json": "text/plain",
+}
+
+// newPolicies reads the policies of the entry points from the configuration, uploads
+// through the api and webdav share the policy of the storage page
+func newPolicies(cfg config.AppConfig) map[string]Policy {
+	files := Policy{Allow: splitTypes(cfg.StorageAllowedTypes), Deny: splitTypes(cfg.StorageDeniedTypes)}
+	quicknote := Policy{Allow: splitTypes(cfg.QuicknoteAllowedTypes), Deny: splitTypes(cfg.QuicknoteDeniedTypes)}
+
+	return map[string]Policy{
+		sqlitedb.FileSourceStorage:   files,
+		sqlitedb.FileSourceAPI:       files,
+		sqlitedb.FileSourceWebDAV:    files,
+		sqlitedb.FileSourceQuicknote: quicknote,
+	}
+}
+
+func splitTypes(list string) []string {
+	var types []string
+	for _, t := range strings.Split(list, ",") {
+		if t = strings.ToLower(strings.TrimSpace(t)); t != "" {
+			types = append(types, t)
+		}
+	}
+	return types
+}
+
+// screen checks the type of the content against the policy of the entry point and
+// starts the malware scan. The returned reader has to be read instead of the content,
+// finish reports the verdict of the scan once all of it was read. Files that were not
+// uploaded through an entry point, such as files found on disk, are not screened.
+func (s *Store) screen(name string, u Upload, content io.Reader) (io.Reader, func() error, error) {
+	noScan := func() error { return nil }
+	policy, ok := s.policies[u.Source]
+	if !ok {
+		return content, noScan, nil
+	}
+
+	br := bufio.NewReaderSize(content, sniffLength)
+	head, _ := br.Peek(sniffLength)
+	detected := mimetype.Detect(head)
+
+	reject := func(reason string) *RejectedError {
+		return &RejectedError{Name: name, Source: u.Source, ContentType: detected.String(), Reason: reason}
+	}
+
+	if reason := policy.refuses(detected); reason != "" {
+		return nil, nil, reject(reason)
+	}
+
+	if expected, ok := extensionTypes[strings.ToLower(path.Ext(name))]; ok && !matchesExtension(detected, expected) {
+		return nil, nil, reject(fmt.Sprintf("content is %s, which does not match the extension", MediaType(detected.String())))
+	}
+
+	if s.scanner == nil {
+		return br, noScan, nil
+	}
+
+	stream, err := s.scanner.stream()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	finish := func() error {
+		signature, err := stream.verdict()
+		if err != nil {
+			return err
+		}
+		if signature != "" {
+			return reject("malware found: " + signature)
+		}
+		return nil
+	}
+
+	return io.TeeReader(br, stream), finish, nil
+}
+
+// screenFile screens a file on disk, see screen
+func (s *Store) screenFile(p, name string, u Upload) error {
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r, finish, err := s.screen(name, u, f)
+	if err != nil {
+		return err
+	}
+
+	if s.scanner != nil {
+		if _, err := io.Copy(io.Discard, r); err != nil {
+			finish()
+			return err
+		}
+	}
+	return finish()
+}
+
+// refuses returns why the policy does not accept the type, empty when it does
+func (p Policy) refuses(detected *mimetype.MIME) string {
+	mediaType := MediaType(detected.String())
+
+	for _, t := range p.Deny {
+		if matchesType(detected, t) {
+			return fmt.Sprintf("type %s is not allowed", mediaType)
+		}
+	}
+
+	if len(p.Allow) == 0 {
+		return ""
+	}
+
+	for _, t := range p.Allow {
+		if matchesType(detected, t) {
+			return ""
+		}
+	}
+	return fmt.Sprintf("type %s is not allowed", mediaType)
+}
+
+// matchesType reports if the type is t, one of the types of "image/*", or a more precise
+// type of t, such as application/x-executable of application/x-elf. Every type is a kind
+// of application/octet-stream, that one only matches unknown binary content.
+func matchesType(detected *mimetype.MIME, t string) bool {
+	if prefix, ok := strings.CutSuffix(t, "/*"); ok {
+		return strings.HasPrefix(MediaType(detected.String()), prefix+"/")
+	}
+
+	if detected.Is(t) {
+		return true
+	}
+	for m := detected.Parent(); m != nil && m.Parent() != nil; m = m.Parent() {
+		if m.Is(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesExtension reports if the content fits the type of the extension. Content that
+// is recognised more precisely, such as html in a .txt file, or less precisely, such as
+// a docx that is only recognised as zip, also fits. Unknown binary content does not.
+func matchesExtension(detected *mimetype.MIME, expected string) bool {
+	for m := detected; m != nil; m = m.Parent() {
+		if m.Is(expected) {
+			return true
+		}
+	}
+
+	if detected.Parent() == nil {
+		return false
+	}
+
+	for m := mimetype.Lookup(expected); m != nil; m = m.Parent() {
+		if detected.Is(m.String()) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,133 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image/png"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/rogierlommers/home/internal/config"
+	"github.com/rogierlommers/home/internal/sqlitedb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newPolicyStore(t *testing.T, cfg config.AppConfig) *Store {
+	db := sqlitedb.InitDatabase(config.AppConfig{Database: filepath.Join(t.TempDir(), "test.db")})
+	t.Cleanup(db.Close)
+
+	cfg.UploadTarget = t.TempDir()
+	cfg.FileCleanUpInDys = 7
+	return New(cfg, db)
+}
+
+func TestFilePolicy(t *testing.T) {
+	store := newPolicyStore(t, config.AppConfig{
+		StorageDeniedTypes:    "application/x-elf",
+		QuicknoteAllowedTypes: "image/*, text/plain",
+	})
+
+	var photo bytes.Buffer
+	require.NoError(t, png.Encode(&photo, testImage(10, 10)))
+	pdf := "%PDF-1.4\n1 0 obj\n<< >>\nendobj\n%%EOF\n"
+	elf := "\x7fELF\x02\x01\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02\x00\x3e\x00"
+
+	storage := Upload{Source: sqlitedb.FileSourceStorage}
+	api := Upload{Source: sqlitedb.FileSourceAPI}
+	quicknote := Upload{Source: sqlitedb.FileSourceQuicknote}
+
+	tests := []struct {
+		name     string
+		content  string
+		upload   Upload
+		accepted bool
+	}{
+		{"photo.png", photo.String(), storage, true},
+		{"photo.png", photo.String(), quicknote, true},
+		{"notes.txt", "hello", quicknote, true},
+		{"notes.md", "# hello", storage, true},
+		{"data.csv", "a,b\n1,2\n", storage, true},
+		{"report.pdf", pdf, storage, true},
+		{"report", pdf, storage, true},
+
+		// types that are denied, or not allowed
+		{"report.pdf", pdf, quicknote, false},
+		{"tool", elf, storage, false},
+		{"tool", elf, api, false},
+
+		// content that does not match the extension
+		{"photo.jpg", photo.String(), storage, false},
+		{"invoice.pdf", "not a pdf", storage, false},
+		{"notes.txt", elf, quicknote, false},
+
+		// files without an entry point are not screened
+		{"tool", elf, Upload{}, true},
+	}
+
+	for _, tt := range tests {
+		_, err := store.Save(tt.name, strings.NewReader(tt.content), tt.upload)
+		if tt.accepted {
+			assert.NoError(t, err, "%s through %q", tt.name, tt.upload.Source)
+			continue
+		}
+
+		var rejected *RejectedError
+		if assert.True(t, errors.As(err, &rejected), "%s through %q: %v", tt.name, tt.upload.Source, err) {
+			assert.ErrorIs(t, err, ErrRejected)
+			assert.Equal(t, tt.upload.Source, rejected.Source)
+			assert.NotEmpty(t, rejected.Reason)
+		}
+	}
+
+	// refused files leave nothing behind
+	files, err := store.List("")
+	require.NoError(t, err)
+	assert.Len(t, files, 8)
+
+	blobs, err := filepath.Glob(filepath.Join(store.Dir(), blobDir, ".tmp-*"))
+	require.NoError(t, err)
+	assert.Empty(t, blobs)
+}
+
+func TestMoveScreensFile(t *testing.T) {
+	store := newPolicyStore(t, config.AppConfig{})
+
+	src := filepath.Join(t.TempDir(), "upload")
+	writePlainFile(t, src, "not a pdf")
+
+	_, err := store.Move(src, "invoice.pdf", Upload{Source: sqlitedb.FileSourceStorage})
+	assert.ErrorIs(t, err, ErrRejected)
+	assert.FileExists(t, src)
+
+	file, err := store.Move(src, "invoice.txt", Upload{Source: sqlitedb.FileSourceStorage})
+	require.NoError(t, err)
+	assert.Equal(t, "not a pdf", readFile(t, store, file.Name))
+}
+
+type recordedEvents struct {
+	messages   []string
+	attributes []map[string]any
+}
+
+func (r *recordedEvents) AddSystemEvent(category, severity, message string, attributes map[string]any) error {
+	r.messages = append(r.messages, category+" "+severity+": "+message)
+	r.attributes = append(r.attributes, attributes)
+	return nil
+}
+
+func TestLogRejected(t *testing.T) {
+	events := &recordedEvents{}
+
+	LogRejected(events, errors.New("disk failure"))
+	LogRejected(events, nil)
+	assert.Empty(t, events.messages)
+
+	err := fmt.Errorf("failed to save file: %w", &RejectedError{Name: "tool", Source: "quicknote", ContentType: "application/x-elf", Reason: "type is not allowed"})
+	LogRejected(events, err)
+	assert.Equal(t, []string{"storage warning: upload of tool through quicknote refused: type is not allowed"}, events.messages)
+	assert.Equal(t, "quicknote", events.attributes[0]["entry_point"])
+	assert.Equal(t, "application/x-elf", events.attributes[0]["content_type"])
+}
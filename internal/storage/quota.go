@@ -0,0 +1,163 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/dustin/go-humanize"
+)
+
+var (
+	ErrTooLarge      = errors.New("file is larger than the upload limit")
+	ErrQuotaExceeded = errors.New("storage quota exceeded")
+	ErrDiskFull      = errors.New("not enough free disk space")
+)
+
+// Usage is the space taken by the store, compared to its limits
+type Usage struct {
+	Files     int     `json:"files"`
+	Used      int64   `json:"used"`
+	Quota     int64   `json:"quota"`      // zero is unlimited
+	MaxUpload int64   `json:"max_upload"` // zero is unlimited
+	DiskFree  uint64  `json:"disk_free"`  // zero when unknown
+	DiskTotal uint64  `json:"disk_total"` // zero when unknown
+	Percent   float64 `json:"percent"`    // of the quota, or of the disk without quota
+}
+
+// NoSpace reports if the error means a file did not fit, clients get a 413 for those
+func NoSpace(err error) bool {
+	return errors.Is(err, ErrTooLarge) || errors.Is(err, ErrQuotaExceeded) || errors.Is(err, ErrDiskFull)
+}
+
+// Usage returns the size of the indexed files and the free space of the disk
+func (s *Store) Usage() (Usage, error) {
+	count, used, err := s.db.GetFilesUsage()
+	if err != nil {
+		return Usage{}, err
+	}
+
+	u := Usage{Files: count, Used: used, Quota: s.quota, MaxUpload: s.maxUpload}
+	if free, total, ok := diskSpace(s.dir); ok {
+		u.DiskFree, u.DiskTotal = free, total
+	}
+
+	switch {
+	case u.Quota > 0:
+		u.Percent = float64(u.Used) / float64(u.Quota) * 100
+	case u.DiskTotal > 0:
+		u.Percent = float64(u.DiskTotal-u.DiskFree) / float64(u.DiskTotal) * 100
+	}
+
+	return u, nil
+}
+
+// Check returns an error when a file of the size does not fit, a negative size is
+// unknown and only checks if there is any room left at all
+func (s *Store) Check(size int64) error {
+	return s.check(size, true)
+}
+
+func (s *Store) check(size int64, disk bool) error {
+	limit, err := s.limit(disk)
+	if err != nil {
+		return err
+	}
+
+	if limit.Bytes >= 0 && (size > limit.Bytes || limit.Bytes == 0) {
+		return limit.Err
+	}
+	return nil
+}
+
+// Limit is a number of bytes that may still be stored, and the error when more is
+// stored
+type Limit struct {
+	Bytes int64 // negative is unlimited
+	Err   error
+}
+
+func (l *Limit) lower(bytes int64, err error) {
+	bytes = max(bytes, 0)
+	if l.Bytes < 0 || bytes < l.Bytes {
+		*l = Limit{Bytes: bytes, Err: err}
+	}
+}
+
+// FileLimit returns how many bytes one file may still take
+func (s *Store) FileLimit() (Limit, error) {
+	return s.limit(true)
+}
+
+// UploadLimit returns how many bytes all files of one upload may take together, the
+// room left in the quota and on disk. The upload limit applies to each file by itself.
+// Handlers cut requests off at it before they are buffered.
+func (s *Store) UploadLimit() (Limit, error) {
+	return s.room(true)
+}
+
+// PendingLimit returns how many bytes uploads that are still in progress may add,
+// when they already hold pending bytes on disk. Those bytes take room in the quota
+// once the uploads complete, the free disk space already accounts for them.
+func (s *Store) PendingLimit(pending int64) (Limit, error) {
+	l, err := s.room(true)
+	if err != nil || s.quota <= 0 {
+		return l, err
+	}
+
+	_, used, err := s.db.GetFilesUsage()
+	if err != nil {
+		return l, err
+	}
+	l.lower(s.quota-used-pending, fmt.Errorf("%w, %s of %s used and %s in uploads in progress", ErrQuotaExceeded,
+		humanize.IBytes(uint64(used)), humanize.IBytes(uint64(s.quota)), humanize.IBytes(uint64(pending))))
+	return l, nil
+}
+
+// limit returns the tightest of the upload limit, the room left in the quota and,
+// when disk is set, the free disk space. The disk always keeps the minimum free.
+func (s *Store) limit(disk bool) (Limit, error) {
+	l, err := s.room(disk)
+	if err != nil {
+		return l, err
+	}
+
+	if s.maxUpload > 0 {
+		l.lower(s.maxUpload, fmt.Errorf("%w of %s", ErrTooLarge, humanize.IBytes(uint64(s.maxUpload))))
+	}
+	return l, nil
+}
+
+// room returns the room left in the quota and, when disk is set, on disk
+func (s *Store) room(disk bool) (Limit, error) {
+	l := Limit{Bytes: -1}
+
+	if s.quota > 0 {
+		_, used, err := s.db.GetFilesUsage()
+		if err != nil {
+			return l, err
+		}
+		l.lower(s.quota-used, fmt.Errorf("%w, %s of %s used", ErrQuotaExceeded, humanize.IBytes(uint64(used)), humanize.IBytes(uint64(s.quota))))
+	}
+
+	if free, _, ok := diskSpace(s.dir); ok && disk {
+		l.lower(int64(free)-s.minFree, fmt.Errorf("%w, %s left", ErrDiskFull, humanize.IBytes(free)))
+	}
+
+	return l, nil
+}
+
+// limitedWriter fails as soon as more than the limit is written
+type limitedWriter struct {
+	w       io.Writer
+	limit   Limit
+	written int64
+}
+
+func (lw *limitedWriter) Write(p []byte) (int, error) {
+	lw.written += int64(len(p))
+	if lw.limit.Bytes >= 0 && lw.written > lw.limit.Bytes {
+		return 0, lw.limit.Err
+	}
+	return lw.w.Write(p)
+}
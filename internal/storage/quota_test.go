@@ -0,0 +1,84 @@
+package storage
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/rogierlommers/home/internal/config"
+	"github.com/rogierlommers/home/internal/sqlitedb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQuota(t *testing.T) {
+	dir := t.TempDir()
+	db := sqlitedb.InitDatabase(config.AppConfig{Database: filepath.Join(t.TempDir(), "test.db")})
+	t.Cleanup(db.Close)
+	store := New(config.AppConfig{UploadTarget: dir, StorageQuotaMB: 2, StorageMaxUploadMB: 1}, db)
+
+	// every file gets other content, the same content is only stored once
+	var fill byte
+	mb := func(n float64) *bytes.Reader {
+		fill++
+		return bytes.NewReader(bytes.Repeat([]byte{fill}, int(n*(1<<20))))
+	}
+
+	_, err := store.Save("large.bin", mb(1.5), Upload{})
+	assert.ErrorIs(t, err, ErrTooLarge)
+	assert.True(t, NoSpace(err))
+	assert.NoFileExists(t, filepath.Join(dir, "large.bin"))
+
+	_, err = store.Save("first.bin", mb(0.9), Upload{})
+	require.NoError(t, err)
+	_, err = store.Save("second.bin", mb(0.9), Upload{})
+	require.NoError(t, err)
+	_, err = store.Save("small.txt", strings.NewReader("small"), Upload{})
+	require.NoError(t, err)
+	_, err = store.Save("copy of small.txt", strings.NewReader("small"), Upload{})
+	require.NoError(t, err)
+
+	usage, err := store.Usage()
+	require.NoError(t, err)
+	assert.Equal(t, 4, usage.Files)
+	assert.Equal(t, int64(2*943718+5), usage.Used) // the copy takes no space
+	assert.Equal(t, int64(2<<20), usage.Quota)
+	assert.InDelta(t, 90, usage.Percent, 0.1)
+
+	// 0.2MB of the quota is left
+	assert.NoError(t, store.Check(100<<10))
+	assert.ErrorIs(t, store.Check(300<<10), ErrQuotaExceeded)
+
+	_, err = store.Save("third.bin", mb(0.5), Upload{})
+	assert.ErrorIs(t, err, ErrQuotaExceeded)
+	assert.NoFileExists(t, filepath.Join(dir, "third.bin"))
+
+	// moving a file in counts as well
+	src := filepath.Join(dir, ".upload")
+	require.NoError(t, os.WriteFile(src, make([]byte, 300<<10), 0o644))
+	_, err = store.Move(src, "moved.bin", Upload{})
+	assert.ErrorIs(t, err, ErrQuotaExceeded)
+}
+
+func TestMinimumFreeSpace(t *testing.T) {
+	dir := t.TempDir()
+	if _, _, ok := diskSpace(dir); !ok {
+		t.Skip("free disk space is unknown on this platform")
+	}
+
+	db := sqlitedb.InitDatabase(config.AppConfig{Database: filepath.Join(t.TempDir(), "test.db")})
+	t.Cleanup(db.Close)
+
+	// no disk has this much room left
+	store := New(config.AppConfig{UploadTarget: dir, StorageMinFreeMB: 1 << 40}, db)
+
+	_, err := store.Save("file.txt", bytes.NewReader([]byte("hello")), Upload{})
+	assert.ErrorIs(t, err, ErrDiskFull)
+	assert.ErrorIs(t, store.Check(-1), ErrDiskFull)
+
+	usage, err := store.Usage()
+	require.NoError(t, err)
+	assert.NotZero(t, usage.DiskTotal)
+}
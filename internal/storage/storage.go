@@ -0,0 +1,493 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/rogierlommers/home/internal/config"
+	"github.com/rogierlommers/home/internal/sqlitedb"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// maximum length of a file name in bytes, the limit of most filesystems
+	maxNameLength = 255
+
+	// maximum number of "name (n).ext" alternatives tried on collisions
+	maxCollisions = 1000
+
+	// number of bytes used to detect the content type
+	sniffLength = 3072
+
+	// Forever is the retention of files that never expire
+	Forever time.Duration = -1
+)
+
+var (
+	ErrInvalidName = errors.New("invalid file name")
+	ErrTraversal   = errors.New("file name points outside of the storage directory")
+)
+
+// Store keeps files in the upload target. The content is stored once as a blob named
+// after its hash, the names and folders of the files only exist in the files index.
+// Names are sanitised, names that point outside of the store are rejected and existing
+// files are never overwritten: on a collision the file is stored as "name (1).ext".
+// Files that do not fit in the quota, the upload limit or the free disk space are refused.
+// With an encryption key configured, blobs and thumbnails are encrypted on disk. Uploads
+// are checked against the file policy of their entry point, see screen.
+type Store struct {
+	dir       string
+	db        *sqlitedb.DB
+	retention time.Duration
+	quota     int64
+	maxUpload int64
+	minFree   int64
+	keys      *keyring // nil when files are not encrypted
+	policies  map[string]Policy
+	scanner   *clamAV // nil when uploads are not scanned
+}
+
+// Upload describes who stored a file, through which entry point and how long it is kept
+type Upload struct {
+	Uploader  string
+	Source    string
+	Folder    string        // folder to store the file in, empty for the upload target itself
+	Retention time.Duration // zero uses the default retention, Forever keeps the file
+}
+
+// ParseRetention parses a retention chosen at upload time: a number of days ("7d"),
+// weeks ("1w"), a duration ("12h") or "forever". An empty value means the default.
+func ParseRetention(value string) (time.Duration, error) {
+	value = strings.ToLower(strings.TrimSpace(value))
+
+	var (
+		retention time.Duration
+		err       error
+	)
+
+	switch {
+	case value == "":
+		return 0, nil
+	case value == "forever":
+		return Forever, nil
+	case strings.HasSuffix(value, "d"), strings.HasSuffix(value, "w"):
+		unit := 24 * time.Hour
+		if strings.HasSuffix(value, "w") {
+			unit *= 7
+		}
+
+		var n int
+		n, err = strconv.Atoi(value[:len(value)-1])
+		retention = time.Duration(n) * unit
+	default:
+		retention, err = time.ParseDuration(value)
+	}
+
+	if err != nil || retention <= 0 {
+		return 0, fmt.Errorf("invalid retention %q", value)
+	}
+	return retention, nil
+}
+
+func New(cfg config.AppConfig, db *sqlitedb.DB) *Store {
+	keys, err := newKeyring(cfg.StorageEncryptionKey, []string{cfg.StorageEncryptionOldKey})
+	if err != nil {
+		logrus.Fatalf("failed to derive storage encryption keys: %v", err)
+	}
+
+	return &Store{
+		dir:       cfg.UploadTarget,
+		db:        db,
+		retention: time.Duration(cfg.FileCleanUpInDys) * 24 * time.Hour,
+		quota:     int64(cfg.StorageQuotaMB) << 20,
+		maxUpload: int64(cfg.StorageMaxUploadMB) << 20,
+		minFree:   int64(cfg.StorageMinFreeMB) << 20,
+		keys:      keys,
+		policies:  newPolicies(cfg),
+		scanner:   newScanner(cfg.ClamAVSocket),
+	}
+}
+
+// Dir returns the directory of the store
+func (s *Store) Dir() string {
+	return s.dir
+}
+
+// SanitizeName turns a name supplied by a client into a safe file name. Directories
+// are stripped, as some clients send the full path, but names with ".." are rejected.
+func SanitizeName(name string) (string, error) {
+	// clients on Windows use backslashes as separator
+	elements := strings.FieldsFunc(name, func(r rune) bool { return r == '/' || r == '\\' })
+	for _, e := range elements {
+		if strings.TrimSpace(e) == ".." {
+			return "", ErrTraversal
+		}
+	}
+
+	if len(elements) == 0 {
+		return "", ErrInvalidName
+	}
+
+	var b strings.Builder
+	for _, r := range elements[len(elements)-1] {
+		switch {
+		case r == utf8.RuneError, unicode.IsControl(r):
+			// dropped
+		case strings.ContainsRune(`<>:"|?*`, r):
+			b.WriteRune('_')
+		default:
+			b.WriteRune(r)
+		}
+	}
+
+	// no hidden files, and no names that only consist of dots and spaces
+	clean := strings.TrimLeft(strings.TrimSpace(b.String()), ". ")
+	clean = strings.TrimRight(clean, ". ")
+	if clean == "" {
+		return "", ErrInvalidName
+	}
+
+	return truncateName(clean, maxNameLength), nil
+}
+
+// CleanFolder checks a folder path supplied by a client, folders are separated by "/".
+// ".." and hidden folders are rejected. The empty path is the upload target itself.
+func CleanFolder(folder string) (string, error) {
+	folder = strings.Trim(folder, "/")
+	if folder == "" {
+		return "", nil
+	}
+
+	for _, element := range strings.Split(folder, "/") {
+		switch {
+		case strings.TrimSpace(element) == "..":
+			return "", ErrTraversal
+		case element == "", strings.HasPrefix(element, "."), strings.ContainsRune(element, '\\'):
+			return "", ErrInvalidName
+		}
+	}
+
+	return folder, nil
+}
+
+// newFolderName checks a folder that is about to be created, unlike existing folders
+// that may have been created outside of the app, all its names have to be sanitised
+func newFolderName(folder string) (string, error) {
+	folder, err := CleanFolder(folder)
+	if err != nil || folder == "" {
+		return folder, err
+	}
+
+	for _, element := range strings.Split(folder, "/") {
+		if clean, err := SanitizeName(element); err != nil || clean != element {
+			return "", ErrInvalidName
+		}
+	}
+
+	return folder, nil
+}
+
+// checkName checks the name of a stored file. Unlike SanitizeName, the name has to be
+// exactly the name of a file in the store, files in folders are named "folder/name".
+func checkName(name string) error {
+	if strings.ContainsRune(name, '\\') {
+		return ErrTraversal
+	}
+
+	folder, base := path.Split(name)
+	if base == "" || strings.HasPrefix(base, ".") || strings.HasPrefix(name, "/") {
+		return ErrInvalidName
+	}
+
+	if folder != "" {
+		clean, err := CleanFolder(folder)
+		if err != nil {
+			return err
+		}
+		if clean+"/" != folder {
+			return ErrInvalidName
+		}
+	}
+
+	return nil
+}
+
+// newFileName checks the name of a file that is about to be stored under exactly that
+// name, the name of the file itself has to be sanitised
+func newFileName(name string) error {
+	if err := checkName(name); err != nil {
+		return err
+	}
+
+	if clean, err := SanitizeName(path.Base(name)); err != nil || clean != path.Base(name) {
+		return ErrInvalidName
+	}
+	return nil
+}
+
+// Open opens the content of a stored file
+func (s *Store) Open(name string) (io.ReadSeekCloser, sqlitedb.File, error) {
+	if err := checkName(name); err != nil {
+		return nil, sqlitedb.File{}, err
+	}
+
+	file, err := s.db.GetFile(name)
+	if err != nil {
+		return nil, sqlitedb.File{}, err
+	}
+	if file == nil {
+		return nil, sqlitedb.File{}, fmt.Errorf("%s: %w", name, ErrNotFound)
+	}
+
+	f, err := s.openBlob(file.SHA256)
+	if err != nil {
+		return nil, sqlitedb.File{}, fmt.Errorf("content of %s: %w", name, err)
+	}
+
+	return f, *file, nil
+}
+
+// Save stores the content under the sanitised name and returns its index entry. When
+// the name is taken, a number is added.
+func (s *Store) Save(name string, content io.Reader, u Upload) (sqlitedb.File, error) {
+	clean, err := SanitizeName(name)
+	if err != nil {
+		return sqlitedb.File{}, err
+	}
+
+	folder, err := s.prepareFolder(u.Folder)
+	if err != nil {
+		return sqlitedb.File{}, err
+	}
+
+	file := s.newFile(folder, name, u)
+	tmp, err := s.receive(clean, content, u, &file)
+	if err != nil {
+		return sqlitedb.File{}, err
+	}
+
+	return s.add(tmp, file, clean)
+}
+
+// Replace stores the content under exactly the name, which has to be sanitised already.
+// An existing file with the name is replaced, it keeps its share links, its pin and its
+// retention, counted from now. Clients that edit files in place, such as network
+// drives, need this; uploads use Save and never overwrite a file.
+func (s *Store) Replace(name string, content io.Reader, u Upload) (sqlitedb.File, error) {
+	if err := newFileName(name); err != nil {
+		return sqlitedb.File{}, err
+	}
+
+	folder, err := s.prepareFolder(folderOf(name))
+	if err != nil {
+		return sqlitedb.File{}, err
+	}
+
+	if exists, err := s.db.FolderExists(name); err != nil || exists {
+		if err == nil {
+			err = fmt.Errorf("folder %s: %w", name, ErrExists)
+		}
+		return sqlitedb.File{}, err
+	}
+
+	old, err := s.db.GetFile(name)
+	if err != nil {
+		return sqlitedb.File{}, err
+	}
+	if old != nil && u.Retention == 0 {
+		u.Retention = Forever
+		if old.Expires != nil {
+			u.Retention = old.Expires.Sub(old.Uploaded)
+		}
+	}
+
+	file := s.newFile(folder, path.Base(name), u)
+	file.Name = name
+	tmp, err := s.receive(path.Base(name), content, u, &file)
+	if err != nil {
+		return sqlitedb.File{}, err
+	}
+
+	blobLock.Lock()
+	defer blobLock.Unlock()
+
+	if err := s.addBlob(tmp, file.SHA256); err != nil {
+		return sqlitedb.File{}, err
+	}
+
+	if old != nil {
+		file.Pinned = old.Pinned
+	}
+	if err := s.db.SaveFile(file); err != nil {
+		s.release(file.SHA256)
+		return sqlitedb.File{}, fmt.Errorf("failed to index file: %w", err)
+	}
+
+	if old != nil {
+		if err := s.release(old.SHA256); err != nil {
+			logrus.Errorf("failed to release the previous content of %s: %v", name, err)
+		}
+	}
+	return file, nil
+}
+
+// receive screens the content and writes it to a temporary file, which is returned.
+// The content type, hash and size of the file are filled in.
+func (s *Store) receive(name string, content io.Reader, u Upload, file *sqlitedb.File) (string, error) {
+	// the size is not known up front, the copy stops when the file no longer fits
+	limit, err := s.limit(true)
+	if err != nil {
+		return "", err
+	}
+	if limit.Bytes == 0 {
+		return "", limit.Err
+	}
+
+	r, finish, err := s.screen(name, u, content)
+	if err != nil {
+		return "", err
+	}
+
+	tmp, err := s.writeTemp(r, limit, file)
+	verdict := finish()
+	if err != nil {
+		return "", err
+	}
+	if verdict != nil {
+		os.Remove(tmp)
+		return "", verdict
+	}
+
+	return tmp, nil
+}
+
+// Move moves a file, which has to be on the same filesystem, into the store under
+// the sanitised name and returns its index entry
+func (s *Store) Move(src string, name string, u Upload) (sqlitedb.File, error) {
+	info, err := os.Stat(src)
+	if err != nil {
+		return sqlitedb.File{}, err
+	}
+
+	// the file is on the same disk already, only the quota and the upload limit matter
+	if err := s.check(info.Size(), false); err != nil {
+		return sqlitedb.File{}, err
+	}
+
+	clean, err := SanitizeName(name)
+	if err != nil {
+		return sqlitedb.File{}, err
+	}
+
+	folder, err := s.prepareFolder(u.Folder)
+	if err != nil {
+		return sqlitedb.File{}, err
+	}
+
+	if err := s.screenFile(src, clean, u); err != nil {
+		return sqlitedb.File{}, err
+	}
+
+	file := s.newFile(folder, name, u)
+	content, err := s.takeFile(src, &file)
+	if err != nil {
+		return sqlitedb.File{}, err
+	}
+
+	return s.add(content, file, clean)
+}
+
+// add moves the content into its blob and indexes the file under the first free
+// alternative of the name
+func (s *Store) add(content string, file sqlitedb.File, name string) (sqlitedb.File, error) {
+	blobLock.Lock()
+	defer blobLock.Unlock()
+
+	if err := s.addBlob(content, file.SHA256); err != nil {
+		return sqlitedb.File{}, err
+	}
+
+	for n := 0; n < maxCollisions; n++ {
+		file.Name = path.Join(file.Folder, alternativeName(name, n))
+
+		added, err := s.db.AddFile(file)
+		if err != nil {
+			s.release(file.SHA256)
+			return sqlitedb.File{}, fmt.Errorf("failed to index file: %w", err)
+		}
+		if added {
+			return file, nil
+		}
+	}
+
+	s.release(file.SHA256)
+	return sqlitedb.File{}, fmt.Errorf("too many files named %s", name)
+}
+
+func (s *Store) newFile(folder, original string, u Upload) sqlitedb.File {
+	now := time.Now().UTC().Truncate(time.Second)
+
+	return sqlitedb.File{
+		Folder:       folder,
+		OriginalName: original,
+		Uploader:     u.Uploader,
+		Source:       u.Source,
+		Uploaded:     now,
+		Expires:      s.expiry(now, u.Retention),
+	}
+}
+
+// expiry returns when a file stored at the given moment expires, or nil when it is kept forever
+func (s *Store) expiry(stored time.Time, retention time.Duration) *time.Time {
+	if retention == 0 {
+		retention = s.retention
+	}
+
+	if retention == Forever {
+		return nil
+	}
+
+	expires := stored.Add(retention)
+	return &expires
+}
+
+// alternativeName returns "name (n).ext", or the name itself for n = 0
+func alternativeName(name string, n int) string {
+	if n == 0 {
+		return name
+	}
+
+	ext := filepath.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	suffix := fmt.Sprintf(" (%d)%s", n, ext)
+
+	return truncateName(base, maxNameLength-len(suffix)) + suffix
+}
+
+// truncateName shortens a name to at most limit bytes, keeping the extension and valid utf-8
+func truncateName(name string, limit int) string {
+	if len(name) <= limit {
+		return name
+	}
+
+	ext := filepath.Ext(name)
+	if len(ext) >= limit {
+		ext = ""
+	}
+
+	base := name[:limit-len(ext)]
+	for !utf8.ValidString(base) {
+		base = base[:len(base)-1]
+	}
+
+	return base + ext
+}
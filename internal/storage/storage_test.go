@@ -0,0 +1,359 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rogierlommers/home/internal/config"
+	"github.com/rogierlommers/home/internal/sqlitedb"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSanitizeName(t *testing.T) {
+	tests := []struct {
+		name          string
+		input         string
+		expected      string
+		expectedError error
+	}{
+		{name: "plain name", input: "report.pdf", expected: "report.pdf"},
+		{name: "unicode is kept", input: "résumé 2025.pdf", expected: "résumé 2025.pdf"},
+		{name: "directories are stripped", input: "photos/holiday/beach.jpg", expected: "beach.jpg"},
+		{name: "windows path", input: `C:\Users\rogier\notes.txt`, expected: "notes.txt"},
+		{name: "absolute path", input: "/etc/passwd", expected: "passwd"},
+		{name: "relative traversal", input: "../../etc/x", expectedError: ErrTraversal},
+		{name: "traversal in the middle", input: "a/../../b.txt", expectedError: ErrTraversal},
+		{name: "windows traversal", input: `..\..\windows\win.ini`, expectedError: ErrTraversal},
+		{name: "only dots", input: "..", expectedError: ErrTraversal},
+		{name: "single dot", input: ".", expectedError: ErrInvalidName},
+		{name: "empty", input: "", expectedError: ErrInvalidName},
+		{name: "only separators", input: "///", expectedError: ErrInvalidName},
+		{name: "hidden file", input: ".htaccess", expected: "htaccess"},
+		{name: "trailing dots and spaces", input: "name.txt. . ", expected: "name.txt"},
+		{name: "null byte", input: "evil.php\x00.jpg", expected: "evil.php.jpg"},
+		{name: "control characters", input: "a\r\nb\t.txt", expected: "ab.txt"},
+		{name: "reserved characters", input: `what?<is>:this|"*.txt`, expected: "what__is__this___.txt"},
+		{name: "invalid utf-8", input: "bad\xff.txt", expected: "bad.txt"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := SanitizeName(tt.input)
+
+			if tt.expectedError != nil {
+				assert.ErrorIs(t, err, tt.expectedError)
+				return
+			}
+
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, result)
+		})
+	}
+}
+
+func TestSanitizeNameLength(t *testing.T) {
+	result, err := SanitizeName(strings.Repeat("é", 200) + ".pdf")
+	require.NoError(t, err)
+
+	assert.LessOrEqual(t, len(result), maxNameLength)
+	assert.True(t, strings.HasSuffix(result, "é.pdf"))
+}
+
+func newTestStore(t *testing.T, dir string) *Store {
+	db := sqlitedb.InitDatabase(config.AppConfig{Database: filepath.Join(t.TempDir(), "test.db")})
+	t.Cleanup(db.Close)
+	return New(config.AppConfig{UploadTarget: dir, FileCleanUpInDys: 7}, db)
+}
+
+// readFile returns the content of a stored file
+func readFile(t *testing.T, store *Store, name string) string {
+	f, _, err := store.Open(name)
+	require.NoError(t, err)
+	defer f.Close()
+
+	content, err := io.ReadAll(f)
+	require.NoError(t, err)
+	return string(content)
+}
+
+// writePlainFile writes a file into the upload target like a copy from outside of the
+// app, old enough to be imported
+func writePlainFile(t *testing.T, path, content string) {
+	require.NoError(t, os.MkdirAll(filepath.Dir(path), 0o755))
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o644))
+
+	old := time.Now().Add(-time.Hour)
+	require.NoError(t, os.Chtimes(path, old, old))
+}
+
+func TestSaveRenamesOnCollision(t *testing.T) {
+	store := newTestStore(t, filepath.Join(t.TempDir(), "uploads"))
+
+	var names []string
+	for _, content := range []string{"first", "second", "third"} {
+		file, err := store.Save("report.pdf", strings.NewReader(content), Upload{})
+		require.NoError(t, err)
+		names = append(names, file.Name)
+	}
+
+	assert.Equal(t, []string{"report.pdf", "report (1).pdf", "report (2).pdf"}, names)
+
+	// the first file is not overwritten
+	assert.Equal(t, "first", readFile(t, store, "report.pdf"))
+}
+
+func TestSaveRejectsTraversal(t *testing.T) {
+	root := t.TempDir()
+	store := newTestStore(t, filepath.Join(root, "uploads"))
+
+	_, err := store.Save("../outside.txt", strings.NewReader("evil"), Upload{})
+	assert.ErrorIs(t, err, ErrTraversal)
+
+	_, err = os.Stat(filepath.Join(root, "outside.txt"))
+	assert.True(t, os.IsNotExist(err))
+
+	files, err := store.List("")
+	require.NoError(t, err)
+	assert.Empty(t, files)
+}
+
+func TestSaveIndexesFile(t *testing.T) {
+	store := newTestStore(t, t.TempDir())
+
+	file, err := store.Save("notes/todo.txt", strings.NewReader("buy milk"), Upload{Uploader: "rogier", Source: sqlitedb.FileSourceStorage})
+	require.NoError(t, err)
+
+	sum := sha256.Sum256([]byte("buy milk"))
+	assert.Equal(t, "todo.txt", file.Name)
+	assert.Equal(t, "notes/todo.txt", file.OriginalName)
+	assert.Equal(t, "text/plain; charset=utf-8", file.ContentType)
+	assert.Equal(t, hex.EncodeToString(sum[:]), file.SHA256)
+	assert.Equal(t, int64(8), file.Size)
+	require.NotNil(t, file.Expires)
+	assert.Equal(t, 7*24*time.Hour, file.Expires.Sub(file.Uploaded))
+
+	indexed, err := store.db.GetFile("todo.txt")
+	require.NoError(t, err)
+	require.NotNil(t, indexed)
+	assert.Equal(t, "rogier", indexed.Uploader)
+	assert.Equal(t, sqlitedb.FileSourceStorage, indexed.Source)
+	assert.Equal(t, file.SHA256, indexed.SHA256)
+
+	files, err := store.List("TODO")
+	require.NoError(t, err)
+	assert.Len(t, files, 1)
+
+	files, err = store.List("report")
+	require.NoError(t, err)
+	assert.Empty(t, files)
+
+	assert.FileExists(t, store.blobPath(file.SHA256))
+	require.NoError(t, store.Remove("todo.txt"))
+	assert.NoFileExists(t, store.blobPath(file.SHA256))
+
+	indexed, err = store.db.GetFile("todo.txt")
+	require.NoError(t, err)
+	assert.Nil(t, indexed)
+}
+
+func TestMove(t *testing.T) {
+	store := newTestStore(t, t.TempDir())
+
+	_, err := store.Save("video.mp4", strings.NewReader("existing"), Upload{})
+	require.NoError(t, err)
+
+	src := filepath.Join(t.TempDir(), "upload.bin")
+	require.NoError(t, os.WriteFile(src, []byte("moved"), 0o644))
+
+	file, err := store.Move(src, "video.mp4", Upload{Source: sqlitedb.FileSourceAPI})
+	require.NoError(t, err)
+	assert.Equal(t, "video (1).mp4", file.Name)
+	assert.Equal(t, int64(5), file.Size)
+
+	assert.Equal(t, "moved", readFile(t, store, file.Name))
+
+	_, err = os.Stat(src)
+	assert.True(t, os.IsNotExist(err))
+
+	indexed, err := store.db.GetFile("video (1).mp4")
+	require.NoError(t, err)
+	require.NotNil(t, indexed)
+	assert.Equal(t, sqlitedb.FileSourceAPI, indexed.Source)
+}
+
+func TestReconcile(t *testing.T) {
+	store := newTestStore(t, t.TempDir())
+
+	_, err := store.Save("kept.txt", strings.NewReader("kept"), Upload{})
+	require.NoError(t, err)
+	deleted, err := store.Save("deleted.txt", strings.NewReader("deleted"), Upload{})
+	require.NoError(t, err)
+	changed, err := store.Save("changed.txt", strings.NewReader("old"), Upload{Uploader: "rogier"})
+	require.NoError(t, err)
+
+	// files stored as plain files by older versions are indexed already
+	legacy := sha256.Sum256([]byte("legacy"))
+	require.NoError(t, store.db.SaveFile(sqlitedb.File{Name: "legacy.txt", OriginalName: "legacy.txt", SHA256: hex.EncodeToString(legacy[:]), Size: 6, Uploader: "rogier"}))
+
+	// changes made outside of the app
+	dir := store.Dir()
+	require.NoError(t, os.Remove(store.blobPath(deleted.SHA256)))
+	writePlainFile(t, filepath.Join(dir, "changed.txt"), "new content")
+	writePlainFile(t, filepath.Join(dir, "copied.txt"), "copied")
+	writePlainFile(t, filepath.Join(dir, "legacy.txt"), "legacy")
+	writePlainFile(t, filepath.Join(dir, ".hidden"), "state")
+	require.NoError(t, os.Mkdir(filepath.Join(dir, ".tus"), 0o755))
+
+	// files that are still being copied are left alone
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "copying.txt"), []byte("copy"), 0o644))
+
+	result, err := store.Reconcile()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"copied.txt"}, result.Added)
+	assert.Equal(t, []string{"legacy.txt"}, result.Migrated)
+	assert.Equal(t, []string{"changed.txt"}, result.Changed)
+	assert.Equal(t, []string{"deleted.txt"}, result.Removed)
+
+	// imported files are moved into blobs
+	assert.NoFileExists(t, filepath.Join(dir, "copied.txt"))
+	assert.FileExists(t, filepath.Join(dir, "copying.txt"))
+
+	copied, err := store.db.GetFile("copied.txt")
+	require.NoError(t, err)
+	require.NotNil(t, copied)
+	assert.Equal(t, sqlitedb.FileSourceExternal, copied.Source)
+	assert.Equal(t, int64(6), copied.Size)
+	assert.Equal(t, "copied", readFile(t, store, "copied.txt"))
+	assert.Equal(t, "legacy", readFile(t, store, "legacy.txt"))
+
+	// a changed file keeps its index entry, the old content is released
+	indexed, err := store.db.GetFile("changed.txt")
+	require.NoError(t, err)
+	require.NotNil(t, indexed)
+	assert.Equal(t, int64(11), indexed.Size)
+	assert.Equal(t, "rogier", indexed.Uploader)
+	assert.Equal(t, "new content", readFile(t, store, "changed.txt"))
+	assert.NoFileExists(t, store.blobPath(changed.SHA256))
+
+	// a second run finds nothing
+	result, err = store.Reconcile()
+	require.NoError(t, err)
+	assert.Empty(t, result.Added)
+	assert.Empty(t, result.Migrated)
+	assert.Empty(t, result.Changed)
+	assert.Empty(t, result.Removed)
+}
+
+func TestCheckName(t *testing.T) {
+	for _, name := range []string{"report.pdf", "invoices/2024/march.pdf", "my: notes.txt"} {
+		assert.NoError(t, checkName(name), name)
+	}
+
+	for _, name := range []string{"../secret", "a/../b.txt", `..\secret`, `a\b.txt`, "..", ".tus", "a/.tus", ".blobs/ab/abc",
+		"/etc/passwd", "a//b.txt", "a/", ""} {
+		assert.Error(t, checkName(name), name)
+	}
+}
+
+func TestOpen(t *testing.T) {
+	store := newTestStore(t, t.TempDir())
+
+	file, err := store.Save("march.pdf", strings.NewReader("march"), Upload{Folder: "invoices"})
+	require.NoError(t, err)
+
+	f, indexed, err := store.Open("invoices/march.pdf")
+	require.NoError(t, err)
+	f.Close()
+	assert.Equal(t, file.SHA256, indexed.SHA256)
+
+	_, _, err = store.Open("invoices/april.pdf")
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	_, _, err = store.Open("../secret")
+	assert.ErrorIs(t, err, ErrTraversal)
+
+	require.NoError(t, os.Remove(store.blobPath(file.SHA256)))
+	_, _, err = store.Open("invoices/march.pdf")
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestParseRetention(t *testing.T) {
+	tests := map[string]time.Duration{
+		"":        0,
+		"forever": Forever,
+		"1d":      24 * time.Hour,
+		"1w":      7 * 24 * time.Hour,
+		"12h":     12 * time.Hour,
+	}
+
+	for input, expected := range tests {
+		retention, err := ParseRetention(input)
+		assert.NoError(t, err, input)
+		assert.Equal(t, expected, retention, input)
+	}
+
+	for _, input := range []string{"0d", "-1w", "soon", "d"} {
+		_, err := ParseRetention(input)
+		assert.Error(t, err, input)
+	}
+}
+
+func TestSaveRetention(t *testing.T) {
+	store := newTestStore(t, t.TempDir())
+
+	day, err := store.Save("day.txt", strings.NewReader("day"), Upload{Retention: 24 * time.Hour})
+	require.NoError(t, err)
+	require.NotNil(t, day.Expires)
+	assert.Equal(t, 24*time.Hour, day.Expires.Sub(day.Uploaded))
+
+	kept, err := store.Save("kept.txt", strings.NewReader("kept"), Upload{Retention: Forever})
+	require.NoError(t, err)
+	assert.Nil(t, kept.Expires)
+
+	indexed, err := store.db.GetFile("kept.txt")
+	require.NoError(t, err)
+	require.NotNil(t, indexed)
+	assert.Nil(t, indexed.Expires)
+}
+
+func TestReplace(t *testing.T) {
+	store := newTestStore(t, t.TempDir())
+
+	first, err := store.Replace("notes.txt", strings.NewReader("first"), Upload{Retention: 24 * time.Hour})
+	require.NoError(t, err)
+	assert.Equal(t, "notes.txt", first.Name)
+	_, err = store.db.SetFilePinned("notes.txt", true)
+	require.NoError(t, err)
+
+	// the file is replaced, not stored under another name, and keeps its pin and retention
+	second, err := store.Replace("notes.txt", strings.NewReader("second"), Upload{})
+	require.NoError(t, err)
+	assert.Equal(t, "notes.txt", second.Name)
+	assert.True(t, second.Pinned)
+	require.NotNil(t, second.Expires)
+	assert.Equal(t, 24*time.Hour, second.Expires.Sub(second.Uploaded))
+	assert.Equal(t, "second", readFile(t, store, "notes.txt"))
+
+	files, err := store.List("")
+	require.NoError(t, err)
+	assert.Len(t, files, 1)
+	assert.NoFileExists(t, store.blobPath(first.SHA256))
+
+	// the folder of the file is created, names are not sanitised
+	_, err = store.Replace("work/todo.txt", strings.NewReader("todo"), Upload{})
+	require.NoError(t, err)
+	assert.Equal(t, "todo", readFile(t, store, "work/todo.txt"))
+
+	for _, name := range []string{"work", "../notes.txt", ".hidden", "what?.txt", "work/"} {
+		_, err = store.Replace(name, strings.NewReader("invalid"), Upload{})
+		assert.Error(t, err, name)
+	}
+}
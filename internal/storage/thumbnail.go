@@ -0,0 +1,288 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"io"
+	"mime"
+	"os"
+	"path/filepath"
+	"strings"
+
+	// decoders of the image formats that get a thumbnail
+	_ "golang.org/x/image/webp"
+	_ "image/gif"
+	_ "image/png"
+
+	"github.com/rogierlommers/home/internal/sqlitedb"
+	"golang.org/x/image/draw"
+)
+
+const (
+	// thumbnails are cached in this hidden directory of the store, named by content hash
+	thumbnailDir = ".thumbs"
+
+	// maximum width and height of a thumbnail
+	thumbnailSize = 256
+
+	thumbnailQuality = 80
+
+	// larger images are not decoded, a 50 megapixel image already takes 200MB of memory
+	maxThumbnailPixels = 50_000_000
+
+	// larger pdfs are not searched for a preview, they are read into memory
+	maxPDFPreviewSize = 64 << 20
+)
+
+// ErrNoThumbnail is returned for files of which no thumbnail can be made
+var ErrNoThumbnail = errors.New("no thumbnail available")
+
+// HasThumbnail reports if a thumbnail can be made for the content type. For pdfs
+// it is only an attempt, see pdfPreview.
+func HasThumbnail(contentType string) bool {
+	switch MediaType(contentType) {
+	case "image/jpeg", "image/png", "image/gif", "image/webp", "application/pdf":
+		return true
+	default:
+		return false
+	}
+}
+
+// MediaType returns the content type without parameters such as the charset
+func MediaType(contentType string) string {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return strings.ToLower(strings.TrimSpace(strings.Split(contentType, ";")[0]))
+	}
+	return mediaType
+}
+
+// Thumbnail opens a jpeg thumbnail of the file, it is made on first use. Thumbnails
+// are named after the hash of the content, so copies of a file share one and a changed
+// file gets a new one.
+func (s *Store) Thumbnail(f sqlitedb.File) (io.ReadSeekCloser, error) {
+	if !HasThumbnail(f.ContentType) || f.SHA256 == "" {
+		return nil, ErrNoThumbnail
+	}
+
+	thumb := s.thumbnailPath(f.SHA256)
+	if r, err := s.openContent(thumb); err == nil {
+		return r, nil
+	}
+
+	content, file, err := s.Open(f.Name)
+	if err != nil {
+		return nil, err
+	}
+	defer content.Close()
+
+	img, err := decodePreview(content, file.Size, MediaType(file.ContentType))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.writeThumbnail(thumb, scale(img, thumbnailSize)); err != nil {
+		return nil, fmt.Errorf("failed to write thumbnail: %w", err)
+	}
+
+	return s.openContent(thumb)
+}
+
+func (s *Store) thumbnailPath(hash string) string {
+	return filepath.Join(s.dir, thumbnailDir, hash+".jpg")
+}
+
+// PruneThumbnails removes cached thumbnails of files that are no longer stored
+func (s *Store) PruneThumbnails() (int, error) {
+	files, err := s.db.GetFiles("")
+	if err != nil {
+		return 0, err
+	}
+
+	hashes := map[string]bool{}
+	for _, f := range files {
+		hashes[f.SHA256] = true
+	}
+
+	entries, err := os.ReadDir(filepath.Join(s.dir, thumbnailDir))
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	removed := 0
+	for _, entry := range entries {
+		// thumbnails that are being written are skipped
+		hash, isThumbnail := strings.CutSuffix(strings.TrimSuffix(entry.Name(), encryptedSuffix), ".jpg")
+		if !isThumbnail || hashes[hash] {
+			continue
+		}
+
+		if err := os.Remove(filepath.Join(s.dir, thumbnailDir, entry.Name())); err != nil && !os.IsNotExist(err) {
+			return removed, err
+		}
+		removed++
+	}
+
+	return removed, nil
+}
+
+func decodePreview(content io.ReadSeeker, size int64, mediaType string) (image.Image, error) {
+	if mediaType == "application/pdf" {
+		return pdfPreview(content, size)
+	}
+
+	return decodeImage(content)
+}
+
+// decodeImage decodes an image, after checking its dimensions
+func decodeImage(r io.ReadSeeker) (image.Image, error) {
+	cfg, _, err := image.DecodeConfig(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode image: %w", err)
+	}
+
+	if cfg.Width*cfg.Height > maxThumbnailPixels {
+		return nil, ErrNoThumbnail
+	}
+
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	img, _, err := image.Decode(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode image: %w", err)
+	}
+	return img, nil
+}
+
+// pdfPreview returns the largest jpeg embedded in a pdf, the first one when several
+// have the same size. Scanners store every page as a jpeg, so for scanned documents
+// this is the first page. Rendering pdfs with text and vector graphics takes a full
+// pdf renderer, those have no preview.
+func pdfPreview(content io.Reader, size int64) (image.Image, error) {
+	if size > maxPDFPreviewSize {
+		return nil, ErrNoThumbnail
+	}
+
+	data, err := io.ReadAll(io.LimitReader(content, maxPDFPreviewSize))
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		best     []byte
+		bestSize int
+	)
+
+	for _, candidate := range pdfJPEGs(data) {
+		cfg, err := jpeg.DecodeConfig(bytes.NewReader(candidate))
+		if err != nil {
+			continue
+		}
+
+		size := cfg.Width * cfg.Height
+		if size > bestSize && size <= maxThumbnailPixels {
+			best, bestSize = candidate, size
+		}
+	}
+
+	if best == nil {
+		return nil, ErrNoThumbnail
+	}
+
+	img, err := jpeg.Decode(bytes.NewReader(best))
+	if err != nil {
+		return nil, ErrNoThumbnail
+	}
+	return img, nil
+}
+
+// pdfJPEGs returns the streams of a pdf that hold a jpeg. A jpeg is stored unchanged
+// with the DCTDecode filter, the data starts right after the "stream" keyword that
+// follows the dictionary with the filter.
+func pdfJPEGs(data []byte) [][]byte {
+	var streams [][]byte
+
+	for offset := 0; ; {
+		i := bytes.Index(data[offset:], []byte("/DCTDecode"))
+		if i < 0 {
+			return streams
+		}
+		offset += i + len("/DCTDecode")
+
+		j := bytes.Index(data[offset:], []byte("stream"))
+		if j < 0 {
+			return streams
+		}
+
+		start := offset + j + len("stream")
+		if bytes.HasPrefix(data[start:], []byte("\r\n")) {
+			start += 2
+		} else if bytes.HasPrefix(data[start:], []byte("\n")) {
+			start++
+		}
+
+		// streams that are compressed on top of the jpeg encoding are skipped
+		if bytes.HasPrefix(data[start:], []byte{0xff, 0xd8}) {
+			streams = append(streams, data[start:])
+		}
+	}
+}
+
+// scale resizes the image to fit in a square of the size, transparent parts become white
+func scale(img image.Image, size int) image.Image {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+
+	if width > size || height > size {
+		if width >= height {
+			width, height = size, max(1, height*size/width)
+		} else {
+			width, height = max(1, width*size/height), size
+		}
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(dst, dst.Bounds(), image.White, image.Point{}, draw.Src)
+	draw.CatmullRom.Scale(dst, dst.Bounds(), img, bounds, draw.Over, nil)
+	return dst
+}
+
+// writeThumbnail writes the jpeg through a temporary file, so a thumbnail that is
+// requested while it is written is never served half-finished
+func (s *Store) writeThumbnail(path string, img image.Image) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	w, err := s.contentWriter(tmp)
+	if err == nil {
+		err = jpeg.Encode(w, img, &jpeg.Options{Quality: thumbnailQuality})
+	}
+	if err == nil {
+		err = w.Close()
+	}
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return s.replaceContent(tmp.Name(), path)
+}
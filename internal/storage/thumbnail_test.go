@@ -0,0 +1,119 @@
+package storage
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testImage(width, height int) image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for x := 0; x < width; x++ {
+		for y := 0; y < height; y++ {
+			img.Set(x, y, color.RGBA{R: uint8(x), G: uint8(y), B: 100, A: 255})
+		}
+	}
+	return img
+}
+
+func TestThumbnail(t *testing.T) {
+	dir := t.TempDir()
+	store := newTestStore(t, dir)
+
+	var buf bytes.Buffer
+	require.NoError(t, png.Encode(&buf, testImage(800, 400)))
+
+	file, err := store.Save("photo.png", &buf, Upload{})
+	require.NoError(t, err)
+
+	f, err := store.Thumbnail(file)
+	require.NoError(t, err)
+	defer f.Close()
+	assert.FileExists(t, filepath.Join(dir, thumbnailDir, file.SHA256+".jpg"))
+
+	cfg, format, err := image.DecodeConfig(f)
+	require.NoError(t, err)
+	assert.Equal(t, "jpeg", format)
+	assert.Equal(t, 256, cfg.Width)
+	assert.Equal(t, 128, cfg.Height)
+
+	// the thumbnail directory is not indexed as a file
+	result, err := store.Reconcile()
+	require.NoError(t, err)
+	assert.Empty(t, result.Added)
+
+	text, err := store.Save("notes.txt", strings.NewReader("hello"), Upload{})
+	require.NoError(t, err)
+	_, err = store.Thumbnail(text)
+	assert.ErrorIs(t, err, ErrNoThumbnail)
+}
+
+func TestPDFThumbnail(t *testing.T) {
+	store := newTestStore(t, t.TempDir())
+
+	var logo, page bytes.Buffer
+	require.NoError(t, jpeg.Encode(&logo, testImage(40, 20), nil))
+	require.NoError(t, jpeg.Encode(&page, testImage(300, 420), nil))
+
+	// a scanned document: a small logo and the page, both stored as jpeg
+	var pdf bytes.Buffer
+	pdf.WriteString("%PDF-1.4\n")
+	pdf.WriteString("4 0 obj\n<< /Type /XObject /Subtype /Image /Width 40 /Height 20 /Filter /DCTDecode >>\nstream\n")
+	pdf.Write(logo.Bytes())
+	pdf.WriteString("\nendstream\nendobj\n")
+	pdf.WriteString("5 0 obj\n<< /Type /XObject /Subtype /Image /Width 300 /Height 420 /Filter [/FlateDecode /DCTDecode] >>\nstream\r\nxxxx\nendstream\nendobj\n")
+	pdf.WriteString("6 0 obj\n<< /Type /XObject /Subtype /Image /Width 300 /Height 420 /Filter /DCTDecode >>\nstream\r\n")
+	pdf.Write(page.Bytes())
+	pdf.WriteString("\nendstream\nendobj\n%%EOF\n")
+
+	file, err := store.Save("scan.pdf", &pdf, Upload{})
+	require.NoError(t, err)
+	require.Equal(t, "application/pdf", file.ContentType)
+
+	f, err := store.Thumbnail(file)
+	require.NoError(t, err)
+	defer f.Close()
+
+	cfg, _, err := image.DecodeConfig(f)
+	require.NoError(t, err)
+	assert.Equal(t, 182, cfg.Width)
+	assert.Equal(t, 256, cfg.Height)
+
+	// a pdf without images has no preview
+	text, err := store.Save("text.pdf", strings.NewReader("%PDF-1.4\n1 0 obj\n<< >>\nendobj\n%%EOF\n"), Upload{})
+	require.NoError(t, err)
+	_, err = store.Thumbnail(text)
+	assert.ErrorIs(t, err, ErrNoThumbnail)
+}
+
+func TestPruneThumbnails(t *testing.T) {
+	store := newTestStore(t, t.TempDir())
+
+	var buf bytes.Buffer
+	require.NoError(t, png.Encode(&buf, testImage(10, 10)))
+
+	file, err := store.Save("photo.png", &buf, Upload{})
+	require.NoError(t, err)
+
+	thumb, err := store.Thumbnail(file)
+	require.NoError(t, err)
+	thumb.Close()
+
+	removed, err := store.PruneThumbnails()
+	require.NoError(t, err)
+	assert.Equal(t, 0, removed)
+
+	require.NoError(t, store.Remove(file.Name))
+	removed, err = store.PruneThumbnails()
+	require.NoError(t, err)
+	assert.Equal(t, 1, removed)
+	assert.NoFileExists(t, store.thumbnailPath(file.SHA256))
+}
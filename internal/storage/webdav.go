@@ -0,0 +1,399 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/rogierlommers/home/internal/sqlitedb"
+	"golang.org/x/net/webdav"
+)
+
+// WebDAV returns the store as webdav file system, with the folders and files of the
+// index. Files written through it are stored as uploads u, unless the request context
+// holds other uploads, see WithUpload. The content is screened and has to fit like any
+// upload. Unlike other uploads, writing to an existing name replaces the file, see Replace.
+func (s *Store) WebDAV(u Upload) webdav.FileSystem {
+	return &davFS{store: s, upload: u}
+}
+
+type davFS struct {
+	store  *Store
+	upload Upload
+}
+
+type uploadKey struct{}
+
+// WithUpload returns a context in which files written through the webdav file system
+// are stored as uploads u, so one file system serves all users
+func WithUpload(ctx context.Context, u Upload) context.Context {
+	return context.WithValue(ctx, uploadKey{}, u)
+}
+
+// uploadFor returns the uploads of the request, or the uploads of the file system
+func (d *davFS) uploadFor(ctx context.Context) Upload {
+	if u, ok := ctx.Value(uploadKey{}).(Upload); ok {
+		return u
+	}
+	return d.upload
+}
+
+// davName turns a webdav path such as "/invoices/2024.pdf" into a stored name, the
+// root is the empty name
+func davName(name string) string {
+	return strings.Trim(path.Clean("/"+name), "/")
+}
+
+// davError turns errors of the store into the errors of the os package, which the
+// webdav handler translates into status codes
+func davError(op, name string, err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, ErrNotFound):
+		return &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+	case errors.Is(err, ErrExists):
+		return &fs.PathError{Op: op, Path: name, Err: fs.ErrExist}
+	case errors.Is(err, ErrInvalidName), errors.Is(err, ErrTraversal):
+		return &fs.PathError{Op: op, Path: name, Err: fs.ErrPermission}
+	default:
+		return err
+	}
+}
+
+// lookup returns the index entry of a file, or nil when the name is a folder
+func (d *davFS) lookup(name string) (*sqlitedb.File, error) {
+	if name == "" {
+		return nil, nil
+	}
+
+	if _, err := CleanFolder(name); err == nil {
+		exists, err := d.store.db.FolderExists(name)
+		if err != nil || exists {
+			return nil, err
+		}
+	}
+
+	if checkName(name) != nil {
+		return nil, fmt.Errorf("%s: %w", name, ErrNotFound)
+	}
+
+	file, err := d.store.db.GetFile(name)
+	if err != nil {
+		return nil, err
+	}
+	if file == nil {
+		return nil, fmt.Errorf("%s: %w", name, ErrNotFound)
+	}
+	return file, nil
+}
+
+// parentExists reports if the folder a name is created in exists, webdav clients have
+// to create folders one by one
+func (d *davFS) parentExists(name string) (bool, error) {
+	parent := folderOf(name)
+	if parent == "" {
+		return true, nil
+	}
+	return d.store.db.FolderExists(parent)
+}
+
+func (d *davFS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	folder := davName(name)
+
+	exists, err := d.parentExists(folder)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return davError("mkdir", name, ErrNotFound)
+	}
+
+	if taken, err := d.store.taken(folder); err != nil || taken || folder == "" {
+		if err == nil {
+			err = ErrExists
+		}
+		return davError("mkdir", name, err)
+	}
+
+	_, err = d.store.CreateFolder(folder)
+	return davError("mkdir", name, err)
+}
+
+func (d *davFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	stored := davName(name)
+
+	if flag&(os.O_WRONLY|os.O_RDWR) != 0 {
+		return d.create(name, stored, d.uploadFor(ctx))
+	}
+
+	file, err := d.lookup(stored)
+	if err != nil {
+		return nil, davError("open", name, err)
+	}
+
+	if file == nil {
+		return &davFolder{store: d.store, info: folderInfo(stored)}, nil
+	}
+
+	content, _, err := d.store.Open(stored)
+	if err != nil {
+		return nil, davError("open", name, err)
+	}
+	return &davFile{ReadSeekCloser: content, info: fileInfo{*file}}, nil
+}
+
+// create starts storing a file, the content is stored while it is written
+func (d *davFS) create(name, stored string, u Upload) (webdav.File, error) {
+	if stored == "" {
+		return nil, davError("open", name, ErrExists)
+	}
+	if err := newFileName(stored); err != nil {
+		return nil, davError("open", name, err)
+	}
+
+	exists, err := d.parentExists(stored)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, davError("open", name, ErrNotFound)
+	}
+
+	r, w := io.Pipe()
+	writer := &davWriter{pipe: w, name: stored, done: make(chan error, 1)}
+
+	go func() {
+		_, err := d.store.Replace(stored, r, u)
+		r.CloseWithError(err)
+		writer.done <- err
+	}()
+
+	return writer, nil
+}
+
+func (d *davFS) RemoveAll(ctx context.Context, name string) error {
+	stored := davName(name)
+	if stored == "" {
+		return davError("remove", name, ErrInvalidName)
+	}
+
+	file, err := d.lookup(stored)
+	switch {
+	case errors.Is(err, ErrNotFound):
+		return nil
+	case err != nil:
+		return err
+	case file == nil:
+		return davError("remove", name, d.store.DeleteFolder(stored, true))
+	default:
+		return davError("remove", name, d.store.Remove(stored))
+	}
+}
+
+func (d *davFS) Rename(ctx context.Context, oldName, newName string) error {
+	from, to := davName(oldName), davName(newName)
+	if from == "" || to == "" {
+		return davError("rename", oldName, ErrInvalidName)
+	}
+
+	file, err := d.lookup(from)
+	if err != nil {
+		return davError("rename", oldName, err)
+	}
+
+	exists, err := d.parentExists(to)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return davError("rename", newName, ErrNotFound)
+	}
+
+	if file == nil {
+		_, err = d.store.RenameFolder(from, to)
+	} else {
+		_, err = d.store.RenameFile(from, to)
+	}
+	return davError("rename", newName, err)
+}
+
+func (d *davFS) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	stored := davName(name)
+
+	file, err := d.lookup(stored)
+	if err != nil {
+		return nil, davError("stat", name, err)
+	}
+	if file == nil {
+		return folderInfo(stored), nil
+	}
+	return fileInfo{*file}, nil
+}
+
+// fileInfo describes a stored file. The content type and hash are known, so the
+// webdav handler does not have to read the content for them.
+type fileInfo struct {
+	file sqlitedb.File
+}
+
+func (i fileInfo) Name() string       { return path.Base(i.file.Name) }
+func (i fileInfo) Size() int64        { return i.file.Size }
+func (i fileInfo) Mode() os.FileMode  { return 0o644 }
+func (i fileInfo) ModTime() time.Time { return i.file.Uploaded }
+func (i fileInfo) IsDir() bool        { return false }
+func (i fileInfo) Sys() any           { return nil }
+
+func (i fileInfo) ContentType(ctx context.Context) (string, error) {
+	return i.file.ContentType, nil
+}
+
+func (i fileInfo) ETag(ctx context.Context) (string, error) {
+	if i.file.SHA256 == "" {
+		return "", webdav.ErrNotImplemented
+	}
+	return `"` + i.file.SHA256 + `"`, nil
+}
+
+// folderInfo describes a folder, folders only exist in the index and have no
+// modification time
+type folderInfo string
+
+func (i folderInfo) Name() string       { return path.Base("/" + string(i)) }
+func (i folderInfo) Size() int64        { return 0 }
+func (i folderInfo) Mode() os.FileMode  { return os.ModeDir | 0o755 }
+func (i folderInfo) ModTime() time.Time { return time.Time{} }
+func (i folderInfo) IsDir() bool        { return true }
+func (i folderInfo) Sys() any           { return nil }
+
+// davFile is a stored file opened for reading
+type davFile struct {
+	io.ReadSeekCloser
+	info fileInfo
+}
+
+func (f *davFile) Readdir(count int) ([]os.FileInfo, error) {
+	return nil, &fs.PathError{Op: "readdir", Path: f.info.file.Name, Err: fs.ErrInvalid}
+}
+
+func (f *davFile) Stat() (os.FileInfo, error) {
+	return f.info, nil
+}
+
+func (f *davFile) Write(p []byte) (int, error) {
+	return 0, &fs.PathError{Op: "write", Path: f.info.file.Name, Err: fs.ErrPermission}
+}
+
+// davFolder is an opened folder, it lists the subfolders and files in it
+type davFolder struct {
+	store   *Store
+	info    folderInfo
+	entries []os.FileInfo // nil until listed
+}
+
+func (f *davFolder) Readdir(count int) ([]os.FileInfo, error) {
+	if f.entries == nil {
+		folders, files, err := f.store.ListFolder(string(f.info))
+		if err != nil {
+			return nil, err
+		}
+
+		f.entries = []os.FileInfo{}
+		for _, folder := range folders {
+			f.entries = append(f.entries, folderInfo(folder.Path))
+		}
+		for _, file := range files {
+			f.entries = append(f.entries, fileInfo{file})
+		}
+	}
+
+	if count <= 0 {
+		entries := f.entries
+		f.entries = f.entries[len(f.entries):]
+		return entries, nil
+	}
+
+	if len(f.entries) == 0 {
+		return nil, io.EOF
+	}
+
+	n := min(count, len(f.entries))
+	entries := f.entries[:n]
+	f.entries = f.entries[n:]
+	return entries, nil
+}
+
+func (f *davFolder) Stat() (os.FileInfo, error) {
+	return f.info, nil
+}
+
+func (f *davFolder) Read(p []byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: string(f.info), Err: fs.ErrInvalid}
+}
+
+func (f *davFolder) Seek(offset int64, whence int) (int64, error) {
+	return 0, &fs.PathError{Op: "seek", Path: string(f.info), Err: fs.ErrInvalid}
+}
+
+func (f *davFolder) Write(p []byte) (int, error) {
+	return 0, &fs.PathError{Op: "write", Path: string(f.info), Err: fs.ErrInvalid}
+}
+
+func (f *davFolder) Close() error {
+	return nil
+}
+
+// davWriter streams the content that is written into the store, the file is stored
+// when it is closed
+type davWriter struct {
+	pipe    *io.PipeWriter
+	name    string
+	written int64
+	done    chan error
+}
+
+func (w *davWriter) Write(p []byte) (int, error) {
+	n, err := w.pipe.Write(p)
+	w.written += int64(n)
+	return n, err
+}
+
+// ReadFrom copies the content into the store. When reading the content fails, such as
+// when the client disconnects, the file is not stored.
+func (w *davWriter) ReadFrom(r io.Reader) (int64, error) {
+	n, err := io.Copy(w.pipe, r)
+	w.written += n
+	if err != nil {
+		w.pipe.CloseWithError(err)
+	}
+	return n, err
+}
+
+func (w *davWriter) Close() error {
+	w.pipe.Close()
+	return <-w.done
+}
+
+// Stat describes the file as far as it is written, the webdav handler asks before it
+// closes the file
+func (w *davWriter) Stat() (os.FileInfo, error) {
+	return fileInfo{sqlitedb.File{Name: w.name, Size: w.written, Uploaded: time.Now()}}, nil
+}
+
+func (w *davWriter) Read(p []byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: w.name, Err: fs.ErrPermission}
+}
+
+func (w *davWriter) Seek(offset int64, whence int) (int64, error) {
+	return 0, &fs.PathError{Op: "seek", Path: w.name, Err: fs.ErrPermission}
+}
+
+func (w *davWriter) Readdir(count int) ([]os.FileInfo, error) {
+	return nil, &fs.PathError{Op: "readdir", Path: w.name, Err: fs.ErrInvalid}
+}
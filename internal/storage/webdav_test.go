@@ -0,0 +1,117 @@
+package storage
+
+import (
+	"io"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/rogierlommers/home/internal/sqlitedb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/webdav"
+)
+
+func TestWebDAV(t *testing.T) {
+	store := newTestStore(t, t.TempDir())
+	handler := &webdav.Handler{
+		FileSystem: store.WebDAV(Upload{Uploader: "laptop", Source: sqlitedb.FileSourceWebDAV}),
+		LockSystem: webdav.NewMemLS(),
+	}
+
+	request := func(method, path string, body string, headers ...string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		for i := 0; i+1 < len(headers); i += 2 {
+			req.Header.Set(headers[i], headers[i+1])
+		}
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	// folders have to be created one by one
+	assert.Equal(t, 409, request("MKCOL", "/invoices/2024", "").Code)
+	assert.Equal(t, 201, request("MKCOL", "/invoices", "").Code)
+	assert.Equal(t, 201, request("MKCOL", "/invoices/2024", "").Code)
+	assert.Equal(t, 405, request("MKCOL", "/invoices", "").Code)
+
+	assert.Equal(t, 201, request("PUT", "/invoices/2024/march.txt", "march").Code)
+	assert.Equal(t, 409, request("PUT", "/missing/march.txt", "march").Code)
+	assert.Equal(t, 404, request("PUT", "/invoices/._march.txt", "resource fork").Code)
+
+	file, err := store.db.GetFile("invoices/2024/march.txt")
+	require.NoError(t, err)
+	require.NotNil(t, file)
+	assert.Equal(t, "laptop", file.Uploader)
+	assert.Equal(t, sqlitedb.FileSourceWebDAV, file.Source)
+	assert.NotNil(t, file.Expires)
+
+	// writing to an existing file replaces it
+	assert.Equal(t, 201, request("PUT", "/invoices/2024/march.txt", "march, corrected").Code)
+	w := request("GET", "/invoices/2024/march.txt", "")
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "march, corrected", w.Body.String())
+	assert.Equal(t, "text/plain; charset=utf-8", w.Header().Get("Content-Type"))
+
+	w = request("PROPFIND", "/invoices/2024/", "", "Depth", "1")
+	assert.Equal(t, 207, w.Code)
+	assert.Contains(t, w.Body.String(), "<D:href>/invoices/2024/march.txt</D:href>")
+	assert.Contains(t, w.Body.String(), "<D:getcontentlength>16</D:getcontentlength>")
+
+	// renamed and copied files keep their share links, copies share the content
+	assert.Equal(t, 201, request("MOVE", "/invoices/2024/march.txt", "", "Destination", "/invoices/march.txt").Code)
+	assert.Equal(t, 201, request("COPY", "/invoices/march.txt", "", "Destination", "/invoices/2024/march.txt").Code)
+	assert.Equal(t, 201, request("MOVE", "/invoices/2024", "", "Destination", "/archive").Code)
+	assert.Equal(t, "march, corrected", readFile(t, store, "archive/march.txt"))
+	assert.Equal(t, "march, corrected", readFile(t, store, "invoices/march.txt"))
+
+	assert.Equal(t, 204, request("DELETE", "/invoices", "").Code)
+	assert.Equal(t, 404, request("DELETE", "/invoices", "").Code)
+	assert.Equal(t, 404, request("GET", "/invoices/march.txt", "").Code)
+
+	files, err := store.List("")
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+	assert.Equal(t, "archive/march.txt", files[0].Name)
+}
+
+func TestWebDAVWithUpload(t *testing.T) {
+	store := newTestStore(t, t.TempDir())
+	dav := store.WebDAV(Upload{Uploader: "laptop", Source: sqlitedb.FileSourceWebDAV})
+
+	// the uploads of the request take the place of those of the file system
+	ctx := WithUpload(t.Context(), Upload{Uploader: "phone", Source: sqlitedb.FileSourceWebDAV})
+	f, err := dav.OpenFile(ctx, "/photo.txt", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o644)
+	require.NoError(t, err)
+	_, err = io.WriteString(f, "photo")
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	file, err := store.db.GetFile("photo.txt")
+	require.NoError(t, err)
+	require.NotNil(t, file)
+	assert.Equal(t, "phone", file.Uploader)
+}
+
+func TestWebDAVReadFrom(t *testing.T) {
+	store := newTestStore(t, t.TempDir())
+
+	f, err := store.WebDAV(Upload{}).OpenFile(t.Context(), "/partial.txt", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o644)
+	require.NoError(t, err)
+
+	// content that cannot be read completely is not stored
+	_, err = io.Copy(f, io.MultiReader(strings.NewReader("partial"), &failingReader{}))
+	assert.Error(t, err)
+	assert.Error(t, f.Close())
+
+	_, _, err = store.Open("partial.txt")
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+type failingReader struct{}
+
+func (failingReader) Read(p []byte) (int, error) {
+	return 0, io.ErrUnexpectedEOF
+}
@@ -1,24 +1,36 @@
 package main
 
 import (
+	"context"
 	"embed"
+	"fmt"
 	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
+	"github.com/rogierlommers/home/internal/auth"
 	"github.com/rogierlommers/home/internal/config"
 	"github.com/rogierlommers/home/internal/greedy"
 	"github.com/rogierlommers/home/internal/homepage"
 	"github.com/rogierlommers/home/internal/mailer"
+	"github.com/rogierlommers/home/internal/mqttclient"
 	"github.com/rogierlommers/home/internal/quicknote"
 	"github.com/rogierlommers/home/internal/sqlitedb"
+	"github.com/rogierlommers/home/internal/storage"
 	"github.com/sirupsen/logrus"
 )
 
 //go:embed static_html/*
 var staticHtmlFS embed.FS
 
+// requests in progress are given this long to finish when the process stops
+const shutdownTimeout = 10 * time.Second
+
 func main() {
 
 	// read config and make globally available
@@ -28,11 +40,73 @@ func main() {
 	db := sqlitedb.InitDatabase(cfg)
 	defer db.Close()
 
+	// "home rotate-keys" encrypts the stored files with the current key and exits
+	if len(os.Args) > 1 && os.Args[1] == "rotate-keys" {
+		rotateKeys(cfg, db)
+		return
+	}
+
+	// background work and the server run until the process is asked to stop
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
 	// create router
 	gin.SetMode(gin.ReleaseMode)
-	router := gin.New()
+	router, background := newRouter(ctx, cfg, db, mailer.NewMailer(cfg))
+
+	// optionally ingest events from mqtt
+	if cfg.MQTTBroker != "" {
+		mqttClient, err := mqttclient.NewClient(cfg, db)
+		if err != nil {
+			logrus.Errorf("failed to start mqtt client: %v", err)
+		} else {
+			defer mqttClient.Close()
+		}
+	}
+
+	// start serving
+	server := &http.Server{Addr: cfg.HostPort, Handler: router.Engine()}
+	go func() {
+		logrus.Infof("listening on http://%s", cfg.HostPort)
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			logrus.Fatal(err)
+		}
+	}()
+
+	<-ctx.Done()
+	logrus.Info("shutting down")
+
+	// requests in progress get some time to finish, the deferred closes run afterwards
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		logrus.Errorf("failed to shut down the server: %v", err)
+	}
 
-	router.Use(cors.New(cors.Config{
+	// the background work uses the database, so it has to stop first
+	background.Wait()
+}
+
+// rotateKeys encrypts the stored files with STORAGE_ENCRYPTION_KEY. Files that were
+// encrypted with STORAGE_ENCRYPTION_OLD_KEY can be read until this is done.
+func rotateKeys(cfg config.AppConfig, db *sqlitedb.DB) {
+	result, err := storage.New(cfg, db).RotateKeys()
+	if err != nil {
+		logrus.Fatalf("failed to rotate keys: %v", err)
+	}
+
+	fmt.Printf("rotated %d files, encrypted %d plain files, %d files were up to date\n", result.Rewrapped, result.Encrypted, result.Current)
+}
+
+// newRouter initializes all services, every route is registered with an authorization
+// policy. The background work of the services stops when ctx is done.
+func newRouter(ctx context.Context, cfg config.AppConfig, db *sqlitedb.DB, m *mailer.Mailer) (*auth.Router, *sync.WaitGroup) {
+	engine := gin.New()
+
+	// files in folders are addressed as one path parameter, with the slashes encoded as %2F
+	engine.UseRawPath = true
+
+	engine.Use(cors.New(cors.Config{
 		AllowOrigins:     []string{"*"},
 		AllowMethods:     []string{"POST", "PATCH"},
 		AllowHeaders:     []string{"Access-Control-Allow-Headers, Origin,Accept, X-Requested-With, Content-Type, Access-Control-Request-Method, Access-Control-Request-Headers"},
@@ -41,16 +115,12 @@ func main() {
 		AllowCredentials: true,
 	}))
 
-	// initialize all services
-	mailer := mailer.NewMailer(cfg)
-	homepage.Add(router, cfg, mailer, staticHtmlFS, db)
-	quicknote.NewQuicknote(router, cfg, mailer, db, staticHtmlFS)
-	greedy.NewGreedy(router, cfg, db)
-
-	// start serving
-	logrus.Infof("listening on http://%s", cfg.HostPort)
-	if err := http.ListenAndServe(cfg.HostPort, router); err != nil {
-		logrus.Fatal(err)
+	router := auth.NewRouter(engine, auth.New(cfg, db))
+	background := homepage.Add(ctx, router, cfg, m, staticHtmlFS, db)
+	quicknote.NewQuicknote(router, cfg, m, db, homepage.EventLog(db), staticHtmlFS)
+	if _, err := greedy.NewGreedy(router, cfg, db); err != nil {
+		logrus.Errorf("failed to start greedy: %v", err)
 	}
 
+	return router, background
 }
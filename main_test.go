@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rogierlommers/home/internal/config"
+	"github.com/rogierlommers/home/internal/mailer"
+	"github.com/rogierlommers/home/internal/sqlitedb"
+	"github.com/stretchr/testify/assert"
+)
+
+// every route has to be registered with an authorization policy, a route added
+// directly on the gin engine would be open to anyone
+func TestAllRoutesHavePolicy(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	cfg := config.AppConfig{
+		Database:                filepath.Join(t.TempDir(), "test.db"),
+		UploadTarget:            t.TempDir(),
+		XHomeAPIKey:             "supersecretkey",
+		GreedyScrapingFrequency: 3600,
+		GreedyCleanupFrequency:  3600,
+	}
+	db := sqlitedb.InitDatabase(cfg)
+	t.Cleanup(db.Close)
+
+	router, _ := newRouter(t.Context(), cfg, db, mailer.NewMailer(cfg))
+
+	assert.NotEmpty(t, router.Engine().Routes())
+	assert.Empty(t, router.Unprotected())
+}
+
+// the background work of the services uses the database, it has to stop before the
+// database is closed
+func TestBackgroundStops(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	cfg := config.AppConfig{
+		Database:                filepath.Join(t.TempDir(), "test.db"),
+		UploadTarget:            t.TempDir(),
+		XHomeAPIKey:             "supersecretkey",
+		GreedyScrapingFrequency: 3600,
+		GreedyCleanupFrequency:  3600,
+	}
+	db := sqlitedb.InitDatabase(cfg)
+	t.Cleanup(db.Close)
+
+	ctx, cancel := context.WithCancel(t.Context())
+	_, background := newRouter(ctx, cfg, db, mailer.NewMailer(cfg))
+
+	cancel()
+	stopped := make(chan struct{})
+	go func() {
+		background.Wait()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("background work did not stop")
+	}
+}